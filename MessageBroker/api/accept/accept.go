@@ -0,0 +1,120 @@
+// Package accept runs the accept loops of the frontends speaking their
+// own protocol over tcp, mqtt and resp. A Loop keeps their listeners and
+// connections, so closing it stops both.
+package accept
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"therealbroker/pkg/broker"
+)
+
+// Loop accepts connections on one or more listeners
+type Loop struct {
+	// Protocol named in the logs
+	name string
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type conn struct {
+	stop func()
+}
+
+func NewLoop(name string) *Loop {
+	return &Loop{
+		name:      name,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}
+}
+
+// Serve accepts connections on lis until the loop is closed. handle is
+// called for every connection, serve runs on its own goroutine until
+// the connection ends and stop makes it return.
+func (l *Loop) Serve(lis net.Listener, handle func(net.Conn) (serve, stop func())) error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return broker.ErrUnavailable
+	}
+	l.listeners[lis] = struct{}{}
+	l.lock.Unlock()
+
+	for {
+		netConn, err := lis.Accept()
+		if err != nil {
+			if l.Closed() {
+				return nil
+			}
+			var temporary interface{ Timeout() bool }
+			if errors.As(err, &temporary) && temporary.Timeout() {
+				slog.Warn(l.name+" accept failed", "error", err)
+				continue
+			}
+			return err
+		}
+		serve, stop := handle(netConn)
+		c := &conn{stop: stop}
+		if !l.track(c) {
+			netConn.Close()
+			return nil
+		}
+		go func() {
+			defer l.wg.Done()
+			defer l.untrack(c)
+			serve()
+		}()
+	}
+}
+
+// Closed reports whether Close was called
+func (l *Loop) Closed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
+}
+
+// Close stops the listeners and the connections, and waits until they
+// are done. It is false when the loop was already closed.
+func (l *Loop) Close() bool {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return false
+	}
+	l.closed = true
+	for lis := range l.listeners {
+		lis.Close()
+	}
+	for c := range l.conns {
+		c.stop()
+	}
+	l.lock.Unlock()
+	l.wg.Wait()
+	return true
+}
+
+func (l *Loop) track(c *conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[c] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+func (l *Loop) untrack(c *conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, c)
+}
@@ -0,0 +1,40 @@
+package accept
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseShouldStopListenersAndConnections(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	loop := NewLoop("test")
+	served := make(chan error, 1)
+	accepted := make(chan struct{})
+	go func() {
+		served <- loop.Serve(lis, func(c net.Conn) (func(), func()) {
+			serve := func() {
+				close(accepted)
+				io.Copy(io.Discard, c)
+			}
+			return serve, func() { c.Close() }
+		})
+	}()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	<-accepted
+
+	assert.True(t, loop.Close())
+	assert.Nil(t, <-served)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, loop.Close())
+	assert.NotNil(t, loop.Serve(lis, nil))
+}
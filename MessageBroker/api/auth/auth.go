@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"sync"
+	"therealbroker/pkg/broker"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+)
+
+type Permission string
+
+const (
+	PermPublish   Permission = "publish"
+	PermSubscribe Permission = "subscribe"
+	PermFetch     Permission = "fetch"
+	// Changing the schema bound to a subject pattern. Granted on ">",
+	// it also allows reading the stats of every subject
+	PermAdmin Permission = "admin"
+)
+
+var (
+	// No bearer token was provided with the call
+	ErrMissingToken = errors.New("missing bearer token")
+	// The token is neither a known api key nor a valid jwt
+	ErrInvalidToken = errors.New("invalid bearer token")
+	// The identity is known, but the acl does not allow the action
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Identity is the authenticated caller of an RPC
+type Identity struct {
+	// Name is matched against the identity of acl rules
+	Name string
+	// Source tells how the identity was proven: "api-key", "jwt" or "tls"
+	Source string
+}
+
+type APIKey struct {
+	Key      string `yaml:"key"`
+	Identity string `yaml:"identity"`
+}
+
+// Rule grants permissions on subject patterns ( see broker.MatchSubject )
+// to an identity. Identity "*" applies the rule to every caller.
+type Rule struct {
+	Identity  string   `yaml:"identity"`
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+	Fetch     []string `yaml:"fetch"`
+	// Subject patterns whose schemas the identity may change, ">" also
+	// grants the broker stats
+	Admin []string `yaml:"admin"`
+}
+
+type Policy struct {
+	APIKeys []APIKey `yaml:"api_keys"`
+	ACL     []Rule   `yaml:"acl"`
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.Unmarshal(content, policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+type Authorizer struct {
+	lock      sync.RWMutex
+	apiKeys   map[string]string
+	jwtSecret []byte
+	acl       []Rule
+}
+
+func NewAuthorizer(policy *Policy, jwtSecret []byte) *Authorizer {
+	a := &Authorizer{}
+	a.Update(policy, jwtSecret)
+	return a
+}
+
+// Update swaps the api keys, acl and jwt secret, e.g. after the policy
+// file was reloaded. Calls in flight finish with the old policy.
+func (a *Authorizer) Update(policy *Policy, jwtSecret []byte) {
+	keys := make(map[string]string)
+	for _, k := range policy.APIKeys {
+		keys[k.Key] = k.Identity
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.apiKeys = keys
+	a.jwtSecret = jwtSecret
+	a.acl = policy.ACL
+}
+
+// Authenticate resolves a bearer token to an identity. Static api keys
+// are checked first, then the token is parsed as an HMAC signed jwt whose
+// `sub` claim is the identity name.
+func (a *Authorizer) Authenticate(token string) (Identity, error) {
+	if token == "" {
+		return Identity{}, ErrMissingToken
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for key, name := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return Identity{Name: name, Source: "api-key"}, nil
+		}
+	}
+	if len(a.jwtSecret) == 0 {
+		return Identity{}, ErrInvalidToken
+	}
+
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		return a.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}), jwt.WithExpirationRequired())
+	if err != nil || !parsed.Valid {
+		return Identity{}, ErrInvalidToken
+	}
+	sub, err := parsed.Claims.GetSubject()
+	if err != nil || sub == "" {
+		return Identity{}, ErrInvalidToken
+	}
+	return Identity{Name: sub, Source: "jwt"}, nil
+}
+
+// Authorize reports whether any acl rule grants perm on subject to id.
+func (a *Authorizer) Authorize(id Identity, perm Permission, subject string) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, rule := range a.acl {
+		if rule.Identity != "*" && rule.Identity != id.Name {
+			continue
+		}
+		if broker.MatchAnySubject(rule.patterns(perm), subject) {
+			return nil
+		}
+	}
+	return ErrPermissionDenied
+}
+
+// AuthorizeAll reports whether an acl rule grants perm on every subject
+// to id, with the pattern ">". Patterns like "*" that match some subject
+// of any call, e.g. the empty one, are not enough.
+func (a *Authorizer) AuthorizeAll(id Identity, perm Permission) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, rule := range a.acl {
+		if rule.Identity != "*" && rule.Identity != id.Name {
+			continue
+		}
+		for _, pattern := range rule.patterns(perm) {
+			if pattern == ">" {
+				return nil
+			}
+		}
+	}
+	return ErrPermissionDenied
+}
+
+func (r Rule) patterns(perm Permission) []string {
+	switch perm {
+	case PermPublish:
+		return r.Publish
+	case PermSubscribe:
+		return r.Subscribe
+	case PermFetch:
+		return r.Fetch
+	case PermAdmin:
+		return r.Admin
+	}
+	return nil
+}
+
+type identityKey struct{}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored by the auth interceptors.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	secret = []byte("test-secret")
+	policy = &Policy{
+		APIKeys: []APIKey{{Key: "key-1", Identity: "producer"}},
+		ACL: []Rule{
+			{Identity: "producer", Publish: []string{"orders.>"}, Admin: []string{"orders.>"}},
+			{Identity: "consumer", Subscribe: []string{"orders.*.created"}, Fetch: []string{"orders.>"}},
+			{Identity: "*", Subscribe: []string{"public"}},
+		},
+	}
+)
+
+func signToken(t *testing.T, claims jwt.MapClaims, key []byte) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	assert.Nil(t, err)
+	return token
+}
+
+func TestAPIKeyShouldAuthenticate(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+
+	id, err := a.Authenticate("key-1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "producer", Source: "api-key"}, id)
+}
+
+func TestMissingOrUnknownTokenShouldFail(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+
+	_, err := a.Authenticate("")
+	assert.Equal(t, ErrMissingToken, err)
+
+	_, err = a.Authenticate("key-2")
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestJWTShouldAuthenticate(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+	token := signToken(t, jwt.MapClaims{"sub": "consumer", "exp": time.Now().Add(time.Minute).Unix()}, secret)
+
+	id, err := a.Authenticate(token)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "consumer", Source: "jwt"}, id)
+}
+
+func TestInvalidJWTShouldFail(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+	tokens := []string{
+		signToken(t, jwt.MapClaims{"sub": "consumer", "exp": time.Now().Add(time.Minute).Unix()}, []byte("other")),
+		signToken(t, jwt.MapClaims{"sub": "consumer", "exp": time.Now().Add(-time.Minute).Unix()}, secret),
+		signToken(t, jwt.MapClaims{"sub": "consumer"}, secret),
+		signToken(t, jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()}, secret),
+	}
+
+	for _, token := range tokens {
+		_, err := a.Authenticate(token)
+		assert.Equal(t, ErrInvalidToken, err)
+	}
+}
+
+func TestACLShouldMatchSubjectPatterns(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+	producer := Identity{Name: "producer"}
+	consumer := Identity{Name: "consumer"}
+
+	assert.Nil(t, a.Authorize(producer, PermPublish, "orders.eu.created"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(producer, PermPublish, "orders"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(producer, PermSubscribe, "orders.eu.created"))
+
+	assert.Nil(t, a.Authorize(consumer, PermSubscribe, "orders.eu.created"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(consumer, PermSubscribe, "orders.eu.deleted"))
+	assert.Nil(t, a.Authorize(consumer, PermFetch, "orders.eu.deleted"))
+
+	assert.Nil(t, a.Authorize(producer, PermSubscribe, "public"))
+
+	// schemas are bound to patterns, a narrower pattern is covered
+	assert.Nil(t, a.Authorize(producer, PermAdmin, "orders.*"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(producer, PermAdmin, ">"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(consumer, PermAdmin, "orders.*"))
+}
+
+func TestAuthorizeAllShouldNeedTheFullWildcard(t *testing.T) {
+	a := NewAuthorizer(&Policy{ACL: []Rule{
+		{Identity: "admin", Admin: []string{">"}},
+		{Identity: "token-admin", Admin: []string{"*"}},
+	}}, secret)
+
+	assert.Nil(t, a.AuthorizeAll(Identity{Name: "admin"}, PermAdmin))
+	assert.Equal(t, ErrPermissionDenied, a.AuthorizeAll(Identity{Name: "token-admin"}, PermAdmin))
+	assert.Equal(t, ErrPermissionDenied, a.AuthorizeAll(Identity{Name: "admin"}, PermFetch))
+}
+
+func TestUpdateShouldReplacePolicy(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+	a.Update(&Policy{
+		APIKeys: []APIKey{{Key: "key-2", Identity: "producer"}},
+		ACL:     []Rule{{Identity: "producer", Publish: []string{"payments"}}},
+	}, nil)
+
+	_, err := a.Authenticate("key-1")
+	assert.Equal(t, ErrInvalidToken, err)
+	id, err := a.Authenticate("key-2")
+	assert.Nil(t, err)
+	assert.Nil(t, a.Authorize(id, PermPublish, "payments"))
+	assert.Equal(t, ErrPermissionDenied, a.Authorize(id, PermPublish, "orders.eu"))
+}
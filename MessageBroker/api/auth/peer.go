@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net"
+
+	"therealbroker/api/certs"
+)
+
+// Identify names a caller the way every frontend does: without an
+// authorizer it is let in under its ClientIdentity, a verified client
+// certificate stands in for a missing token, otherwise token must be a
+// valid api key or jwt. state is nil for a plain connection, addr is the
+// remote address.
+func Identify(authorizer *Authorizer, token string, state *tls.ConnectionState, addr string) (Identity, error) {
+	if authorizer == nil {
+		return Identity{Name: ClientIdentity(state, addr)}, nil
+	}
+	if name := PeerCertIdentity(state); token == "" && name != "" {
+		return Identity{Name: name, Source: "tls"}, nil
+	}
+	return authorizer.Authenticate(token)
+}
+
+// PeerCertIdentity names the client by its verified certificate, see
+// certs.Identity. Empty without one.
+func PeerCertIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certs.Identity(state.VerifiedChains[0][0])
+}
+
+// ClientIdentity names a caller that did not authenticate, for per
+// client limits: its certificate, or the host of addr.
+func ClientIdentity(state *tls.ConnectionState, addr string) string {
+	if name := PeerCertIdentity(state); name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ConnState is the tls state of c, nil for a plain connection
+func ConnState(c net.Conn) *tls.ConnectionState {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifyShouldPreferTheTokenOverTheCertificate(t *testing.T) {
+	a := NewAuthorizer(policy, secret)
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "device-1"}}}}}
+
+	id, err := Identify(a, "", state, "10.0.0.1:5000")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "device-1", Source: "tls"}, id)
+
+	id, err = Identify(a, "key-1", state, "10.0.0.1:5000")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "producer", Source: "api-key"}, id)
+
+	_, err = Identify(a, "", nil, "10.0.0.1:5000")
+	assert.Equal(t, ErrMissingToken, err)
+}
+
+func TestIdentifyWithoutAuthorizerShouldNameTheClient(t *testing.T) {
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "device-1"}}}}}
+
+	id, err := Identify(nil, "ignored", state, "10.0.0.1:5000")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "device-1"}, id)
+
+	id, err = Identify(nil, "", nil, "10.0.0.1:5000")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Name: "10.0.0.1"}, id)
+}
@@ -0,0 +1,248 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type ClientAuth string
+
+const (
+	// Clients are not asked for a certificate
+	ClientAuthNone ClientAuth = "none"
+	// Client certificates are verified if presented
+	ClientAuthOptional ClientAuth = "optional"
+	// Every client must present a certificate signed by the client ca
+	ClientAuthRequire ClientAuth = "require"
+)
+
+var (
+	ErrNoClientCA = errors.New("client certificate verification needs a client ca file")
+	// The client auth is not one of the ClientAuth constants
+	ErrUnknownClientAuth = errors.New("client auth must be none, optional or require")
+)
+
+// Reloader serves the server certificate and client ca pool from files
+// and reloads them when the files change on disk.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   ClientAuth
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+
+	// closed by Stop, so it returns with or without a Watch running
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewReloader(certFile, keyFile, clientCAFile string, clientAuth ClientAuth) (*Reloader, error) {
+	switch clientAuth {
+	case "":
+		clientAuth = ClientAuthNone
+	case ClientAuthNone, ClientAuthOptional, ClientAuthRequire:
+	default:
+		return nil, fmt.Errorf("%w, got %q", ErrUnknownClientAuth, clientAuth)
+	}
+	if clientAuth != ClientAuthNone && clientCAFile == "" {
+		return nil, ErrNoClientCA
+	}
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		clientAuth:   clientAuth,
+		modTimes:     make(map[string]time.Time),
+		stop:         make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate, key and client ca files again.
+// On failure the previously loaded certificates are kept.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		pool, err = LoadCertPool(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.clientCA = pool
+	for _, f := range r.files() {
+		if info, err := os.Stat(f); err == nil {
+			r.modTimes[f] = info.ModTime()
+		}
+	}
+	r.lock.Unlock()
+	return nil
+}
+
+// Watch polls the files every interval and reloads them after a change.
+func (r *Reloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+				if err := r.Reload(); err != nil {
+					slog.Error("failed to reload tls certificates", "cert_file", r.certFile, "error", err)
+					continue
+				}
+				slog.Info("tls certificates reloaded", "cert_file", r.certFile)
+			case <-r.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the Watch, it may be called more than once.
+func (r *Reloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Reloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// ServerConfig returns a tls config that always uses the latest
+// loaded certificates, so running listeners pick up reloads.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.clientCA,
+				ClientAuth:   r.tlsClientAuth(),
+			}, nil
+		},
+	}
+}
+
+func (r *Reloader) tlsClientAuth() tls.ClientAuthType {
+	switch r.clientAuth {
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// ClientConfig returns a tls config presenting the latest loaded
+// certificate as a client certificate, so connections opened after a
+// reload use it, e.g. between the nodes of a cluster. Servers are verified
+// with the client ca loaded by now, or the system roots without one.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    r.clientCA,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.cert, nil
+		},
+	}
+}
+
+// ClientConfig builds the tls config of a broker client. caFile verifies
+// the server, certFile and keyFile are optional and used for mutual tls.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// Identity returns the client name of a verified certificate: the common
+// name, or the first dns / uri san when the common name is empty.
+func Identity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, os.WriteFile(path, content, 0o600))
+	return path
+}
+
+// handshake serves one tls connection and returns the states seen by
+// both sides.
+func handshake(t *testing.T, server, client *tls.Config) (tls.ConnectionState, tls.ConnectionState, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lis.Close()
+
+	serverState := make(chan tls.ConnectionState, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Server(conn, server)
+		if tlsConn.Handshake() == nil {
+			serverState <- tlsConn.ConnectionState()
+		}
+		close(serverState)
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return tls.ConnectionState{}, tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	clientState := conn.ConnectionState()
+	// read forces the client to wait for the server side handshake result
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	conn.Read(make([]byte, 1))
+	return <-serverState, clientState, nil
+}
+
+func TestMutualTLSShouldExposeClientIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "broker", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "producer", 3, x509.ExtKeyUsageClientAuth)
+	caFile := writeFile(t, dir, "ca.crt", ca.pem)
+
+	reloader, err := NewReloader(
+		writeFile(t, dir, "server.crt", serverCert),
+		writeFile(t, dir, "server.key", serverKey),
+		caFile, ClientAuthRequire)
+	assert.Nil(t, err)
+
+	client, err := ClientConfig(caFile, writeFile(t, dir, "client.crt", clientCert), writeFile(t, dir, "client.key", clientKey), "localhost")
+	assert.Nil(t, err)
+
+	serverState, _, err := handshake(t, reloader.ServerConfig(), client)
+	assert.Nil(t, err)
+	assert.Equal(t, "producer", Identity(serverState.VerifiedChains[0][0]))
+}
+
+func TestRequiredClientCertShouldRejectAnonymousClients(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "broker", 2, x509.ExtKeyUsageServerAuth)
+	caFile := writeFile(t, dir, "ca.crt", ca.pem)
+
+	reloader, err := NewReloader(
+		writeFile(t, dir, "server.crt", serverCert),
+		writeFile(t, dir, "server.key", serverKey),
+		caFile, ClientAuthRequire)
+	assert.Nil(t, err)
+
+	client, err := ClientConfig(caFile, "", "", "localhost")
+	assert.Nil(t, err)
+
+	serverState, _, _ := handshake(t, reloader.ServerConfig(), client)
+	assert.Empty(t, serverState.PeerCertificates)
+}
+
+func TestClientAuthWithoutCAShouldFail(t *testing.T) {
+	_, err := NewReloader("server.crt", "server.key", "", ClientAuthOptional)
+	assert.Equal(t, ErrNoClientCA, err)
+}
+
+func TestUnknownClientAuthShouldFail(t *testing.T) {
+	_, err := NewReloader("server.crt", "server.key", "ca.crt", "required")
+	assert.ErrorIs(t, err, ErrUnknownClientAuth)
+}
+
+func TestStopShouldNotBlockWithoutWatch(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newTestCA(t).issue(t, "broker", 10, x509.ExtKeyUsageServerAuth)
+	reloader, err := NewReloader(writeFile(t, dir, "server.crt", cert), writeFile(t, dir, "server.key", key), "", ClientAuthNone)
+	assert.Nil(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		reloader.Stop()
+		reloader.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked")
+	}
+}
+
+func TestChangedCertificateShouldBeReloaded(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	firstCert, firstKey := ca.issue(t, "broker", 10, x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "server.crt", firstCert)
+	keyFile := writeFile(t, dir, "server.key", firstKey)
+	caFile := writeFile(t, dir, "ca.crt", ca.pem)
+
+	reloader, err := NewReloader(certFile, keyFile, "", ClientAuthNone)
+	assert.Nil(t, err)
+	reloader.Watch(10 * time.Millisecond)
+	defer reloader.Stop()
+
+	client, err := ClientConfig(caFile, "", "", "localhost")
+	assert.Nil(t, err)
+	_, clientState, err := handshake(t, reloader.ServerConfig(), client)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), clientState.PeerCertificates[0].SerialNumber.Int64())
+
+	secondCert, secondKey := ca.issue(t, "broker", 11, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "server.crt", secondCert)
+	writeFile(t, dir, "server.key", secondKey)
+	future := time.Now().Add(time.Second)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	assert.Eventually(t, func() bool {
+		_, clientState, err := handshake(t, reloader.ServerConfig(), client)
+		return err == nil && clientState.PeerCertificates[0].SerialNumber.Int64() == 11
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestPeerCertificateShouldBeReloaded(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	// nodes present their server certificate to each other
+	firstCert, firstKey := ca.issue(t, "broker", 20, x509.ExtKeyUsageAny)
+	certFile := writeFile(t, dir, "server.crt", firstCert)
+	keyFile := writeFile(t, dir, "server.key", firstKey)
+	reloader, err := NewReloader(certFile, keyFile, writeFile(t, dir, "ca.crt", ca.pem), ClientAuthRequire)
+	assert.Nil(t, err)
+	client := reloader.ClientConfig("localhost")
+
+	serverState, _, err := handshake(t, reloader.ServerConfig(), client)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), serverState.PeerCertificates[0].SerialNumber.Int64())
+
+	secondCert, secondKey := ca.issue(t, "broker", 21, x509.ExtKeyUsageAny)
+	writeFile(t, dir, "server.crt", secondCert)
+	writeFile(t, dir, "server.key", secondKey)
+	assert.Nil(t, reloader.Reload())
+
+	serverState, _, err = handshake(t, reloader.ServerConfig(), client)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(21), serverState.PeerCertificates[0].SerialNumber.Int64())
+}
@@ -0,0 +1,391 @@
+// Package gateway serves the broker over HTTP/JSON, for clients that
+// can't speak gRPC:
+//
+//	POST /subjects/{subject}/messages       publish, answers 201 {"id": ...}
+//	GET  /subjects/{subject}/messages/{id}  fetch
+//	GET  /subjects/{subject}/stream         subscribe as Server-Sent Events
+//	GET  /ws                                websocket, framing described in socket.go
+//
+// Streams send an id with every event, a client reconnecting with the
+// Last-Event-ID header gets the events it missed replayed, as long as
+// they are still in the replay buffer of the subject.
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/api/ratelimit"
+	"therealbroker/internal/logging"
+	"therealbroker/pkg/broker"
+
+	"github.com/google/uuid"
+)
+
+const (
+	routePublish = "POST /subjects/{subject}/messages"
+	routeFetch   = "GET /subjects/{subject}/messages/{id}"
+	routeStream  = "GET /subjects/{subject}/stream"
+	routeSocket  = "GET /ws"
+)
+
+type Options struct {
+	// Checks bearer tokens and the acl when set
+	Authorizer *auth.Authorizer
+	// Applies publish rates and subscription quotas when set
+	Limiter *ratelimit.Limiter
+	// Events kept per subject for reconnecting streams
+	ReplaySize int
+	// How long a subject keeps its subscription and replay buffer after
+	// its last stream ended
+	Retention time.Duration
+	// Interval of the comments that keep idle streams open through proxies
+	KeepAlive time.Duration
+	// Delay the browser waits before reconnecting a dropped stream
+	RetryDelay time.Duration
+	// Largest accepted publish request or websocket frame
+	MaxBodyBytes int64
+	// Origins allowed to open a websocket, e.g. "https://dashboard.example.com".
+	// Any origin is allowed when empty, tokens are not sent by browsers on
+	// their own so a foreign page can't reuse them.
+	AllowedOrigins []string
+	// How long a websocket write may block before the connection is closed
+	WriteTimeout time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ReplaySize:   1000,
+		Retention:    time.Minute,
+		KeepAlive:    15 * time.Second,
+		RetryDelay:   2 * time.Second,
+		MaxBodyBytes: 1 << 20,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// Gateway is an http.Handler in front of a broker.Broker
+type Gateway struct {
+	broker  broker.Broker
+	options Options
+	mux     *http.ServeMux
+
+	lock    sync.Mutex
+	topics  map[string]*topic
+	sockets map[*socket]struct{}
+	closed  bool
+}
+
+// New serves b, zero fields of options take their DefaultOptions value.
+func New(b broker.Broker, options Options) *Gateway {
+	defaults := DefaultOptions()
+	if options.ReplaySize <= 0 {
+		options.ReplaySize = defaults.ReplaySize
+	}
+	if options.Retention <= 0 {
+		options.Retention = defaults.Retention
+	}
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = defaults.KeepAlive
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = defaults.RetryDelay
+	}
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = defaults.MaxBodyBytes
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = defaults.WriteTimeout
+	}
+	g := &Gateway{
+		broker:  b,
+		options: options,
+		mux:     http.NewServeMux(),
+		topics:  make(map[string]*topic),
+		sockets: make(map[*socket]struct{}),
+	}
+	g.mux.Handle(routePublish, g.instrument(routePublish, g.publish))
+	g.mux.Handle(routeFetch, g.instrument(routeFetch, g.fetch))
+	g.mux.Handle(routeStream, g.instrument(routeStream, g.stream))
+	g.mux.Handle(routeSocket, g.instrument(routeSocket, g.socket))
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+// Close ends the open streams and websockets and drops the subject
+// subscriptions. The broker itself is left open.
+func (g *Gateway) Close() error {
+	g.lock.Lock()
+	g.closed = true
+	topics, sockets := g.topics, g.sockets
+	g.topics, g.sockets = make(map[string]*topic), make(map[*socket]struct{})
+	g.lock.Unlock()
+
+	for _, t := range topics {
+		t.stop()
+	}
+	for s := range sockets {
+		s.conn.Close()
+	}
+	return nil
+}
+
+type publishRequest struct {
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// 0 publishes in fire & forget mode, the message can't be fetched
+	ExpirationSeconds int64 `json:"expiration_seconds"`
+	// sync, async or none, only sync publishes answer with an id
+	Durability string `json:"durability,omitempty"`
+}
+
+type publishResponse struct {
+	ID string `json:"id"`
+}
+
+type messageResponse struct {
+	ID      string            `json:"id,omitempty"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (g *Gateway) publish(w http.ResponseWriter, r *http.Request) {
+	subject := r.PathValue("subject")
+	identity, ok := g.authorize(w, r, routePublish, auth.PermPublish, subject)
+	if !ok {
+		return
+	}
+	if g.options.Limiter != nil {
+		if denial := g.options.Limiter.AllowPublish(identity, subject); denial != nil {
+			rateLimited(w, routePublish, denial)
+			return
+		}
+	}
+
+	var req publishRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, g.options.MaxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.ExpirationSeconds < 0 {
+		writeError(w, http.StatusBadRequest, "expiration_seconds must not be negative")
+		return
+	}
+
+	id, err := g.broker.Publish(r.Context(), subject, broker.Message{
+		Body:       req.Body,
+		Expiration: time.Duration(req.ExpirationSeconds) * time.Second,
+		Headers:    req.Headers,
+		Durability: broker.Durability(req.Durability),
+	})
+	if err != nil {
+		brokerError(w, r, err)
+		return
+	}
+	if id != "" {
+		w.Header().Set("Location", r.URL.Path+"/"+id)
+	}
+	writeJSON(w, http.StatusCreated, publishResponse{ID: id})
+}
+
+func (g *Gateway) fetch(w http.ResponseWriter, r *http.Request) {
+	subject, id := r.PathValue("subject"), r.PathValue("id")
+	if _, ok := g.authorize(w, r, routeFetch, auth.PermFetch, subject); !ok {
+		return
+	}
+	msg, err := g.broker.Fetch(r.Context(), subject, id)
+	if err != nil {
+		brokerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, messageResponse{ID: id, Subject: subject, Body: msg.Body, Headers: msg.Headers})
+}
+
+// brokerError answers with the status code matching a broker error
+func brokerError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := brokerStatus(err)
+	if code == http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error("broker call failed", "error", err)
+	}
+	writeError(w, code, message)
+}
+
+func brokerStatus(err error) (int, string) {
+	if errors.Is(err, broker.ErrInvalidMessage) || errors.Is(err, broker.ErrInvalidDurability) {
+		return http.StatusBadRequest, err.Error()
+	}
+	switch err {
+	case broker.ErrInvalidID:
+		return http.StatusNotFound, "message id does not exist"
+	case broker.ErrExpiredID:
+		return http.StatusGone, "message is expired"
+	case broker.ErrAlreadyExistID:
+		return http.StatusConflict, "message id already exists"
+	case broker.ErrUnavailable:
+		return http.StatusServiceUnavailable, "broker is closed"
+	}
+	return http.StatusInternalServerError, "internal error"
+}
+
+// authorize authenticates the caller and checks perm on subject. It
+// returns the name used for rate limits, or false once it answered the
+// request with an error.
+func (g *Gateway) authorize(w http.ResponseWriter, r *http.Request, route string, perm auth.Permission, subject string) (string, bool) {
+	id, ok := g.authenticate(w, r, route)
+	if !ok {
+		return "", false
+	}
+	if err := g.allowed(id, route, perm, subject); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return "", false
+	}
+	return id.Name, true
+}
+
+// authenticate resolves the caller like the grpc interceptors do. Without
+// an authorizer every caller is let in under its certificate or ip.
+func (g *Gateway) authenticate(w http.ResponseWriter, r *http.Request, route string) (auth.Identity, bool) {
+	id, err := auth.Identify(g.options.Authorizer, bearerToken(r), r.TLS, r.RemoteAddr)
+	if err != nil {
+		metrics.AuthDenials.WithLabelValues(route, "unauthenticated").Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return auth.Identity{}, false
+	}
+	return id, true
+}
+
+// allowed checks the acl, if any, for perm on subject
+func (g *Gateway) allowed(id auth.Identity, route string, perm auth.Permission, subject string) error {
+	if g.options.Authorizer == nil {
+		return nil
+	}
+	if err := g.options.Authorizer.Authorize(id, perm, subject); err != nil {
+		metrics.AuthDenials.WithLabelValues(route, "forbidden").Inc()
+		return fmt.Errorf("%s is not allowed to %s on %q", id.Name, perm, subject)
+	}
+	return nil
+}
+
+// bearerToken reads the Authorization header, or the access_token query
+// parameter since browsers can't set headers on an EventSource or a
+// WebSocket.
+func bearerToken(r *http.Request) string {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+func rateLimited(w http.ResponseWriter, route string, denial *ratelimit.Denial) {
+	metrics.RateLimited.WithLabelValues(route, denial.Scope).Inc()
+	if denial.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(denial.RetryAfter.Seconds()))))
+	}
+	writeError(w, http.StatusTooManyRequests, denial.Err.Error()+": "+denial.Scope+" limit")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorResponse{Error: message})
+}
+
+// instrument writes the access log and metrics of a route, and passes a
+// logger with the request id down the context.
+func (g *Gateway) instrument(route string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		logger := logging.FromContext(r.Context()).With(
+			"request_id", requestID,
+			"route", route,
+			"subject", r.PathValue("subject"),
+			"client", auth.ClientIdentity(r.TLS, r.RemoteAddr),
+		)
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		handler(recorder, r.WithContext(logging.NewContext(r.Context(), logger)))
+
+		metrics.GatewayDurations.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		metrics.GatewayRequests.WithLabelValues(strconv.Itoa(recorder.code), route).Inc()
+		level := slog.LevelInfo
+		switch {
+		case recorder.code >= 500:
+			level = slog.LevelError
+		case recorder.code >= 400:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(r.Context(), level, "request finished",
+			slog.Int("status", recorder.code),
+			slog.Duration("latency", time.Since(start)))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.code, s.wroteHeader = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush the streams
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Hijack hands the connection over to the websocket handshake, which
+// type asserts http.Hijacker instead of using http.ResponseController.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil {
+		s.code, s.wroteHeader = http.StatusSwitchingProtocols, true
+	}
+	return conn, rw, err
+}
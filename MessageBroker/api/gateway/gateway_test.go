@@ -0,0 +1,360 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/ratelimit"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startGateway(t *testing.T, b broker.Broker, options Options) *httptest.Server {
+	g := New(b, options)
+	srv := httptest.NewServer(g)
+	t.Cleanup(func() {
+		g.Close()
+		srv.Close()
+	})
+	return srv
+}
+
+func newModule(t *testing.T) broker.Broker {
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	t.Cleanup(func() { module.Close() })
+	return module
+}
+
+func request(t *testing.T, method, url, body string, header http.Header) (*http.Response, map[string]interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	decoded := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp, decoded
+}
+
+func TestPublishAndFetchShouldRoundTrip(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+
+	resp, body := request(t, http.MethodPost, srv.URL+"/subjects/orders/messages",
+		`{"body":"hello","headers":{"k":"v"},"expiration_seconds":60}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	id, _ := body["id"].(string)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "/subjects/orders/messages/"+id, resp.Header.Get("Location"))
+	assert.NotEmpty(t, resp.Header.Get("X-Request-Id"))
+
+	resp, body = request(t, http.MethodGet, srv.URL+"/subjects/orders/messages/"+id, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, id, body["id"])
+	assert.Equal(t, "orders", body["subject"])
+	assert.Equal(t, "hello", body["body"])
+	assert.Equal(t, "v", body["headers"].(map[string]interface{})["k"])
+}
+
+func TestPublishShouldRejectBadRequests(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{MaxBodyBytes: 64})
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`not json`, http.StatusBadRequest},
+		{`{"body":"x","unknown":1}`, http.StatusBadRequest},
+		{`{"body":"x","expiration_seconds":-1}`, http.StatusBadRequest},
+		{`{"body":"x","durability":"later"}`, http.StatusBadRequest},
+		{`{"body":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge},
+	} {
+		resp, body := request(t, http.MethodPost, srv.URL+"/subjects/orders/messages", c.body, nil)
+		assert.Equal(t, c.code, resp.StatusCode, c.body)
+		assert.NotEmpty(t, body["error"])
+	}
+}
+
+// failingBroker answers every call with err
+type failingBroker struct {
+	err error
+}
+
+func (b failingBroker) Close() error { return nil }
+
+func (b failingBroker) Publish(ctx context.Context, subject string, msg broker.Message) (string, error) {
+	return "", b.err
+}
+
+func (b failingBroker) Subscribe(ctx context.Context, subject string) (<-chan broker.Message, error) {
+	return nil, b.err
+}
+
+func (b failingBroker) Fetch(ctx context.Context, subject string, id string) (broker.Message, error) {
+	return broker.Message{}, b.err
+}
+
+func TestBrokerErrorsShouldMapToStatusCodes(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{broker.ErrInvalidID, http.StatusNotFound},
+		{broker.ErrExpiredID, http.StatusGone},
+		{broker.ErrAlreadyExistID, http.StatusConflict},
+		{broker.ErrUnavailable, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: missing id", broker.ErrInvalidMessage), http.StatusBadRequest},
+		{broker.ErrRunQuery, http.StatusInternalServerError},
+	} {
+		srv := startGateway(t, failingBroker{c.err}, Options{})
+
+		resp, body := request(t, http.MethodGet, srv.URL+"/subjects/orders/messages/1", "", nil)
+		assert.Equal(t, c.code, resp.StatusCode, c.err.Error())
+		assert.NotEmpty(t, body["error"])
+
+		resp, _ = request(t, http.MethodPost, srv.URL+"/subjects/orders/messages", `{"body":"x"}`, nil)
+		assert.Equal(t, c.code, resp.StatusCode, c.err.Error())
+	}
+}
+
+func TestFetchShouldAnswerNotFoundAndGone(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+
+	resp, _ := request(t, http.MethodGet, srv.URL+"/subjects/orders/messages/999999", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, body := request(t, http.MethodPost, srv.URL+"/subjects/orders/messages", `{"body":"x","expiration_seconds":1}`, nil)
+	time.Sleep(1100 * time.Millisecond)
+	resp, _ = request(t, http.MethodGet, srv.URL+"/subjects/orders/messages/"+body["id"].(string), "", nil)
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestAuthShouldRejectMissingTokensAndForbiddenSubjects(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "producer"}},
+		ACL:     []auth.Rule{{Identity: "producer", Publish: []string{"orders.>"}, Subscribe: []string{"orders.>"}}},
+	}, nil)
+	srv := startGateway(t, newModule(t), Options{Authorizer: authorizer})
+	token := http.Header{"Authorization": {"Bearer key-1"}}
+
+	resp, _ := request(t, http.MethodPost, srv.URL+"/subjects/orders.eu/messages", `{"body":"x"}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+
+	resp, _ = request(t, http.MethodPost, srv.URL+"/subjects/payments/messages", `{"body":"x"}`, token)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = request(t, http.MethodGet, srv.URL+"/subjects/orders.eu/messages/1", "", token)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = request(t, http.MethodPost, srv.URL+"/subjects/orders.eu/messages", `{"body":"x"}`, token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// EventSource can't set headers, the token comes in the query
+	stream := openStream(t, srv.URL+"/subjects/orders.eu/stream?access_token=key-1", "")
+	assert.Equal(t, http.StatusOK, stream.resp.StatusCode)
+}
+
+func TestRateLimitShouldAnswerTooManyRequests(t *testing.T) {
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		Global: ratelimit.Limit{PublishRate: 1, PublishBurst: 1, MaxSubscriptions: 1},
+	})
+	srv := startGateway(t, newModule(t), Options{Limiter: limiter})
+
+	resp, _ := request(t, http.MethodPost, srv.URL+"/subjects/orders/messages", `{"body":"x"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = request(t, http.MethodPost, srv.URL+"/subjects/orders/messages", `{"body":"x"}`, nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	openStream(t, srv.URL+"/subjects/orders/stream", "")
+	resp, _ = request(t, http.MethodGet, srv.URL+"/subjects/orders/stream", "", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+type stream struct {
+	resp   *http.Response
+	events chan sseEvent
+	cancel context.CancelFunc
+}
+
+// openStream connects to an event stream and parses its events until
+// the test ends or close is called.
+func openStream(t *testing.T, url, lastEventID string) *stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	assert.Nil(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		cancel()
+		t.FailNow()
+	}
+	s := &stream{resp: resp, events: make(chan sseEvent, 100), cancel: cancel}
+	t.Cleanup(s.close)
+
+	reader := bufio.NewReader(resp.Body)
+	// the retry line is flushed first, so the stream is registered
+	// once it was read
+	if line, err := reader.ReadString('\n'); resp.StatusCode == http.StatusOK {
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(line, "retry: "), line)
+	}
+	go func() {
+		defer close(s.events)
+		var e sseEvent
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.id = value
+			case "event":
+				e.name = value
+			case "data":
+				e.data = value
+			case "":
+				if e.data != "" {
+					s.events <- e
+				}
+				e = sseEvent{}
+			}
+		}
+	}()
+	return s
+}
+
+func (s *stream) close() {
+	s.cancel()
+	io.Copy(io.Discard, s.resp.Body)
+	s.resp.Body.Close()
+}
+
+func (s *stream) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-s.events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return sseEvent{}
+}
+
+func (s *stream) body(t *testing.T) string {
+	t.Helper()
+	e := s.next(t)
+	assert.Equal(t, "message", e.name)
+	var msg messageResponse
+	assert.Nil(t, json.Unmarshal([]byte(e.data), &msg))
+	return msg.Body
+}
+
+func publish(t *testing.T, srv *httptest.Server, subject, body string) {
+	t.Helper()
+	resp, _ := request(t, http.MethodPost, srv.URL+"/subjects/"+subject+"/messages", `{"body":"`+body+`"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestStreamShouldDeliverPublishedMessages(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+	first := openStream(t, srv.URL+"/subjects/orders/stream", "")
+	second := openStream(t, srv.URL+"/subjects/orders/stream", "")
+	assert.Equal(t, "text/event-stream", first.resp.Header.Get("Content-Type"))
+
+	publish(t, srv, "orders", "a")
+	publish(t, srv, "orders", "b")
+	publish(t, srv, "payments", "ignored")
+
+	for _, s := range []*stream{first, second} {
+		assert.Equal(t, "a", s.body(t))
+		assert.Equal(t, "b", s.body(t))
+	}
+}
+
+func TestStreamShouldReplayMissedEventsAfterLastEventID(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+	s := openStream(t, srv.URL+"/subjects/orders/stream", "")
+	publish(t, srv, "orders", "a")
+	seen := s.next(t)
+	assert.NotEmpty(t, seen.id)
+	s.close()
+
+	// the subject keeps buffering while nobody is connected
+	publish(t, srv, "orders", "b")
+	publish(t, srv, "orders", "c")
+
+	resumed := openStream(t, srv.URL+"/subjects/orders/stream", seen.id)
+	assert.Equal(t, "b", resumed.body(t))
+	assert.Equal(t, "c", resumed.body(t))
+
+	// a new stream only gets new events
+	fresh := openStream(t, srv.URL+"/subjects/orders/stream", "")
+	publish(t, srv, "orders", "d")
+	assert.Equal(t, "d", fresh.body(t))
+	assert.Equal(t, "d", resumed.body(t))
+}
+
+func TestStreamShouldSkipEventsLostFromTheReplayBuffer(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{ReplaySize: 2})
+	s := openStream(t, srv.URL+"/subjects/orders/stream", "")
+	publish(t, srv, "orders", "a")
+	seen := s.next(t)
+	s.close()
+
+	for _, body := range []string{"b", "c", "d"} {
+		publish(t, srv, "orders", body)
+	}
+
+	resumed := openStream(t, srv.URL+"/subjects/orders/stream", seen.id)
+	assert.Equal(t, "c", resumed.body(t))
+	assert.Equal(t, "d", resumed.body(t))
+}
+
+func TestStreamShouldEndWhenGatewayCloses(t *testing.T) {
+	g := New(newModule(t), Options{})
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	s := openStream(t, srv.URL+"/subjects/orders/stream", "")
+
+	g.Close()
+
+	select {
+	case _, ok := <-s.events:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end")
+	}
+}
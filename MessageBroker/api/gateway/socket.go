@@ -0,0 +1,343 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/api/ratelimit"
+	"therealbroker/internal/logging"
+	"therealbroker/pkg/broker"
+
+	"golang.org/x/net/websocket"
+)
+
+// Operations of the websocket framing. Every frame is one json object
+// in a text message, requests may carry an id that is echoed on their
+// answer:
+//
+//	-> {"op":"subscribe","id":"1","subject":"orders"}
+//	<- {"op":"ack","id":"1","subject":"orders"}
+//	<- {"op":"message","subject":"orders","body":"...","headers":{...}}
+//	-> {"op":"publish","id":"2","subject":"orders","body":"...","expiration_seconds":60}
+//	<- {"op":"ack","id":"2","subject":"orders","message_id":"42"}
+//	-> {"op":"unsubscribe","id":"3","subject":"orders"}
+//	<- {"op":"error","id":"3","status":404,"error":"not subscribed to \"orders\""}
+//
+// Errors carry the http status the same failure gets on the other routes.
+// A subscription ended by the broker gets an error without id.
+const (
+	opSubscribe   = "subscribe"
+	opUnsubscribe = "unsubscribe"
+	opPublish     = "publish"
+	opPing        = "ping"
+
+	opAck       = "ack"
+	opMessage   = "message"
+	opError     = "error"
+	opPong      = "pong"
+	opKeepAlive = "keepalive"
+)
+
+type frame struct {
+	Op string `json:"op"`
+	// Chosen by the client, echoed on the ack or error of the request
+	ID                string            `json:"id,omitempty"`
+	Subject           string            `json:"subject,omitempty"`
+	Body              string            `json:"body,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	ExpirationSeconds int64             `json:"expiration_seconds,omitempty"`
+	// Id of the published message, on the ack of a publish
+	MessageID string `json:"message_id,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// socket is one websocket connection, it may hold several subscriptions
+type socket struct {
+	gateway  *Gateway
+	conn     *websocket.Conn
+	identity auth.Identity
+	ctx      context.Context
+
+	writeLock sync.Mutex
+
+	lock          sync.Mutex
+	subscriptions map[string]context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+func (g *Gateway) socket(w http.ResponseWriter, r *http.Request) {
+	id, ok := g.authenticate(w, r, routeSocket)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		writeError(w, http.StatusBadRequest, "expected a websocket upgrade")
+		return
+	}
+	// browsers always send their origin, other clients can't be abused
+	// by a foreign page
+	if origin := r.Header.Get("Origin"); origin != "" && len(g.options.AllowedOrigins) > 0 &&
+		!slices.Contains(g.options.AllowedOrigins, origin) {
+		writeError(w, http.StatusForbidden, "origin "+origin+" is not allowed")
+		return
+	}
+
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		conn.MaxPayloadBytes = int(g.options.MaxBodyBytes)
+		s := &socket{
+			gateway:       g,
+			conn:          conn,
+			identity:      id,
+			ctx:           r.Context(),
+			subscriptions: make(map[string]context.CancelFunc),
+		}
+		if !g.track(s) {
+			return
+		}
+		defer g.untrack(s)
+		metrics.GatewayWebSockets.Inc()
+		defer metrics.GatewayWebSockets.Dec()
+		s.serve()
+	}}
+	server.ServeHTTP(w, r)
+}
+
+func (g *Gateway) track(s *socket) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	g.sockets[s] = struct{}{}
+	return true
+}
+
+func (g *Gateway) untrack(s *socket) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.sockets, s)
+}
+
+// serve reads requests until the connection ends, then drops its
+// subscriptions.
+func (s *socket) serve() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.ctx = ctx
+	defer func() {
+		cancel()
+		s.conn.Close()
+		s.wg.Wait()
+	}()
+	go s.keepAlive()
+
+	logger := logging.FromContext(ctx)
+	logger.Debug("websocket connected")
+	for {
+		var request frame
+		err := websocket.JSON.Receive(s.conn, &request)
+		var syntax *json.SyntaxError
+		var mismatch *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntax), errors.As(err, &mismatch):
+			// the frame was read, the connection is still usable
+			if s.send(frame{Op: opError, Status: http.StatusBadRequest, Error: "invalid frame: " + err.Error()}) != nil {
+				return
+			}
+			continue
+		case err != nil:
+			if !errors.Is(err, context.Canceled) && ctx.Err() == nil {
+				logger.Debug("websocket closed", "error", err)
+			}
+			return
+		}
+		if s.handle(request) != nil {
+			return
+		}
+	}
+}
+
+// handle answers one request, an error means the answer could not be
+// written.
+func (s *socket) handle(request frame) error {
+	switch request.Op {
+	case opSubscribe:
+		return s.subscribe(request)
+	case opUnsubscribe:
+		return s.unsubscribe(request)
+	case opPublish:
+		return s.publish(request)
+	case opPing:
+		return s.send(frame{Op: opPong, ID: request.ID})
+	}
+	return s.fail(request, http.StatusBadRequest, "unknown op "+strconv.Quote(request.Op))
+}
+
+func (s *socket) subscribe(request frame) error {
+	subject := request.Subject
+	if subject == "" {
+		return s.fail(request, http.StatusBadRequest, "subject is required")
+	}
+	if err := s.gateway.allowed(s.identity, routeSocket, auth.PermSubscribe, subject); err != nil {
+		return s.fail(request, http.StatusForbidden, err.Error())
+	}
+	s.lock.Lock()
+	_, exists := s.subscriptions[subject]
+	s.lock.Unlock()
+	if exists {
+		return s.fail(request, http.StatusConflict, "already subscribed to "+strconv.Quote(subject))
+	}
+
+	release := func() {}
+	if limiter := s.gateway.options.Limiter; limiter != nil {
+		var denial *ratelimit.Denial
+		release, denial = limiter.AcquireSubscription(s.identity.Name, subject)
+		if denial != nil {
+			metrics.RateLimited.WithLabelValues(routeSocket, denial.Scope).Inc()
+			return s.fail(request, http.StatusTooManyRequests, denial.Err.Error()+": "+denial.Scope+" limit")
+		}
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	ch, err := s.gateway.broker.Subscribe(ctx, subject)
+	if err != nil {
+		cancel()
+		release()
+		return s.brokerFail(request, err)
+	}
+	s.lock.Lock()
+	s.subscriptions[subject] = cancel
+	s.lock.Unlock()
+
+	// acked before the first message is forwarded
+	if err := s.send(frame{Op: opAck, ID: request.ID, Subject: subject}); err != nil {
+		release()
+		return err
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer release()
+		s.forward(ctx, subject, ch)
+	}()
+	return nil
+}
+
+// forward sends the messages of one subscription. Like a grpc stream, a
+// slow connection holds the broker back until the write times out.
+func (s *socket) forward(ctx context.Context, subject string, ch <-chan broker.Message) {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				if ctx.Err() == nil {
+					s.drop(subject)
+					s.send(frame{Op: opError, Subject: subject, Status: http.StatusServiceUnavailable, Error: "broker is closed"})
+				}
+				return
+			}
+			sent := subject
+			if msg.Subject != "" {
+				sent = msg.Subject
+			}
+			if err := s.send(frame{Op: opMessage, Subject: sent, Body: msg.Body, Headers: msg.Headers}); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *socket) unsubscribe(request frame) error {
+	if !s.drop(request.Subject) {
+		return s.fail(request, http.StatusNotFound, "not subscribed to "+strconv.Quote(request.Subject))
+	}
+	return s.send(frame{Op: opAck, ID: request.ID, Subject: request.Subject})
+}
+
+// drop cancels the subscription to subject, if there is one
+func (s *socket) drop(subject string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cancel, ok := s.subscriptions[subject]
+	if ok {
+		cancel()
+		delete(s.subscriptions, subject)
+	}
+	return ok
+}
+
+func (s *socket) publish(request frame) error {
+	subject := request.Subject
+	if subject == "" {
+		return s.fail(request, http.StatusBadRequest, "subject is required")
+	}
+	if request.ExpirationSeconds < 0 {
+		return s.fail(request, http.StatusBadRequest, "expiration_seconds must not be negative")
+	}
+	if err := s.gateway.allowed(s.identity, routeSocket, auth.PermPublish, subject); err != nil {
+		return s.fail(request, http.StatusForbidden, err.Error())
+	}
+	if limiter := s.gateway.options.Limiter; limiter != nil {
+		if denial := limiter.AllowPublish(s.identity.Name, subject); denial != nil {
+			metrics.RateLimited.WithLabelValues(routeSocket, denial.Scope).Inc()
+			return s.fail(request, http.StatusTooManyRequests, denial.Err.Error()+": "+denial.Scope+" limit")
+		}
+	}
+	id, err := s.gateway.broker.Publish(s.ctx, subject, broker.Message{
+		Body:       request.Body,
+		Expiration: time.Duration(request.ExpirationSeconds) * time.Second,
+		Headers:    request.Headers,
+	})
+	if err != nil {
+		return s.brokerFail(request, err)
+	}
+	return s.send(frame{Op: opAck, ID: request.ID, Subject: subject, MessageID: id})
+}
+
+func (s *socket) keepAlive() {
+	ticker := time.NewTicker(s.gateway.options.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.send(frame{Op: opKeepAlive}) != nil {
+				s.conn.Close()
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *socket) brokerFail(request frame, err error) error {
+	code, message := brokerStatus(err)
+	if code == http.StatusInternalServerError {
+		logging.FromContext(s.ctx).Error("broker call failed", "op", request.Op, "subject", request.Subject, "error", err)
+	}
+	return s.fail(request, code, message)
+}
+
+func (s *socket) fail(request frame, code int, message string) error {
+	return s.send(frame{Op: opError, ID: request.ID, Subject: request.Subject, Status: code, Error: message})
+}
+
+// send writes one frame, the subscriptions and the reader share the
+// connection.
+func (s *socket) send(f frame) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.gateway.options.WriteTimeout))
+	return websocket.JSON.Send(s.conn, f)
+}
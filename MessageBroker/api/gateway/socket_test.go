@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func dialSocket(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws" + query
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, f frame) {
+	t.Helper()
+	assert.Nil(t, websocket.JSON.Send(conn, f))
+}
+
+// readFrame returns the next frame that is not a keepalive
+func readFrame(t *testing.T, conn *websocket.Conn) frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f frame
+		if err := websocket.JSON.Receive(conn, &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Op != opKeepAlive {
+			return f
+		}
+	}
+}
+
+func TestSocketShouldSubscribePublishAndUnsubscribe(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+	conn := dialSocket(t, srv, "")
+
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "1", Subject: "orders"})
+	assert.Equal(t, frame{Op: opAck, ID: "1", Subject: "orders"}, readFrame(t, conn))
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "2", Subject: "payments"})
+	assert.Equal(t, frame{Op: opAck, ID: "2", Subject: "payments"}, readFrame(t, conn))
+
+	sendFrame(t, conn, frame{Op: opPublish, ID: "3", Subject: "orders", Body: "a", Headers: map[string]string{"k": "v"}, ExpirationSeconds: 60})
+	// the message may be forwarded before the publish is acked
+	received := map[string]frame{}
+	for len(received) < 2 {
+		f := readFrame(t, conn)
+		received[f.Op] = f
+	}
+	assert.Equal(t, "3", received[opAck].ID)
+	assert.NotEmpty(t, received[opAck].MessageID)
+	assert.Equal(t, frame{Op: opMessage, Subject: "orders", Body: "a", Headers: map[string]string{"k": "v"}}, received[opMessage])
+
+	// the published message can be fetched over http
+	resp, body := request(t, http.MethodGet, srv.URL+"/subjects/orders/messages/"+received[opAck].MessageID, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "a", body["body"])
+
+	publish(t, srv, "payments", "b")
+	assert.Equal(t, frame{Op: opMessage, Subject: "payments", Body: "b"}, readFrame(t, conn))
+
+	sendFrame(t, conn, frame{Op: opUnsubscribe, ID: "4", Subject: "orders"})
+	assert.Equal(t, frame{Op: opAck, ID: "4", Subject: "orders"}, readFrame(t, conn))
+	publish(t, srv, "orders", "ignored")
+	publish(t, srv, "payments", "c")
+	assert.Equal(t, frame{Op: opMessage, Subject: "payments", Body: "c"}, readFrame(t, conn))
+}
+
+func TestSocketShouldAnswerBadRequestsWithErrors(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{})
+	conn := dialSocket(t, srv, "")
+
+	assert.Nil(t, websocket.Message.Send(conn, "not json"))
+	f := readFrame(t, conn)
+	assert.Equal(t, opError, f.Op)
+	assert.Equal(t, http.StatusBadRequest, f.Status)
+
+	for _, c := range []struct {
+		request frame
+		status  int
+	}{
+		{frame{Op: "dance", ID: "1"}, http.StatusBadRequest},
+		{frame{Op: opSubscribe, ID: "2"}, http.StatusBadRequest},
+		{frame{Op: opUnsubscribe, ID: "3", Subject: "orders"}, http.StatusNotFound},
+		{frame{Op: opPublish, ID: "4", Subject: "orders", ExpirationSeconds: -1}, http.StatusBadRequest},
+	} {
+		sendFrame(t, conn, c.request)
+		f := readFrame(t, conn)
+		assert.Equal(t, opError, f.Op)
+		assert.Equal(t, c.request.ID, f.ID)
+		assert.Equal(t, c.status, f.Status, f.Error)
+	}
+
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "5", Subject: "orders"})
+	assert.Equal(t, opAck, readFrame(t, conn).Op)
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "6", Subject: "orders"})
+	assert.Equal(t, http.StatusConflict, readFrame(t, conn).Status)
+
+	sendFrame(t, conn, frame{Op: opPing, ID: "7"})
+	assert.Equal(t, frame{Op: opPong, ID: "7"}, readFrame(t, conn))
+}
+
+func TestSocketShouldApplyAuthAndLimits(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "dashboard"}},
+		ACL:     []auth.Rule{{Identity: "dashboard", Subscribe: []string{"orders.>"}, Publish: []string{"orders.>"}}},
+	}, nil)
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{
+		Clients: map[string]ratelimit.Limit{"dashboard": {MaxSubscriptions: 1}},
+	})
+	srv := startGateway(t, newModule(t), Options{Authorizer: authorizer, Limiter: limiter})
+
+	_, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", "http://localhost/")
+	assert.NotNil(t, err, "connected without a token")
+
+	conn := dialSocket(t, srv, "?access_token=key-1")
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "1", Subject: "payments"})
+	assert.Equal(t, http.StatusForbidden, readFrame(t, conn).Status)
+	sendFrame(t, conn, frame{Op: opPublish, ID: "2", Subject: "payments"})
+	assert.Equal(t, http.StatusForbidden, readFrame(t, conn).Status)
+
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "3", Subject: "orders.eu"})
+	assert.Equal(t, opAck, readFrame(t, conn).Op)
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "4", Subject: "orders.us"})
+	assert.Equal(t, http.StatusTooManyRequests, readFrame(t, conn).Status)
+
+	// unsubscribing gives the quota back
+	sendFrame(t, conn, frame{Op: opUnsubscribe, ID: "5", Subject: "orders.eu"})
+	assert.Equal(t, opAck, readFrame(t, conn).Op)
+	assert.Eventually(t, func() bool {
+		sendFrame(t, conn, frame{Op: opSubscribe, ID: "6", Subject: "orders.us"})
+		return readFrame(t, conn).Op == opAck
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSocketShouldRejectForeignOrigins(t *testing.T) {
+	srv := startGateway(t, newModule(t), Options{AllowedOrigins: []string{"https://dashboard.example.com"}})
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	_, err := websocket.Dial(url, "", "https://evil.example.com")
+	assert.NotNil(t, err)
+	conn, err := websocket.Dial(url, "", "https://dashboard.example.com")
+	assert.Nil(t, err)
+	conn.Close()
+}
+
+func TestSocketShouldCloseWithTheGateway(t *testing.T) {
+	g := New(newModule(t), Options{})
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+	conn := dialSocket(t, srv, "")
+	sendFrame(t, conn, frame{Op: opSubscribe, ID: "1", Subject: "orders"})
+	readFrame(t, conn)
+
+	g.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var f frame
+	assert.NotNil(t, websocket.JSON.Receive(conn, &f))
+}
@@ -0,0 +1,291 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/internal/logging"
+	"therealbroker/pkg/broker"
+)
+
+// event is a message delivered on a subject, numbered for Last-Event-ID
+type event struct {
+	seq  uint64
+	data []byte
+}
+
+// topic holds the one broker subscription every stream of a subject
+// shares, and a ring of its latest events. Streams read the ring at
+// their own pace, a slow stream skips events instead of blocking the
+// broker.
+type topic struct {
+	subject string
+	// Tells apart the topics a subject had over time, so an event id of
+	// a dropped topic is not resumed against a new one
+	epoch  string
+	cancel context.CancelFunc
+
+	lock   sync.Mutex
+	ring   []event
+	next   uint64
+	notify chan struct{}
+	done   chan struct{}
+
+	// Guarded by the gateway lock
+	streams int
+	idle    *time.Timer
+}
+
+func (t *topic) run(ctx context.Context, ch <-chan broker.Message) {
+	defer t.stop()
+	for {
+		var msg broker.Message
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-ctx.Done():
+			return
+		}
+		subject := t.subject
+		if msg.Subject != "" {
+			// delivered to a pattern, tell which subject it was sent to
+			subject = msg.Subject
+		}
+		data, err := json.Marshal(messageResponse{Subject: subject, Body: msg.Body, Headers: msg.Headers})
+		if err != nil {
+			continue
+		}
+		t.lock.Lock()
+		t.ring[t.next%uint64(len(t.ring))] = event{seq: t.next, data: data}
+		t.next++
+		close(t.notify)
+		t.notify = make(chan struct{})
+		t.lock.Unlock()
+	}
+}
+
+func (t *topic) stop() {
+	t.cancel()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+}
+
+// since returns the events numbered after seq that are still in the
+// ring, and a channel closed on the next event.
+func (t *topic) since(seq uint64) ([]event, <-chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	first := seq + 1
+	if oldest := t.oldest(); first < oldest {
+		first = oldest
+	}
+	var events []event
+	for s := first; s < t.next; s++ {
+		events = append(events, t.ring[s%uint64(len(t.ring))])
+	}
+	return events, t.notify
+}
+
+func (t *topic) oldest() uint64 {
+	if t.next <= uint64(len(t.ring)) {
+		return 1
+	}
+	return t.next - uint64(len(t.ring))
+}
+
+// resume tells where a stream starts: after the event of lastEventID,
+// with everything still buffered when the id belongs to an older topic,
+// or with the next event for a new stream.
+func (t *topic) resume(lastEventID string) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	live := t.next - 1
+	if lastEventID == "" {
+		return live
+	}
+	epoch, seq, found := strings.Cut(lastEventID, ":")
+	if !found || epoch != t.epoch {
+		// the topic was dropped and recreated since that event, every
+		// event it buffered came after the stream went away
+		return 0
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n > live {
+		return live
+	}
+	return n
+}
+
+func (t *topic) eventID(e event) string {
+	return t.epoch + ":" + strconv.FormatUint(e.seq, 10)
+}
+
+// acquire returns the topic of subject, subscribing to the broker on the
+// first stream.
+func (g *Gateway) acquire(subject string) (*topic, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return nil, broker.ErrUnavailable
+	}
+	if t, ok := g.topics[subject]; ok {
+		select {
+		case <-t.done:
+		default:
+			if t.idle != nil {
+				t.idle.Stop()
+				t.idle = nil
+			}
+			t.streams++
+			return t, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := g.broker.Subscribe(ctx, subject)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t := &topic{
+		subject: subject,
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		cancel:  cancel,
+		ring:    make([]event, g.options.ReplaySize),
+		next:    1,
+		notify:  make(chan struct{}),
+		done:    make(chan struct{}),
+		streams: 1,
+	}
+	g.topics[subject] = t
+	go func() {
+		t.run(ctx, ch)
+		g.drop(t)
+	}()
+	return t, nil
+}
+
+// release is called when a stream ends, the last one leaves the topic
+// buffering for the retention period so clients can reconnect.
+func (g *Gateway) release(t *topic) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	t.streams--
+	if t.streams > 0 {
+		return
+	}
+	t.idle = time.AfterFunc(g.options.Retention, func() {
+		g.lock.Lock()
+		idle := t.streams == 0
+		g.lock.Unlock()
+		if idle {
+			t.stop()
+		}
+	})
+}
+
+func (g *Gateway) drop(t *topic) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.topics[t.subject] == t {
+		delete(g.topics, t.subject)
+	}
+}
+
+func (g *Gateway) stream(w http.ResponseWriter, r *http.Request) {
+	subject := r.PathValue("subject")
+	identity, ok := g.authorize(w, r, routeStream, auth.PermSubscribe, subject)
+	if !ok {
+		return
+	}
+	if g.options.Limiter != nil {
+		release, denial := g.options.Limiter.AcquireSubscription(identity, subject)
+		if denial != nil {
+			rateLimited(w, routeStream, denial)
+			return
+		}
+		defer release()
+	}
+
+	t, err := g.acquire(subject)
+	if err != nil {
+		brokerError(w, r, err)
+		return
+	}
+	defer g.release(t)
+	metrics.GatewayStreams.Inc()
+	defer metrics.GatewayStreams.Dec()
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		// EventSource polyfills that can't set headers send it this way
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	cursor := t.resume(lastEventID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	fmt.Fprintf(w, "retry: %d\n\n", g.options.RetryDelay.Milliseconds())
+	if err := flusher.Flush(); err != nil {
+		logging.FromContext(r.Context()).Error("stream can't be flushed", "error", err)
+		return
+	}
+	logging.FromContext(r.Context()).Debug("stream started", "last_event_id", lastEventID)
+
+	keepAlive := time.NewTicker(g.options.KeepAlive)
+	defer keepAlive.Stop()
+	for {
+		events, notify := t.since(cursor)
+		for _, e := range events {
+			if err := writeEvent(w, t.eventID(e), e.data); err != nil {
+				return
+			}
+			cursor = e.seq
+		}
+		if len(events) > 0 {
+			if err := flusher.Flush(); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := flusher.Flush(); err != nil {
+				return
+			}
+		case <-t.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, id string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", id, data)
+	return err
+}
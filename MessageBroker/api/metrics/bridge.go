@@ -0,0 +1,60 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `bridge_forwarded` counts messages republished on the destination
+	BridgeForwarded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_forwarded_messages_total",
+			Help: "Total number of messages copied to the destination broker per route.",
+		},
+		[]string{"route"},
+	)
+
+	// `bridge_failures` counts failed publish attempts, retried until
+	// they succeed
+	BridgeFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_publish_failures_total",
+			Help: "Total number of failed publishes to the destination broker per route.",
+		},
+		[]string{"route"},
+	)
+
+	// `bridge_loops` counts messages not forwarded because they already
+	// passed through the destination broker
+	BridgeLoops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_loop_dropped_messages_total",
+			Help: "Total number of messages dropped by loop prevention per route.",
+		},
+		[]string{"route"},
+	)
+
+	// `bridge_subscribed` is 1 while the source subscription of a route is up
+	BridgeSubscribed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bridge_subscribed",
+			Help: "Whether the source subscription of a route is established.",
+		},
+		[]string{"route"},
+	)
+
+	// `bridge_last_forward` is the unix time of the last copied message
+	BridgeLastForward = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bridge_last_forward_timestamp_seconds",
+			Help: "Unix time of the last message copied per route.",
+		},
+		[]string{"route"},
+	)
+)
+
+func InitBridgeMetrics() {
+	prometheus.MustRegister(BridgeForwarded)
+	prometheus.MustRegister(BridgeFailures)
+	prometheus.MustRegister(BridgeLoops)
+	prometheus.MustRegister(BridgeSubscribed)
+	prometheus.MustRegister(BridgeLastForward)
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `forwarded_messages` counts messages sent to another cluster node,
+	// once per node that has subscribers for the subject
+	ForwardedMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_cluster_forwarded_messages_total",
+			Help: "Total number of messages forwarded to other cluster nodes per subject.",
+		},
+		[]string{"subject"},
+	)
+
+	// `cluster_peers` is the number of other nodes this node is linked to
+	ClusterPeers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "broker_cluster_peers",
+			Help: "Number of cluster peers with a working interest stream.",
+		},
+	)
+)
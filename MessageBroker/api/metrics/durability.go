@@ -0,0 +1,51 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `published_by_durability` counts publishes per durability level
+	PublishedByDurability = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_published_by_durability_total",
+			Help: "Total number of messages published per durability level.",
+		},
+		[]string{"durability"},
+	)
+
+	// `publish_ack_duration` for how long publishes take to return per
+	// durability level, storage included for sync only
+	PublishAckDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "broker_publish_ack_duration_seconds",
+			Help:    "Histogram of the time until a publish is acknowledged per durability level.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"durability"},
+	)
+
+	// `async_save_queue` is the number of async publishes not saved yet
+	AsyncSaveQueue = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "broker_async_save_queue_depth",
+			Help: "Number of async publishes waiting to be saved.",
+		},
+	)
+
+	// `async_save_fallbacks` counts async publishes saved before
+	// returning because the queue was full
+	AsyncSaveFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "broker_async_save_fallbacks_total",
+			Help: "Total number of async publishes saved synchronously because the save queue was full.",
+		},
+	)
+
+	// `async_save_failures` counts async publishes that could not be
+	// saved, the publisher already got its acknowledgement
+	AsyncSaveFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "broker_async_save_failures_total",
+			Help: "Total number of async publishes that failed to be saved.",
+		},
+	)
+)
@@ -0,0 +1,40 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `gateway_requests` counts http gateway requests per route and status
+	GatewayRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_gateway_requests_total",
+			Help: "Total number of HTTP gateway requests.",
+		},
+		[]string{"code", "route"},
+	)
+
+	// `gateway_duration` for latency of each route, streams included
+	GatewayDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_gateway_duration_seconds",
+			Help:    "Histogram of HTTP gateway request durations.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+
+	// `gateway_streams` is the number of open Server-Sent Events streams
+	GatewayStreams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_gateway_active_streams",
+			Help: "Current number of Server-Sent Events streams.",
+		},
+	)
+
+	// `gateway_websockets` is the number of open websocket connections
+	GatewayWebSockets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_gateway_active_websockets",
+			Help: "Current number of WebSocket connections.",
+		},
+	)
+)
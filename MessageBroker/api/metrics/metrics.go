@@ -1,7 +1,7 @@
 package metrics
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"runtime"
 
@@ -37,6 +37,24 @@ var (
 		},
 	)
 
+	// `auth_denials` to count calls rejected by the auth interceptors
+	AuthDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_auth_denials_total",
+			Help: "Total number of gRPC calls rejected by authentication or authorization.",
+		},
+		[]string{"method", "reason"},
+	)
+
+	// `rate_limited` to count calls rejected by rate limits and quotas
+	RateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_rate_limited_total",
+			Help: "Total number of gRPC calls rejected by rate limits or subscription quotas.",
+		},
+		[]string{"method", "scope"},
+	)
+
 	MemStats = prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Name: "application_memory_usage_bytes",
@@ -86,19 +104,52 @@ func InitMetrics() {
 	prometheus.MustRegister(RpcDurations)
 	prometheus.MustRegister(RpcCalls)
 	prometheus.MustRegister(ActiveSubscriptions)
+	prometheus.MustRegister(AuthDenials)
+	prometheus.MustRegister(RateLimited)
+	prometheus.MustRegister(PublishedMessages)
+	prometheus.MustRegister(DeliveredMessages)
+	prometheus.MustRegister(DroppedMessages)
+	prometheus.MustRegister(DataControlDurations)
+	prometheus.MustRegister(PostgresBatchSize)
+	prometheus.MustRegister(CompressedBytes)
+	prometheus.MustRegister(SchemaRejections)
+	prometheus.MustRegister(FilteredMessages)
+	prometheus.MustRegister(PublishedByDurability)
+	prometheus.MustRegister(PublishAckDurations)
+	prometheus.MustRegister(AsyncSaveQueue)
+	prometheus.MustRegister(AsyncSaveFallbacks)
+	prometheus.MustRegister(AsyncSaveFailures)
+	prometheus.MustRegister(ForwardedMessages)
+	prometheus.MustRegister(ClusterPeers)
+	prometheus.MustRegister(GatewayRequests)
+	prometheus.MustRegister(GatewayDurations)
+	prometheus.MustRegister(GatewayStreams)
+	prometheus.MustRegister(GatewayWebSockets)
+	prometheus.MustRegister(MQTTConnections)
+	prometheus.MustRegister(MQTTSessions)
+	prometheus.MustRegister(MQTTMessages)
+	prometheus.MustRegister(MQTTDroppedMessages)
+	prometheus.MustRegister(RESPConnections)
+	prometheus.MustRegister(RESPCommands)
 	prometheus.MustRegister(MemStats)
 	prometheus.MustRegister(GcCount)
 	prometheus.MustRegister(CpuNum)
 	prometheus.MustRegister(GoRoutineNum)
 }
 
-func StartMetricsServer() {
+func StartMetricsServer(address string) {
 	InitMetrics()
+	ServeMetrics(address)
+}
+
+// ServeMetrics exposes the registered metrics on address without
+// registering the broker ones, e.g. for the bridge.
+func ServeMetrics(address string) {
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
-		if err := http.ListenAndServe(":2112", nil); err != nil {
-			log.Println("failed to start metrics server")
+		if err := http.ListenAndServe(address, nil); err != nil {
+			slog.Error("failed to start metrics server", "address", address, "error", err)
 		}
 	}()
-	log.Println("*** metric server started ***")
+	slog.Info("metric server started", "address", address)
 }
@@ -0,0 +1,39 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `mqtt_connections` is the number of open mqtt connections
+	MQTTConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_active_connections",
+			Help: "Current number of MQTT connections.",
+		},
+	)
+
+	// `mqtt_sessions` counts sessions, persistent ones of offline clients included
+	MQTTSessions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mqtt_sessions",
+			Help: "Current number of MQTT sessions.",
+		},
+	)
+
+	// `mqtt_messages` counts publishes received from and sent to mqtt clients
+	MQTTMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_messages_total",
+			Help: "Total number of MQTT publishes per direction.",
+		},
+		[]string{"direction"},
+	)
+
+	// `mqtt_dropped` counts messages a session could not queue
+	MQTTDroppedMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_dropped_messages_total",
+			Help: "Total number of messages dropped for MQTT clients.",
+		},
+		[]string{"reason"},
+	)
+)
@@ -0,0 +1,22 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// `resp_connections` is the number of open redis protocol connections
+	RESPConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "resp_active_connections",
+			Help: "Current number of RESP connections.",
+		},
+	)
+
+	// `resp_commands` counts commands per name, unknown ones under "unknown"
+	RESPCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "resp_commands_total",
+			Help: "Total number of RESP commands per command.",
+		},
+		[]string{"command"},
+	)
+)
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Label of every subject that comes after the tracked ones are full
+	OtherSubjects = "_other"
+	// Default number of subjects that get their own label values
+	DefaultMaxSubjects = 100
+)
+
+var (
+	// `published_messages` per subject
+	PublishedMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_published_messages_total",
+			Help: "Total number of messages published per subject.",
+		},
+		[]string{"subject"},
+	)
+
+	// `delivered_messages` counts every message put in a subscriber queue,
+	// so one publish with three subscribers counts three deliveries
+	DeliveredMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_delivered_messages_total",
+			Help: "Total number of messages fanned out to subscriber queues per subject.",
+		},
+		[]string{"subject"},
+	)
+
+	// `dropped_messages` counts messages that were queued for a subscriber
+	// but never delivered, e.g. because it unsubscribed
+	DroppedMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_dropped_messages_total",
+			Help: "Total number of queued messages discarded before delivery per subject.",
+		},
+		[]string{"subject", "reason"},
+	)
+
+	// `datacontrol_duration` for latency of every storage call
+	DataControlDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "broker_datacontrol_duration_seconds",
+			Help:    "Histogram of data control operation durations per backend.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"backend", "operation", "result"},
+	)
+
+	// `postgres_batch_size` for number of messages inserted per flush
+	PostgresBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "broker_postgres_batch_size",
+			Help:    "Histogram of messages inserted per postgres batch flush.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		},
+	)
+
+	// `compressed_bytes` counts the raw and compressed bytes of bodies compressed at rest
+	CompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_compressed_bytes_total",
+			Help: "Total size of the bodies compressed at rest, before and after compression.",
+		},
+		[]string{"algorithm", "stage"},
+	)
+
+	// `schema_rejections` counts publishes whose body did not match the
+	// schema of the subject
+	SchemaRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_schema_rejections_total",
+			Help: "Total number of publishes rejected by the schema registry per subject.",
+		},
+		[]string{"subject"},
+	)
+
+	// `filtered_messages` counts messages not put in a subscriber queue
+	// because the filter of the subscription did not match them
+	FilteredMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_filtered_messages_total",
+			Help: "Total number of messages skipped by subscription filters per subject.",
+		},
+		[]string{"subject"},
+	)
+
+	subjectQueueDepth = prometheus.NewDesc(
+		"broker_subscriber_queue_depth",
+		"Messages waiting in the fullest subscriber queue of each subject.",
+		[]string{"subject"}, nil,
+	)
+
+	subjects = NewSubjectLabels(DefaultMaxSubjects)
+)
+
+// SubjectLabels bounds the cardinality of subject labels. The first max
+// subjects seen keep their name, later ones share the OtherSubjects label.
+type SubjectLabels struct {
+	lock    sync.RWMutex
+	max     int
+	tracked map[string]bool
+}
+
+func NewSubjectLabels(max int) *SubjectLabels {
+	return &SubjectLabels{max: max, tracked: make(map[string]bool)}
+}
+
+func (s *SubjectLabels) Label(subject string) string {
+	s.lock.RLock()
+	tracked := s.tracked[subject]
+	full := len(s.tracked) >= s.max
+	s.lock.RUnlock()
+	if tracked {
+		return subject
+	}
+	if full {
+		return OtherSubjects
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tracked) >= s.max && !s.tracked[subject] {
+		return OtherSubjects
+	}
+	s.tracked[subject] = true
+	return subject
+}
+
+// SetMaxSubjects changes how many subjects get their own label values.
+// Subjects that are already tracked keep their label.
+func SetMaxSubjects(max int) {
+	subjects.lock.Lock()
+	defer subjects.lock.Unlock()
+	subjects.max = max
+}
+
+// SubjectLabel returns the label value to use for subject.
+func SubjectLabel(subject string) string {
+	return subjects.Label(subject)
+}
+
+// QueueDepthCollector reports subscriber queue depths at scrape time.
+// depths returns the depth of the fullest queue per subject.
+type QueueDepthCollector struct {
+	depths func() map[string]int
+}
+
+func NewQueueDepthCollector(depths func() map[string]int) *QueueDepthCollector {
+	return &QueueDepthCollector{depths: depths}
+}
+
+func (c *QueueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subjectQueueDepth
+}
+
+func (c *QueueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	byLabel := make(map[string]int)
+	for subject, depth := range c.depths() {
+		label := SubjectLabel(subject)
+		byLabel[label] = max(byLabel[label], depth)
+	}
+	for label, depth := range byLabel {
+		ch <- prometheus.MustNewConstMetric(subjectQueueDepth, prometheus.GaugeValue, float64(depth), label)
+	}
+}
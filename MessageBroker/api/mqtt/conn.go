@@ -0,0 +1,473 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/api/ratelimit"
+	"therealbroker/internal/logging"
+	"therealbroker/pkg/broker"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/uuid"
+)
+
+// Method labels of the auth and rate limit metrics
+const (
+	methodConnect   = "MQTT CONNECT"
+	methodPublish   = "MQTT PUBLISH"
+	methodSubscribe = "MQTT SUBSCRIBE"
+)
+
+// Return code of a SUBACK for a filter that was not subscribed
+const subscribeFailure = 0x80
+
+// A client has this long to send its CONNECT
+const connectTimeout = 10 * time.Second
+
+var (
+	errPacketTooLarge = errors.New("packet is too large")
+	errQoS2           = errors.New("QoS 2 is not supported")
+	errSessionTaken   = errors.New("client id is used by another identity")
+)
+
+// conn is one network connection, from its CONNECT to its end
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	identity  auth.Identity
+	session   *session
+	keepAlive time.Duration
+	// Published when the connection ends without a DISCONNECT
+	will *packets.PublishPacket
+
+	writeLock sync.Mutex
+	// Set when a newer connection of the client or the server closing
+	// ended this one, the will is not published then
+	kicked atomic.Bool
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		server:  server,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	metrics.MQTTConnections.Inc()
+	defer metrics.MQTTConnections.Dec()
+
+	if !c.connect() {
+		return
+	}
+	defer c.server.detach(c, c.session)
+	logger := logging.FromContext(c.ctx)
+	logger.Debug("mqtt client connected", "clean_session", c.session.clean)
+
+	err := c.readLoop()
+	if c.will != nil && !c.kicked.Load() {
+		c.publishWill()
+	}
+	switch {
+	case err == nil, errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), c.kicked.Load():
+		logger.Debug("mqtt client disconnected")
+	default:
+		logger.Warn("mqtt connection closed", "error", err)
+	}
+}
+
+// readLoop handles packets until DISCONNECT, which returns nil, or until
+// the connection fails or breaks the protocol.
+func (c *conn) readLoop() error {
+	for {
+		packet, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			err = c.publish(p)
+		case *packets.PubackPacket:
+			c.session.acked(p.MessageID)
+		case *packets.SubscribePacket:
+			err = c.subscribe(p)
+		case *packets.UnsubscribePacket:
+			err = c.unsubscribe(p)
+		case *packets.PingreqPacket:
+			err = c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			c.will = nil
+			return nil
+		default:
+			err = fmt.Errorf("unexpected packet %T", packet)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect reads the CONNECT packet, authenticates the client and attaches
+// it to its session. It reports whether the connection was accepted.
+func (c *conn) connect() bool {
+	c.netConn.SetReadDeadline(time.Now().Add(connectTimeout))
+	packet, err := readPacket(c.reader, c.server.options.MaxPacketBytes)
+	if err != nil {
+		return false
+	}
+	p, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return false
+	}
+	switch code := p.Validate(); code {
+	case packets.Accepted:
+	case packets.ErrProtocolViolation:
+		return false
+	default:
+		c.refuse(code)
+		return false
+	}
+
+	clientID := p.ClientIdentifier
+	if clientID == "" {
+		// only clean sessions may leave the id to the server
+		clientID = "auto-" + uuid.NewString()
+	}
+	logger := slog.Default().With("client_id", clientID, "remote_address", c.netConn.RemoteAddr().String())
+
+	id, code := c.authenticate(p)
+	if code != packets.Accepted {
+		logger.Warn("mqtt client refused", "reason", packets.ConnackReturnCodes[code])
+		c.refuse(code)
+		return false
+	}
+	c.identity = id
+	logger = logger.With("client", id.Name)
+	c.ctx = logging.NewContext(c.ctx, logger)
+
+	if p.WillFlag {
+		subject, err := topicSubject(p.WillTopic)
+		if err != nil {
+			logger.Warn("mqtt client refused", "reason", "invalid will topic", "error", err)
+			return false
+		}
+		if !c.allowed(methodConnect, auth.PermPublish, subject) {
+			c.refuse(packets.ErrRefusedNotAuthorised)
+			return false
+		}
+		c.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		c.will.TopicName = p.WillTopic
+		c.will.Payload = p.WillMessage
+		c.will.Qos = min(p.WillQos, 1)
+		c.will.Retain = p.WillRetain
+	}
+	c.keepAlive = time.Duration(p.Keepalive) * time.Second
+
+	sess, present, err := c.server.attach(c, clientID, p.CleanSession)
+	if err == errSessionTaken {
+		metrics.AuthDenials.WithLabelValues(methodConnect, "session_taken").Inc()
+		logger.Warn("mqtt client refused", "reason", err)
+		c.refuse(packets.ErrRefusedNotAuthorised)
+		return false
+	}
+	if err != nil {
+		c.refuse(packets.ErrRefusedServerUnavailable)
+		return false
+	}
+	c.session = sess
+	if !sess.resume(c, present) {
+		c.server.detach(c, sess)
+		return false
+	}
+	return true
+}
+
+// authenticate checks the password as a bearer token, or the client
+// certificate when there is no password.
+func (c *conn) authenticate(p *packets.ConnectPacket) (auth.Identity, byte) {
+	token := string(p.Password)
+	id, err := auth.Identify(c.server.options.Authorizer, token, auth.ConnState(c.netConn), c.netConn.RemoteAddr().String())
+	if err != nil {
+		metrics.AuthDenials.WithLabelValues(methodConnect, "unauthenticated").Inc()
+		if token == "" {
+			return auth.Identity{}, packets.ErrRefusedNotAuthorised
+		}
+		return auth.Identity{}, packets.ErrRefusedBadUsernameOrPassword
+	}
+	return id, packets.Accepted
+}
+
+func (c *conn) allowed(method string, perm auth.Permission, subject string) bool {
+	authorizer := c.server.options.Authorizer
+	if authorizer == nil {
+		return true
+	}
+	if err := authorizer.Authorize(c.identity, perm, subject); err != nil {
+		metrics.AuthDenials.WithLabelValues(method, "forbidden").Inc()
+		logging.FromContext(c.ctx).Warn("mqtt request denied", "permission", perm, "subject", subject)
+		return false
+	}
+	return true
+}
+
+func (c *conn) refuse(code byte) {
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = code
+	c.write(connack)
+}
+
+// publish sends a client publish to the broker. MQTT 3.1.1 has no way to
+// reject a single publish, so a forbidden one or one that does not match
+// the schema of the subject ends the connection, and a rate limited one
+// holds the client back until it is allowed.
+func (c *conn) publish(p *packets.PublishPacket) error {
+	if p.Qos > 1 {
+		return errQoS2
+	}
+	subject, err := topicSubject(p.TopicName)
+	if err != nil {
+		return fmt.Errorf("invalid topic %q: %w", p.TopicName, err)
+	}
+	if !c.allowed(methodPublish, auth.PermPublish, subject) {
+		return fmt.Errorf("publish on %q is not allowed", p.TopicName)
+	}
+	if err := c.waitForRate(subject); err != nil {
+		return err
+	}
+	if err := c.send(subject, p); err != nil {
+		return err
+	}
+	metrics.MQTTMessages.WithLabelValues("in").Inc()
+	if p.Qos == 1 {
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		return c.write(puback)
+	}
+	return nil
+}
+
+// send publishes p on subject and keeps it when it is retained
+func (c *conn) send(subject string, p *packets.PublishPacket) error {
+	_, err := c.server.broker.Publish(c.ctx, subject, broker.Message{
+		Body:       string(p.Payload),
+		Expiration: c.server.options.Expiration,
+	})
+	if err != nil {
+		// not acknowledged, a QoS 1 publish is sent again on reconnect
+		return fmt.Errorf("publish on %q failed: %w", p.TopicName, err)
+	}
+	if p.Retain {
+		c.server.retain(p)
+	}
+	return nil
+}
+
+func (c *conn) waitForRate(subject string) error {
+	limiter := c.server.options.Limiter
+	if limiter == nil {
+		return nil
+	}
+	for {
+		denial := limiter.AllowPublish(c.identity.Name, subject)
+		if denial == nil {
+			return nil
+		}
+		metrics.RateLimited.WithLabelValues(methodPublish, denial.Scope).Inc()
+		timer := time.NewTimer(denial.RetryAfter)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+			return c.ctx.Err()
+		}
+	}
+}
+
+func (c *conn) publishWill() {
+	subject, err := topicSubject(c.will.TopicName)
+	if err != nil {
+		return
+	}
+	if err := c.send(subject, c.will); err != nil {
+		logging.FromContext(c.ctx).Error("mqtt will not published", "error", err)
+	}
+}
+
+func (c *conn) subscribe(p *packets.SubscribePacket) error {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+	granted := make(map[string]byte, len(p.Topics))
+	for i, filter := range p.Topics {
+		code := c.subscribeFilter(filter, p.Qoss[i])
+		if code != subscribeFailure {
+			granted[filter] = code
+		}
+		suback.ReturnCodes = append(suback.ReturnCodes, code)
+	}
+	if err := c.write(suback); err != nil {
+		return err
+	}
+
+	// retained messages follow the SUBACK, flagged as such
+	for filter, qos := range granted {
+		for _, retained := range c.server.retainedFor(filter) {
+			p := retained.Copy()
+			p.Qos = min(retained.Qos, qos)
+			p.Retain = true
+			c.session.deliver(p)
+		}
+	}
+	return nil
+}
+
+// subscribeFilter returns the granted QoS, or subscribeFailure
+func (c *conn) subscribeFilter(filter string, qos byte) byte {
+	logger := logging.FromContext(c.ctx)
+	subjects, err := filterSubjects(filter)
+	if err != nil || qos > 2 {
+		logger.Warn("mqtt subscribe refused", "filter", filter, "error", err)
+		return subscribeFailure
+	}
+	if !c.allowed(methodSubscribe, auth.PermSubscribe, subjects[len(subjects)-1]) {
+		return subscribeFailure
+	}
+	// "a/#" is allowed by an acl on "a.>" alone, without the parent level
+	if authorizer := c.server.options.Authorizer; len(subjects) > 1 &&
+		authorizer != nil && authorizer.Authorize(c.identity, auth.PermSubscribe, subjects[0]) != nil {
+		subjects = subjects[1:]
+	}
+
+	release := func() {}
+	if limiter := c.server.options.Limiter; limiter != nil {
+		// counted once, on the widest subject of the filter
+		var denial *ratelimit.Denial
+		release, denial = limiter.AcquireSubscription(c.identity.Name, subjects[len(subjects)-1])
+		if denial != nil {
+			metrics.RateLimited.WithLabelValues(methodSubscribe, denial.Scope).Inc()
+			logger.Warn("mqtt subscribe refused", "filter", filter, "error", denial.Err, "scope", denial.Scope)
+			return subscribeFailure
+		}
+	}
+	qos = min(qos, 1)
+	if err := c.session.subscribe(filter, qos, subjects, release); err != nil {
+		logger.Error("mqtt subscribe failed", "filter", filter, "error", err)
+		return subscribeFailure
+	}
+	return qos
+}
+
+func (c *conn) unsubscribe(p *packets.UnsubscribePacket) error {
+	for _, filter := range p.Topics {
+		c.session.unsubscribe(filter)
+	}
+	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	unsuback.MessageID = p.MessageID
+	return c.write(unsuback)
+}
+
+// read waits for the next packet, at most one and a half keepalive
+// periods as the spec asks.
+func (c *conn) read() (packets.ControlPacket, error) {
+	deadline := time.Time{}
+	if c.keepAlive > 0 {
+		deadline = time.Now().Add(c.keepAlive * 3 / 2)
+	}
+	c.netConn.SetReadDeadline(deadline)
+	return readPacket(c.reader, c.server.options.MaxPacketBytes)
+}
+
+// write sends one packet, a failed write closes the connection
+func (c *conn) write(p packets.ControlPacket) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.netConn.SetWriteDeadline(time.Now().Add(c.server.options.WriteTimeout))
+	err := p.Write(c.netConn)
+	if err != nil {
+		c.netConn.Close()
+	}
+	return err
+}
+
+// kick closes the connection without publishing its will
+func (c *conn) kick() {
+	c.kicked.Store(true)
+	c.close()
+}
+
+func (c *conn) close() {
+	c.cancel()
+	c.netConn.Close()
+}
+
+// readPacket reads one packet, refusing one larger than limit before
+// its body is allocated.
+func readPacket(r *bufio.Reader, limit int) (packets.ControlPacket, error) {
+	typeAndFlags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > limit {
+		return nil, errPacketTooLarge
+	}
+	packet, err := packets.NewControlPacketWithHeader(packets.FixedHeader{
+		MessageType:     typeAndFlags >> 4,
+		Dup:             typeAndFlags&0x08 != 0,
+		Qos:             (typeAndFlags >> 1) & 0x03,
+		Retain:          typeAndFlags&0x01 != 0,
+		RemainingLength: length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if err := packet.Unpack(bytes.NewBuffer(body)); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// readLength decodes the variable length remaining length of the fixed
+// header, at most four bytes.
+func readLength(r *bufio.Reader) (int, error) {
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
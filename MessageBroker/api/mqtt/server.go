@@ -0,0 +1,203 @@
+// Package mqtt serves MQTT 3.1.1 clients on top of broker.Broker, so
+// devices publish and subscribe on the same subjects as grpc clients.
+// QoS 2 is not supported, subscriptions are granted QoS 1 at most.
+package mqtt
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"therealbroker/api/accept"
+	"therealbroker/api/auth"
+	"therealbroker/api/ratelimit"
+	"therealbroker/pkg/broker"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+type Options struct {
+	// Checks the password as a bearer token, and the acl, when set
+	Authorizer *auth.Authorizer
+	// Applies publish rates and subscription quotas when set
+	Limiter *ratelimit.Limiter
+	// Expiration of the messages published over mqtt, zero keeps them
+	Expiration time.Duration
+	// QoS 1 messages sent to a client and not acknowledged yet
+	MaxInflight int
+	// QoS 1 messages queued for a client that is offline or has too
+	// many in flight, newer ones are dropped
+	MaxQueued int
+	// How long the session of a disconnected client is kept
+	SessionExpiry time.Duration
+	// Largest accepted packet
+	MaxPacketBytes int
+	// Longest a write to a client may block its subscriptions
+	WriteTimeout time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxInflight:    100,
+		MaxQueued:      1000,
+		SessionExpiry:  time.Hour,
+		MaxPacketBytes: 1 << 20,
+		WriteTimeout:   10 * time.Second,
+	}
+}
+
+// Server accepts mqtt connections. Sessions and retained messages are
+// kept in memory, they don't survive a restart and are not shared with
+// the other nodes of a cluster.
+type Server struct {
+	broker  broker.Broker
+	options Options
+	loop    *accept.Loop
+
+	lock     sync.Mutex
+	sessions map[string]*session
+
+	retainLock sync.RWMutex
+	// Last retained publish of every topic
+	retained map[string]*packets.PublishPacket
+}
+
+// New creates a server on b, zero options take their default.
+func New(b broker.Broker, options Options) *Server {
+	defaults := DefaultOptions()
+	if options.MaxInflight <= 0 {
+		options.MaxInflight = defaults.MaxInflight
+	}
+	if options.MaxQueued <= 0 {
+		options.MaxQueued = defaults.MaxQueued
+	}
+	if options.SessionExpiry <= 0 {
+		options.SessionExpiry = defaults.SessionExpiry
+	}
+	if options.MaxPacketBytes <= 0 {
+		options.MaxPacketBytes = defaults.MaxPacketBytes
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = defaults.WriteTimeout
+	}
+	return &Server{
+		broker:   b,
+		options:  options,
+		loop:     accept.NewLoop("mqtt"),
+		sessions: make(map[string]*session),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+}
+
+// Serve accepts connections on lis until the server is closed.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.loop.Serve(lis, func(netConn net.Conn) (func(), func()) {
+		c := newConn(s, netConn)
+		return c.serve, c.kick
+	})
+}
+
+// Close stops the listeners, drops every connection and session.
+func (s *Server) Close() error {
+	if !s.loop.Close() {
+		return nil
+	}
+	// no connection is left to attach a session
+	s.lock.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*session)
+	s.lock.Unlock()
+	for _, sess := range sessions {
+		sess.end()
+	}
+	return nil
+}
+
+// attach binds c to the session of its client id, taking it over from
+// an older connection. A clean connection, or one following a clean
+// one, gets a new session. present tells whether a stored session was
+// resumed. With auth on, a session opened by another identity is
+// errSessionTaken.
+func (s *Server) attach(c *conn, clientID string, clean bool) (sess *session, present bool, err error) {
+	s.lock.Lock()
+	if s.loop.Closed() {
+		s.lock.Unlock()
+		return nil, false, broker.ErrUnavailable
+	}
+	old, ok := s.sessions[clientID]
+	if ok && s.options.Authorizer != nil && old.identity.Name != c.identity.Name {
+		s.lock.Unlock()
+		return nil, false, errSessionTaken
+	}
+	if ok && !clean && !old.clean {
+		sess, present = old, true
+	} else {
+		sess = newSession(s, clientID, clean, c.identity)
+		s.sessions[clientID] = sess
+	}
+	sess.claim(c)
+	s.lock.Unlock()
+
+	if ok && !present {
+		old.end()
+	}
+	return sess, present, nil
+}
+
+// detach unbinds c from its session, ending the session when it is
+// clean or once it expired.
+func (s *Server) detach(c *conn, sess *session) {
+	if !sess.release(c) {
+		// taken over by a newer connection
+		return
+	}
+	if sess.clean {
+		s.remove(sess)
+		sess.end()
+		return
+	}
+	sess.expireAfter(s.options.SessionExpiry, func() {
+		if s.remove(sess) {
+			sess.end()
+		}
+	})
+}
+
+// remove forgets sess if it is still the session of its client id and
+// no connection claimed it since
+func (s *Server) remove(sess *session) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sessions[sess.clientID] != sess || !sess.idle() {
+		return false
+	}
+	delete(s.sessions, sess.clientID)
+	return true
+}
+
+// retain stores the retained message of a topic, an empty payload
+// deletes it.
+func (s *Server) retain(p *packets.PublishPacket) {
+	s.retainLock.Lock()
+	defer s.retainLock.Unlock()
+	if len(p.Payload) == 0 {
+		delete(s.retained, p.TopicName)
+		return
+	}
+	stored := p.Copy()
+	stored.Qos = p.Qos
+	s.retained[p.TopicName] = stored
+}
+
+// retainedFor returns the retained messages matching filter
+func (s *Server) retainedFor(filter string) []*packets.PublishPacket {
+	s.retainLock.RLock()
+	defer s.retainLock.RUnlock()
+	var matched []*packets.PublishPacket
+	for topic, p := range s.retained {
+		if matchFilter(filter, topic) {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
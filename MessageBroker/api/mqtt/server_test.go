@@ -0,0 +1,294 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"therealbroker/api/auth"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func newModule(t *testing.T) broker.Broker {
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	t.Cleanup(func() { module.Close() })
+	return module
+}
+
+// startServer serves b on a random port and returns its address
+func startServer(t *testing.T, b broker.Broker, options Options) (*Server, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	server := New(b, options)
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+	return server, lis.Addr().String()
+}
+
+// offline reports whether the session of clientID has no connection
+func (s *Server) offline(clientID string) bool {
+	s.lock.Lock()
+	sess, ok := s.sessions[clientID]
+	s.lock.Unlock()
+	return ok && sess.idle()
+}
+
+func clientOptions(address, clientID string) *paho.ClientOptions {
+	return paho.NewClientOptions().
+		AddBroker("tcp://" + address).
+		SetClientID(clientID).
+		SetAutoReconnect(false).
+		SetConnectTimeout(5 * time.Second)
+}
+
+func connect(t *testing.T, options *paho.ClientOptions) paho.Client {
+	client := paho.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(5*time.Second) || !assert.Nil(t, token.Error()) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// subscribe collects the messages of filter
+func subscribe(t *testing.T, client paho.Client, filter string, qos byte) <-chan paho.Message {
+	messages := make(chan paho.Message, 100)
+	token := client.Subscribe(filter, qos, func(_ paho.Client, msg paho.Message) {
+		messages <- msg
+	})
+	wait(t, token)
+	return messages
+}
+
+func wait(t *testing.T, token paho.Token) {
+	if !token.WaitTimeout(5*time.Second) || !assert.Nil(t, token.Error()) {
+		t.FailNow()
+	}
+}
+
+func next(t *testing.T, messages <-chan paho.Message) paho.Message {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestPublishAndSubscribeShouldMapTopicsToSubjects(t *testing.T) {
+	module := newModule(t)
+	_, address := startServer(t, module, Options{})
+	client := connect(t, clientOptions(address, "device-1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// devices see grpc publishes
+	temps := subscribe(t, client, "sensors/+/temp", 0)
+	// paho hands a message to every matching handler of a client
+	all := subscribe(t, connect(t, clientOptions(address, "device-2")), "sensors/#", 0)
+	_, err := module.Publish(ctx, "sensors.a.temp", broker.Message{Body: "21"})
+	assert.Nil(t, err)
+	_, err = module.Publish(ctx, "sensors", broker.Message{Body: "root"})
+	assert.Nil(t, err)
+
+	msg := next(t, temps)
+	assert.Equal(t, "sensors/a/temp", msg.Topic())
+	assert.Equal(t, "21", string(msg.Payload()))
+	// "#" covers the parent level too, ordered per topic only
+	assert.ElementsMatch(t, []string{"sensors/a/temp", "sensors"}, []string{next(t, all).Topic(), next(t, all).Topic()})
+
+	// and grpc clients see device publishes
+	ch, err := module.Subscribe(ctx, "orders.eu")
+	assert.Nil(t, err)
+	wait(t, client.Publish("orders/eu", 1, false, "hello"))
+	assert.Equal(t, "hello", (<-ch).Body)
+}
+
+func TestQoS1ShouldBeRedeliveredToPersistentSessions(t *testing.T) {
+	module := newModule(t)
+	server, address := startServer(t, module, Options{})
+	subscriber := connect(t, clientOptions(address, "device-1").SetCleanSession(false))
+	subscribe(t, subscriber, "alerts/#", 1)
+	subscribe(t, subscriber, "news/#", 0)
+	subscriber.Disconnect(0)
+	assert.Eventually(t, func() bool { return server.offline("device-1") }, 5*time.Second, 10*time.Millisecond)
+
+	// messages get the QoS of the subscription, the broker keeps no QoS
+	publisher := connect(t, clientOptions(address, "device-2"))
+	wait(t, publisher.Publish("alerts/fire", 1, false, "1"))
+	wait(t, publisher.Publish("news/today", 1, false, "2"))
+	wait(t, publisher.Publish("alerts/flood", 0, false, "3"))
+
+	// QoS 1 messages were queued while offline, QoS 0 ones dropped
+	messages := make(chan paho.Message, 10)
+	options := clientOptions(address, "device-1").SetCleanSession(false).
+		SetDefaultPublishHandler(func(_ paho.Client, msg paho.Message) { messages <- msg })
+	client := paho.NewClient(options)
+	token := client.Connect()
+	wait(t, token)
+	defer client.Disconnect(0)
+	assert.True(t, token.(*paho.ConnectToken).SessionPresent())
+
+	msg := next(t, messages)
+	assert.Equal(t, "1", string(msg.Payload()))
+	assert.Equal(t, byte(1), msg.Qos())
+	assert.Equal(t, "3", string(next(t, messages).Payload()))
+	assert.Empty(t, messages)
+
+	// a clean connection drops the stored session
+	client.Disconnect(0)
+	clean := paho.NewClient(clientOptions(address, "device-1"))
+	token = clean.Connect()
+	wait(t, token)
+	defer clean.Disconnect(0)
+	assert.False(t, token.(*paho.ConnectToken).SessionPresent())
+}
+
+func TestRetainedMessagesShouldBeSentOnSubscribe(t *testing.T) {
+	_, address := startServer(t, newModule(t), Options{})
+	client := connect(t, clientOptions(address, "device-1"))
+	wait(t, client.Publish("status/door", 1, true, "open"))
+	wait(t, client.Publish("status/window", 1, true, "closed"))
+	// an empty retained publish clears the topic
+	wait(t, client.Publish("status/window", 1, true, ""))
+
+	late := connect(t, clientOptions(address, "device-2"))
+	messages := subscribe(t, late, "status/+", 1)
+	msg := next(t, messages)
+	assert.Equal(t, "status/door", msg.Topic())
+	assert.Equal(t, "open", string(msg.Payload()))
+	assert.True(t, msg.Retained())
+	assert.Empty(t, messages)
+
+	// live messages are not flagged
+	wait(t, client.Publish("status/door", 0, true, "closed"))
+	msg = next(t, messages)
+	assert.Equal(t, "closed", string(msg.Payload()))
+	assert.False(t, msg.Retained())
+}
+
+func TestWillShouldBePublishedOnAbnormalDisconnect(t *testing.T) {
+	module := newModule(t)
+	_, address := startServer(t, module, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := module.Subscribe(ctx, "devices.gone")
+	assert.Nil(t, err)
+
+	conn, err := net.Dial("tcp", address)
+	assert.Nil(t, err)
+	connectPacket := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connectPacket.ProtocolName, connectPacket.ProtocolVersion = "MQTT", 4
+	connectPacket.CleanSession = true
+	connectPacket.ClientIdentifier = "device-1"
+	connectPacket.WillFlag, connectPacket.WillTopic, connectPacket.WillMessage = true, "devices/gone", []byte("device-1")
+	assert.Nil(t, connectPacket.Write(conn))
+	connack, err := packets.ReadPacket(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(packets.Accepted), connack.(*packets.ConnackPacket).ReturnCode)
+	conn.Close()
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "device-1", msg.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("will was not published")
+	}
+
+	// not after a DISCONNECT
+	graceful := connect(t, clientOptions(address, "device-2").SetWill("devices/gone", "device-2", 0, false))
+	graceful.Disconnect(100)
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected will %q", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAuthShouldRefuseBadPasswordsAndForbiddenFilters(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "device"}},
+		ACL:     []auth.Rule{{Identity: "device", Publish: []string{"sensors.>"}, Subscribe: []string{"sensors.>"}}},
+	}, nil)
+	_, address := startServer(t, newModule(t), Options{Authorizer: authorizer})
+
+	client := paho.NewClient(clientOptions(address, "device-1").SetUsername("device").SetPassword("wrong"))
+	token := client.Connect()
+	token.WaitTimeout(5 * time.Second)
+	assert.NotNil(t, token.Error())
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), token.(*paho.ConnectToken).ReturnCode())
+
+	client = connect(t, clientOptions(address, "device-1").SetUsername("device").SetPassword("key-1"))
+	token = client.SubscribeMultiple(map[string]byte{"sensors/#": 1, "orders/#": 1, "#": 0}, nil)
+	wait(t, token)
+	granted := token.(*paho.SubscribeToken).Result()
+	assert.Equal(t, byte(1), granted["sensors/#"])
+	assert.Equal(t, byte(subscribeFailure), granted["orders/#"])
+	assert.Equal(t, byte(subscribeFailure), granted["#"])
+
+	// a forbidden publish can't be refused in 3.1.1, the connection ends
+	token = client.Publish("orders/eu", 1, false, "x")
+	token.WaitTimeout(5 * time.Second)
+	assert.Eventually(t, func() bool { return !client.IsConnectionOpen() }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSessionShouldNotBeTakenOverByAnotherIdentity(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "device"}, {Key: "key-2", Identity: "intruder"}},
+		ACL:     []auth.Rule{{Identity: "*", Publish: []string{"sensors.>"}, Subscribe: []string{"sensors.>"}}},
+	}, nil)
+	server, address := startServer(t, newModule(t), Options{Authorizer: authorizer})
+	owner := connect(t, clientOptions(address, "device-1").SetCleanSession(false).SetUsername("device").SetPassword("key-1"))
+	subscribe(t, owner, "sensors/#", 1)
+
+	for _, clean := range []bool{false, true} {
+		intruder := paho.NewClient(clientOptions(address, "device-1").SetCleanSession(clean).SetUsername("intruder").SetPassword("key-2"))
+		token := intruder.Connect()
+		token.WaitTimeout(5 * time.Second)
+		assert.NotNil(t, token.Error())
+		assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), token.(*paho.ConnectToken).ReturnCode())
+	}
+	assert.True(t, owner.IsConnectionOpen())
+	assert.False(t, server.offline("device-1"))
+
+	// the owner still resumes its session
+	owner.Disconnect(0)
+	assert.Eventually(t, func() bool { return server.offline("device-1") }, 5*time.Second, 10*time.Millisecond)
+	client := paho.NewClient(clientOptions(address, "device-1").SetCleanSession(false).SetUsername("device").SetPassword("key-1"))
+	token := client.Connect()
+	wait(t, token)
+	defer client.Disconnect(0)
+	assert.True(t, token.(*paho.ConnectToken).SessionPresent())
+}
+
+func TestServerCloseShouldDisconnectClients(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := New(newModule(t), Options{})
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(lis) }()
+
+	lost := make(chan error, 1)
+	options := clientOptions(lis.Addr().String(), "device-1").
+		SetConnectionLostHandler(func(_ paho.Client, err error) { lost <- err })
+	connect(t, options)
+
+	assert.Nil(t, server.Close())
+	assert.Nil(t, <-served)
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+}
@@ -0,0 +1,327 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/pkg/broker"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// session is the state of a client id: its subscriptions and the QoS 1
+// messages not acknowledged yet. A persistent session outlives its
+// connections, its subscriptions keep queueing while the client is away.
+type session struct {
+	server   *Server
+	clientID string
+	clean    bool
+	// Who opened the session, only they may take it over
+	identity auth.Identity
+
+	lock sync.Mutex
+	// Latest connection of the client, it gets messages once online
+	owner  *conn
+	online bool
+	ended  bool
+	expiry *time.Timer
+	// Keyed by topic filter
+	subscriptions map[string]*subscription
+	// Sent and not acknowledged, in send order
+	inflight []*packets.PublishPacket
+	// Waiting for a connection or a free inflight slot
+	queue  []*packets.PublishPacket
+	nextID uint16
+}
+
+type subscription struct {
+	qos     byte
+	cancel  context.CancelFunc
+	release func()
+}
+
+func newSession(server *Server, clientID string, clean bool, identity auth.Identity) *session {
+	metrics.MQTTSessions.Inc()
+	return &session{
+		server:        server,
+		clientID:      clientID,
+		clean:         clean,
+		identity:      identity,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// claim makes c the owner of the session and drops the previous
+// connection. The server lock must be held, so an expiring session is
+// never claimed.
+func (s *session) claim(c *conn) {
+	s.lock.Lock()
+	old := s.owner
+	s.owner, s.online = c, false
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.lock.Unlock()
+	if old != nil {
+		old.kick()
+	}
+}
+
+// resume sends the CONNACK, then the messages left unacknowledged by the
+// previous connection and the queued ones. It fails when c was taken
+// over in the meantime.
+func (s *session) resume(c *conn, present bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.owner != c || s.ended {
+		return false
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.SessionPresent = present
+	connack.ReturnCode = packets.Accepted
+	if c.write(connack) != nil {
+		return false
+	}
+	s.online = true
+	for _, p := range s.inflight {
+		p.Dup = true
+		if c.write(p) != nil {
+			return true
+		}
+	}
+	s.fill()
+	return true
+}
+
+// release unbinds c, it reports false when c no longer owns the session
+func (s *session) release(c *conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.owner != c {
+		return false
+	}
+	s.owner, s.online = nil, false
+	return true
+}
+
+// idle reports whether no connection owns the session
+func (s *session) idle() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.owner == nil
+}
+
+func (s *session) expireAfter(d time.Duration, expire func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.owner != nil || s.ended {
+		return
+	}
+	s.expiry = time.AfterFunc(d, expire)
+}
+
+// end drops the subscriptions and pending messages, and closes the
+// owning connection.
+func (s *session) end() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	for filter, sub := range s.subscriptions {
+		sub.cancel()
+		sub.release()
+		delete(s.subscriptions, filter)
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	owner := s.owner
+	s.owner, s.online = nil, false
+	s.inflight, s.queue = nil, nil
+	s.lock.Unlock()
+
+	metrics.MQTTSessions.Dec()
+	if owner != nil {
+		owner.kick()
+	}
+}
+
+// subscribe subscribes filter to its subjects on the broker, replacing
+// an older subscription of the same filter. release frees its quota.
+func (s *session) subscribe(filter string, qos byte, subjects []string, release func()) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	channels := make([]<-chan broker.Message, len(subjects))
+	for i, subject := range subjects {
+		ch, err := s.server.broker.Subscribe(ctx, subject)
+		if err != nil {
+			cancel()
+			release()
+			return err
+		}
+		channels[i] = ch
+	}
+
+	sub := &subscription{qos: qos, cancel: cancel, release: release}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		cancel()
+		release()
+		return broker.ErrUnavailable
+	}
+	if old, ok := s.subscriptions[filter]; ok {
+		old.cancel()
+		old.release()
+	}
+	s.subscriptions[filter] = sub
+	s.lock.Unlock()
+
+	for i, ch := range channels {
+		go s.forward(ctx, filter, sub, subjects[i], ch)
+	}
+	return nil
+}
+
+func (s *session) unsubscribe(filter string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sub, ok := s.subscriptions[filter]; ok {
+		sub.cancel()
+		sub.release()
+		delete(s.subscriptions, filter)
+	}
+}
+
+// forward delivers the messages of one broker subscription of filter
+func (s *session) forward(ctx context.Context, filter string, sub *subscription, subject string, ch <-chan broker.Message) {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				if ctx.Err() == nil {
+					s.brokerClosed(filter, sub)
+				}
+				return
+			}
+			if msg.Subject != "" {
+				// delivered to a pattern
+				subject = msg.Subject
+			}
+			p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			p.TopicName = subjectTopic(subject)
+			p.Payload = []byte(msg.Body)
+			p.Qos = sub.qos
+			s.deliver(p)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// brokerClosed drops a subscription the broker ended, the client is
+// disconnected since mqtt can't tell it the subscription is gone.
+func (s *session) brokerClosed(filter string, sub *subscription) {
+	s.lock.Lock()
+	if s.subscriptions[filter] == sub {
+		sub.cancel()
+		sub.release()
+		delete(s.subscriptions, filter)
+	}
+	owner := s.owner
+	s.lock.Unlock()
+	slog.Warn("mqtt subscription ended by the broker", "client_id", s.clientID, "filter", filter)
+	if owner != nil {
+		owner.close()
+	}
+}
+
+// deliver sends p to the client. QoS 0 messages are dropped while the
+// client is offline, QoS 1 ones are queued until it acknowledges
+// enough of the messages in flight.
+func (s *session) deliver(p *packets.PublishPacket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended {
+		return
+	}
+	if p.Qos == 0 {
+		if !s.online {
+			metrics.MQTTDroppedMessages.WithLabelValues("offline").Inc()
+			return
+		}
+		if s.owner.write(p) == nil {
+			metrics.MQTTMessages.WithLabelValues("out").Inc()
+		}
+		return
+	}
+	if s.online && len(s.queue) == 0 && len(s.inflight) < s.server.options.MaxInflight {
+		s.send(p)
+		return
+	}
+	if len(s.queue) >= s.server.options.MaxQueued {
+		metrics.MQTTDroppedMessages.WithLabelValues("queue_full").Inc()
+		return
+	}
+	s.queue = append(s.queue, p)
+}
+
+// acked removes an acknowledged message from the ones in flight
+func (s *session) acked(id uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, p := range s.inflight {
+		if p.MessageID == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			break
+		}
+	}
+	s.fill()
+}
+
+// fill sends queued messages while there is room in flight, s.lock must
+// be held
+func (s *session) fill() {
+	for s.online && len(s.queue) > 0 && len(s.inflight) < s.server.options.MaxInflight {
+		p := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.send(p)
+	}
+}
+
+// send numbers a QoS 1 message and writes it, it stays in flight even if
+// the write fails so the next connection gets it. s.lock must be held.
+func (s *session) send(p *packets.PublishPacket) {
+	p.MessageID = s.newID()
+	s.inflight = append(s.inflight, p)
+	if s.owner.write(p) == nil {
+		metrics.MQTTMessages.WithLabelValues("out").Inc()
+	}
+}
+
+// newID returns a packet id not used by a message in flight
+func (s *session) newID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		used := false
+		for _, p := range s.inflight {
+			if p.MessageID == s.nextID {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return s.nextID
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+
+	"therealbroker/pkg/broker"
+)
+
+// Topics map to subjects level by level: "sensors/a/temp" is the subject
+// "sensors.a.temp", the filter "sensors/+/temp" the pattern "sensors.*.temp".
+const (
+	topicSeparator  = "/"
+	singleLevel     = "+"
+	multiLevel      = "#"
+	reservedPrefix  = "$"
+	subjectReserved = broker.SubjectSeparator + broker.SingleWildcard + broker.TailWildcard
+)
+
+var (
+	errEmptyTopic    = errors.New("topic must not be empty")
+	errEmptyLevel    = errors.New("topic levels must not be empty")
+	errReservedChars = errors.New("topic must not contain '.', '*' or '>'")
+	errWildcardTopic = errors.New("topic name must not contain wildcards")
+	errReservedTopic = errors.New("topics starting with '$' are reserved")
+	errBadWildcard   = errors.New("wildcards must fill a whole level, '#' only the last one")
+)
+
+// topicSubject maps the topic name of a publish to its subject
+func topicSubject(topic string) (string, error) {
+	if strings.HasPrefix(topic, reservedPrefix) {
+		return "", errReservedTopic
+	}
+	if strings.ContainsAny(topic, singleLevel+multiLevel) {
+		return "", errWildcardTopic
+	}
+	levels, err := splitTopic(topic)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(levels, broker.SubjectSeparator), nil
+}
+
+// filterSubjects maps a topic filter to the subjects to subscribe to.
+// "#" also matches the parent level, so "a/#" needs both "a" and "a.>".
+func filterSubjects(filter string) ([]string, error) {
+	if strings.HasPrefix(filter, reservedPrefix) {
+		return nil, errReservedTopic
+	}
+	levels, err := splitTopic(filter)
+	if err != nil {
+		return nil, err
+	}
+	for i, level := range levels {
+		switch {
+		case level == singleLevel:
+			levels[i] = broker.SingleWildcard
+		case level == multiLevel && i == len(levels)-1:
+			levels[i] = broker.TailWildcard
+		case strings.ContainsAny(level, singleLevel+multiLevel):
+			return nil, errBadWildcard
+		}
+	}
+	subject := strings.Join(levels, broker.SubjectSeparator)
+	if len(levels) > 1 && levels[len(levels)-1] == broker.TailWildcard {
+		return []string{strings.Join(levels[:len(levels)-1], broker.SubjectSeparator), subject}, nil
+	}
+	return []string{subject}, nil
+}
+
+// subjectTopic maps a subject back to a topic name
+func subjectTopic(subject string) string {
+	return strings.ReplaceAll(subject, broker.SubjectSeparator, topicSeparator)
+}
+
+// matchFilter reports whether a topic name matches a topic filter
+func matchFilter(filter, topic string) bool {
+	subject, err := topicSubject(topic)
+	if err != nil {
+		return false
+	}
+	patterns, err := filterSubjects(filter)
+	if err != nil {
+		return false
+	}
+	return broker.MatchAnySubject(patterns, subject)
+}
+
+func splitTopic(topic string) ([]string, error) {
+	if topic == "" {
+		return nil, errEmptyTopic
+	}
+	if strings.ContainsAny(topic, subjectReserved) {
+		return nil, errReservedChars
+	}
+	levels := strings.Split(topic, topicSeparator)
+	for _, level := range levels {
+		if level == "" {
+			return nil, errEmptyLevel
+		}
+	}
+	return levels, nil
+}
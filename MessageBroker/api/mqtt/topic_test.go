@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicsShouldMapToSubjects(t *testing.T) {
+	subject, err := topicSubject("sensors/a/temp")
+	assert.Nil(t, err)
+	assert.Equal(t, "sensors.a.temp", subject)
+	assert.Equal(t, "sensors/a/temp", subjectTopic(subject))
+
+	for _, topic := range []string{"", "a//b", "/a", "a.b", "a/*", "a/+", "a/#", "$SYS/x"} {
+		_, err := topicSubject(topic)
+		assert.NotNil(t, err, topic)
+	}
+}
+
+func TestFiltersShouldMapToPatterns(t *testing.T) {
+	for filter, subjects := range map[string][]string{
+		"sensors/+/temp": {"sensors.*.temp"},
+		"sensors/#":      {"sensors", "sensors.>"},
+		"#":              {">"},
+		"+":              {"*"},
+		"orders":         {"orders"},
+	} {
+		mapped, err := filterSubjects(filter)
+		assert.Nil(t, err, filter)
+		assert.Equal(t, subjects, mapped, filter)
+	}
+
+	for _, filter := range []string{"a/#/b", "a/b#", "a+/b", "a.b/#", "$SYS/#"} {
+		_, err := filterSubjects(filter)
+		assert.NotNil(t, err, filter)
+	}
+
+	assert.True(t, matchFilter("sensors/#", "sensors"))
+	assert.True(t, matchFilter("sensors/+/temp", "sensors/a/temp"))
+	assert.False(t, matchFilter("sensors/+", "sensors/a/temp"))
+}
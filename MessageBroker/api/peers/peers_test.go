@@ -0,0 +1,31 @@
+package peers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerShouldOnlyAcceptTheToken(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	grpcServer := grpc.NewServer(ServerOptions(nil, "secret")...)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	for token, code := range map[string]codes.Code{"": codes.Unauthenticated, "guess": codes.Unauthenticated, "secret": codes.OK} {
+		conn, err := grpc.NewClient(lis.Addr().String(), DialOptions(nil, token)...)
+		assert.Nil(t, err)
+		_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.Equal(t, code, status.Code(err), token)
+		conn.Close()
+	}
+}
@@ -19,9 +19,12 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Broker_Publish_FullMethodName   = "/broker.Broker/Publish"
-	Broker_Subscribe_FullMethodName = "/broker.Broker/Subscribe"
-	Broker_Fetch_FullMethodName     = "/broker.Broker/Fetch"
+	Broker_Publish_FullMethodName      = "/broker.Broker/Publish"
+	Broker_Subscribe_FullMethodName    = "/broker.Broker/Subscribe"
+	Broker_Fetch_FullMethodName        = "/broker.Broker/Fetch"
+	Broker_Stats_FullMethodName        = "/broker.Broker/Stats"
+	Broker_ListMessages_FullMethodName = "/broker.Broker/ListMessages"
+	Broker_FetchRange_FullMethodName   = "/broker.Broker/FetchRange"
 )
 
 // BrokerClient is the client API for Broker service.
@@ -39,6 +42,15 @@ type BrokerClient interface {
 	// If the provided id is expired or not present,
 	// should return InvalidArgument
 	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*MessageResponse, error)
+	// Stats reports the subjects with subscribers on this broker node
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	// ListMessages pages through the stored, unexpired messages of a
+	// subject without their bodies, to inspect it
+	// If the range is malformed or starts at an unknown id,
+	// should return InvalidArgument
+	ListMessages(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (*MessagePage, error)
+	// FetchRange is ListMessages with the bodies, to backfill a consumer
+	FetchRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (*MessagePage, error)
 }
 
 type brokerClient struct {
@@ -88,6 +100,36 @@ func (c *brokerClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc
 	return out, nil
 }
 
+func (c *brokerClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, Broker_Stats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) ListMessages(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (*MessagePage, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MessagePage)
+	err := c.cc.Invoke(ctx, Broker_ListMessages_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) FetchRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (*MessagePage, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MessagePage)
+	err := c.cc.Invoke(ctx, Broker_FetchRange_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BrokerServer is the server API for Broker service.
 // All implementations must embed UnimplementedBrokerServer
 // for forward compatibility.
@@ -103,6 +145,15 @@ type BrokerServer interface {
 	// If the provided id is expired or not present,
 	// should return InvalidArgument
 	Fetch(context.Context, *FetchRequest) (*MessageResponse, error)
+	// Stats reports the subjects with subscribers on this broker node
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// ListMessages pages through the stored, unexpired messages of a
+	// subject without their bodies, to inspect it
+	// If the range is malformed or starts at an unknown id,
+	// should return InvalidArgument
+	ListMessages(context.Context, *RangeRequest) (*MessagePage, error)
+	// FetchRange is ListMessages with the bodies, to backfill a consumer
+	FetchRange(context.Context, *RangeRequest) (*MessagePage, error)
 	mustEmbedUnimplementedBrokerServer()
 }
 
@@ -122,6 +173,15 @@ func (UnimplementedBrokerServer) Subscribe(*SubscribeRequest, grpc.ServerStreami
 func (UnimplementedBrokerServer) Fetch(context.Context, *FetchRequest) (*MessageResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
 }
+func (UnimplementedBrokerServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedBrokerServer) ListMessages(context.Context, *RangeRequest) (*MessagePage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMessages not implemented")
+}
+func (UnimplementedBrokerServer) FetchRange(context.Context, *RangeRequest) (*MessagePage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FetchRange not implemented")
+}
 func (UnimplementedBrokerServer) mustEmbedUnimplementedBrokerServer() {}
 func (UnimplementedBrokerServer) testEmbeddedByValue()                {}
 
@@ -190,6 +250,60 @@ func _Broker_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_Stats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_ListMessages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).ListMessages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_ListMessages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).ListMessages(ctx, req.(*RangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_FetchRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).FetchRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_FetchRange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).FetchRange(ctx, req.(*RangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Broker_ServiceDesc is the grpc.ServiceDesc for Broker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -205,6 +319,18 @@ var Broker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Fetch",
 			Handler:    _Broker_Fetch_Handler,
 		},
+		{
+			MethodName: "Stats",
+			Handler:    _Broker_Stats_Handler,
+		},
+		{
+			MethodName: "ListMessages",
+			Handler:    _Broker_ListMessages_Handler,
+		},
+		{
+			MethodName: "FetchRange",
+			Handler:    _Broker_FetchRange_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,171 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.21.12
+// source: cluster.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Cluster_Interest_FullMethodName = "/broker.Cluster/Interest"
+	Cluster_Forward_FullMethodName  = "/broker.Cluster/Forward"
+)
+
+// ClusterClient is the client API for Cluster service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Cluster is served on the internal port of every broker node. Nodes
+// watch each other's interest and forward publishes to the nodes that
+// have subscribers for the subject.
+type ClusterClient interface {
+	// Interest streams the subjects the node has local subscribers for.
+	// The first update is a snapshot and one more follows every change.
+	Interest(ctx context.Context, in *InterestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[InterestUpdate], error)
+	// Forward delivers messages published on another node to the local
+	// subscribers, in the order they are sent
+	Forward(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ForwardRequest, ForwardResponse], error)
+}
+
+type clusterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClusterClient(cc grpc.ClientConnInterface) ClusterClient {
+	return &clusterClient{cc}
+}
+
+func (c *clusterClient) Interest(ctx context.Context, in *InterestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[InterestUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cluster_ServiceDesc.Streams[0], Cluster_Interest_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[InterestRequest, InterestUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cluster_InterestClient = grpc.ServerStreamingClient[InterestUpdate]
+
+func (c *clusterClient) Forward(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ForwardRequest, ForwardResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cluster_ServiceDesc.Streams[1], Cluster_Forward_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ForwardRequest, ForwardResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cluster_ForwardClient = grpc.ClientStreamingClient[ForwardRequest, ForwardResponse]
+
+// ClusterServer is the server API for Cluster service.
+// All implementations must embed UnimplementedClusterServer
+// for forward compatibility.
+//
+// Cluster is served on the internal port of every broker node. Nodes
+// watch each other's interest and forward publishes to the nodes that
+// have subscribers for the subject.
+type ClusterServer interface {
+	// Interest streams the subjects the node has local subscribers for.
+	// The first update is a snapshot and one more follows every change.
+	Interest(*InterestRequest, grpc.ServerStreamingServer[InterestUpdate]) error
+	// Forward delivers messages published on another node to the local
+	// subscribers, in the order they are sent
+	Forward(grpc.ClientStreamingServer[ForwardRequest, ForwardResponse]) error
+	mustEmbedUnimplementedClusterServer()
+}
+
+// UnimplementedClusterServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedClusterServer struct{}
+
+func (UnimplementedClusterServer) Interest(*InterestRequest, grpc.ServerStreamingServer[InterestUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method Interest not implemented")
+}
+func (UnimplementedClusterServer) Forward(grpc.ClientStreamingServer[ForwardRequest, ForwardResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Forward not implemented")
+}
+func (UnimplementedClusterServer) mustEmbedUnimplementedClusterServer() {}
+func (UnimplementedClusterServer) testEmbeddedByValue()                 {}
+
+// UnsafeClusterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ClusterServer will
+// result in compilation errors.
+type UnsafeClusterServer interface {
+	mustEmbedUnimplementedClusterServer()
+}
+
+func RegisterClusterServer(s grpc.ServiceRegistrar, srv ClusterServer) {
+	// If the following call pancis, it indicates UnimplementedClusterServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Cluster_ServiceDesc, srv)
+}
+
+func _Cluster_Interest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(InterestRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ClusterServer).Interest(m, &grpc.GenericServerStream[InterestRequest, InterestUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cluster_InterestServer = grpc.ServerStreamingServer[InterestUpdate]
+
+func _Cluster_Forward_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ClusterServer).Forward(&grpc.GenericServerStream[ForwardRequest, ForwardResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cluster_ForwardServer = grpc.ClientStreamingServer[ForwardRequest, ForwardResponse]
+
+// Cluster_ServiceDesc is the grpc.ServiceDesc for Cluster service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cluster_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "broker.Cluster",
+	HandlerType: (*ClusterServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Interest",
+			Handler:       _Cluster_Interest_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Forward",
+			Handler:       _Cluster_Forward_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "cluster.proto",
+}
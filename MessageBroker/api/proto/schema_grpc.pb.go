@@ -0,0 +1,303 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.21.12
+// source: schema.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SchemaRegistry_RegisterSchema_FullMethodName     = "/broker.SchemaRegistry/RegisterSchema"
+	SchemaRegistry_GetSchema_FullMethodName          = "/broker.SchemaRegistry/GetSchema"
+	SchemaRegistry_ListSchemas_FullMethodName        = "/broker.SchemaRegistry/ListSchemas"
+	SchemaRegistry_DeleteSchema_FullMethodName       = "/broker.SchemaRegistry/DeleteSchema"
+	SchemaRegistry_CheckCompatibility_FullMethodName = "/broker.SchemaRegistry/CheckCompatibility"
+)
+
+// SchemaRegistryClient is the client API for SchemaRegistry service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// SchemaRegistry binds schemas to subject patterns. Bodies published on
+// a subject are checked against the latest schema of the most specific
+// pattern matching it.
+type SchemaRegistryClient interface {
+	// RegisterSchema adds a version to the schema of a subject pattern.
+	// If the definition does not compile, should return InvalidArgument
+	// If it breaks the compatibility of the pattern, should return
+	// FailedPrecondition
+	RegisterSchema(ctx context.Context, in *RegisterSchemaRequest, opts ...grpc.CallOption) (*Schema, error)
+	// GetSchema returns a version of the schema, the latest one when
+	// version is 0. If it is not registered, should return NotFound
+	GetSchema(ctx context.Context, in *GetSchemaRequest, opts ...grpc.CallOption) (*Schema, error)
+	// ListSchemas returns the latest version of every subject pattern
+	ListSchemas(ctx context.Context, in *ListSchemasRequest, opts ...grpc.CallOption) (*ListSchemasResponse, error)
+	// DeleteSchema removes every version of the schema of a subject pattern
+	// If it is not registered, should return NotFound
+	DeleteSchema(ctx context.Context, in *DeleteSchemaRequest, opts ...grpc.CallOption) (*DeleteSchemaResponse, error)
+	// CheckCompatibility reports whether RegisterSchema would accept the
+	// schema, without registering it
+	CheckCompatibility(ctx context.Context, in *RegisterSchemaRequest, opts ...grpc.CallOption) (*CompatibilityResponse, error)
+}
+
+type schemaRegistryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSchemaRegistryClient(cc grpc.ClientConnInterface) SchemaRegistryClient {
+	return &schemaRegistryClient{cc}
+}
+
+func (c *schemaRegistryClient) RegisterSchema(ctx context.Context, in *RegisterSchemaRequest, opts ...grpc.CallOption) (*Schema, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Schema)
+	err := c.cc.Invoke(ctx, SchemaRegistry_RegisterSchema_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schemaRegistryClient) GetSchema(ctx context.Context, in *GetSchemaRequest, opts ...grpc.CallOption) (*Schema, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Schema)
+	err := c.cc.Invoke(ctx, SchemaRegistry_GetSchema_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schemaRegistryClient) ListSchemas(ctx context.Context, in *ListSchemasRequest, opts ...grpc.CallOption) (*ListSchemasResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSchemasResponse)
+	err := c.cc.Invoke(ctx, SchemaRegistry_ListSchemas_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schemaRegistryClient) DeleteSchema(ctx context.Context, in *DeleteSchemaRequest, opts ...grpc.CallOption) (*DeleteSchemaResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteSchemaResponse)
+	err := c.cc.Invoke(ctx, SchemaRegistry_DeleteSchema_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schemaRegistryClient) CheckCompatibility(ctx context.Context, in *RegisterSchemaRequest, opts ...grpc.CallOption) (*CompatibilityResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CompatibilityResponse)
+	err := c.cc.Invoke(ctx, SchemaRegistry_CheckCompatibility_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SchemaRegistryServer is the server API for SchemaRegistry service.
+// All implementations must embed UnimplementedSchemaRegistryServer
+// for forward compatibility.
+//
+// SchemaRegistry binds schemas to subject patterns. Bodies published on
+// a subject are checked against the latest schema of the most specific
+// pattern matching it.
+type SchemaRegistryServer interface {
+	// RegisterSchema adds a version to the schema of a subject pattern.
+	// If the definition does not compile, should return InvalidArgument
+	// If it breaks the compatibility of the pattern, should return
+	// FailedPrecondition
+	RegisterSchema(context.Context, *RegisterSchemaRequest) (*Schema, error)
+	// GetSchema returns a version of the schema, the latest one when
+	// version is 0. If it is not registered, should return NotFound
+	GetSchema(context.Context, *GetSchemaRequest) (*Schema, error)
+	// ListSchemas returns the latest version of every subject pattern
+	ListSchemas(context.Context, *ListSchemasRequest) (*ListSchemasResponse, error)
+	// DeleteSchema removes every version of the schema of a subject pattern
+	// If it is not registered, should return NotFound
+	DeleteSchema(context.Context, *DeleteSchemaRequest) (*DeleteSchemaResponse, error)
+	// CheckCompatibility reports whether RegisterSchema would accept the
+	// schema, without registering it
+	CheckCompatibility(context.Context, *RegisterSchemaRequest) (*CompatibilityResponse, error)
+	mustEmbedUnimplementedSchemaRegistryServer()
+}
+
+// UnimplementedSchemaRegistryServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSchemaRegistryServer struct{}
+
+func (UnimplementedSchemaRegistryServer) RegisterSchema(context.Context, *RegisterSchemaRequest) (*Schema, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterSchema not implemented")
+}
+func (UnimplementedSchemaRegistryServer) GetSchema(context.Context, *GetSchemaRequest) (*Schema, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSchema not implemented")
+}
+func (UnimplementedSchemaRegistryServer) ListSchemas(context.Context, *ListSchemasRequest) (*ListSchemasResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSchemas not implemented")
+}
+func (UnimplementedSchemaRegistryServer) DeleteSchema(context.Context, *DeleteSchemaRequest) (*DeleteSchemaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSchema not implemented")
+}
+func (UnimplementedSchemaRegistryServer) CheckCompatibility(context.Context, *RegisterSchemaRequest) (*CompatibilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckCompatibility not implemented")
+}
+func (UnimplementedSchemaRegistryServer) mustEmbedUnimplementedSchemaRegistryServer() {}
+func (UnimplementedSchemaRegistryServer) testEmbeddedByValue()                        {}
+
+// UnsafeSchemaRegistryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SchemaRegistryServer will
+// result in compilation errors.
+type UnsafeSchemaRegistryServer interface {
+	mustEmbedUnimplementedSchemaRegistryServer()
+}
+
+func RegisterSchemaRegistryServer(s grpc.ServiceRegistrar, srv SchemaRegistryServer) {
+	// If the following call pancis, it indicates UnimplementedSchemaRegistryServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SchemaRegistry_ServiceDesc, srv)
+}
+
+func _SchemaRegistry_RegisterSchema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterSchemaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchemaRegistryServer).RegisterSchema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SchemaRegistry_RegisterSchema_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchemaRegistryServer).RegisterSchema(ctx, req.(*RegisterSchemaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SchemaRegistry_GetSchema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSchemaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchemaRegistryServer).GetSchema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SchemaRegistry_GetSchema_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchemaRegistryServer).GetSchema(ctx, req.(*GetSchemaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SchemaRegistry_ListSchemas_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSchemasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchemaRegistryServer).ListSchemas(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SchemaRegistry_ListSchemas_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchemaRegistryServer).ListSchemas(ctx, req.(*ListSchemasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SchemaRegistry_DeleteSchema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSchemaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchemaRegistryServer).DeleteSchema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SchemaRegistry_DeleteSchema_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchemaRegistryServer).DeleteSchema(ctx, req.(*DeleteSchemaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SchemaRegistry_CheckCompatibility_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterSchemaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchemaRegistryServer).CheckCompatibility(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SchemaRegistry_CheckCompatibility_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchemaRegistryServer).CheckCompatibility(ctx, req.(*RegisterSchemaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SchemaRegistry_ServiceDesc is the grpc.ServiceDesc for SchemaRegistry service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SchemaRegistry_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "broker.SchemaRegistry",
+	HandlerType: (*SchemaRegistryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterSchema",
+			Handler:    _SchemaRegistry_RegisterSchema_Handler,
+		},
+		{
+			MethodName: "GetSchema",
+			Handler:    _SchemaRegistry_GetSchema_Handler,
+		},
+		{
+			MethodName: "ListSchemas",
+			Handler:    _SchemaRegistry_ListSchemas_Handler,
+		},
+		{
+			MethodName: "DeleteSchema",
+			Handler:    _SchemaRegistry_DeleteSchema_Handler,
+		},
+		{
+			MethodName: "CheckCompatibility",
+			Handler:    _SchemaRegistry_CheckCompatibility_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "schema.proto",
+}
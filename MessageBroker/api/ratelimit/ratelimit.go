@@ -0,0 +1,258 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ScopeGlobal  = "global"
+	ScopeClient  = "client"
+	ScopeSubject = "subject"
+
+	// idle buckets are dropped once this many are tracked per scope
+	maxIdleBuckets = 10000
+)
+
+var (
+	// Publish rate of a scope is exceeded
+	ErrRateLimited = errors.New("publish rate limit exceeded")
+	// Concurrent subscription quota of a scope is exceeded
+	ErrQuotaExceeded = errors.New("subscription quota exceeded")
+)
+
+// Limit of one scope. Zero values mean unlimited.
+type Limit struct {
+	// Published messages per second
+	PublishRate float64 `yaml:"publish_rate"`
+	// Messages that can be published at once after being idle,
+	// defaults to one second worth of PublishRate
+	PublishBurst int `yaml:"publish_burst"`
+	// Concurrent Subscribe streams
+	MaxSubscriptions int `yaml:"max_subscriptions"`
+}
+
+type SubjectLimit struct {
+	Pattern string `yaml:"pattern"`
+	Limit   `yaml:",inline"`
+}
+
+type Config struct {
+	Global Limit `yaml:"global"`
+	// Applies to every client identity that has no entry in Clients
+	DefaultClient Limit            `yaml:"default_client"`
+	Clients       map[string]Limit `yaml:"clients"`
+	// The first matching pattern applies, each subject gets its own bucket
+	Subjects []SubjectLimit `yaml:"subjects"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Denial tells which scope rejected a call and when it is worth retrying.
+type Denial struct {
+	Err        error
+	Scope      string
+	RetryAfter time.Duration
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit Limit, now time.Time) *tokenBucket {
+	burst := float64(limit.PublishBurst)
+	if burst <= 0 {
+		burst = math.Max(1, limit.PublishRate)
+	}
+	return &tokenBucket{rate: limit.PublishRate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until one token is available, zero if it is now.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) idle() bool {
+	return b.tokens >= b.burst
+}
+
+type scopeState struct {
+	buckets       map[string]*tokenBucket
+	subscriptions map[string]int
+}
+
+func newScopeState() *scopeState {
+	return &scopeState{
+		buckets:       make(map[string]*tokenBucket),
+		subscriptions: make(map[string]int),
+	}
+}
+
+func (s *scopeState) bucket(key string, limit Limit, now time.Time) *tokenBucket {
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxIdleBuckets {
+			s.prune(now)
+		}
+		b = newTokenBucket(limit, now)
+		s.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+func (s *scopeState) prune(now time.Time) {
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.idle() {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+type scopeCheck struct {
+	scope string
+	key   string
+	limit Limit
+	state *scopeState
+}
+
+// Limiter enforces publish token buckets and subscription quotas on the
+// global, client and subject scopes.
+type Limiter struct {
+	lock   sync.Mutex
+	config *Config
+	scopes map[string]*scopeState
+	now    func() time.Time
+}
+
+func NewLimiter(config *Config) *Limiter {
+	return &Limiter{
+		config: config,
+		scopes: map[string]*scopeState{
+			ScopeGlobal:  newScopeState(),
+			ScopeClient:  newScopeState(),
+			ScopeSubject: newScopeState(),
+		},
+		now: time.Now,
+	}
+}
+
+// SetConfig replaces the limits. Publish buckets start over with the new
+// rates, subscriptions already counted keep their quota slot.
+func (l *Limiter) SetConfig(config *Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.config = config
+	for _, state := range l.scopes {
+		state.buckets = make(map[string]*tokenBucket)
+	}
+}
+
+func (l *Limiter) checks(client, subject string) []scopeCheck {
+	clientLimit, ok := l.config.Clients[client]
+	if !ok {
+		clientLimit = l.config.DefaultClient
+	}
+	checks := []scopeCheck{
+		{ScopeGlobal, "", l.config.Global, l.scopes[ScopeGlobal]},
+		{ScopeClient, client, clientLimit, l.scopes[ScopeClient]},
+	}
+	for _, s := range l.config.Subjects {
+		if broker.MatchSubject(s.Pattern, subject) {
+			checks = append(checks, scopeCheck{ScopeSubject, subject, s.Limit, l.scopes[ScopeSubject]})
+			break
+		}
+	}
+	return checks
+}
+
+// AllowPublish takes a token from every bucket the publish falls in.
+// If any of them is empty, nothing is taken and the longest wait is returned.
+func (l *Limiter) AllowPublish(client, subject string) *Denial {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	checks := l.checks(client, subject)
+	buckets := make([]*tokenBucket, 0, len(checks))
+	var denial *Denial
+	for _, c := range checks {
+		if c.limit.PublishRate <= 0 {
+			continue
+		}
+		b := c.state.bucket(c.key, c.limit, now)
+		if wait := b.wait(); wait > 0 {
+			if denial == nil || wait > denial.RetryAfter {
+				denial = &Denial{Err: ErrRateLimited, Scope: c.scope, RetryAfter: wait}
+			}
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+	if denial != nil {
+		return denial
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
+
+// AcquireSubscription counts a new subscription against every quota it
+// falls in. The returned release func must be called when it ends.
+func (l *Limiter) AcquireSubscription(client, subject string) (func(), *Denial) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	checks := l.checks(client, subject)
+	for _, c := range checks {
+		if c.limit.MaxSubscriptions > 0 && c.state.subscriptions[c.key] >= c.limit.MaxSubscriptions {
+			return nil, &Denial{Err: ErrQuotaExceeded, Scope: c.scope}
+		}
+	}
+	for _, c := range checks {
+		c.state.subscriptions[c.key]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			for _, c := range checks {
+				c.state.subscriptions[c.key]--
+				if c.state.subscriptions[c.key] <= 0 {
+					delete(c.state.subscriptions, c.key)
+				}
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(config *Config) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	limiter := NewLimiter(config)
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+func TestPublishShouldBeLimitedPerClient(t *testing.T) {
+	limiter, clock := newTestLimiter(&Config{
+		DefaultClient: Limit{PublishRate: 10, PublishBurst: 2},
+	})
+
+	assert.Nil(t, limiter.AllowPublish("ali", "orders"))
+	assert.Nil(t, limiter.AllowPublish("ali", "orders"))
+
+	denial := limiter.AllowPublish("ali", "orders")
+	assert.NotNil(t, denial)
+	assert.Equal(t, ErrRateLimited, denial.Err)
+	assert.Equal(t, ScopeClient, denial.Scope)
+	assert.Equal(t, 100*time.Millisecond, denial.RetryAfter)
+
+	assert.Nil(t, limiter.AllowPublish("maryam", "orders"))
+
+	clock.now = clock.now.Add(100 * time.Millisecond)
+	assert.Nil(t, limiter.AllowPublish("ali", "orders"))
+}
+
+func TestClientOverrideShouldReplaceDefault(t *testing.T) {
+	limiter, _ := newTestLimiter(&Config{
+		DefaultClient: Limit{PublishRate: 1, PublishBurst: 1},
+		Clients:       map[string]Limit{"producer": {PublishRate: 100, PublishBurst: 100}},
+	})
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, limiter.AllowPublish("producer", "orders"))
+	}
+	assert.NotNil(t, limiter.AllowPublish("producer", "orders"))
+}
+
+func TestSubjectLimitShouldApplyPerSubject(t *testing.T) {
+	limiter, _ := newTestLimiter(&Config{
+		Subjects: []SubjectLimit{{Pattern: "orders.>", Limit: Limit{PublishRate: 1, PublishBurst: 1}}},
+	})
+
+	assert.Nil(t, limiter.AllowPublish("ali", "orders.eu"))
+	assert.Equal(t, ScopeSubject, limiter.AllowPublish("maryam", "orders.eu").Scope)
+	assert.Nil(t, limiter.AllowPublish("maryam", "orders.us"))
+	assert.Nil(t, limiter.AllowPublish("maryam", "payments"))
+}
+
+func TestDeniedPublishShouldNotTakeTokens(t *testing.T) {
+	limiter, _ := newTestLimiter(&Config{
+		Global:   Limit{PublishRate: 2, PublishBurst: 2},
+		Subjects: []SubjectLimit{{Pattern: "hot", Limit: Limit{PublishRate: 1, PublishBurst: 1}}},
+	})
+
+	assert.Nil(t, limiter.AllowPublish("ali", "hot"))
+	assert.NotNil(t, limiter.AllowPublish("ali", "hot"))
+	assert.Nil(t, limiter.AllowPublish("ali", "cold"))
+	assert.Equal(t, ScopeGlobal, limiter.AllowPublish("ali", "cold").Scope)
+}
+
+func TestSubscriptionQuotaShouldBeReleased(t *testing.T) {
+	limiter, _ := newTestLimiter(&Config{
+		DefaultClient: Limit{MaxSubscriptions: 2},
+	})
+
+	release1, denial := limiter.AcquireSubscription("ali", "orders")
+	assert.Nil(t, denial)
+	_, denial = limiter.AcquireSubscription("ali", "payments")
+	assert.Nil(t, denial)
+
+	_, denial = limiter.AcquireSubscription("ali", "orders")
+	assert.Equal(t, ErrQuotaExceeded, denial.Err)
+
+	release1()
+	release1()
+	_, denial = limiter.AcquireSubscription("ali", "orders")
+	assert.Nil(t, denial)
+	_, denial = limiter.AcquireSubscription("ali", "orders")
+	assert.NotNil(t, denial)
+}
+
+func TestSetConfigShouldApplyNewLimits(t *testing.T) {
+	limiter, _ := newTestLimiter(&Config{
+		DefaultClient: Limit{PublishRate: 1, MaxSubscriptions: 1},
+	})
+	assert.Nil(t, limiter.AllowPublish("ali", "orders"))
+	assert.NotNil(t, limiter.AllowPublish("ali", "orders"))
+	release, denial := limiter.AcquireSubscription("ali", "orders")
+	assert.Nil(t, denial)
+
+	limiter.SetConfig(&Config{DefaultClient: Limit{PublishRate: 100, MaxSubscriptions: 1}})
+	assert.Nil(t, limiter.AllowPublish("ali", "orders"))
+	_, denial = limiter.AcquireSubscription("ali", "orders")
+	assert.NotNil(t, denial)
+
+	release()
+	_, denial = limiter.AcquireSubscription("ali", "orders")
+	assert.Nil(t, denial)
+}
@@ -0,0 +1,505 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"therealbroker/api/auth"
+	"therealbroker/api/metrics"
+	"therealbroker/api/ratelimit"
+	"therealbroker/internal/logging"
+	"therealbroker/pkg/broker"
+)
+
+// Method labels of the auth and rate limit metrics
+const (
+	methodAuth       = "RESP AUTH"
+	methodPublish    = "RESP PUBLISH"
+	methodSubscribe  = "RESP SUBSCRIBE"
+	methodPSubscribe = "RESP PSUBSCRIBE"
+)
+
+// handler runs one command, false ends the connection
+type handler func(c *conn, args []string) bool
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"PING":         (*conn).ping,
+		"AUTH":         (*conn).auth,
+		"QUIT":         (*conn).quit,
+		"RESET":        (*conn).reset,
+		"PUBLISH":      (*conn).publish,
+		"SUBSCRIBE":    (*conn).subscribe,
+		"PSUBSCRIBE":   (*conn).psubscribe,
+		"UNSUBSCRIBE":  (*conn).unsubscribe,
+		"PUNSUBSCRIBE": (*conn).punsubscribe,
+	}
+}
+
+// Commands a client may send while it has subscriptions
+var subscribeContext = []string{"PING", "QUIT", "RESET", "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE"}
+
+// Commands a client may send before AUTH
+var beforeAuth = []string{"AUTH", "QUIT"}
+
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	identity auth.Identity
+	// Set once the identity was checked, after AUTH or from the client
+	// certificate
+	authenticated bool
+	resolved      bool
+
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+
+	lock sync.Mutex
+	// Keyed by channel, and by glob pattern
+	channels map[string]*subscription
+	patterns map[string]*subscription
+	wg       sync.WaitGroup
+}
+
+type subscription struct {
+	cancel  context.CancelFunc
+	release func()
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := slog.Default().With("remote_address", netConn.RemoteAddr().String())
+	return &conn{
+		server:   server,
+		netConn:  netConn,
+		reader:   bufio.NewReader(netConn),
+		writer:   bufio.NewWriter(netConn),
+		ctx:      logging.NewContext(ctx, logger),
+		cancel:   cancel,
+		channels: make(map[string]*subscription),
+		patterns: make(map[string]*subscription),
+	}
+}
+
+func (c *conn) serve() {
+	metrics.RESPConnections.Inc()
+	defer metrics.RESPConnections.Dec()
+	defer func() {
+		c.close()
+		c.dropAll()
+		c.wg.Wait()
+	}()
+
+	for {
+		args, err := readCommand(c.reader, c.server.options.MaxBulkBytes, c.server.options.MaxCommandBytes)
+		switch {
+		case errors.Is(err, errProtocol):
+			logging.FromContext(c.ctx).Warn("resp protocol error", "error", err)
+			c.reply(func(w *bufio.Writer) {
+				writeError(w, "ERR Protocol error: "+strings.TrimPrefix(err.Error(), errProtocol.Error()+": "))
+			})
+			return
+		case err != nil:
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && c.ctx.Err() == nil {
+				logging.FromContext(c.ctx).Debug("resp connection closed", "error", err)
+			}
+			return
+		case len(args) == 0:
+			continue
+		}
+		if !c.handle(args) {
+			return
+		}
+	}
+}
+
+func (c *conn) handle(args []string) bool {
+	if !c.resolved {
+		// the tls handshake is done once the first command was read
+		c.resolveIdentity()
+	}
+	name := strings.ToUpper(args[0])
+	h, ok := handlers[name]
+	if !ok {
+		metrics.RESPCommands.WithLabelValues("unknown").Inc()
+		return c.fail(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	metrics.RESPCommands.WithLabelValues(name).Inc()
+	if !c.authenticated && !slices.Contains(beforeAuth, name) {
+		return c.fail("NOAUTH Authentication required.")
+	}
+	if c.subscribed() && !slices.Contains(subscribeContext, name) {
+		return c.fail(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(name)))
+	}
+	return h(c, args)
+}
+
+// resolveIdentity names the client from its certificate, or its address
+// when auth is off. Others have to AUTH.
+func (c *conn) resolveIdentity() {
+	c.resolved = true
+	id, err := auth.Identify(c.server.options.Authorizer, "", auth.ConnState(c.netConn), c.netConn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	c.identity, c.authenticated = id, true
+	c.ctx = logging.NewContext(c.ctx, logging.FromContext(c.ctx).With("client", c.identity.Name))
+}
+
+func (c *conn) ping(args []string) bool {
+	if len(args) > 2 {
+		return c.wrongArgs(args[0])
+	}
+	message := ""
+	if len(args) == 2 {
+		message = args[1]
+	}
+	return c.reply(func(w *bufio.Writer) {
+		switch {
+		case c.subscribed():
+			// subscribed clients tell replies from messages by arrays
+			writeArray(w, 2)
+			writeBulk(w, "pong")
+			writeBulk(w, message)
+		case len(args) == 2:
+			writeBulk(w, message)
+		default:
+			writeSimple(w, "PONG")
+		}
+	}) == nil
+}
+
+// auth takes "AUTH password" or "AUTH username password", the password
+// is a bearer token and the username is ignored.
+func (c *conn) auth(args []string) bool {
+	if len(args) < 2 || len(args) > 3 {
+		return c.wrongArgs(args[0])
+	}
+	authorizer := c.server.options.Authorizer
+	if authorizer == nil {
+		return c.fail("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	id, err := authorizer.Authenticate(args[len(args)-1])
+	if err != nil {
+		metrics.AuthDenials.WithLabelValues(methodAuth, "unauthenticated").Inc()
+		logging.FromContext(c.ctx).Warn("resp client refused", "error", err)
+		return c.fail("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	c.identity, c.authenticated = id, true
+	c.ctx = logging.NewContext(c.ctx, logging.FromContext(c.ctx).With("client", id.Name))
+	return c.reply(func(w *bufio.Writer) { writeSimple(w, "OK") }) == nil
+}
+
+func (c *conn) quit(args []string) bool {
+	c.reply(func(w *bufio.Writer) { writeSimple(w, "OK") })
+	return false
+}
+
+// reset leaves the subscribed state
+func (c *conn) reset(args []string) bool {
+	c.dropAll()
+	return c.reply(func(w *bufio.Writer) { writeSimple(w, "RESET") }) == nil
+}
+
+func (c *conn) publish(args []string) bool {
+	if len(args) != 3 {
+		return c.wrongArgs(args[0])
+	}
+	channel, body := args[1], args[2]
+	if err := validChannel(channel); err != nil {
+		return c.fail("ERR " + err.Error())
+	}
+	if !c.allowed(methodPublish, auth.PermPublish, channel) {
+		return c.noPermission(channel)
+	}
+	if limiter := c.server.options.Limiter; limiter != nil {
+		if denial := limiter.AllowPublish(c.identity.Name, channel); denial != nil {
+			metrics.RateLimited.WithLabelValues(methodPublish, denial.Scope).Inc()
+			return c.fail(fmt.Sprintf("ERR %s: %s limit, retry after %s", denial.Err, denial.Scope, denial.RetryAfter.Round(time.Millisecond)))
+		}
+	}
+	_, err := c.server.broker.Publish(c.ctx, channel, broker.Message{
+		Body:       body,
+		Expiration: c.server.options.Expiration,
+	})
+	if errors.Is(err, broker.ErrInvalidMessage) {
+		return c.fail("ERR " + err.Error())
+	}
+	if err != nil {
+		logging.FromContext(c.ctx).Error("resp publish failed", "channel", channel, "error", err)
+		return c.fail("ERR " + err.Error())
+	}
+
+	// redis answers with the number of clients that got the message
+	receivers := 0
+	if b, ok := c.server.broker.(interface{ Receivers(string) int }); ok {
+		receivers = b.Receivers(channel)
+	}
+	return c.reply(func(w *bufio.Writer) { writeInt(w, receivers) }) == nil
+}
+
+func (c *conn) subscribe(args []string) bool {
+	if len(args) < 2 {
+		return c.wrongArgs(args[0])
+	}
+	channels := args[1:]
+	// like redis, the whole command fails on one forbidden channel
+	for _, channel := range channels {
+		if err := validChannel(channel); err != nil {
+			return c.fail("ERR " + err.Error())
+		}
+		if !c.allowed(methodSubscribe, auth.PermSubscribe, channel) {
+			return c.noPermission(channel)
+		}
+	}
+	for _, channel := range channels {
+		if !c.add(c.channels, "subscribe", methodSubscribe, channel, channel, "") {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *conn) psubscribe(args []string) bool {
+	if len(args) < 2 {
+		return c.wrongArgs(args[0])
+	}
+	patterns := args[1:]
+	for _, pattern := range patterns {
+		if !c.allowed(methodPSubscribe, auth.PermSubscribe, globSubject(pattern)) {
+			return c.noPermission(pattern)
+		}
+	}
+	for _, pattern := range patterns {
+		if !c.add(c.patterns, "psubscribe", methodPSubscribe, pattern, globSubject(pattern), pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// add subscribes key of subs to subject and confirms it. Messages of a
+// pattern subscription are filtered with glob.
+func (c *conn) add(subs map[string]*subscription, kind, method, key, subject, glob string) bool {
+	c.lock.Lock()
+	_, exists := subs[key]
+	c.lock.Unlock()
+	if exists {
+		return c.confirm(kind, key)
+	}
+
+	release := func() {}
+	if limiter := c.server.options.Limiter; limiter != nil {
+		var denial *ratelimit.Denial
+		release, denial = limiter.AcquireSubscription(c.identity.Name, subject)
+		if denial != nil {
+			metrics.RateLimited.WithLabelValues(method, denial.Scope).Inc()
+			return c.fail(fmt.Sprintf("ERR %s: %s limit", denial.Err, denial.Scope))
+		}
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	ch, err := c.server.broker.Subscribe(ctx, subject)
+	if err != nil {
+		cancel()
+		release()
+		logging.FromContext(c.ctx).Error("resp subscribe failed", "subject", subject, "error", err)
+		return c.fail("ERR " + err.Error())
+	}
+	c.lock.Lock()
+	subs[key] = &subscription{cancel: cancel, release: release}
+	c.lock.Unlock()
+
+	// confirmed before the first message is forwarded
+	if !c.confirm(kind, key) {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.forward(ctx, subject, glob, ch)
+	}()
+	return true
+}
+
+// forward writes the messages of one subscription
+func (c *conn) forward(ctx context.Context, subject, glob string, ch <-chan broker.Message) {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				if ctx.Err() == nil {
+					// the broker closed, clients reconnect and subscribe again
+					c.close()
+				}
+				return
+			}
+			channel := subject
+			if msg.Subject != "" {
+				channel = msg.Subject
+			}
+			if glob != "" && !matchGlob(glob, channel) {
+				continue
+			}
+			err := c.reply(func(w *bufio.Writer) {
+				if glob == "" {
+					writeArray(w, 3)
+					writeBulk(w, "message")
+				} else {
+					writeArray(w, 4)
+					writeBulk(w, "pmessage")
+					writeBulk(w, glob)
+				}
+				writeBulk(w, channel)
+				writeBulk(w, msg.Body)
+			})
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *conn) unsubscribe(args []string) bool {
+	return c.remove(c.channels, "unsubscribe", args[1:])
+}
+
+func (c *conn) punsubscribe(args []string) bool {
+	return c.remove(c.patterns, "punsubscribe", args[1:])
+}
+
+// remove drops the given keys of subs, all of them when keys is empty,
+// and confirms each one.
+func (c *conn) remove(subs map[string]*subscription, kind string, keys []string) bool {
+	if len(keys) == 0 {
+		c.lock.Lock()
+		for key := range subs {
+			keys = append(keys, key)
+		}
+		c.lock.Unlock()
+		slices.Sort(keys)
+		if len(keys) == 0 {
+			return c.reply(func(w *bufio.Writer) {
+				writeArray(w, 3)
+				writeBulk(w, kind)
+				writeNull(w)
+				writeInt(w, c.count())
+			}) == nil
+		}
+	}
+	for _, key := range keys {
+		c.lock.Lock()
+		if sub, ok := subs[key]; ok {
+			sub.cancel()
+			sub.release()
+			delete(subs, key)
+		}
+		c.lock.Unlock()
+		if !c.confirm(kind, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropAll cancels every subscription
+func (c *conn) dropAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, subs := range []map[string]*subscription{c.channels, c.patterns} {
+		for key, sub := range subs {
+			sub.cancel()
+			sub.release()
+			delete(subs, key)
+		}
+	}
+}
+
+// confirm answers a (un)subscribe with the number of subscriptions left
+func (c *conn) confirm(kind, key string) bool {
+	return c.reply(func(w *bufio.Writer) {
+		writeArray(w, 3)
+		writeBulk(w, kind)
+		writeBulk(w, key)
+		writeInt(w, c.count())
+	}) == nil
+}
+
+func (c *conn) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *conn) subscribed() bool {
+	return c.count() > 0
+}
+
+func (c *conn) allowed(method string, perm auth.Permission, subject string) bool {
+	authorizer := c.server.options.Authorizer
+	if authorizer == nil {
+		return true
+	}
+	if err := authorizer.Authorize(c.identity, perm, subject); err != nil {
+		metrics.AuthDenials.WithLabelValues(method, "forbidden").Inc()
+		logging.FromContext(c.ctx).Warn("resp request denied", "permission", perm, "subject", subject)
+		return false
+	}
+	return true
+}
+
+func (c *conn) noPermission(channel string) bool {
+	return c.fail(fmt.Sprintf("NOPERM User %s has no permissions to access the '%s' channel", c.identity.Name, channel))
+}
+
+func (c *conn) wrongArgs(command string) bool {
+	return c.fail(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// fail answers with an error, the connection goes on
+func (c *conn) fail(message string) bool {
+	return c.reply(func(w *bufio.Writer) { writeError(w, message) }) == nil
+}
+
+// reply writes and flushes one reply, the subscriptions and the reader
+// share the connection.
+func (c *conn) reply(write func(w *bufio.Writer)) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.netConn.SetWriteDeadline(time.Now().Add(c.server.options.WriteTimeout))
+	write(c.writer)
+	return c.writer.Flush()
+}
+
+func (c *conn) close() {
+	c.cancel()
+	c.netConn.Close()
+}
+
+// validChannel rejects channels the broker would take for patterns
+func validChannel(channel string) error {
+	if channel == "" {
+		return errors.New("channel must not be empty")
+	}
+	if broker.IsPattern(channel) {
+		return fmt.Errorf("channel %q is a subject pattern, use PSUBSCRIBE", channel)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package resp
+
+import (
+	"strings"
+
+	"therealbroker/pkg/broker"
+)
+
+// Characters with a meaning in redis glob patterns
+const globChars = `*?[\`
+
+// globSubject returns the narrowest subject pattern covering every
+// channel a glob matches: its literal leading tokens followed by ">".
+// Messages of that pattern are then filtered with matchGlob.
+func globSubject(glob string) string {
+	tokens := strings.Split(glob, broker.SubjectSeparator)
+	for i, token := range tokens {
+		if strings.ContainsAny(token, globChars) {
+			return strings.Join(append(tokens[:i:i], broker.TailWildcard), broker.SubjectSeparator)
+		}
+	}
+	return glob
+}
+
+// matchGlob reports whether s matches a redis glob pattern: "*" matches
+// anything, "?" one byte, "[a-z]" and "[^a-z]" a class of bytes, and "\"
+// escapes the next character.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the class at the start of pattern, just
+// after its "[". It returns the pattern following the class.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	// an unterminated class ends with the pattern, as in redis
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
@@ -0,0 +1,40 @@
+package resp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlobShouldFollowRedisPatterns(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.paid", true},
+		{"orders.*", "orders", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*", "", true},
+		{"a**b", "axyzb", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchGlob(c.pattern, c.s), "%q on %q", c.pattern, c.s)
+	}
+}
+
+func TestGlobSubjectShouldKeepLiteralTokens(t *testing.T) {
+	assert.Equal(t, "orders.eu", globSubject("orders.eu"))
+	assert.Equal(t, "orders.>", globSubject("orders.*"))
+	assert.Equal(t, "orders.>", globSubject("orders.e?.paid"))
+	assert.Equal(t, ">", globSubject("*"))
+	assert.Equal(t, ">", globSubject("ord[ae]rs.eu"))
+}
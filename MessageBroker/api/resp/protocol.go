@@ -0,0 +1,118 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Largest inline command, as in redis
+const maxInlineBytes = 64 * 1024
+
+// Largest number of arguments of one command
+const maxArgs = 1024 * 1024
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads one request: a RESP array of bulk strings, or an
+// inline command split on spaces as sent by telnet. The bulks and their
+// headers may not add up to more than maxCommandBytes.
+func readCommand(r *bufio.Reader, maxBulkBytes, maxCommandBytes int) ([]string, error) {
+	line, err := readLine(r, maxInlineBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, min(n, 64))
+	total := len(line)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxInlineBytes)
+		if err != nil {
+			return nil, err
+		}
+		total += len(line)
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkBytes {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		// checked before reading, so the bulk is never allocated
+		total += size
+		if total > maxCommandBytes {
+			return nil, fmt.Errorf("%w: too big request", errProtocol)
+		}
+		// the bulk and its CRLF
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return nil, err
+		}
+		if bulk[size] != '\r' || bulk[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk is not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(bulk[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads up to CRLF, or a bare LF, without the terminator
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return "", fmt.Errorf("%w: too big request", errProtocol)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return string(line), nil
+	}
+}
+
+// Replies, written to a buffered writer flushed once per reply
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
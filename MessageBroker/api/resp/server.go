@@ -0,0 +1,78 @@
+// Package resp speaks enough of the redis protocol for pub/sub clients:
+// PUBLISH, SUBSCRIBE, PSUBSCRIBE, their unsubscribes, PING, AUTH and
+// QUIT. Redis channels are broker subjects, so services using redis
+// pub/sub reach the same subscribers as grpc clients.
+package resp
+
+import (
+	"net"
+	"time"
+
+	"therealbroker/api/accept"
+	"therealbroker/api/auth"
+	"therealbroker/api/ratelimit"
+	"therealbroker/pkg/broker"
+)
+
+type Options struct {
+	// Checks the AUTH password as a bearer token, and the acl, when set
+	Authorizer *auth.Authorizer
+	// Applies publish rates and subscription quotas when set
+	Limiter *ratelimit.Limiter
+	// Expiration of the messages published over resp, zero keeps them
+	Expiration time.Duration
+	// Largest accepted argument of a command
+	MaxBulkBytes int
+	// Largest accepted command, all of its arguments together
+	MaxCommandBytes int
+	// Longest a write to a client may block its subscriptions
+	WriteTimeout time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxBulkBytes:    1 << 20,
+		MaxCommandBytes: 4 << 20,
+		WriteTimeout:    10 * time.Second,
+	}
+}
+
+// Server accepts resp connections on one or more listeners
+type Server struct {
+	broker  broker.Broker
+	options Options
+	loop    *accept.Loop
+}
+
+// New creates a server on b, zero options take their default.
+func New(b broker.Broker, options Options) *Server {
+	defaults := DefaultOptions()
+	if options.MaxBulkBytes <= 0 {
+		options.MaxBulkBytes = defaults.MaxBulkBytes
+	}
+	if options.MaxCommandBytes <= 0 {
+		options.MaxCommandBytes = defaults.MaxCommandBytes
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = defaults.WriteTimeout
+	}
+	return &Server{
+		broker:  b,
+		options: options,
+		loop:    accept.NewLoop("resp"),
+	}
+}
+
+// Serve accepts connections on lis until the server is closed.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.loop.Serve(lis, func(netConn net.Conn) (func(), func()) {
+		c := newConn(s, netConn)
+		return c.serve, c.close
+	})
+}
+
+// Close stops the listeners and drops every connection.
+func (s *Server) Close() error {
+	s.loop.Close()
+	return nil
+}
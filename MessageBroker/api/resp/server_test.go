@@ -0,0 +1,207 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"therealbroker/api/auth"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newModule(t *testing.T) broker.Broker {
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	t.Cleanup(func() { module.Close() })
+	return module
+}
+
+// startServer serves b on a random port and returns its address
+func startServer(t *testing.T, b broker.Broker, options Options) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	server := New(b, options)
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+	return lis.Addr().String()
+}
+
+func newClient(t *testing.T, address, password string) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:            address,
+		Password:        password,
+		Protocol:        2,
+		DisableIdentity: true,
+		MaxRetries:      -1,
+	})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func subscribe(t *testing.T, pubsub *redis.PubSub) <-chan *redis.Message {
+	// the confirmation, the subscription is live after it
+	_, err := pubsub.Receive(context.Background())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { pubsub.Close() })
+	return pubsub.Channel()
+}
+
+func next(t *testing.T, messages <-chan *redis.Message) *redis.Message {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestPublishAndSubscribeShouldShareSubjectsWithTheBroker(t *testing.T) {
+	module := newModule(t)
+	client := newClient(t, startServer(t, module, Options{}), "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// redis subscribers see grpc publishes
+	messages := subscribe(t, client.Subscribe(ctx, "orders.eu"))
+	_, err := module.Publish(ctx, "orders.eu", broker.Message{Body: "hello"})
+	assert.Nil(t, err)
+	msg := next(t, messages)
+	assert.Equal(t, "orders.eu", msg.Channel)
+	assert.Equal(t, "hello", msg.Payload)
+
+	// and grpc subscribers see redis publishes, counted as receivers
+	ch, err := module.Subscribe(ctx, "orders.us")
+	assert.Nil(t, err)
+	receivers, err := client.Publish(ctx, "orders.us", "world").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), receivers)
+	assert.Equal(t, "world", (<-ch).Body)
+
+	receivers, err = client.Publish(ctx, "orders.none", "lost").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), receivers)
+
+	// channels are subjects, not subject patterns
+	assert.ErrorContains(t, client.Publish(ctx, "orders.*", "x").Err(), "PSUBSCRIBE")
+}
+
+func TestPSubscribeShouldMatchGlobs(t *testing.T) {
+	client := newClient(t, startServer(t, newModule(t), Options{}), "")
+	ctx := context.Background()
+	messages := subscribe(t, client.PSubscribe(ctx, "orders.*.paid"))
+
+	for _, channel := range []string{"orders.eu.paid", "orders.eu.new", "orders.us.paid"} {
+		assert.Nil(t, client.Publish(ctx, channel, channel).Err())
+	}
+	for _, channel := range []string{"orders.eu.paid", "orders.us.paid"} {
+		msg := next(t, messages)
+		assert.Equal(t, "orders.*.paid", msg.Pattern)
+		assert.Equal(t, channel, msg.Channel)
+		assert.Equal(t, channel, msg.Payload)
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message on %q", msg.Channel)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAuthShouldCheckPasswordsAndChannels(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "service"}},
+		ACL:     []auth.Rule{{Identity: "service", Publish: []string{"orders.>"}, Subscribe: []string{"orders.>"}}},
+	}, nil)
+	address := startServer(t, newModule(t), Options{Authorizer: authorizer})
+	ctx := context.Background()
+
+	assert.ErrorContains(t, newClient(t, address, "").Publish(ctx, "orders.eu", "x").Err(), "NOAUTH")
+	assert.ErrorContains(t, newClient(t, address, "wrong").Publish(ctx, "orders.eu", "x").Err(), "WRONGPASS")
+
+	client := newClient(t, address, "key-1")
+	assert.Nil(t, client.Publish(ctx, "orders.eu", "x").Err())
+	assert.ErrorContains(t, client.Publish(ctx, "payments.eu", "x").Err(), "NOPERM")
+	_, err := client.Subscribe(ctx, "orders.eu", "payments.eu").Receive(ctx)
+	assert.ErrorContains(t, err, "NOPERM")
+	_, err = client.PSubscribe(ctx, "*").Receive(ctx)
+	assert.ErrorContains(t, err, "NOPERM")
+}
+
+// raw sends one inline command and reads the reply lines
+func raw(t *testing.T, conn net.Conn, reader *bufio.Reader, command string, lines int) []string {
+	_, err := conn.Write([]byte(command + "\r\n"))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]string, 0, lines)
+	for range lines {
+		line, err := readLine(reader, maxInlineBytes)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		reply = append(reply, line)
+	}
+	return reply
+}
+
+func TestSubscribedClientsShouldOnlyRunPubSubCommands(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t, newModule(t), Options{}))
+	assert.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	assert.Equal(t, []string{"+PONG"}, raw(t, conn, reader, "PING", 1))
+	assert.Equal(t, []string{"*3", "$9", "subscribe", "$1", "a", ":1"}, raw(t, conn, reader, "SUBSCRIBE a", 6))
+	reply := raw(t, conn, reader, "PUBLISH a x", 1)
+	assert.Contains(t, reply[0], "-ERR Can't execute 'publish'")
+	assert.Equal(t, []string{"*2", "$4", "pong", "$0", ""}, raw(t, conn, reader, "PING", 5))
+	assert.Equal(t, []string{"*3", "$11", "unsubscribe", "$1", "a", ":0"}, raw(t, conn, reader, "UNSUBSCRIBE", 6))
+	assert.Equal(t, []string{":0"}, raw(t, conn, reader, "PUBLISH a x", 1))
+	assert.Equal(t, []string{"+OK"}, raw(t, conn, reader, "QUIT", 1))
+}
+
+func TestServerCloseShouldDisconnectClients(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := New(newModule(t), Options{})
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(lis) }()
+
+	client := newClient(t, lis.Addr().String(), "")
+	pubsub := client.Subscribe(context.Background(), "orders.eu")
+	subscribe(t, pubsub)
+
+	assert.Nil(t, server.Close())
+	assert.Nil(t, <-served)
+	_, err = pubsub.ReceiveTimeout(context.Background(), 5*time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestCommandsShouldBeLimitedInTotal(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t, newModule(t), Options{MaxBulkBytes: 10, MaxCommandBytes: 32}))
+	assert.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	assert.Equal(t, []string{":0"}, raw(t, conn, reader, "*3\r\n$7\r\nPUBLISH\r\n$1\r\na\r\n$2\r\nhi", 1))
+	// every argument is below the bulk limit, not all of them together
+	command := "*5\r\n$9\r\nSUBSCRIBE"
+	for _, channel := range []string{"aaaaaaaaa", "bbbbbbbbb", "ccccccccc", "ddddddddd"} {
+		command += "\r\n$9\r\n" + channel
+	}
+	assert.Equal(t, []string{"-ERR Protocol error: too big request"}, raw(t, conn, reader, command, 1))
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	datacontrol "therealbroker/internal/data_control"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// Readiness of the whole server, what probes get with an empty service
+	ReadinessService = ""
+	// Serving as long as the process is able to answer
+	LivenessService = "liveness"
+	// Readiness of the broker service itself
+	BrokerService = "broker.Broker"
+)
+
+type closer interface {
+	IsClosed() bool
+}
+
+// HealthChecker keeps the grpc.health.v1 statuses up to date with the
+// connectivity of the data control and the state of the broker.
+type HealthChecker struct {
+	*health.Server
+	data     datacontrol.DataControl
+	broker   closer
+	interval time.Duration
+	timeout  time.Duration
+	stopChan chan bool
+}
+
+func NewHealthChecker(s *Server, interval time.Duration) *HealthChecker {
+	hc := &HealthChecker{
+		Server:   health.NewServer(),
+		data:     s.data,
+		interval: interval,
+		timeout:  interval,
+		stopChan: make(chan bool),
+	}
+	if b, ok := s.broker.(closer); ok {
+		hc.broker = b
+	}
+	hc.SetServingStatus(LivenessService, healthpb.HealthCheckResponse_SERVING)
+	hc.Refresh()
+	return hc
+}
+
+// Ready reports whether the broker is open and the data control answers
+// its ping within the timeout.
+func (hc *HealthChecker) Ready() bool {
+	if hc.broker != nil && hc.broker.IsClosed() {
+		return false
+	}
+	if hc.data == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	pong := make(chan bool, 1)
+	go func() {
+		pong <- hc.data.TestConnection()
+	}()
+	select {
+	case ok := <-pong:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Refresh updates the readiness statuses once.
+func (hc *HealthChecker) Refresh() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if hc.Ready() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	hc.SetServingStatus(ReadinessService, status)
+	hc.SetServingStatus(BrokerService, status)
+}
+
+func (hc *HealthChecker) Start() {
+	ticker := time.NewTicker(hc.interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				hc.Refresh()
+			case <-hc.stopChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the checks and reports every service as not serving,
+// so clients stop sending requests while the server drains.
+func (hc *HealthChecker) Stop() {
+	hc.stopChan <- true
+	hc.Shutdown()
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datacontrol "therealbroker/internal/data_control"
+
+	"github.com/stretchr/testify/assert"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type unreachableData struct {
+	*datacontrol.DataMemory
+}
+
+func (unreachableData) TestConnection() bool {
+	return false
+}
+
+func servingStatus(t *testing.T, hc *HealthChecker, service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	assert.Nil(t, err)
+	return resp.Status
+}
+
+func TestHealthShouldServeWhenDataIsReachable(t *testing.T) {
+	hc := NewHealthChecker(NewServer(datacontrol.NewDataMemory()), time.Second)
+
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(t, hc, ReadinessService))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(t, hc, BrokerService))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(t, hc, LivenessService))
+}
+
+func TestHealthShouldNotServeWhenDataIsUnreachable(t *testing.T) {
+	hc := NewHealthChecker(NewServer(unreachableData{datacontrol.NewDataMemory()}), time.Second)
+
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus(t, hc, ReadinessService))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(t, hc, LivenessService))
+}
+
+func TestHealthShouldNotServeWhenBrokerIsClosed(t *testing.T) {
+	s := NewServer(datacontrol.NewDataMemory())
+	hc := NewHealthChecker(s, 10*time.Millisecond)
+	hc.Start()
+	defer hc.Stop()
+
+	s.broker.Close()
+
+	assert.Eventually(t, func() bool {
+		return servingStatus(t, hc, BrokerService) == healthpb.HealthCheckResponse_NOT_SERVING
+	}, time.Second, 10*time.Millisecond)
+}
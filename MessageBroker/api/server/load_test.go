@@ -2,81 +2,144 @@ package server
 
 import (
 	"context"
-	"log"
-	"sync"
+	"crypto/tls"
+	"net"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
+	"therealbroker/api/certs"
 	"therealbroker/api/proto"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/loadgen"
+	"therealbroker/pkg/client"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-)
-
-const (
-	serverAddr = "192.168.49.2:30000" // Update this to your server address
-	reqPerSec  = 30000
-	duration   = 30 * time.Second
 )
 
+// TestPublishLoad puts load on the broker through the grpc api. The broker
+// is served in this process unless BROKER_LOAD_ADDRESS is set, the load
+// is shaped by the LOAD_* variables below and LOAD_REPORT names a file
+// for the json report.
+//
+//	BROKER_LOAD_ADDRESS=192.168.49.2:30000 LOAD_RATE=30000 LOAD_DURATION=30s \
+//	LOAD_REPORT=report.json go test ./api/server -run TestPublishLoad -v
 func TestPublishLoad(t *testing.T) {
-	conn, err := grpc.NewClient(serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if testing.Short() {
+		t.Skip("load test in short mode")
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Invalid load config: %v", err)
+	}
+
+	address := os.Getenv("BROKER_LOAD_ADDRESS")
+	target := address
+	if address == "" {
+		address = serveInProcess(t)
+		target = "in-process"
+	}
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		t.Fatalf("Failed to load tls config: %v", err)
+	}
+	c, err := client.New(client.Options{
+		Address:       address,
+		TLS:           tlsConfig,
+		Token:         os.Getenv("BROKER_TOKEN"),
+		InsecureToken: os.Getenv("BROKER_INSECURE_TOKEN") == "true",
+	})
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
-	defer conn.Close()
+	defer c.Close()
 
-	client := proto.NewBrokerClient(conn)
-	numRequests := reqPerSec * int(duration.Seconds()) * 2
-	delay := time.Duration(time.Second.Nanoseconds() / reqPerSec)
-	log.Println(delay)
-	ticker := time.NewTicker(delay)
-	defer ticker.Stop()
-	timeout := time.NewTicker(duration)
-	defer timeout.Stop()
-	results := make(chan error, numRequests)
-	var wg sync.WaitGroup
+	report, err := loadgen.Run(context.Background(), c, config)
+	if err != nil {
+		t.Fatalf("Load did not start: %v", err)
+	}
+	report.Target = target
+	t.Log("\n" + report.String())
+	if path := os.Getenv("LOAD_REPORT"); path != "" {
+		if err := report.WriteFile(path); err != nil {
+			t.Errorf("Failed to write report: %v", err)
+		}
+	}
+	if report.PublishErrors > 0 {
+		t.Errorf("%d publishes failed, first: %v", report.PublishErrors, report.Errors)
+	}
+	if report.Lost > 0 {
+		t.Errorf("%d of %d deliveries lost", report.Lost, report.ExpectedDeliveries)
+	}
+}
 
-	StartTest(ticker, timeout, &wg, results, client)
+func serveInProcess(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	proto.RegisterBrokerServer(grpcServer, NewServer(datacontrol.NewDataMemory()))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
 
-	wg.Wait()
-	close(results)
+// loadConfig reads LOAD_PUBLISHERS, LOAD_SUBSCRIBERS, LOAD_SUBJECTS,
+// LOAD_SIZES, LOAD_RATE, LOAD_DURATION and LOAD_EXPIRATION. The
+// defaults are light enough for every test run.
+func loadConfig() (loadgen.Config, error) {
+	config := loadgen.DefaultConfig()
+	config.Publishers = 4
+	config.Subscribers = 2
+	config.Subjects = 4
+	config.Rate = 2000
+	config.Duration = 2 * time.Second
+	config.Expiration = time.Hour
 
-	for err := range results {
+	for name, field := range map[string]*int{
+		"LOAD_PUBLISHERS":  &config.Publishers,
+		"LOAD_SUBSCRIBERS": &config.Subscribers,
+		"LOAD_SUBJECTS":    &config.Subjects,
+		"LOAD_RATE":        &config.Rate,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return config, err
+			}
+			*field = n
+		}
+	}
+	for name, field := range map[string]*time.Duration{
+		"LOAD_DURATION":   &config.Duration,
+		"LOAD_EXPIRATION": &config.Expiration,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return config, err
+			}
+			*field = d
+		}
+	}
+	if value := os.Getenv("LOAD_SIZES"); value != "" {
+		sizes, err := loadgen.ParseSizes(value)
 		if err != nil {
-			t.Errorf("Request failed: %v", err)
-			return
+			return config, err
 		}
+		config.PayloadSizes = sizes
 	}
+	return config, config.Validate()
 }
 
-func StartTest(ticker, timeout *time.Ticker, wg *sync.WaitGroup, results chan error, client proto.BrokerClient) {
-	for {
-		select {
-		case <-ticker.C:
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				req := &proto.PublishRequest{
-					Subject:           "Test Subject",
-					Body:              "Test Body",
-					ExpirationSeconds: 3600,
-				}
-
-				ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
-				defer cancel()
-
-				_, err := client.Publish(ctx, req)
-				if err != nil {
-					results <- err
-					return
-				}
-
-				results <- nil
-			}()
-		case <-timeout.C:
-			log.Println("test finished")
-			return
-		}
+// clientTLSConfig uses tls when BROKER_CA_FILE is set, and mutual tls
+// when BROKER_CERT_FILE and BROKER_KEY_FILE are set too.
+func clientTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("BROKER_CA_FILE")
+	if caFile == "" {
+		return nil, nil
 	}
+	return certs.ClientConfig(caFile, os.Getenv("BROKER_CERT_FILE"), os.Getenv("BROKER_KEY_FILE"), "")
 }
@@ -2,10 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"log/slog"
+	"strconv"
+	"strings"
+	"therealbroker/api/auth"
 	"therealbroker/api/metrics"
+	pb "therealbroker/api/proto"
+	"therealbroker/api/ratelimit"
+	"therealbroker/internal/logging"
 	"time"
 
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -38,8 +52,10 @@ func StreamMetricsInterceptor() grpc.StreamServerInterceptor {
 		info *grpc.StreamServerInfo,
 		handler grpc.StreamHandler,
 	) error {
-		metrics.ActiveSubscriptions.Inc()
-		defer metrics.ActiveSubscriptions.Dec()
+		if info.FullMethod == pb.Broker_Subscribe_FullMethodName {
+			metrics.ActiveSubscriptions.Inc()
+			defer metrics.ActiveSubscriptions.Dec()
+		}
 
 		start := time.Now()
 		err := handler(srv, stream)
@@ -53,3 +69,384 @@ func StreamMetricsInterceptor() grpc.StreamServerInterceptor {
 		return err
 	}
 }
+
+// Permission required by each broker RPC. Methods that are not listed
+// only need a valid identity.
+var methodPermissions = map[string]auth.Permission{
+	pb.Broker_Publish_FullMethodName:      auth.PermPublish,
+	pb.Broker_Subscribe_FullMethodName:    auth.PermSubscribe,
+	pb.Broker_Fetch_FullMethodName:        auth.PermFetch,
+	pb.Broker_ListMessages_FullMethodName: auth.PermFetch,
+	pb.Broker_FetchRange_FullMethodName:   auth.PermFetch,
+
+	pb.SchemaRegistry_RegisterSchema_FullMethodName: auth.PermAdmin,
+	pb.SchemaRegistry_DeleteSchema_FullMethodName:   auth.PermAdmin,
+}
+
+// Permission required on every subject, see auth.AuthorizeAll, by the
+// RPCs that are not about one subject
+var globalPermissions = map[string]auth.Permission{
+	// names every subject with subscribers
+	pb.Broker_Stats_FullMethodName: auth.PermAdmin,
+}
+
+// Methods that are served without authentication, so probes work
+var publicMethods = map[string]bool{
+	healthpb.Health_Check_FullMethodName: true,
+	healthpb.Health_Watch_FullMethodName: true,
+}
+
+type subjectRequest interface {
+	GetSubject() string
+}
+
+// UnaryAuthInterceptor validates the bearer token of unary calls and
+// checks the acl against the subject of the request.
+func UnaryAuthInterceptor(authorizer *auth.Authorizer) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if publicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		id, err := authenticate(ctx, authorizer, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		ctx = withIdentity(ctx, id)
+		if err := authorize(authorizer, id, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuthInterceptor validates the bearer token of streaming calls.
+// The acl is checked when the handler receives the request message,
+// since the subject is not known before that.
+func StreamAuthInterceptor(authorizer *auth.Authorizer) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if publicMethods[info.FullMethod] {
+			return handler(srv, stream)
+		}
+		id, err := authenticate(stream.Context(), authorizer, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authServerStream{
+			ServerStream: stream,
+			ctx:          withIdentity(stream.Context(), id),
+			authorizer:   authorizer,
+			identity:     id,
+			method:       info.FullMethod,
+		})
+	}
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	authorizer *auth.Authorizer
+	identity   auth.Identity
+	method     string
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authorize(s.authorizer, s.identity, s.method, m)
+}
+
+// withIdentity passes id down ctx, and names it in the access log and
+// the logs of the handler
+func withIdentity(ctx context.Context, id auth.Identity) context.Context {
+	if fields, ok := ctx.Value(accessFieldsKey{}).(*accessFields); ok {
+		fields.identity = id.Name
+	}
+	ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("identity", id.Name))
+	return auth.NewContext(ctx, id)
+}
+
+// authenticate prefers the bearer token, and falls back to the verified
+// client certificate of a mutual tls connection.
+func authenticate(ctx context.Context, authorizer *auth.Authorizer, method string) (auth.Identity, error) {
+	state, addr := peerInfo(ctx)
+	id, err := auth.Identify(authorizer, bearerToken(ctx), state, addr)
+	if err != nil {
+		metrics.AuthDenials.WithLabelValues(method, "unauthenticated").Inc()
+		return auth.Identity{}, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return id, nil
+}
+
+func authorize(authorizer *auth.Authorizer, id auth.Identity, method string, req interface{}) error {
+	if perm, ok := globalPermissions[method]; ok {
+		if err := authorizer.AuthorizeAll(id, perm); err != nil {
+			metrics.AuthDenials.WithLabelValues(method, "forbidden").Inc()
+			return status.Errorf(codes.PermissionDenied, "%s is not allowed to %s on every subject", id.Name, perm)
+		}
+		return nil
+	}
+	perm, ok := methodPermissions[method]
+	if !ok {
+		return nil
+	}
+	subject := ""
+	if r, ok := req.(subjectRequest); ok {
+		subject = r.GetSubject()
+	}
+	if err := authorizer.Authorize(id, perm, subject); err != nil {
+		metrics.AuthDenials.WithLabelValues(method, "forbidden").Inc()
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to %s on %q", id.Name, perm, subject)
+	}
+	return nil
+}
+
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ""
+	}
+	token, found := strings.CutPrefix(values[0], "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// peerInfo is the tls state, nil without tls, and the address of the
+// caller
+func peerInfo(ctx context.Context) (*tls.ConnectionState, string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, ""
+	}
+	addr := ""
+	if p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		return &info.State, addr
+	}
+	return nil, addr
+}
+
+// UnaryRateLimitInterceptor applies the publish token buckets of the
+// caller and the subject.
+func UnaryRateLimitInterceptor(limiter *ratelimit.Limiter) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if info.FullMethod != pb.Broker_Publish_FullMethodName {
+			return handler(ctx, req)
+		}
+		subject := ""
+		if r, ok := req.(subjectRequest); ok {
+			subject = r.GetSubject()
+		}
+		if denial := limiter.AllowPublish(clientIdentity(ctx), subject); denial != nil {
+			return nil, rateLimitError(ctx, info.FullMethod, denial)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamRateLimitInterceptor applies the concurrent subscription quotas.
+func StreamRateLimitInterceptor(limiter *ratelimit.Limiter) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if info.FullMethod != pb.Broker_Subscribe_FullMethodName {
+			return handler(srv, stream)
+		}
+		wrapped := &quotaServerStream{ServerStream: stream, limiter: limiter, method: info.FullMethod}
+		defer wrapped.release()
+		return handler(srv, wrapped)
+	}
+}
+
+type quotaServerStream struct {
+	grpc.ServerStream
+	limiter  *ratelimit.Limiter
+	method   string
+	releases []func()
+}
+
+func (s *quotaServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	subject := ""
+	if r, ok := m.(subjectRequest); ok {
+		subject = r.GetSubject()
+	}
+	release, denial := s.limiter.AcquireSubscription(clientIdentity(s.Context()), subject)
+	if denial != nil {
+		return rateLimitError(s.Context(), s.method, denial)
+	}
+	s.releases = append(s.releases, release)
+	return nil
+}
+
+func (s *quotaServerStream) release() {
+	for _, release := range s.releases {
+		release()
+	}
+}
+
+func rateLimitError(ctx context.Context, method string, denial *ratelimit.Denial) error {
+	metrics.RateLimited.WithLabelValues(method, denial.Scope).Inc()
+	if denial.RetryAfter > 0 {
+		retryAfter := strconv.FormatFloat(denial.RetryAfter.Seconds(), 'f', 3, 64)
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfter))
+	}
+	return status.Errorf(codes.ResourceExhausted, "%s: %s limit", denial.Err.Error(), denial.Scope)
+}
+
+// clientIdentity names the caller for per client limits: the
+// authenticated identity, the client certificate or the peer ip.
+func clientIdentity(ctx context.Context) string {
+	if id, ok := auth.FromContext(ctx); ok {
+		return id.Name
+	}
+	return auth.ClientIdentity(peerInfo(ctx))
+}
+
+// UnaryLoggingInterceptor writes an access log per call and passes a
+// logger with the request id down the context.
+func UnaryLoggingInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		ctx, logger := requestLogger(ctx, info.FullMethod)
+		if r, ok := req.(subjectRequest); ok {
+			logger = logger.With("subject", r.GetSubject())
+			ctx = logging.NewContext(ctx, logger)
+		}
+
+		resp, err := handler(ctx, req)
+
+		accessLog(ctx, logger, start, err)
+		return resp, err
+	}
+}
+
+// StreamLoggingInterceptor writes an access log when a stream ends.
+func StreamLoggingInterceptor() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		ctx, logger := requestLogger(stream.Context(), info.FullMethod)
+		wrapped := &loggingServerStream{ServerStream: stream, ctx: ctx, logger: logger}
+
+		err := handler(srv, wrapped)
+
+		accessLog(ctx, wrapped.logger, start, err)
+		return err
+	}
+}
+
+type loggingServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	logger *slog.Logger
+}
+
+func (s *loggingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if r, ok := m.(subjectRequest); ok && err == nil {
+		s.logger = s.logger.With("subject", r.GetSubject())
+		s.ctx = logging.NewContext(s.ctx, s.logger)
+		s.logger.Debug("stream started")
+	}
+	return err
+}
+
+// accessFields are filled in by the interceptors chained after the
+// logging one, which only know the caller by its address
+type accessFields struct {
+	identity string
+}
+
+type accessFieldsKey struct{}
+
+// requestLogger uses the x-request-id of the caller, or creates one, and
+// sends it back in the response headers.
+func requestLogger(ctx context.Context, method string) (context.Context, *slog.Logger) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-request-id"); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+
+	logger := logging.FromContext(ctx).With(
+		"request_id", requestID,
+		"method", method,
+		"client", clientIdentity(ctx),
+	)
+	ctx = context.WithValue(ctx, accessFieldsKey{}, &accessFields{})
+	return logging.NewContext(ctx, logger), logger
+}
+
+func accessLog(ctx context.Context, logger *slog.Logger, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK, codes.Canceled:
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+	}
+	if fields, ok := ctx.Value(accessFieldsKey{}).(*accessFields); ok && fields.identity != "" {
+		attrs = append(attrs, slog.String("identity", fields.identity))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	logger.LogAttrs(ctx, level, "rpc finished", attrs...)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"therealbroker/api/auth"
+	pb "therealbroker/api/proto"
+	"therealbroker/internal/logging"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLogsShouldNameTheAuthenticatedCaller(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{{Key: "key-1", Identity: "producer"}},
+		ACL:     []auth.Rule{{Identity: "producer", Publish: []string{"orders"}}},
+	}, nil)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer key-1"))
+	ctx = logging.NewContext(ctx, logger)
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Broker_Publish_FullMethodName}
+
+	// chained like main does, the logging interceptor runs first
+	authenticated := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return UnaryAuthInterceptor(authorizer)(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			logging.FromContext(ctx).Info("published")
+			return &pb.PublishResponse{}, nil
+		})
+	}
+	_, err := UnaryLoggingInterceptor()(ctx, &pb.PublishRequest{Subject: "orders"}, info, authenticated)
+	assert.Nil(t, err)
+
+	var messages []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		messages = append(messages, record["msg"].(string))
+		assert.Equal(t, "producer", record["identity"], record["msg"])
+	}
+	assert.Equal(t, []string{"published", "rpc finished"}, messages)
+}
+
+func TestStatsShouldRequireTheAdminPermissionOnEverySubject(t *testing.T) {
+	authorizer := auth.NewAuthorizer(&auth.Policy{
+		APIKeys: []auth.APIKey{
+			{Key: "key-1", Identity: "producer"},
+			{Key: "key-2", Identity: "orders-admin"},
+			{Key: "key-3", Identity: "admin"},
+			{Key: "key-4", Identity: "token-admin"},
+		},
+		ACL: []auth.Rule{
+			{Identity: "producer", Publish: []string{">"}, Subscribe: []string{">"}},
+			{Identity: "orders-admin", Admin: []string{"orders.>"}},
+			{Identity: "admin", Admin: []string{">"}},
+			{Identity: "token-admin", Admin: []string{"*"}},
+		},
+	}, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: pb.Broker_Stats_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.StatsResponse{}, nil
+	}
+
+	for key, code := range map[string]codes.Code{
+		"key-1": codes.PermissionDenied,
+		"key-2": codes.PermissionDenied,
+		"key-3": codes.OK,
+		// "*" matches the empty subject of the request, not every subject
+		"key-4": codes.PermissionDenied,
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+key))
+		_, err := UnaryAuthInterceptor(authorizer)(ctx, &pb.StatsRequest{}, info, handler)
+		assert.Equal(t, code, status.Code(err), key)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	pb "therealbroker/api/proto"
+	"therealbroker/internal/logging"
+	"therealbroker/internal/schema"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SchemaServer is the admin api of the schema registry. Registering and
+// deleting need the admin permission on the subject pattern.
+type SchemaServer struct {
+	pb.UnimplementedSchemaRegistryServer
+	registry *schema.Registry
+}
+
+func NewSchemaServer(registry *schema.Registry) *SchemaServer {
+	return &SchemaServer{registry: registry}
+}
+
+func (s *SchemaServer) RegisterSchema(ctx context.Context, req *pb.RegisterSchemaRequest) (*pb.Schema, error) {
+	registered, err := s.registry.Register(schemaFromRequest(req))
+	if err != nil {
+		return nil, schemaError(ctx, err)
+	}
+	logging.FromContext(ctx).Info("schema registered", "version", registered.Version, "type", registered.Type)
+	return schemaMessage(registered), nil
+}
+
+func (s *SchemaServer) GetSchema(ctx context.Context, req *pb.GetSchemaRequest) (*pb.Schema, error) {
+	found, err := s.registry.Get(req.Subject, int(req.Version))
+	if err != nil {
+		return nil, schemaError(ctx, err)
+	}
+	return schemaMessage(found), nil
+}
+
+func (s *SchemaServer) ListSchemas(ctx context.Context, req *pb.ListSchemasRequest) (*pb.ListSchemasResponse, error) {
+	resp := &pb.ListSchemasResponse{}
+	for _, found := range s.registry.List() {
+		resp.Schemas = append(resp.Schemas, schemaMessage(found))
+	}
+	return resp, nil
+}
+
+func (s *SchemaServer) DeleteSchema(ctx context.Context, req *pb.DeleteSchemaRequest) (*pb.DeleteSchemaResponse, error) {
+	versions, err := s.registry.Delete(req.Subject)
+	if err != nil {
+		return nil, schemaError(ctx, err)
+	}
+	logging.FromContext(ctx).Info("schema deleted", "versions", versions)
+	return &pb.DeleteSchemaResponse{Versions: int32(versions)}, nil
+}
+
+func (s *SchemaServer) CheckCompatibility(ctx context.Context, req *pb.RegisterSchemaRequest) (*pb.CompatibilityResponse, error) {
+	problems, err := s.registry.Check(schemaFromRequest(req))
+	if err != nil {
+		return nil, schemaError(ctx, err)
+	}
+	return &pb.CompatibilityResponse{Compatible: len(problems) == 0, Problems: problems}, nil
+}
+
+func schemaFromRequest(req *pb.RegisterSchemaRequest) schema.Schema {
+	return schema.Schema{
+		Subject:       req.Subject,
+		Type:          schema.Type(req.Type),
+		Definition:    req.Definition,
+		DescriptorSet: req.DescriptorSet,
+		MessageType:   req.MessageType,
+		Compatibility: schema.Compatibility(req.Compatibility),
+	}
+}
+
+func schemaMessage(s schema.Schema) *pb.Schema {
+	return &pb.Schema{
+		Subject:       s.Subject,
+		Version:       int32(s.Version),
+		Type:          string(s.Type),
+		Definition:    s.Definition,
+		DescriptorSet: s.DescriptorSet,
+		MessageType:   s.MessageType,
+		Compatibility: string(s.Compatibility),
+	}
+}
+
+func schemaError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, schema.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, schema.ErrInvalidSchema):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, schema.ErrIncompatible):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logging.FromContext(ctx).Error("schema registry failed", "error", err)
+	return status.Errorf(codes.Internal, "internal error")
+}
@@ -2,14 +2,23 @@ package server
 
 import (
 	"context"
-	"log"
+	"errors"
+	"slices"
+	"strings"
 	"sync"
 	pb "therealbroker/api/proto"
 	bm "therealbroker/internal/broker"
 	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/logging"
+	"therealbroker/internal/tracing"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/filter"
+	// answers calls compressed with snappy or zstd, next to gzip
+	_ "therealbroker/pkg/compression"
 	"time"
 
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -18,28 +27,78 @@ type Server struct {
 	pb.UnimplementedBrokerServer
 	mu     sync.Mutex
 	broker broker.Broker
+	data   datacontrol.DataControl
+	start  time.Time
 }
 
 func NewServer(data datacontrol.DataControl) *Server {
-	return &Server{mu: sync.Mutex{}, broker: bm.NewModule(data)}
+	return NewServerWithBroker(bm.NewModule(data), data)
+}
+
+// NewServerWithBroker serves b, data is only used for health checks.
+func NewServerWithBroker(b broker.Broker, data datacontrol.DataControl) *Server {
+	return &Server{mu: sync.Mutex{}, broker: b, data: data, start: time.Now()}
+}
+
+// QueueDepths reports the subscriber queue depths of the broker, if it
+// keeps local queues.
+func (s *Server) QueueDepths() map[string]int {
+	if b, ok := s.broker.(interface{ QueueDepths() map[string]int }); ok {
+		return b.QueueDepths()
+	}
+	return nil
+}
+
+// brokerStatus is a status of code and message naming err in its
+// details, so clients get the broker error back without parsing message
+func brokerStatus(code codes.Code, err error, message string) error {
+	s := status.New(code, message)
+	reason, ok := broker.ErrorReason(err)
+	if !ok {
+		return s.Err()
+	}
+	detailed, detailErr := s.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: broker.ErrorDomain})
+	if detailErr != nil {
+		return s.Err()
+	}
+	return detailed.Err()
 }
 
 func (s *Server) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
-	msg := broker.Message{Body: req.Body, Expiration: time.Duration(time.Duration(req.ExpirationSeconds) * time.Second)}
+	msg := broker.Message{
+		Body:       req.Body,
+		Expiration: time.Duration(time.Duration(req.ExpirationSeconds) * time.Second),
+		Headers:    req.Headers,
+		Durability: broker.Durability(req.Durability),
+	}
 	id, err := s.broker.Publish(ctx, req.Subject, msg)
 	if err == broker.ErrAlreadyExistID {
-		return nil, status.Errorf(codes.InvalidArgument, "message id already exists")
+		return nil, brokerStatus(codes.InvalidArgument, err, "message id already exists")
+	}
+	if err == broker.ErrUnavailable {
+		return nil, brokerStatus(codes.Unavailable, err, "broker is closed")
+	}
+	if errors.Is(err, broker.ErrInvalidMessage) || errors.Is(err, broker.ErrInvalidDurability) {
+		return nil, brokerStatus(codes.InvalidArgument, err, err.Error())
 	}
 	if err != nil {
+		logging.FromContext(ctx).Error("failed to publish message", "error", err)
 		return nil, status.Errorf(codes.Internal, "internal error")
 	}
 	return &pb.PublishResponse{Id: id}, nil
 }
 
 func (s *Server) Subscribe(req *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error {
-	ch, err := s.broker.Subscribe(stream.Context(), req.Subject)
+	var f *filter.Filter
+	if req.Filter != "" {
+		var err error
+		if f, err = filter.Compile(req.Filter); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	ch, err := s.subscribe(stream.Context(), req.Subject, f)
 	if err != nil {
-		return status.Errorf(codes.Unavailable, "broker is closed")
+		return brokerStatus(codes.Unavailable, broker.ErrUnavailable, "broker is closed")
 	}
 
 	for {
@@ -48,27 +107,169 @@ func (s *Server) Subscribe(req *pb.SubscribeRequest, stream pb.Broker_SubscribeS
 			if !ok {
 				return nil
 			}
-			stream.Send(&pb.MessageResponse{Body: msg.Body})
+			_, span := tracing.StartDelivery(stream.Context(), req.Subject, msg)
+			err := stream.Send(&pb.MessageResponse{Body: msg.Body, Headers: msg.Headers})
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(otelcodes.Error, err.Error())
+			}
+			span.End()
 		case <-stream.Context().Done():
 			return status.Error(codes.Canceled, "subscription is cancelled")
 		}
 	}
 }
 
+// subscribe lets the broker apply f while fanning out when it can, and
+// otherwise drops the messages f does not match from the subscription.
+func (s *Server) subscribe(ctx context.Context, subject string, f *filter.Filter) (<-chan broker.Message, error) {
+	if b, ok := s.broker.(interface {
+		SubscribeFilter(context.Context, string, *filter.Filter) (<-chan broker.Message, error)
+	}); ok {
+		return b.SubscribeFilter(ctx, subject, f)
+	}
+	ch, err := s.broker.Subscribe(ctx, subject)
+	if err != nil || f == nil {
+		return ch, err
+	}
+	filtered := make(chan broker.Message)
+	go func() {
+		defer close(filtered)
+		for {
+			var msg broker.Message
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				msg = m
+			case <-ctx.Done():
+				return
+			}
+			candidate := &filter.Message{Subject: subject, Headers: msg.Headers, Body: msg.Body}
+			if msg.Subject != "" {
+				candidate.Subject = msg.Subject
+			}
+			if !f.Match(candidate) {
+				continue
+			}
+			select {
+			case filtered <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return filtered, nil
+}
+
 func (s *Server) Fetch(ctx context.Context, req *pb.FetchRequest) (*pb.MessageResponse, error) {
 	msg, err := s.broker.Fetch(ctx, req.Subject, req.Id)
 	if err == broker.ErrUnavailable {
-		return nil, status.Errorf(codes.Unavailable, "broker is closed")
+		return nil, brokerStatus(codes.Unavailable, err, "broker is closed")
 	}
 	if err == broker.ErrExpiredID {
-		return nil, status.Errorf(codes.InvalidArgument, "message is expired")
+		return nil, brokerStatus(codes.InvalidArgument, err, "message is expired")
 	}
 	if err == broker.ErrInvalidID {
-		return nil, status.Errorf(codes.InvalidArgument, "message id does not exits")
+		return nil, brokerStatus(codes.InvalidArgument, err, "message id does not exist")
 	}
 	if err != nil {
-		log.Println(err)
+		logging.FromContext(ctx).Error("failed to fetch message", "id", req.Id, "error", err)
 		return nil, status.Errorf(codes.Internal, "internal error")
 	}
-	return &pb.MessageResponse{Body: msg.Body}, nil
+	return &pb.MessageResponse{Body: msg.Body, Headers: msg.Headers}, nil
+}
+
+// ListMessages pages through the stored messages of a subject, without
+// their bodies
+func (s *Server) ListMessages(ctx context.Context, req *pb.RangeRequest) (*pb.MessagePage, error) {
+	return s.messageRange(ctx, req, false)
+}
+
+// FetchRange pages through the stored messages of a subject
+func (s *Server) FetchRange(ctx context.Context, req *pb.RangeRequest) (*pb.MessagePage, error) {
+	return s.messageRange(ctx, req, true)
+}
+
+func (s *Server) messageRange(ctx context.Context, req *pb.RangeRequest, bodies bool) (*pb.MessagePage, error) {
+	b, ok := s.broker.(interface {
+		ListMessages(context.Context, broker.Range) (broker.Page, error)
+	})
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "broker does not keep messages")
+	}
+	r := broker.Range{
+		Subject:       req.Subject,
+		Cursor:        req.Cursor,
+		StartID:       req.StartId,
+		StartSequence: req.StartSequence,
+		Limit:         int(req.Limit),
+		Reverse:       req.Reverse,
+	}
+	if req.SinceMs > 0 {
+		r.Since = time.UnixMilli(req.SinceMs)
+	}
+	if req.UntilMs > 0 {
+		r.Until = time.UnixMilli(req.UntilMs)
+	}
+	page, err := b.ListMessages(ctx, r)
+	if err == broker.ErrUnavailable {
+		return nil, brokerStatus(codes.Unavailable, err, "broker is closed")
+	}
+	if err == broker.ErrInvalidID {
+		return nil, brokerStatus(codes.InvalidArgument, err, "message id does not exist")
+	}
+	if errors.Is(err, broker.ErrInvalidRange) {
+		return nil, brokerStatus(codes.InvalidArgument, err, err.Error())
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to list messages", "subject", req.Subject, "error", err)
+		return nil, status.Errorf(codes.Internal, "internal error")
+	}
+
+	resp := &pb.MessagePage{NextCursor: page.Next}
+	for _, msg := range page.Messages {
+		stored := &pb.StoredMessage{
+			Id:            msg.Id,
+			Sequence:      msg.Sequence,
+			Headers:       msg.Headers,
+			PublishedAtMs: msg.SavedAt.UnixMilli(),
+			ExpiresAtMs:   msg.ExpiresAt().UnixMilli(),
+			Size:          int32(len(msg.Body)),
+		}
+		if bodies {
+			stored.Body = msg.Body
+		}
+		resp.Messages = append(resp.Messages, stored)
+	}
+	return resp, nil
+}
+
+// Stats lists the subjects with subscribers, if the broker keeps local
+// subscriptions.
+func (s *Server) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	resp := &pb.StatsResponse{
+		Backend:       "unknown",
+		UptimeSeconds: int64(time.Since(s.start).Seconds()),
+	}
+	if s.data != nil {
+		resp.Backend = datacontrol.BackendName(s.data)
+	}
+	b, ok := s.broker.(interface{ SubscriberCounts() map[string]int })
+	if !ok {
+		return resp, nil
+	}
+	depths := s.QueueDepths()
+	for subject, count := range b.SubscriberCounts() {
+		resp.Subjects = append(resp.Subjects, &pb.SubjectStats{
+			Subject:     subject,
+			Subscribers: int32(count),
+			QueueDepth:  int32(depths[subject]),
+		})
+	}
+	slices.SortFunc(resp.Subjects, func(a, b *pb.SubjectStats) int {
+		return strings.Compare(a.Subject, b.Subject)
+	})
+	return resp, nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"therealbroker/api/metrics"
+	"therealbroker/internal/bridge"
+	"therealbroker/internal/logging"
+)
+
+// bridge copies subjects from one broker to another, see
+// config/bridge.yml for the routes it takes.
+func main() {
+	configPath := flag.String("config", "config/bridge.yml", "path of the bridge yaml config")
+	logLevel := flag.String("log-level", "info", "debug, info, warn or error")
+	flag.Parse()
+
+	if _, _, err := logging.Setup(logging.Options{Level: *logLevel, Output: os.Stdout}); err != nil {
+		slog.Error("failed to setup logging", "error", err)
+		return
+	}
+	config, err := bridge.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("failed to load bridge config", "file", *configPath, "error", err)
+		return
+	}
+
+	source, err := bridge.Dial(config.Source)
+	if err != nil {
+		slog.Error("failed to connect to source broker", "address", config.Source.Address, "error", err)
+		return
+	}
+	defer source.Close()
+	destination, err := bridge.Dial(config.Destination)
+	if err != nil {
+		slog.Error("failed to connect to destination broker", "address", config.Destination.Address, "error", err)
+		return
+	}
+	defer destination.Close()
+
+	if config.MetricsAddress != "" {
+		metrics.InitBridgeMetrics()
+		metrics.ServeMetrics(config.MetricsAddress)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.Info("bridge started", "source", config.Source.Name, "destination", config.Destination.Name, "routes", len(config.Routes))
+	bridge.New(config, source, destination).Run(ctx)
+	slog.Info("bridge stopped")
+}
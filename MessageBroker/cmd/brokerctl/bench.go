@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "therealbroker/api/proto"
+)
+
+const (
+	// Unix nanoseconds of the publish, for the delivery latency
+	headerSent = "x-brokerctl-sent"
+	// Set on the messages sent until the bench subscription is open
+	headerProbe = "x-brokerctl-probe"
+)
+
+// latencies summarizes durations in milliseconds
+type latencies struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+func summarize(durations []time.Duration) latencies {
+	if len(durations) == 0 {
+		return latencies{}
+	}
+	slices.Sort(durations)
+	at := func(q float64) float64 {
+		i := int(q * float64(len(durations)-1))
+		return float64(durations[i].Microseconds()) / 1000
+	}
+	return latencies{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: at(1)}
+}
+
+func (l latencies) String() string {
+	return fmt.Sprintf("p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms", l.P50, l.P90, l.P99, l.Max)
+}
+
+type benchResult struct {
+	Subject    string     `json:"subject"`
+	Published  int        `json:"published"`
+	Errors     int        `json:"errors"`
+	Seconds    float64    `json:"seconds"`
+	Rate       float64    `json:"rate"`
+	Publish    latencies  `json:"publish"`
+	Delivered  int        `json:"delivered,omitempty"`
+	Delivery   *latencies `json:"delivery,omitempty"`
+	FirstError string     `json:"first_error,omitempty"`
+}
+
+func (c *cli) bench(ctx context.Context, args []string) error {
+	fs := c.flags("bench", "[subject]")
+	messages := fs.Int("messages", 10000, "messages to publish")
+	concurrency := fs.Int("concurrency", 10, "concurrent publishers")
+	size := fs.Int("size", 128, "body size in bytes")
+	expiration := fs.Duration("expiration", 0, "expiration of the messages, 0 to not store them")
+	subscribe := fs.Bool("subscribe", true, "subscribe to the subject and measure delivery latency")
+	wait := fs.Duration("wait", 5*time.Second, "how long to wait for deliveries after the last publish")
+	if err := c.parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	subject := "brokerctl.bench"
+	if fs.NArg() == 1 {
+		subject = fs.Arg(0)
+	}
+	if *messages <= 0 || *concurrency <= 0 {
+		return fmt.Errorf("-messages and -concurrency must be positive")
+	}
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var receiver *benchReceiver
+	if *subscribe {
+		receiver, err = c.openReceiver(ctx, rpc, subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	body := strings.Repeat("x", *size)
+	result := benchResult{Subject: subject}
+	var (
+		next    atomic.Int64
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		publish []time.Duration
+	)
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			var errors int
+			var firstError error
+			for next.Add(1) <= int64(*messages) && ctx.Err() == nil {
+				sent := time.Now()
+				callCtx, callCancel := context.WithTimeout(ctx, c.timeout)
+				_, err := rpc.Publish(callCtx, &pb.PublishRequest{
+					Subject:           subject,
+					Body:              body,
+					ExpirationSeconds: int32(expiration.Seconds()),
+					Headers:           map[string]string{headerSent: strconv.FormatInt(sent.UnixNano(), 10)},
+				})
+				callCancel()
+				if err != nil {
+					errors++
+					if firstError == nil {
+						firstError = describe(err)
+					}
+					continue
+				}
+				local = append(local, time.Since(sent))
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			publish = append(publish, local...)
+			result.Errors += errors
+			if firstError != nil && result.FirstError == "" {
+				result.FirstError = firstError.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result.Published = len(publish)
+	result.Seconds = elapsed.Seconds()
+	result.Rate = float64(result.Published) / elapsed.Seconds()
+	result.Publish = summarize(publish)
+	if receiver != nil {
+		delivery := receiver.wait(result.Published, *wait)
+		result.Delivered = len(delivery)
+		summary := summarize(delivery)
+		result.Delivery = &summary
+	}
+
+	return c.emit(result, func(w io.Writer) {
+		fmt.Fprintf(w, "published %d messages to %q in %s, %.0f msg/s, %d errors\n",
+			result.Published, subject, elapsed.Round(time.Millisecond), result.Rate, result.Errors)
+		if result.FirstError != "" {
+			fmt.Fprintf(w, "first error: %s\n", result.FirstError)
+		}
+		fmt.Fprintf(w, "publish latency:  %s\n", result.Publish)
+		if result.Delivery != nil {
+			fmt.Fprintf(w, "delivered %d of %d messages\n", result.Delivered, result.Published)
+			fmt.Fprintf(w, "delivery latency: %s\n", result.Delivery)
+		}
+	})
+}
+
+// benchReceiver records the delivery latency of the bench messages
+type benchReceiver struct {
+	lock     sync.Mutex
+	delivery []time.Duration
+	updated  chan struct{}
+	done     chan struct{}
+}
+
+// openReceiver subscribes to subject and publishes probes until one of
+// them arrives, so no bench message is published before the
+// subscription is in place.
+func (c *cli) openReceiver(ctx context.Context, rpc pb.BrokerClient, subject string) (*benchReceiver, error) {
+	stream, err := rpc.Subscribe(ctx, &pb.SubscribeRequest{Subject: subject})
+	if err != nil {
+		return nil, describe(err)
+	}
+	r := &benchReceiver{updated: make(chan struct{}, 1), done: make(chan struct{})}
+	opened := make(chan struct{})
+	go func() {
+		defer close(r.done)
+		probed := false
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if msg.Headers[headerProbe] != "" {
+				if !probed {
+					probed = true
+					close(opened)
+				}
+				continue
+			}
+			sent, err := strconv.ParseInt(msg.Headers[headerSent], 10, 64)
+			if err != nil {
+				continue
+			}
+			r.lock.Lock()
+			r.delivery = append(r.delivery, time.Since(time.Unix(0, sent)))
+			r.lock.Unlock()
+			select {
+			case r.updated <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	deadline := time.After(c.timeout)
+	for {
+		_, err := rpc.Publish(ctx, &pb.PublishRequest{Subject: subject, Headers: map[string]string{headerProbe: "1"}})
+		if err != nil {
+			return nil, describe(err)
+		}
+		select {
+		case <-opened:
+			return r, nil
+		case <-r.done:
+			return nil, fmt.Errorf("subscription to %q ended", subject)
+		case <-deadline:
+			return nil, fmt.Errorf("subscription to %q did not open in %s", subject, c.timeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// wait returns the delivery latencies once count messages arrived, or
+// when none arrived for idle
+func (r *benchReceiver) wait(count int, idle time.Duration) []time.Duration {
+	for {
+		r.lock.Lock()
+		received := len(r.delivery)
+		r.lock.Unlock()
+		if received >= count {
+			break
+		}
+		select {
+		case <-r.updated:
+			continue
+		case <-r.done:
+		case <-time.After(idle):
+		}
+		break
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.delivery)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	pb "therealbroker/api/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// message is the json output of pub, sub and fetch
+type message struct {
+	Subject string            `json:"subject"`
+	Id      string            `json:"id,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (c *cli) pub(ctx context.Context, args []string) error {
+	fs := c.flags("pub", "<subject> [body]")
+	file := fs.String("file", "", "read the body from a file, - for stdin")
+	expiration := fs.Duration("expiration", 0, "how long the message stays fetchable, 0 to not store it")
+	lines := fs.Bool("lines", false, "publish every line of the input as its own message")
+	durability := fs.String("durability", "", "sync, async or none, the level of the broker when empty; only sync prints ids")
+	headers := headerFlag{}
+	fs.Var(headers, "header", "key=value header, repeatable")
+	if err := c.parse(fs, args, 1, 2); err != nil {
+		return err
+	}
+	subject := fs.Arg(0)
+
+	var input io.Reader
+	switch {
+	case fs.NArg() == 2:
+		if *file != "" {
+			return fmt.Errorf("pass either a body or -file")
+		}
+		input = strings.NewReader(fs.Arg(1))
+	case *file != "" && *file != "-":
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	default:
+		input = c.stdin
+	}
+
+	var bodies []string
+	if *lines {
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			bodies = append(bodies, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else {
+		content, err := io.ReadAll(input)
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, string(content))
+	}
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, body := range bodies {
+		callCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		resp, err := rpc.Publish(callCtx, &pb.PublishRequest{
+			Subject:           subject,
+			Body:              body,
+			ExpirationSeconds: int32(expiration.Seconds()),
+			Headers:           headers,
+			Durability:        *durability,
+		})
+		cancel()
+		if err != nil {
+			return describe(err)
+		}
+		err = c.emit(message{Subject: subject, Id: resp.Id}, func(w io.Writer) {
+			if resp.Id != "" {
+				fmt.Fprintln(w, resp.Id)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) sub(ctx context.Context, args []string) error {
+	fs := c.flags("sub", "<subject>")
+	count := fs.Int("count", 0, "exit after this many messages, 0 to run until interrupted")
+	showHeaders := fs.Bool("headers", false, "print the headers before every body in text output")
+	expression := fs.String("filter", "", `only get matching messages, e.g. 'header.region == "eu" && body.amount > 100'`)
+	if err := c.parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	subject := fs.Arg(0)
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := rpc.Subscribe(ctx, &pb.SubscribeRequest{Subject: subject, Filter: *expression})
+	if err != nil {
+		return describe(err)
+	}
+	for received := 0; *count == 0 || received < *count; received++ {
+		msg, err := stream.Recv()
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return describe(err)
+		}
+		err = c.emit(message{Subject: subject, Body: msg.Body, Headers: msg.Headers}, func(w io.Writer) {
+			if *showHeaders {
+				for k, v := range msg.Headers {
+					fmt.Fprintf(w, "%s: %s\n", k, v)
+				}
+			}
+			fmt.Fprintln(w, msg.Body)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) fetch(ctx context.Context, args []string) error {
+	fs := c.flags("fetch", "<subject> <id>")
+	if err := c.parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	subject, id := fs.Arg(0), fs.Arg(1)
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	msg, err := rpc.Fetch(ctx, &pb.FetchRequest{Subject: subject, Id: id})
+	if err != nil {
+		return describe(err)
+	}
+	return c.emit(message{Subject: subject, Id: id, Body: msg.Body, Headers: msg.Headers}, func(w io.Writer) {
+		fmt.Fprintln(w, msg.Body)
+	})
+}
+
+// storedMessage is a message in the json output of list
+type storedMessage struct {
+	Id          string            `json:"id"`
+	Sequence    uint64            `json:"sequence"`
+	Body        string            `json:"body,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	PublishedAt time.Time         `json:"published_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	Size        int32             `json:"size"`
+}
+
+type messagePage struct {
+	Subject    string          `json:"subject"`
+	Messages   []storedMessage `json:"messages"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	fs := c.flags("list", "<subject>")
+	req := &pb.RangeRequest{}
+	limit := fs.Int("limit", 0, "messages in the page, 100 when 0")
+	fs.StringVar(&req.Cursor, "cursor", "", "next cursor printed by the previous page")
+	fs.StringVar(&req.StartId, "start-id", "", "start at the message with this id")
+	fs.Uint64Var(&req.StartSequence, "start-seq", 0, "start at the message with this sequence")
+	fs.Func("since", "only messages published at or after this RFC 3339 time", timeFlag(&req.SinceMs))
+	fs.Func("until", "only messages published before this RFC 3339 time", timeFlag(&req.UntilMs))
+	fs.BoolVar(&req.Reverse, "reverse", false, "newest messages first")
+	bodies := fs.Bool("bodies", false, "print the bodies too")
+	if err := c.parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	req.Subject = fs.Arg(0)
+	req.Limit = int32(*limit)
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	call := rpc.ListMessages
+	if *bodies {
+		call = rpc.FetchRange
+	}
+	resp, err := call(ctx, req)
+	if err != nil {
+		return describe(err)
+	}
+
+	out := messagePage{Subject: req.Subject, Messages: []storedMessage{}, NextCursor: resp.NextCursor}
+	for _, msg := range resp.Messages {
+		out.Messages = append(out.Messages, storedMessage{
+			Id:          msg.Id,
+			Sequence:    msg.Sequence,
+			Body:        msg.Body,
+			Headers:     msg.Headers,
+			PublishedAt: time.UnixMilli(msg.PublishedAtMs).UTC(),
+			ExpiresAt:   time.UnixMilli(msg.ExpiresAtMs).UTC(),
+			Size:        msg.Size,
+		})
+	}
+	return c.emit(out, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		header := "SEQ\tID\tPUBLISHED\tEXPIRES\tSIZE"
+		if *bodies {
+			header += "\tBODY"
+		}
+		fmt.Fprintln(tw, header)
+		for _, msg := range out.Messages {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d", msg.Sequence, msg.Id, msg.PublishedAt.Format(time.RFC3339), msg.ExpiresAt.Format(time.RFC3339), msg.Size)
+			if *bodies {
+				fmt.Fprintf(tw, "\t%s", msg.Body)
+			}
+			fmt.Fprintln(tw)
+		}
+		tw.Flush()
+		if out.NextCursor != "" {
+			fmt.Fprintf(w, "\nnext cursor: %s\n", out.NextCursor)
+		}
+	})
+}
+
+// timeFlag parses an RFC 3339 flag into unix milliseconds
+func timeFlag(ms *int64) func(string) error {
+	return func(value string) error {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		*ms = t.UnixMilli()
+		return nil
+	}
+}
+
+type subjectStats struct {
+	Subject     string `json:"subject"`
+	Subscribers int32  `json:"subscribers"`
+	QueueDepth  int32  `json:"queue_depth"`
+}
+
+type stats struct {
+	Backend       string         `json:"backend"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	Subjects      []subjectStats `json:"subjects"`
+}
+
+func (c *cli) stats(ctx context.Context, args []string) error {
+	fs := c.flags("stats", "")
+	if err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	rpc, conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := rpc.Stats(ctx, &pb.StatsRequest{})
+	if err != nil {
+		return describe(err)
+	}
+
+	out := stats{Backend: resp.Backend, UptimeSeconds: resp.UptimeSeconds, Subjects: []subjectStats{}}
+	for _, s := range resp.Subjects {
+		out.Subjects = append(out.Subjects, subjectStats{Subject: s.Subject, Subscribers: s.Subscribers, QueueDepth: s.QueueDepth})
+	}
+	return c.emit(out, func(w io.Writer) {
+		fmt.Fprintf(w, "backend: %s\nuptime:  %s\n\n", out.Backend, time.Duration(out.UptimeSeconds)*time.Second)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SUBJECT\tSUBSCRIBERS\tQUEUE DEPTH")
+		for _, s := range out.Subjects {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", s.Subject, s.Subscribers, s.QueueDepth)
+		}
+		tw.Flush()
+	})
+}
+
+// describe turns a grpc status into a short error for the terminal
+func describe(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if s.Code() == codes.Unavailable {
+		return fmt.Errorf("broker unavailable: %s", s.Message())
+	}
+	return fmt.Errorf("%s: %s", strings.ToLower(s.Code().String()), s.Message())
+}
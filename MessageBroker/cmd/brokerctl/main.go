@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"therealbroker/api/certs"
+	pb "therealbroker/api/proto"
+	"therealbroker/pkg/client"
+)
+
+const usage = `brokerctl talks to a broker from the shell.
+
+Usage:
+  brokerctl <command> [flags] [arguments]
+
+Commands:
+  pub    <subject> [body]     publish a body, a file or stdin
+  sub    <subject>            print the messages published on subject
+  fetch  <subject> <id>       print a stored message
+  list   <subject>            page through the stored messages of subject
+  stats                       list the subjects with subscribers
+  schema <action> [pattern]   list, get, register, check or delete schemas
+  bench  [subject]            measure publish and delivery latency
+
+Run 'brokerctl <command> -h' for the flags of a command.
+`
+
+// errUsage is returned after the usage of a command has been printed
+var errUsage = errors.New("usage")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "brokerctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	commands := map[string]func(context.Context, []string) error{
+		"pub":    c.pub,
+		"sub":    c.sub,
+		"fetch":  c.fetch,
+		"list":   c.list,
+		"stats":  c.stats,
+		"schema": c.schema,
+		"bench":  c.bench,
+	}
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "-help" {
+			fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		}
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	return command(ctx, args[1:])
+}
+
+// cli holds the flags every command shares
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	address    string
+	token      string
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	useTLS     bool
+	// sends the token without tls
+	insecureToken bool
+	timeout       time.Duration
+	output        string
+}
+
+// flags returns the flag set of a command with the connection and output
+// flags registered. Address and token default to BROKER_ADDRESS and
+// BROKER_TOKEN.
+func (c *cli) flags(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: brokerctl %s [flags] %s\n\nFlags:\n", name, arguments)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&c.address, "address", envOr("BROKER_ADDRESS", "localhost:50051"), "host:port of the broker grpc api")
+	fs.StringVar(&c.token, "token", os.Getenv("BROKER_TOKEN"), "bearer token, an api key or a jwt")
+	fs.BoolVar(&c.useTLS, "tls", false, "connect over tls, implied by -ca")
+	fs.BoolVar(&c.insecureToken, "insecure-token", false, "send the token over a plaintext connection")
+	fs.StringVar(&c.caFile, "ca", "", "ca certificate of the broker, system roots when empty")
+	fs.StringVar(&c.certFile, "cert", "", "client certificate for mutual tls")
+	fs.StringVar(&c.keyFile, "key", "", "key of the client certificate")
+	fs.StringVar(&c.serverName, "server-name", "", "name expected in the broker certificate")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "timeout of unary calls")
+	fs.StringVar(&c.output, "output", "text", "output format, text or json")
+	return fs
+}
+
+// parse parses the flags of a command and checks the number of
+// positional arguments is between min and max.
+func (c *cli) parse(fs *flag.FlagSet, args []string, min, max int) error {
+	// the flag set already printed the problem and the usage
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		return errUsage
+	}
+	if c.output != "text" && c.output != "json" {
+		return fmt.Errorf("unknown output %q, want text or json", c.output)
+	}
+	return nil
+}
+
+// connect dials the broker with the connection flags
+func (c *cli) connect() (pb.BrokerClient, io.Closer, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.RPC(), conn, nil
+}
+
+func (c *cli) dial() (*client.Client, error) {
+	options := client.Options{Address: c.address, Token: c.token, InsecureToken: c.insecureToken}
+	if c.useTLS || c.caFile != "" || c.certFile != "" {
+		tlsConfig, err := certs.ClientConfig(c.caFile, c.certFile, c.keyFile, c.serverName)
+		if err != nil {
+			return nil, err
+		}
+		options.TLS = tlsConfig
+	}
+	return client.New(options)
+}
+
+// emit writes v as a line of json, or calls text with the output
+func (c *cli) emit(v any, text func(w io.Writer)) error {
+	if c.output == "json" {
+		return json.NewEncoder(c.stdout).Encode(v)
+	}
+	text(c.stdout)
+	return nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// headerFlag collects repeated -header key=value flags
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	pairs := make([]string, 0, len(h))
+	for k, v := range h {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("header %q is not key=value", value)
+	}
+	h[k] = v
+	return nil
+}
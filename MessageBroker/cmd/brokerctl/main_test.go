@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	pb "therealbroker/api/proto"
+	"therealbroker/api/server"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/schema"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func startBroker(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBrokerServer(grpcServer, server.NewServer(datacontrol.NewDataMemory()))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
+
+// startSchemaBroker serves a broker that checks bodies against a schema
+// registry, and the registry admin api
+func startSchemaBroker(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	data := datacontrol.NewDataMemory()
+	module := bm.NewModule(data)
+	registry, err := schema.Open("")
+	assert.Nil(t, err)
+	module.(*bm.Module).SetValidator(registry.Validate)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBrokerServer(grpcServer, server.NewServerWithBroker(module, data))
+	pb.RegisterSchemaRegistryServer(grpcServer, server.NewSchemaServer(registry))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
+
+// brokerctl runs a command against address and returns its output
+func brokerctl(t *testing.T, address, stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{args[0], "-address", address}, args[1:]...)
+	err := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestPubShouldReadStdinAndFetchShouldPrintIt(t *testing.T) {
+	address := startBroker(t)
+
+	out, err := brokerctl(t, address, "from stdin", "pub", "-expiration", "1m", "-header", "k=v", "orders")
+	assert.Nil(t, err)
+	id := strings.TrimSpace(out)
+
+	out, err = brokerctl(t, address, "", "fetch", "-output", "json", "orders", id)
+	assert.Nil(t, err)
+	var msg message
+	assert.Nil(t, json.Unmarshal([]byte(out), &msg))
+	assert.Equal(t, "from stdin", msg.Body)
+	assert.Equal(t, "v", msg.Headers["k"])
+
+	_, err = brokerctl(t, address, "", "fetch", "orders", "missing")
+	assert.ErrorContains(t, err, "invalidargument")
+}
+
+func TestPubLinesShouldPublishEveryLine(t *testing.T) {
+	address := startBroker(t)
+
+	out, err := brokerctl(t, address, "a\nb\nc\n", "pub", "-lines", "-expiration", "1m", "orders")
+	assert.Nil(t, err)
+	ids := strings.Fields(out)
+	assert.Len(t, ids, 3)
+
+	out, err = brokerctl(t, address, "", "fetch", "orders", ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, "c\n", out)
+}
+
+func TestListShouldPageThroughStoredMessages(t *testing.T) {
+	address := startBroker(t)
+	_, err := brokerctl(t, address, "a\nb\nc\n", "pub", "-lines", "-expiration", "1m", "orders")
+	assert.Nil(t, err)
+
+	out, err := brokerctl(t, address, "", "list", "-output", "json", "-limit", "2", "-bodies", "orders")
+	assert.Nil(t, err)
+	var page messagePage
+	assert.Nil(t, json.Unmarshal([]byte(out), &page))
+	assert.Len(t, page.Messages, 2)
+	assert.Equal(t, "a", page.Messages[0].Body)
+	assert.Equal(t, uint64(2), page.Messages[1].Sequence)
+	assert.NotEmpty(t, page.NextCursor)
+
+	out, err = brokerctl(t, address, "", "list", "-cursor", page.NextCursor, "orders")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "SEQ")
+	assert.Contains(t, out, "\n3 ")
+	assert.NotContains(t, out, "next cursor")
+
+	_, err = brokerctl(t, address, "", "list", "-cursor", "nope", "orders")
+	assert.ErrorContains(t, err, "invalidargument: invalid message range")
+}
+
+func TestSubShouldStopAfterCount(t *testing.T) {
+	address := startBroker(t)
+
+	done := make(chan string)
+	go func() {
+		out, err := brokerctl(t, address, "", "sub", "-count", "1", "orders")
+		assert.Nil(t, err)
+		done <- out
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		_, err := brokerctl(t, address, "", "pub", "orders", "hello")
+		assert.Nil(t, err)
+		select {
+		case out := <-done:
+			assert.Equal(t, "hello\n", out)
+			return
+		case <-deadline:
+			t.Fatal("sub did not receive a message")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestSubFilterShouldSkipOtherMessages(t *testing.T) {
+	address := startBroker(t)
+	_, err := brokerctl(t, address, "", "sub", "-filter", "body.amount >", "orders")
+	assert.ErrorContains(t, err, "invalidargument: invalid filter")
+
+	done := make(chan string)
+	go func() {
+		out, err := brokerctl(t, address, "", "sub", "-count", "1", "-filter", "body.amount > 100", "orders")
+		assert.Nil(t, err)
+		done <- out
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		for _, body := range []string{`{"amount": 5}`, `{"amount": 500}`} {
+			_, err := brokerctl(t, address, "", "pub", "orders", body)
+			assert.Nil(t, err)
+		}
+		select {
+		case out := <-done:
+			assert.Equal(t, "{\"amount\": 500}\n", out)
+			return
+		case <-deadline:
+			t.Fatal("sub did not receive a message")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestStatsShouldListSubscribedSubjects(t *testing.T) {
+	address := startBroker(t)
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = pb.NewBrokerClient(conn).Subscribe(ctx, &pb.SubscribeRequest{Subject: "orders"})
+	assert.Nil(t, err)
+
+	var got stats
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got.Subjects) == 0 && time.Now().Before(deadline) {
+		out, err := brokerctl(t, address, "", "stats", "-output", "json")
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal([]byte(out), &got))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "memory", got.Backend)
+	assert.Equal(t, []subjectStats{{Subject: "orders", Subscribers: 1}}, got.Subjects)
+}
+
+func TestBenchShouldReportDeliveries(t *testing.T) {
+	address := startBroker(t)
+
+	out, err := brokerctl(t, address, "", "bench", "-output", "json", "-messages", "200", "-concurrency", "4")
+	assert.Nil(t, err)
+	var result benchResult
+	assert.Nil(t, json.Unmarshal([]byte(out), &result))
+	assert.Equal(t, 200, result.Published)
+	assert.Equal(t, 200, result.Delivered)
+	assert.Zero(t, result.Errors)
+}
+
+func TestSchemaShouldRejectInvalidPublishes(t *testing.T) {
+	address := startSchemaBroker(t)
+	definition := `{"type": "object", "required": ["id"]}`
+
+	out, err := brokerctl(t, address, definition, "schema", "-file", "-", "register", "orders.*")
+	assert.Nil(t, err)
+	assert.Equal(t, "orders.* version 1\n", out)
+
+	_, err = brokerctl(t, address, "", "pub", "orders.eu", `{"amount": 3}`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalidargument: message does not match the schema")
+
+	out, err = brokerctl(t, address, "", "pub", "-expiration", "1m", "orders.eu", `{"id": "a1"}`)
+	assert.Nil(t, err)
+	out, err = brokerctl(t, address, "", "fetch", "-output", "json", "orders.eu", strings.TrimSpace(out))
+	assert.Nil(t, err)
+	var fetched message
+	assert.Nil(t, json.Unmarshal([]byte(out), &fetched))
+	assert.Equal(t, "1", fetched.Headers[schema.HeaderVersion])
+
+	out, err = brokerctl(t, address, `{"type": "object", "required": ["id", "currency"]}`, "schema", "-file", "-", "check", "orders.*")
+	assert.ErrorIs(t, err, errIncompatible)
+	assert.Contains(t, out, `property "currency" became required`)
+
+	out, err = brokerctl(t, address, "", "schema", "-output", "json", "list")
+	assert.Nil(t, err)
+	var list []schemaInfo
+	assert.Nil(t, json.Unmarshal([]byte(out), &list))
+	assert.Equal(t, []schemaInfo{{Subject: "orders.*", Version: 1, Type: "json", Compatibility: "backward", Definition: definition}}, list)
+
+	out, err = brokerctl(t, address, "", "schema", "delete", "orders.*")
+	assert.Nil(t, err)
+	assert.Equal(t, "deleted 1 versions of orders.*\n", out)
+	_, err = brokerctl(t, address, "", "schema", "get", "orders.*")
+	assert.Contains(t, err.Error(), "notfound")
+}
+
+func TestUnknownCommandShouldPrintUsage(t *testing.T) {
+	var stderr bytes.Buffer
+	err := run(context.Background(), []string{"publish"}, nil, &bytes.Buffer{}, &stderr)
+	assert.ErrorIs(t, err, errUsage)
+	assert.Contains(t, stderr.String(), "Commands:")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	pb "therealbroker/api/proto"
+)
+
+// schemaInfo is the json output of the schema command
+type schemaInfo struct {
+	Subject       string `json:"subject"`
+	Version       int32  `json:"version"`
+	Type          string `json:"type"`
+	Compatibility string `json:"compatibility"`
+	Definition    string `json:"definition,omitempty"`
+	MessageType   string `json:"message_type,omitempty"`
+}
+
+func newSchemaInfo(s *pb.Schema) schemaInfo {
+	return schemaInfo{
+		Subject:       s.Subject,
+		Version:       s.Version,
+		Type:          s.Type,
+		Compatibility: s.Compatibility,
+		Definition:    s.Definition,
+		MessageType:   s.MessageType,
+	}
+}
+
+type compatibility struct {
+	Compatible bool     `json:"compatible"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// errIncompatible makes check exit with an error, for scripts
+var errIncompatible = errors.New("schema is not compatible")
+
+func (c *cli) schema(ctx context.Context, args []string) error {
+	fs := c.flags("schema", "<list|get|register|check|delete> [pattern]")
+	kind := fs.String("type", "json", "json or protobuf, for register and check")
+	file := fs.String("file", "", "JSON Schema document or protobuf descriptor set, - for stdin")
+	messageType := fs.String("message", "", "full name of the protobuf message")
+	mode := fs.String("compatibility", "", "backward, forward, full or none, the current one when empty")
+	version := fs.Int("version", 0, "version to get, the latest when 0")
+	if err := c.parse(fs, args, 1, 2); err != nil {
+		return err
+	}
+	action, pattern := fs.Arg(0), fs.Arg(1)
+	if (action == "list") != (pattern == "") {
+		fs.Usage()
+		return errUsage
+	}
+
+	var req *pb.RegisterSchemaRequest
+	if action == "register" || action == "check" {
+		if *file == "" {
+			return fmt.Errorf("%s needs -file", action)
+		}
+		content, err := c.readFile(*file)
+		if err != nil {
+			return err
+		}
+		req = &pb.RegisterSchemaRequest{Subject: pattern, Type: *kind, MessageType: *messageType, Compatibility: *mode}
+		if *kind == "protobuf" {
+			req.DescriptorSet = content
+		} else {
+			req.Definition = string(content)
+		}
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rpc := conn.Schemas()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	switch action {
+	case "list":
+		resp, err := rpc.ListSchemas(ctx, &pb.ListSchemasRequest{})
+		if err != nil {
+			return describe(err)
+		}
+		list := []schemaInfo{}
+		for _, s := range resp.Schemas {
+			list = append(list, newSchemaInfo(s))
+		}
+		return c.emit(list, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "SUBJECT\tVERSION\tTYPE\tCOMPATIBILITY")
+			for _, s := range list {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", s.Subject, s.Version, s.Type, s.Compatibility)
+			}
+			tw.Flush()
+		})
+
+	case "get":
+		s, err := rpc.GetSchema(ctx, &pb.GetSchemaRequest{Subject: pattern, Version: int32(*version)})
+		if err != nil {
+			return describe(err)
+		}
+		return c.emit(newSchemaInfo(s), func(w io.Writer) {
+			if s.Type == "protobuf" {
+				fmt.Fprintf(w, "%s version %d: protobuf message %s\n", s.Subject, s.Version, s.MessageType)
+				return
+			}
+			fmt.Fprintln(w, s.Definition)
+		})
+
+	case "register":
+		s, err := rpc.RegisterSchema(ctx, req)
+		if err != nil {
+			return describe(err)
+		}
+		return c.emit(newSchemaInfo(s), func(w io.Writer) {
+			fmt.Fprintf(w, "%s version %d\n", s.Subject, s.Version)
+		})
+
+	case "check":
+		resp, err := rpc.CheckCompatibility(ctx, req)
+		if err != nil {
+			return describe(err)
+		}
+		err = c.emit(compatibility{Compatible: resp.Compatible, Problems: resp.Problems}, func(w io.Writer) {
+			if resp.Compatible {
+				fmt.Fprintln(w, "compatible")
+			}
+			for _, problem := range resp.Problems {
+				fmt.Fprintln(w, problem)
+			}
+		})
+		if err == nil && !resp.Compatible {
+			return errIncompatible
+		}
+		return err
+
+	case "delete":
+		resp, err := rpc.DeleteSchema(ctx, &pb.DeleteSchemaRequest{Subject: pattern})
+		if err != nil {
+			return describe(err)
+		}
+		return c.emit(map[string]int32{"versions": resp.Versions}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted %d versions of %s\n", resp.Versions, pattern)
+		})
+	}
+	fs.Usage()
+	return errUsage
+}
+
+// readFile reads path, or stdin for -
+func (c *cli) readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(c.stdin)
+	}
+	return os.ReadFile(path)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"therealbroker/api/certs"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/loadgen"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/client"
+)
+
+// loadgen puts load on a broker and writes a json report, e.g.
+//
+//	loadgen -address localhost:50051 -publishers 8 -rate 20000 -duration 1m -report report.json
+//
+// Without -address the load goes to a broker embedded in this process.
+func main() {
+	config := loadgen.DefaultConfig()
+	address := flag.String("address", "", "host:port of the broker, an in process broker when empty")
+	token := flag.String("token", os.Getenv("BROKER_TOKEN"), "bearer token of the remote broker")
+	insecureToken := flag.Bool("insecure-token", false, "send the token over a plaintext connection")
+	caFile := flag.String("ca", "", "ca certificate of the remote broker, enables tls")
+	certFile := flag.String("cert", "", "client certificate for mutual tls")
+	keyFile := flag.String("key", "", "key of the client certificate")
+	serverName := flag.String("server-name", "", "name expected in the broker certificate")
+	compression := flag.String("compression", "", "gzip, snappy or zstd compression of the calls to the remote broker")
+	bufferSize := flag.Int("buffer-size", bm.DefaultBufferSize, "subscriber buffer of the in process broker")
+	sizes := flag.String("sizes", "128", "comma separated payload sizes in bytes")
+	reportPath := flag.String("report", "-", "file of the json report, - for stdout")
+	flag.IntVar(&config.Publishers, "publishers", config.Publishers, "concurrent publishers")
+	flag.IntVar(&config.Subscribers, "subscribers", config.Subscribers, "subscribers per subject")
+	flag.IntVar(&config.Subjects, "subjects", config.Subjects, "number of subjects")
+	flag.StringVar(&config.SubjectPrefix, "subject-prefix", config.SubjectPrefix, "prefix of the subject names")
+	flag.IntVar(&config.Rate, "rate", config.Rate, "publishes per second over all publishers, 0 for unlimited")
+	flag.DurationVar(&config.Duration, "duration", config.Duration, "how long to publish")
+	flag.DurationVar(&config.Expiration, "expiration", config.Expiration, "expiration of the messages, 0 to not store them")
+	flag.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "how long to wait for missing deliveries")
+	flag.DurationVar(&config.PublishTimeout, "publish-timeout", config.PublishTimeout, "timeout of a publish")
+	flag.Parse()
+
+	var err error
+	if config.PayloadSizes, err = loadgen.ParseSizes(*sizes); err != nil {
+		fail(err)
+	}
+
+	var target broker.Broker
+	name := "in-process"
+	if *address == "" {
+		target = bm.NewModuleWithBufferSize(datacontrol.NewDataMemory(), *bufferSize)
+	} else {
+		options := client.Options{Address: *address, Token: *token, InsecureToken: *insecureToken, Compression: *compression}
+		if *caFile != "" {
+			if options.TLS, err = certs.ClientConfig(*caFile, *certFile, *keyFile, *serverName); err != nil {
+				fail(err)
+			}
+		}
+		if target, err = client.New(options); err != nil {
+			fail(err)
+		}
+		name = *address
+	}
+	defer target.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := loadgen.Run(ctx, target, config)
+	report.Target = name
+	if err != nil && ctx.Err() == nil {
+		fail(err)
+	}
+	fmt.Fprint(os.Stderr, report)
+	if err := report.WriteFile(*reportPath); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "loadgen:", err)
+	os.Exit(1)
+}
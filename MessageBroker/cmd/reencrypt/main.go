@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"therealbroker/config"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/keyring"
+	"therealbroker/internal/logging"
+)
+
+// store is a backend that can move its bodies to the primary key
+type store interface {
+	Reencrypt(ctx context.Context) (int, error)
+	Close() error
+}
+
+// reencrypt seals every stored body that is not sealed by the primary key
+// of the keyring, plaintext bodies included, with the primary key. It
+// takes the flags, environment and config file of the broker:
+//
+//	reencrypt -config config/broker.yml
+//
+// Reload the brokers with the new keyring first, so they can read the
+// bodies this job rewrites. Interrupting it is safe, a later run picks up
+// the remaining bodies.
+func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error("failed to load configs", "error", err)
+		os.Exit(1)
+	}
+	if _, _, err := logging.Setup(logging.Options{Level: cfg.Log.Level, Format: cfg.Log.Format, Output: os.Stdout}); err != nil {
+		slog.Error("failed to setup logging", "error", err)
+		os.Exit(1)
+	}
+	if !cfg.Encryption.Enabled {
+		slog.Error("encryption is not enabled in the broker config")
+		os.Exit(1)
+	}
+	var keys *keyring.Keyring
+	file, err := keyring.LoadFile(cfg.Encryption.KeyringFile)
+	if err == nil {
+		keys, err = keyring.New(file)
+	}
+	if err != nil {
+		slog.Error("failed to load keyring", "file", cfg.Encryption.KeyringFile, "error", err)
+		os.Exit(1)
+	}
+
+	data, err := connect(cfg, keys)
+	if err != nil {
+		slog.Error("failed to connect to data control", "backend", cfg.DataControl, "error", err)
+		os.Exit(1)
+	}
+	defer data.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.Info("re-encryption started", "backend", cfg.DataControl, "primary_key", keys.Primary())
+	rewritten, err := data.Reencrypt(ctx)
+	if err != nil {
+		slog.Error("re-encryption failed", "rewritten", rewritten, "error", err)
+		data.Close()
+		os.Exit(1)
+	}
+	slog.Info("re-encryption done", "rewritten", rewritten)
+}
+
+// connect opens the backend of the config, with its compression so the
+// rewritten bodies are stored like new ones
+func connect(cfg *config.Config, keys *keyring.Keyring) (store, error) {
+	switch cfg.DataControl {
+	case "postgres":
+		postgres := datacontrol.NewDataPostgres(
+			cfg.Postgres.Host,
+			cfg.Postgres.Port,
+			cfg.Postgres.User,
+			cfg.Postgres.Password,
+			cfg.Postgres.DBName,
+			context.Background())
+		postgres.SetPool(int32(cfg.Postgres.MaxConns), int32(cfg.Postgres.MinConns))
+		postgres.SetCompression(cfg.Compression.Algorithm, cfg.Compression.Threshold)
+		postgres.SetEncryption(keys)
+		return postgres, postgres.Connect()
+	case "scylla":
+		scylla := datacontrol.NewDataScylla(cfg.Scylla.Host, cfg.Scylla.Port, cfg.Scylla.Keyspace, cfg.Scylla.Forget)
+		scylla.SetCompression(cfg.Compression.Algorithm, cfg.Compression.Threshold)
+		scylla.SetEncryption(keys)
+		return scylla, scylla.Connect()
+	}
+	// the memory backend starts empty with the current keyring
+	return nil, fmt.Errorf("data_control %q keeps no bodies to re-encrypt", cfg.DataControl)
+}
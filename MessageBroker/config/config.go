@@ -2,57 +2,775 @@ package config
 
 import (
 	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
-var (
-	DATA_CONTROL    string
-	SCYLLA_HOST     string
-	SCYLLA_PORT     string
-	SCYLLA_KEYSPACE string
-	SCYLLA_FORGET   time.Duration
+type Config struct {
+	GRPCPort    string `yaml:"grpc_port"`
+	DataControl string `yaml:"data_control"`
 
-	POSTGRES_HOST   string
-	POSTGRES_PORT   string
-	POSTGRES_USER   string
-	POSTGRES_PASS   string
-	POSTGRES_DBNAME string
+	Broker   BrokerConfig   `yaml:"broker"`
+	Postgres PostgresConfig `yaml:"postgres"`
+	Scylla   ScyllaConfig   `yaml:"scylla"`
+	// Compression of the bodies stored by postgres and scylla
+	Compression CompressionConfig `yaml:"compression"`
+	// Encryption of the bodies stored by memory, postgres and scylla
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Raft       RaftConfig       `yaml:"raft"`
+	Auth       AuthConfig       `yaml:"auth"`
+	TLS        TLSConfig        `yaml:"tls"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Health     HealthConfig     `yaml:"health"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Log        LogConfig        `yaml:"log"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Cluster    ClusterConfig    `yaml:"cluster"`
+	Gateway    GatewayConfig    `yaml:"gateway"`
+	MQTT       MQTTConfig       `yaml:"mqtt"`
+	RESP       RESPConfig       `yaml:"resp"`
+	// Schemas that published bodies are checked against
+	Schema SchemaConfig `yaml:"schema"`
+}
 
-	GRPC_PORT string
-)
+type BrokerConfig struct {
+	// Messages queued per subscriber before publishes wait for it
+	BufferSize int `yaml:"buffer_size"`
+	// How publishes that do not ask for a level are stored, sync, async
+	// or none
+	Durability string `yaml:"durability"`
+}
+
+type PostgresConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	DBName   string `yaml:"dbname"`
+	MaxConns int    `yaml:"max_conns"`
+	MinConns int    `yaml:"min_conns"`
+	// How often queued publishes are inserted as one batch
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type ScyllaConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Keyspace string `yaml:"keyspace"`
+	// How long expired messages are kept before the ttl removes them
+	Forget time.Duration `yaml:"forget"`
+}
+
+type CompressionConfig struct {
+	// gzip, snappy or zstd, stored bodies are not compressed when empty
+	Algorithm string `yaml:"algorithm"`
+	// Bodies shorter than this many bytes are stored as they are
+	Threshold int `yaml:"threshold"`
+}
+
+type EncryptionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Keys of the envelope encryption, see config/keyring.yml
+	KeyringFile string `yaml:"keyring_file"`
+}
+
+type SchemaConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Where the registry is saved, schemas are lost on restart when empty
+	File string `yaml:"file"`
+}
+
+type RaftConfig struct {
+	// Unique name of the node, defaults to the hostname
+	NodeID string `yaml:"node_id"`
+	// Raft transport address, and the one the other nodes reach it at
+	BindAddress      string `yaml:"bind_address"`
+	AdvertiseAddress string `yaml:"advertise_address"`
+	// Replication grpc service, followers send publishes to the leader
+	RPCBindAddress      string `yaml:"rpc_bind_address"`
+	RPCAdvertiseAddress string `yaml:"rpc_advertise_address"`
+	// id=host:port of every voter of a new cluster, this node included
+	Peers []string `yaml:"peers"`
+	// Log and snapshots directory, in memory when empty
+	Dir               string        `yaml:"dir"`
+	SnapshotThreshold int           `yaml:"snapshot_threshold"`
+	SnapshotInterval  time.Duration `yaml:"snapshot_interval"`
+	// Secret every node sends to the Replication service, not needed
+	// when tls requires client certificates
+	Token string `yaml:"token"`
+}
+
+// RaftPeers splits the id=host:port entries of Peers
+func (c RaftConfig) RaftPeers() (ids, addresses []string, err error) {
+	for _, p := range c.Peers {
+		id, address, ok := strings.Cut(p, "=")
+		if !ok || id == "" || address == "" {
+			return nil, nil, fmt.Errorf("raft peer %q must look like id=host:port", p)
+		}
+		ids = append(ids, id)
+		addresses = append(addresses, address)
+	}
+	return ids, addresses, nil
+}
+
+type AuthConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	PolicyFile string `yaml:"policy_file"`
+	JWTSecret  string `yaml:"jwt_secret"`
+}
+
+type TLSConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// none, optional or require
+	ClientAuth     string        `yaml:"client_auth"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"`
+}
 
-func LoadConfig() error {
-	// Load .env file
-	err := godotenv.Load()
+type HealthConfig struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+type TracingConfig struct {
+	Enabled      bool    `yaml:"enabled"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// json or text
+	Format       string `yaml:"format"`
+	GELFProtocol string `yaml:"gelf_protocol"`
+	GELFAddress  string `yaml:"gelf_address"`
+}
+
+type MetricsConfig struct {
+	Port        string `yaml:"port"`
+	MaxSubjects int    `yaml:"max_subjects"`
+}
+
+type ClusterConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Defaults to the hostname
+	NodeID string `yaml:"node_id"`
+	// Internal port the nodes forward messages on
+	Port string `yaml:"port"`
+	// Static host:port list of the nodes, may include this one
+	Peers []string `yaml:"peers"`
+	// Resolved to the node addresses when set, e.g. a headless service
+	DNSName         string        `yaml:"dns_name"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Messages queued per peer before new ones are dropped
+	QueueSize int `yaml:"queue_size"`
+	// Secret every node sends to the mesh, not needed when tls requires
+	// client certificates
+	Token string `yaml:"token"`
+}
+
+type GatewayConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Port of the HTTP/JSON gateway, served with the tls settings of grpc
+	Port string `yaml:"port"`
+	// Events kept per subject for streams reconnecting with Last-Event-ID
+	ReplaySize int `yaml:"replay_size"`
+	// How long a subject keeps buffering after its last stream ended
+	Retention time.Duration `yaml:"retention"`
+	// Interval of the comments sent on idle streams and websockets
+	KeepAlive time.Duration `yaml:"keepalive"`
+	// Origins allowed to open a websocket, any when empty
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type MQTTConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Port of the MQTT 3.1.1 listener, served with the tls settings of grpc
+	Port string `yaml:"port"`
+	// Expiration of the messages published by mqtt clients, zero keeps them
+	Expiration time.Duration `yaml:"expiration"`
+	// QoS 1 messages sent to a client and not acknowledged yet
+	MaxInflight int `yaml:"max_inflight"`
+	// QoS 1 messages queued per client before new ones are dropped
+	MaxQueued int `yaml:"max_queued"`
+	// How long the session of a disconnected client is kept
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+}
+
+type RESPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Port of the redis pub/sub listener, served with the tls settings of grpc
+	Port string `yaml:"port"`
+	// Expiration of the messages published by redis clients, zero keeps them
+	Expiration time.Duration `yaml:"expiration"`
+}
+
+func Default() *Config {
+	return &Config{
+		GRPCPort:    "50051",
+		DataControl: "memory",
+		Broker:      BrokerConfig{BufferSize: 1000, Durability: "sync"},
+		Postgres: PostgresConfig{
+			Port:          "5432",
+			MaxConns:      5,
+			MinConns:      2,
+			FlushInterval: 100 * time.Millisecond,
+		},
+		Scylla:      ScyllaConfig{Port: "9042", Forget: 10 * time.Second},
+		Compression: CompressionConfig{Threshold: 1024},
+		Raft: RaftConfig{
+			BindAddress:       ":7000",
+			RPCBindAddress:    ":7001",
+			SnapshotThreshold: 8192,
+			SnapshotInterval:  2 * time.Minute,
+		},
+		TLS:     TLSConfig{ClientAuth: "none", ReloadInterval: 10 * time.Second},
+		Health:  HealthConfig{CheckInterval: 5 * time.Second},
+		Tracing: TracingConfig{SampleRatio: 1},
+		Log:     LogConfig{Level: "info", Format: "json", GELFProtocol: "udp"},
+		Metrics: MetricsConfig{Port: "2112", MaxSubjects: 100},
+		Cluster: ClusterConfig{Port: "50052", RefreshInterval: 10 * time.Second, QueueSize: 10000},
+		Gateway: GatewayConfig{Port: "8080", ReplaySize: 1000, Retention: time.Minute, KeepAlive: 15 * time.Second},
+		MQTT:    MQTTConfig{Port: "1883", MaxInflight: 100, MaxQueued: 1000, SessionExpiry: time.Hour},
+		RESP:    RESPConfig{Port: "6379"},
+	}
+}
+
+// .env file read by Load, relative to the working directory
+var dotEnvPath = ".env"
+
+// Load builds the config from, in increasing priority: defaults, the yaml
+// file given by -config or CONFIG_FILE, the .env file if present,
+// environment variables and command line flags. The result is validated.
+// The .env file is read again on every call and never copied into the
+// process environment, so a reload picks up its changes.
+func Load(args []string) (*Config, error) {
+	env, err := readDotEnv(dotEnvPath)
 	if err != nil {
-		return errors.New("failed to load .env file")
+		return nil, err
+	}
+	path := configPath(args, env)
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(env); err != nil {
+		return nil, err
+	}
+	if err := c.loadFlags(args); err != nil {
+		return nil, err
 	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// environment holds the variables of the .env file, under the ones of
+// the process
+type environment map[string]string
+
+// readDotEnv reads the variables of path, none when it does not exist
+func readDotEnv(path string) (environment, error) {
+	env, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return environment{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return env, nil
+}
+
+func (e environment) lookup(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return e[name]
+}
 
-	DATA_CONTROL = os.Getenv("DATA_CONTROL")
-	if DATA_CONTROL == "scylla" {
-		SCYLLA_HOST = os.Getenv("SCYLLA_HOST")
-		SCYLLA_PORT = os.Getenv("SCYLLA_PORT")
-		SCYLLA_KEYSPACE = os.Getenv("SCYLLA_KEYSPACE")
-		forgetSeconds, err := strconv.Atoi(os.Getenv("SCYLLA_FORGET"))
-		if err != nil {
-			return errors.New("failed to convert SCYLLA_FORGET")
+func (c *Config) loadEnv(env environment) error {
+	for _, s := range c.settings() {
+		value := env.lookup(s.env)
+		if value == "" {
+			continue
+		}
+		if err := s.value.Set(value); err != nil {
+			return fmt.Errorf("failed to convert %s: %w", s.env, err)
 		}
-		SCYLLA_FORGET = time.Duration(forgetSeconds * int(time.Second))
 	}
+	return nil
+}
+
+func (c *Config) loadFlags(args []string) error {
+	fs := newFlagSet()
+	for _, s := range c.settings() {
+		fs.Var(s.value, s.flag, s.usage+" (env "+s.env+")")
+	}
+	return fs.Parse(args)
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("therealbroker", flag.ContinueOnError)
+	fs.String("config", "", "path of the yaml config file (env CONFIG_FILE)")
+	return fs
+}
 
-	if DATA_CONTROL == "postgres" {
-		POSTGRES_HOST = os.Getenv("POSTGRES_HOST")
-		POSTGRES_PORT = os.Getenv("POSTGRES_PORT")
-		POSTGRES_USER = os.Getenv("POSTGRES_USER")
-		POSTGRES_PASS = os.Getenv("POSTGRES_PASS")
-		POSTGRES_DBNAME = os.Getenv("POSTGRES_DBNAME")
+// configPath finds -config in args without parsing the other flags,
+// since the file has to be read before them.
+func configPath(args []string, env environment) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
 	}
+	return env.lookup("CONFIG_FILE")
+}
+
+// setting binds a config field to its environment variable and flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"GRPC_PORT", "grpc-port", "port of the grpc server", stringValue{&c.GRPCPort}},
+		{"DATA_CONTROL", "data-control", "storage backend: memory, postgres, scylla or raft", stringValue{&c.DataControl}},
+		{"BROKER_BUFFER_SIZE", "broker-buffer-size", "messages queued per subscriber", intValue{&c.Broker.BufferSize}},
+		{"BROKER_DURABILITY", "broker-durability", "sync, async or none storage of publishes that do not ask for a level", stringValue{&c.Broker.Durability}},
+
+		{"POSTGRES_HOST", "postgres-host", "postgres host", stringValue{&c.Postgres.Host}},
+		{"POSTGRES_PORT", "postgres-port", "postgres port", stringValue{&c.Postgres.Port}},
+		{"POSTGRES_USER", "postgres-user", "postgres user", stringValue{&c.Postgres.User}},
+		{"POSTGRES_PASS", "postgres-pass", "postgres password", stringValue{&c.Postgres.Password}},
+		{"POSTGRES_DBNAME", "postgres-dbname", "postgres database", stringValue{&c.Postgres.DBName}},
+		{"POSTGRES_MAX_CONNS", "postgres-max-conns", "max connections of the postgres pool", intValue{&c.Postgres.MaxConns}},
+		{"POSTGRES_MIN_CONNS", "postgres-min-conns", "min connections of the postgres pool", intValue{&c.Postgres.MinConns}},
+		{"POSTGRES_FLUSH_INTERVAL", "postgres-flush-interval", "interval of postgres batch inserts", durationValue{&c.Postgres.FlushInterval}},
+
+		{"SCYLLA_HOST", "scylla-host", "scylla host", stringValue{&c.Scylla.Host}},
+		{"SCYLLA_PORT", "scylla-port", "scylla port", stringValue{&c.Scylla.Port}},
+		{"SCYLLA_KEYSPACE", "scylla-keyspace", "scylla keyspace", stringValue{&c.Scylla.Keyspace}},
+		{"SCYLLA_FORGET", "scylla-forget", "how long expired messages are kept", durationValue{&c.Scylla.Forget}},
+
+		{"COMPRESSION_ALGORITHM", "compression-algorithm", "gzip, snappy or zstd compression of stored bodies, none when empty", stringValue{&c.Compression.Algorithm}},
+		{"COMPRESSION_THRESHOLD", "compression-threshold", "smallest body in bytes that is compressed", intValue{&c.Compression.Threshold}},
+
+		{"ENCRYPTION_ENABLED", "encryption-enabled", "encrypt stored bodies with the keyring", boolValue{&c.Encryption.Enabled}},
+		{"ENCRYPTION_KEYRING_FILE", "encryption-keyring-file", "keyring yaml file of the stored body encryption", stringValue{&c.Encryption.KeyringFile}},
 
-	GRPC_PORT = os.Getenv("GRPC_PORT")
+		{"SCHEMA_ENABLED", "schema-enabled", "check published bodies against the schema registry", boolValue{&c.Schema.Enabled}},
+		{"SCHEMA_FILE", "schema-file", "json file the schema registry is saved in, memory only when empty", stringValue{&c.Schema.File}},
 
+		{"RAFT_NODE_ID", "raft-node-id", "unique name of this raft node", stringValue{&c.Raft.NodeID}},
+		{"RAFT_BIND_ADDRESS", "raft-bind-address", "raft transport listen address", stringValue{&c.Raft.BindAddress}},
+		{"RAFT_ADVERTISE_ADDRESS", "raft-advertise-address", "raft transport address other nodes use", stringValue{&c.Raft.AdvertiseAddress}},
+		{"RAFT_RPC_BIND_ADDRESS", "raft-rpc-bind-address", "replication grpc listen address", stringValue{&c.Raft.RPCBindAddress}},
+		{"RAFT_RPC_ADVERTISE_ADDRESS", "raft-rpc-advertise-address", "replication grpc address other nodes use", stringValue{&c.Raft.RPCAdvertiseAddress}},
+		{"RAFT_PEERS", "raft-peers", "comma separated id=host:port voters of a new cluster", listValue{&c.Raft.Peers}},
+		{"RAFT_DIR", "raft-dir", "raft log and snapshot directory, in memory when empty", stringValue{&c.Raft.Dir}},
+		{"RAFT_SNAPSHOT_THRESHOLD", "raft-snapshot-threshold", "log entries between snapshots", intValue{&c.Raft.SnapshotThreshold}},
+		{"RAFT_SNAPSHOT_INTERVAL", "raft-snapshot-interval", "how often the snapshot threshold is checked", durationValue{&c.Raft.SnapshotInterval}},
+		{"RAFT_TOKEN", "raft-token", "secret shared by the nodes of the replication service", stringValue{&c.Raft.Token}},
+
+		{"AUTH_ENABLED", "auth-enabled", "require bearer tokens", boolValue{&c.Auth.Enabled}},
+		{"AUTH_POLICY_FILE", "auth-policy-file", "api keys and acl yaml file", stringValue{&c.Auth.PolicyFile}},
+		{"AUTH_JWT_SECRET", "auth-jwt-secret", "hmac secret of accepted jwts", stringValue{&c.Auth.JWTSecret}},
+
+		{"TLS_ENABLED", "tls-enabled", "serve grpc over tls", boolValue{&c.TLS.Enabled}},
+		{"TLS_CERT_FILE", "tls-cert-file", "server certificate", stringValue{&c.TLS.CertFile}},
+		{"TLS_KEY_FILE", "tls-key-file", "server key", stringValue{&c.TLS.KeyFile}},
+		{"TLS_CLIENT_CA_FILE", "tls-client-ca-file", "ca of client certificates", stringValue{&c.TLS.ClientCAFile}},
+		{"TLS_CLIENT_AUTH", "tls-client-auth", "client certificates: none, optional or require", stringValue{&c.TLS.ClientAuth}},
+		{"TLS_RELOAD_SECONDS", "tls-reload-interval", "how often certificate files are checked", durationValue{&c.TLS.ReloadInterval}},
+
+		{"RATE_LIMIT_ENABLED", "rate-limit-enabled", "enforce rate limits and quotas", boolValue{&c.RateLimit.Enabled}},
+		{"RATE_LIMIT_FILE", "rate-limit-file", "rate limits yaml file", stringValue{&c.RateLimit.File}},
+
+		{"HEALTH_CHECK_SECONDS", "health-check-interval", "interval of readiness checks", durationValue{&c.Health.CheckInterval}},
+
+		{"TRACING_ENABLED", "tracing-enabled", "export opentelemetry traces", boolValue{&c.Tracing.Enabled}},
+		{"OTLP_ENDPOINT", "otlp-endpoint", "otlp grpc endpoint of the collector", stringValue{&c.Tracing.OTLPEndpoint}},
+		{"OTLP_INSECURE", "otlp-insecure", "connect to the collector without tls", boolValue{&c.Tracing.OTLPInsecure}},
+		{"TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "ratio of traces sampled", floatValue{&c.Tracing.SampleRatio}},
+
+		{"LOG_LEVEL", "log-level", "debug, info, warn or error", stringValue{&c.Log.Level}},
+		{"LOG_FORMAT", "log-format", "json or text", stringValue{&c.Log.Format}},
+		{"GELF_PROTOCOL", "gelf-protocol", "udp or tcp", stringValue{&c.Log.GELFProtocol}},
+		{"GELF_ADDRESS", "gelf-address", "graylog gelf input, empty to disable", stringValue{&c.Log.GELFAddress}},
+
+		{"METRICS_PORT", "metrics-port", "port of the prometheus metrics server", stringValue{&c.Metrics.Port}},
+		{"METRICS_MAX_SUBJECTS", "metrics-max-subjects", "subjects with their own metric labels", intValue{&c.Metrics.MaxSubjects}},
+
+		{"CLUSTER_ENABLED", "cluster-enabled", "forward publishes to the other broker nodes", boolValue{&c.Cluster.Enabled}},
+		{"CLUSTER_NODE_ID", "cluster-node-id", "unique name of this node", stringValue{&c.Cluster.NodeID}},
+		{"CLUSTER_PORT", "cluster-port", "internal port of the cluster mesh", stringValue{&c.Cluster.Port}},
+		{"CLUSTER_PEERS", "cluster-peers", "comma separated host:port list of the nodes", listValue{&c.Cluster.Peers}},
+		{"CLUSTER_DNS_NAME", "cluster-dns-name", "dns name resolving to every node", stringValue{&c.Cluster.DNSName}},
+		{"CLUSTER_REFRESH_INTERVAL", "cluster-refresh-interval", "how often peers are discovered", durationValue{&c.Cluster.RefreshInterval}},
+		{"CLUSTER_QUEUE_SIZE", "cluster-queue-size", "messages queued per peer", intValue{&c.Cluster.QueueSize}},
+		{"CLUSTER_TOKEN", "cluster-token", "secret shared by the nodes of the mesh", stringValue{&c.Cluster.Token}},
+
+		{"GATEWAY_ENABLED", "gateway-enabled", "serve the http/json gateway", boolValue{&c.Gateway.Enabled}},
+		{"GATEWAY_PORT", "gateway-port", "port of the http/json gateway", stringValue{&c.Gateway.Port}},
+		{"GATEWAY_REPLAY_SIZE", "gateway-replay-size", "events kept per subject for reconnecting streams", intValue{&c.Gateway.ReplaySize}},
+		{"GATEWAY_RETENTION", "gateway-retention", "how long a subject buffers after its last stream", durationValue{&c.Gateway.Retention}},
+		{"GATEWAY_KEEPALIVE", "gateway-keepalive", "interval of keepalives on streams and websockets", durationValue{&c.Gateway.KeepAlive}},
+		{"GATEWAY_ALLOWED_ORIGINS", "gateway-allowed-origins", "comma separated origins allowed to open a websocket", listValue{&c.Gateway.AllowedOrigins}},
+
+		{"MQTT_ENABLED", "mqtt-enabled", "serve mqtt 3.1.1 clients", boolValue{&c.MQTT.Enabled}},
+		{"MQTT_PORT", "mqtt-port", "port of the mqtt listener", stringValue{&c.MQTT.Port}},
+		{"MQTT_EXPIRATION", "mqtt-expiration", "expiration of messages published over mqtt, 0 keeps them", durationValue{&c.MQTT.Expiration}},
+		{"MQTT_MAX_INFLIGHT", "mqtt-max-inflight", "unacknowledged qos 1 messages per client", intValue{&c.MQTT.MaxInflight}},
+		{"MQTT_MAX_QUEUED", "mqtt-max-queued", "qos 1 messages queued per client", intValue{&c.MQTT.MaxQueued}},
+		{"MQTT_SESSION_EXPIRY", "mqtt-session-expiry", "how long sessions of disconnected clients are kept", durationValue{&c.MQTT.SessionExpiry}},
+		{"RESP_ENABLED", "resp-enabled", "serve redis pub/sub clients", boolValue{&c.RESP.Enabled}},
+		{"RESP_PORT", "resp-port", "port of the redis protocol listener", stringValue{&c.RESP.Port}},
+		{"RESP_EXPIRATION", "resp-expiration", "expiration of messages published over resp, 0 keeps them", durationValue{&c.RESP.Expiration}},
+	}
+}
+
+// reloadable settings can change on a running broker, see reloadOnSignal
+// in main
+var reloadable = map[string]bool{
+	"auth-policy-file":        true,
+	"encryption-keyring-file": true,
+	"auth-jwt-secret":         true,
+	"rate-limit-file":         true,
+	"log-level":               true,
+	"metrics-max-subjects":    true,
+}
+
+// RestartRequired lists the settings that differ between c and next and
+// only take effect after a restart.
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	current, updated := c.settings(), next.settings()
+	for i, s := range current {
+		if !reloadable[s.flag] && s.value.String() != updated[i].value.String() {
+			changed = append(changed, s.flag)
+		}
+	}
+	return changed
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(validPort(c.GRPCPort), "grpc_port %q is not a valid port", c.GRPCPort)
+	check(validPort(c.Metrics.Port), "metrics.port %q is not a valid port", c.Metrics.Port)
+	check(c.GRPCPort != c.Metrics.Port, "grpc_port and metrics.port must differ")
+	check(c.Broker.BufferSize > 0, "broker.buffer_size must be positive")
+	switch c.Broker.Durability {
+	case "sync", "async", "none":
+	default:
+		check(false, "broker.durability %q must be sync, async or none", c.Broker.Durability)
+	}
+	check(c.Metrics.MaxSubjects > 0, "metrics.max_subjects must be positive")
+	check(c.Health.CheckInterval > 0, "health.check_interval must be positive")
+
+	switch c.DataControl {
+	case "memory":
+	case "postgres":
+		check(c.Postgres.Host != "", "postgres.host is required")
+		check(validPort(c.Postgres.Port), "postgres.port %q is not a valid port", c.Postgres.Port)
+		check(c.Postgres.User != "", "postgres.user is required")
+		check(c.Postgres.DBName != "", "postgres.dbname is required")
+		check(c.Postgres.MaxConns > 0, "postgres.max_conns must be positive")
+		check(c.Postgres.MinConns >= 0 && c.Postgres.MinConns <= c.Postgres.MaxConns,
+			"postgres.min_conns must be between 0 and max_conns")
+		check(c.Postgres.FlushInterval > 0, "postgres.flush_interval must be positive")
+	case "scylla":
+		check(c.Scylla.Host != "", "scylla.host is required")
+		check(validPort(c.Scylla.Port), "scylla.port %q is not a valid port", c.Scylla.Port)
+		check(c.Scylla.Keyspace != "", "scylla.keyspace is required")
+		check(c.Scylla.Forget >= 0, "scylla.forget must not be negative")
+	case "raft":
+		check(c.Raft.AdvertiseAddress != "", "raft.advertise_address is required")
+		check(c.Raft.RPCAdvertiseAddress != "", "raft.rpc_advertise_address is required")
+		check(c.Raft.BindAddress != "" && c.Raft.RPCBindAddress != "", "raft bind addresses are required")
+		check(c.Raft.SnapshotThreshold > 0, "raft.snapshot_threshold must be positive")
+		check(c.Raft.SnapshotInterval > 0, "raft.snapshot_interval must be positive")
+		check(c.Raft.Token != "" || c.peerCertificates(), "raft needs a token or tls with client_auth require")
+		ids, _, err := c.Raft.RaftPeers()
+		check(err == nil, "%v", err)
+		check(err != nil || len(ids) > 0, "raft.peers is required")
+	default:
+		check(false, "data_control %q must be memory, postgres, scylla or raft", c.DataControl)
+	}
+
+	switch c.Compression.Algorithm {
+	case "", "gzip", "snappy", "zstd":
+	default:
+		check(false, "compression.algorithm %q must be gzip, snappy, zstd or empty", c.Compression.Algorithm)
+	}
+	check(c.Compression.Threshold >= 0, "compression.threshold must not be negative")
+	if c.Encryption.Enabled {
+		check(fileExists(c.Encryption.KeyringFile), "encryption.keyring_file %q does not exist", c.Encryption.KeyringFile)
+		check(c.DataControl != "raft", "encryption is not supported by the raft data_control")
+	}
+	if c.Schema.Enabled && c.Schema.File != "" {
+		check(dirExists(filepath.Dir(c.Schema.File)), "schema.file %q is not in an existing directory", c.Schema.File)
+	}
+
+	if c.Auth.Enabled {
+		check(fileExists(c.Auth.PolicyFile), "auth.policy_file %q does not exist", c.Auth.PolicyFile)
+	}
+	if c.TLS.Enabled {
+		check(fileExists(c.TLS.CertFile), "tls.cert_file %q does not exist", c.TLS.CertFile)
+		check(fileExists(c.TLS.KeyFile), "tls.key_file %q does not exist", c.TLS.KeyFile)
+		check(c.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+		switch c.TLS.ClientAuth {
+		case "none":
+		case "optional", "require":
+			check(fileExists(c.TLS.ClientCAFile), "tls.client_ca_file %q does not exist", c.TLS.ClientCAFile)
+		default:
+			check(false, "tls.client_auth %q must be none, optional or require", c.TLS.ClientAuth)
+		}
+	}
+	if c.RateLimit.Enabled {
+		check(fileExists(c.RateLimit.File), "rate_limit.file %q does not exist", c.RateLimit.File)
+	}
+	if c.Tracing.Enabled {
+		check(c.Tracing.OTLPEndpoint != "", "tracing.otlp_endpoint is required")
+	}
+	if c.Cluster.Enabled {
+		check(validPort(c.Cluster.Port), "cluster.port %q is not a valid port", c.Cluster.Port)
+		check(c.Cluster.Port != c.GRPCPort && c.Cluster.Port != c.Metrics.Port, "cluster.port must differ from the other ports")
+		check(len(c.Cluster.Peers) > 0 || c.Cluster.DNSName != "", "cluster needs peers or a dns_name")
+		check(c.Cluster.RefreshInterval > 0, "cluster.refresh_interval must be positive")
+		check(c.Cluster.QueueSize > 0, "cluster.queue_size must be positive")
+		check(c.Cluster.Token != "" || c.peerCertificates(), "cluster needs a token or tls with client_auth require")
+	}
+	if c.Gateway.Enabled {
+		check(validPort(c.Gateway.Port), "gateway.port %q is not a valid port", c.Gateway.Port)
+		check(c.Gateway.Port != c.GRPCPort && c.Gateway.Port != c.Metrics.Port &&
+			(!c.Cluster.Enabled || c.Gateway.Port != c.Cluster.Port), "gateway.port must differ from the other ports")
+		check(c.Gateway.ReplaySize > 0, "gateway.replay_size must be positive")
+		check(c.Gateway.Retention > 0, "gateway.retention must be positive")
+		check(c.Gateway.KeepAlive > 0, "gateway.keepalive must be positive")
+	}
+	if c.MQTT.Enabled {
+		check(validPort(c.MQTT.Port), "mqtt.port %q is not a valid port", c.MQTT.Port)
+		check(c.MQTT.Port != c.GRPCPort && c.MQTT.Port != c.Metrics.Port &&
+			(!c.Cluster.Enabled || c.MQTT.Port != c.Cluster.Port) &&
+			(!c.Gateway.Enabled || c.MQTT.Port != c.Gateway.Port), "mqtt.port must differ from the other ports")
+		check(c.MQTT.Expiration >= 0, "mqtt.expiration must not be negative")
+		check(c.MQTT.MaxInflight > 0, "mqtt.max_inflight must be positive")
+		check(c.MQTT.MaxQueued > 0, "mqtt.max_queued must be positive")
+		check(c.MQTT.SessionExpiry > 0, "mqtt.session_expiry must be positive")
+	}
+	if c.RESP.Enabled {
+		check(validPort(c.RESP.Port), "resp.port %q is not a valid port", c.RESP.Port)
+		check(c.RESP.Port != c.GRPCPort && c.RESP.Port != c.Metrics.Port &&
+			(!c.Cluster.Enabled || c.RESP.Port != c.Cluster.Port) &&
+			(!c.Gateway.Enabled || c.RESP.Port != c.Gateway.Port) &&
+			(!c.MQTT.Enabled || c.RESP.Port != c.MQTT.Port), "resp.port must differ from the other ports")
+		check(c.RESP.Expiration >= 0, "resp.expiration must not be negative")
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "log.level %q must be debug, info, warn or error", c.Log.Level)
+	check(oneOf(c.Log.Format, "json", "text"), "log.format %q must be json or text", c.Log.Format)
+	check(oneOf(c.Log.GELFProtocol, "udp", "tcp"), "log.gelf_protocol %q must be udp or tcp", c.Log.GELFProtocol)
+
+	return errors.Join(errs...)
+}
+
+// peerCertificates reports whether nodes prove who they are with client
+// certificates, so the services between them need no token
+func (c *Config) peerCertificates() bool {
+	return c.TLS.Enabled && c.TLS.ClientAuth == "require"
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func oneOf(value string, options ...string) bool {
+	for _, o := range options {
+		if value == o {
+			return true
+		}
+	}
+	return false
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+// listValue reads comma separated values
+type listValue struct{ p *[]string }
+
+func (v listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v listValue) Set(s string) error {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*v.p = list
+	return nil
+}
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v.p = i
+	return nil
+}
+
+type floatValue struct{ p *float64 }
+
+func (v floatValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(*v.p, 'g', -1, 64)
+}
+
+func (v floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v.p = f
+	return nil
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.p = b
+	return nil
+}
+
+func (v boolValue) IsBoolFlag() bool {
+	return true
+}
+
+// durationValue accepts go durations like "100ms", and plain numbers as
+// seconds to stay compatible with the old *_SECONDS variables.
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) String() string {
+	if v.p == nil {
+		return "0s"
+	}
+	return v.p.String()
+}
+
+func (v durationValue) Set(s string) error {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		*v.p = time.Duration(seconds) * time.Second
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v.p = d
 	return nil
 }
@@ -0,0 +1,255 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestDefaultsShouldBeValid(t *testing.T) {
+	assert.Nil(t, Default().Validate())
+}
+
+func TestLoadShouldLayerFileEnvAndFlags(t *testing.T) {
+	path := writeFile(t, "broker.yml", `
+grpc_port: "6000"
+broker:
+  buffer_size: 10
+postgres:
+  host: db
+  user: broker
+  dbname: messages
+  flush_interval: 250ms
+log:
+  level: debug
+`)
+	t.Setenv("DATA_CONTROL", "postgres")
+	t.Setenv("GRPC_PORT", "7000")
+	t.Setenv("POSTGRES_MAX_CONNS", "20")
+	t.Setenv("HEALTH_CHECK_SECONDS", "30")
+
+	c, err := Load([]string{"-config", path, "-grpc-port", "8000", "-log-level=warn"})
+	assert.Nil(t, err)
+	assert.Equal(t, "8000", c.GRPCPort)
+	assert.Equal(t, "postgres", c.DataControl)
+	assert.Equal(t, 10, c.Broker.BufferSize)
+	assert.Equal(t, 20, c.Postgres.MaxConns)
+	assert.Equal(t, 2, c.Postgres.MinConns)
+	assert.Equal(t, 250*time.Millisecond, c.Postgres.FlushInterval)
+	assert.Equal(t, 30*time.Second, c.Health.CheckInterval)
+	assert.Equal(t, "warn", c.Log.Level)
+}
+
+func TestLoadShouldPickUpEditedFiles(t *testing.T) {
+	path := writeFile(t, "broker.yml", "metrics:\n  max_subjects: 10\n")
+	dotEnv := writeFile(t, ".env", "LOG_LEVEL=debug\n")
+	defer func(previous string) { dotEnvPath = previous }(dotEnvPath)
+	dotEnvPath = dotEnv
+
+	c, err := Load([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, 10, c.Metrics.MaxSubjects)
+	_, copied := os.LookupEnv("LOG_LEVEL")
+	assert.False(t, copied)
+
+	// as on SIGHUP, see reloadOnSignal in main
+	assert.Nil(t, os.WriteFile(dotEnv, []byte("LOG_LEVEL=warn\n"), 0o600))
+	assert.Nil(t, os.WriteFile(path, []byte("metrics:\n  max_subjects: 20\n"), 0o600))
+	c, err = Load([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", c.Log.Level)
+	assert.Equal(t, 20, c.Metrics.MaxSubjects)
+
+	// the process environment still wins over the file
+	t.Setenv("LOG_LEVEL", "error")
+	c, err = Load([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "error", c.Log.Level)
+}
+
+func TestLoadShouldRejectUnknownFileKeys(t *testing.T) {
+	path := writeFile(t, "broker.yml", "grpc_prot: 6000\n")
+	_, err := Load([]string{"-config", path})
+	assert.NotNil(t, err)
+}
+
+func TestLoadShouldRejectBadValues(t *testing.T) {
+	t.Setenv("BROKER_BUFFER_SIZE", "many")
+	_, err := Load(nil)
+	assert.NotNil(t, err)
+}
+
+func TestValidateShouldReportEveryProblem(t *testing.T) {
+	c := Default()
+	c.DataControl = "mongo"
+	c.GRPCPort = "70000"
+	c.Broker.BufferSize = 0
+	c.Broker.Durability = "eventually"
+	c.Log.Format = "xml"
+	c.Auth.Enabled = true
+	c.Auth.PolicyFile = "missing.yml"
+
+	err := c.Validate()
+	assert.NotNil(t, err)
+	for _, want := range []string{"data_control", "grpc_port", "buffer_size", "broker.durability", "log.format", "auth.policy_file"} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidateShouldRequireBackendSettings(t *testing.T) {
+	c := Default()
+	c.DataControl = "postgres"
+	c.Postgres.MinConns = 10
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "postgres.host")
+	assert.Contains(t, err.Error(), "postgres.min_conns")
+}
+
+func TestRestartRequiredShouldIgnoreReloadableSettings(t *testing.T) {
+	c, next := Default(), Default()
+	next.Log.Level = "debug"
+	next.Metrics.MaxSubjects = 5
+	next.RateLimit.File = "limits.yml"
+	assert.Empty(t, c.RestartRequired(next))
+
+	next.GRPCPort = "6000"
+	next.Broker.BufferSize = 5
+	assert.Equal(t, []string{"grpc-port", "broker-buffer-size"}, c.RestartRequired(next))
+}
+
+func TestValidateShouldCheckRaftPeers(t *testing.T) {
+	c := Default()
+	c.DataControl = "raft"
+	c.Raft.AdvertiseAddress = "broker-0:7000"
+	c.Raft.RPCAdvertiseAddress = "broker-0:7001"
+	c.Raft.Token = "secret"
+	c.Raft.Peers = []string{"broker-0=broker-0:7000", "broker-1"}
+	assert.NotNil(t, c.Validate())
+
+	c.Raft.Peers = []string{"broker-0=broker-0:7000", "broker-1=broker-1:7000"}
+	assert.Nil(t, c.Validate())
+	ids, addresses, err := c.Raft.RaftPeers()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"broker-0", "broker-1"}, ids)
+	assert.Equal(t, []string{"broker-0:7000", "broker-1:7000"}, addresses)
+}
+
+func TestValidateShouldRequireClusterCredentials(t *testing.T) {
+	c := Default()
+	c.Cluster.Enabled = true
+	c.Cluster.Peers = []string{"broker-1:50052"}
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cluster needs a token")
+
+	c.Cluster.Token = "secret"
+	assert.Nil(t, c.Validate())
+}
+
+func TestValidateShouldRequireRaftCredentials(t *testing.T) {
+	c := Default()
+	c.DataControl = "raft"
+	c.Raft.AdvertiseAddress = "broker-0:7000"
+	c.Raft.RPCAdvertiseAddress = "broker-0:7001"
+	c.Raft.Peers = []string{"broker-0=broker-0:7000"}
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "raft needs a token")
+
+	c.Raft.Token = "secret"
+	assert.Nil(t, c.Validate())
+}
+
+func TestValidateShouldCheckGatewaySettings(t *testing.T) {
+	c := Default()
+	c.Gateway.Enabled = true
+	assert.Nil(t, c.Validate())
+
+	c.Gateway.Port = c.GRPCPort
+	c.Gateway.ReplaySize = 0
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "gateway.port")
+	assert.Contains(t, err.Error(), "gateway.replay_size")
+}
+
+func TestValidateShouldCheckMQTTSettings(t *testing.T) {
+	c := Default()
+	c.MQTT.Enabled = true
+	assert.Nil(t, c.Validate())
+
+	c.Gateway.Enabled = true
+	c.Gateway.Port = c.MQTT.Port
+	c.MQTT.MaxInflight = 0
+	c.MQTT.Expiration = -time.Second
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "mqtt.port")
+	assert.Contains(t, err.Error(), "mqtt.max_inflight")
+	assert.Contains(t, err.Error(), "mqtt.expiration")
+}
+
+func TestValidateShouldCheckRESPSettings(t *testing.T) {
+	c := Default()
+	c.RESP.Enabled = true
+	assert.Nil(t, c.Validate())
+
+	c.MQTT.Enabled = true
+	c.MQTT.Port = c.RESP.Port
+	c.RESP.Expiration = -time.Second
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "resp.port")
+	assert.Contains(t, err.Error(), "resp.expiration")
+}
+
+func TestValidateShouldCheckCompressionSettings(t *testing.T) {
+	c := Default()
+	c.Compression.Algorithm = "zstd"
+	assert.Nil(t, c.Validate())
+
+	c.Compression.Algorithm = "lz4"
+	c.Compression.Threshold = -1
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "compression.algorithm")
+	assert.Contains(t, err.Error(), "compression.threshold")
+}
+
+func TestValidateShouldCheckEncryptionSettings(t *testing.T) {
+	c := Default()
+	c.Encryption.Enabled = true
+	c.Encryption.KeyringFile = writeFile(t, "keyring.yml", "primary: key-1")
+	assert.Nil(t, c.Validate())
+
+	c.Encryption.KeyringFile = "missing.yml"
+	c.DataControl = "raft"
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "encryption.keyring_file")
+	assert.Contains(t, err.Error(), "raft")
+}
+
+func TestValidateShouldCheckSchemaSettings(t *testing.T) {
+	c := Default()
+	c.Schema.Enabled = true
+	assert.Nil(t, c.Validate())
+	c.Schema.File = filepath.Join(t.TempDir(), "schemas.json")
+	assert.Nil(t, c.Validate())
+
+	c.Schema.File = filepath.Join(t.TempDir(), "missing", "schemas.json")
+	err := c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "schema.file")
+}
@@ -0,0 +1,247 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"therealbroker/api/certs"
+	"therealbroker/api/metrics"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/client"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Comma separated names of the brokers a message has been copied from
+	HeaderPath = "x-bridge-path"
+	// Subject the message was first published on
+	HeaderOrigin = "x-bridge-origin"
+
+	DefaultMaxHops = 8
+)
+
+// Endpoint is one broker the bridge connects to. Name identifies the
+// broker in the loop prevention header, so every broker needs its own.
+type Endpoint struct {
+	Name       string `yaml:"name"`
+	Address    string `yaml:"address"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	Token      string `yaml:"token"`
+	// Sends the token without tls, see client.Options.InsecureToken
+	InsecureToken bool `yaml:"insecure_token"`
+}
+
+// Route copies one subject of the source broker to the destination
+type Route struct {
+	Subject string `yaml:"subject"`
+	// Subject on the destination, defaults to Subject
+	Rewrite string `yaml:"rewrite"`
+	// Expiration of the copies, they are not fetchable when zero
+	Expiration time.Duration `yaml:"expiration"`
+}
+
+func (r Route) destination() string {
+	if r.Rewrite != "" {
+		return r.Rewrite
+	}
+	return r.Subject
+}
+
+func (r Route) name() string {
+	return r.Subject + "->" + r.destination()
+}
+
+type Config struct {
+	Source      Endpoint `yaml:"source"`
+	Destination Endpoint `yaml:"destination"`
+	Routes      []Route  `yaml:"routes"`
+	// Messages copied more often than this are dropped
+	MaxHops int `yaml:"max_hops"`
+	// Address of the prometheus metrics server
+	MetricsAddress string `yaml:"metrics_address"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{MaxHops: DefaultMaxHops}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	for _, e := range []Endpoint{c.Source, c.Destination} {
+		if e.Name == "" || e.Address == "" {
+			errs = append(errs, errors.New("source and destination need a name and an address"))
+		}
+	}
+	if c.Source.Name == c.Destination.Name {
+		errs = append(errs, errors.New("source and destination must have different names"))
+	}
+	if len(c.Routes) == 0 {
+		errs = append(errs, errors.New("at least one route is required"))
+	}
+	for _, r := range c.Routes {
+		if r.Subject == "" {
+			errs = append(errs, errors.New("every route needs a subject"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dial connects to e, over tls when a ca file is given, sending the
+// bearer token with every call when one is set. A token needs tls,
+// unless e.InsecureToken is set.
+func Dial(e Endpoint) (*client.Client, error) {
+	options := client.Options{Address: e.Address, Token: e.Token, InsecureToken: e.InsecureToken}
+	if e.CAFile != "" {
+		tlsConfig, err := certs.ClientConfig(e.CAFile, e.CertFile, e.KeyFile, e.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		options.TLS = tlsConfig
+	}
+	return client.New(options)
+}
+
+// Bridge subscribes to the routes on the source broker and republishes
+// every message on the destination. A publish is retried until it
+// succeeds before the next message is taken, so messages received by
+// the bridge are copied at least once and in order.
+//
+// Source and destination are usually clients of remote brokers, but any
+// broker.Broker works, e.g. the Module embedded in this process.
+type Bridge struct {
+	config      *Config
+	source      broker.Broker
+	destination broker.Broker
+}
+
+func New(config *Config, source, destination broker.Broker) *Bridge {
+	if config.MaxHops <= 0 {
+		config.MaxHops = DefaultMaxHops
+	}
+	return &Bridge{config: config, source: source, destination: destination}
+}
+
+// Run copies every route until ctx is done
+func (b *Bridge) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range b.config.Routes {
+		wg.Add(1)
+		go func(r Route) {
+			defer wg.Done()
+			b.runRoute(ctx, r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (b *Bridge) runRoute(ctx context.Context, r Route) {
+	name := r.name()
+	log := slog.With("route", name, "source", b.config.Source.Name, "destination", b.config.Destination.Name)
+	delay := newDelay()
+	for ctx.Err() == nil {
+		// remote sources resubscribe by themselves, the channel only
+		// closes when the subscription is refused or the source closed
+		messages, err := b.source.Subscribe(ctx, r.Subject)
+		if err != nil {
+			log.Warn("failed to subscribe on source", "error", err)
+			delay.wait(ctx)
+			continue
+		}
+		metrics.BridgeSubscribed.WithLabelValues(name).Set(1)
+		log.Info("bridge route subscribed")
+		for msg := range messages {
+			delay.reset()
+			b.forward(ctx, r, msg, log)
+		}
+		metrics.BridgeSubscribed.WithLabelValues(name).Set(0)
+		if ctx.Err() == nil {
+			log.Warn("source subscription ended")
+		}
+		delay.wait(ctx)
+	}
+}
+
+func (b *Bridge) forward(ctx context.Context, r Route, msg broker.Message, log *slog.Logger) {
+	name := r.name()
+	headers, ok := b.stamp(r, msg.Headers)
+	if !ok {
+		metrics.BridgeLoops.WithLabelValues(name).Inc()
+		log.Debug("message dropped by loop prevention", "path", msg.Headers[HeaderPath])
+		return
+	}
+	copied := broker.Message{Body: msg.Body, Expiration: r.Expiration, Headers: headers}
+	delay := newDelay()
+	for ctx.Err() == nil {
+		_, err := b.destination.Publish(ctx, r.destination(), copied)
+		if err == nil {
+			metrics.BridgeForwarded.WithLabelValues(name).Inc()
+			metrics.BridgeLastForward.WithLabelValues(name).SetToCurrentTime()
+			return
+		}
+		metrics.BridgeFailures.WithLabelValues(name).Inc()
+		log.Warn("failed to publish on destination, retrying", "error", err)
+		delay.wait(ctx)
+	}
+}
+
+// stamp adds the source broker to the path of a message. It reports
+// false when the message already passed through the destination or
+// has been copied too often.
+func (b *Bridge) stamp(r Route, headers map[string]string) (map[string]string, bool) {
+	var path []string
+	if headers[HeaderPath] != "" {
+		path = strings.Split(headers[HeaderPath], ",")
+	}
+	if slices.Contains(path, b.config.Destination.Name) || len(path) >= b.config.MaxHops {
+		return nil, false
+	}
+
+	stamped := make(map[string]string, len(headers)+2)
+	for k, v := range headers {
+		stamped[k] = v
+	}
+	stamped[HeaderPath] = strings.Join(append(path, b.config.Source.Name), ",")
+	if stamped[HeaderOrigin] == "" {
+		stamped[HeaderOrigin] = r.Subject
+	}
+	return stamped, true
+}
+
+// delay backs off between reconnects and retries
+type delay struct {
+	d time.Duration
+}
+
+func newDelay() *delay {
+	return &delay{d: 100 * time.Millisecond}
+}
+
+func (d *delay) reset() {
+	d.d = 100 * time.Millisecond
+}
+
+func (d *delay) wait(ctx context.Context) {
+	select {
+	case <-time.After(d.d):
+	case <-ctx.Done():
+	}
+	d.d = min(2*d.d, 10*time.Second)
+}
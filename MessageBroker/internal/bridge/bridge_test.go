@@ -0,0 +1,164 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "therealbroker/api/proto"
+	"therealbroker/api/server"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/client"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// startBroker serves an in memory broker and returns a client of it
+func startBroker(t *testing.T, name string) (Endpoint, *client.Client) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBrokerServer(grpcServer, server.NewServer(datacontrol.NewDataMemory()))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	endpoint := Endpoint{Name: name, Address: lis.Addr().String()}
+	c, err := Dial(endpoint)
+	assert.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	return endpoint, c
+}
+
+func subscribe(t *testing.T, ctx context.Context, c *client.Client, subject string) <-chan broker.Message {
+	ch, err := c.Subscribe(ctx, subject)
+	assert.Nil(t, err)
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan broker.Message) broker.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return broker.Message{}
+	}
+}
+
+func expectNothing(t *testing.T, ch <-chan broker.Message) {
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// publishUntilBridged publishes until the bridge subscription is up
+// and the first copy arrives on ch
+func publishUntilBridged(t *testing.T, ctx context.Context, c *client.Client, subject string, ch <-chan broker.Message) broker.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := c.Publish(ctx, subject, broker.Message{Body: "probe"})
+		assert.Nil(t, err)
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("bridge did not start")
+	return broker.Message{}
+}
+
+func TestBridgeShouldCopyAndRewriteSubjects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	staging, stagingClient := startBroker(t, "staging")
+	production, productionClient := startBroker(t, "production")
+
+	copies := subscribe(t, ctx, productionClient, "staging.orders")
+	b := New(&Config{
+		Source:      staging,
+		Destination: production,
+		Routes:      []Route{{Subject: "orders", Rewrite: "staging.orders"}},
+	}, stagingClient, productionClient)
+	go b.Run(ctx)
+
+	publishUntilBridged(t, ctx, stagingClient, "orders", copies)
+	_, err := stagingClient.Publish(ctx, "orders", broker.Message{
+		Body:    "order-1",
+		Headers: map[string]string{"trace": "abc"},
+	})
+	assert.Nil(t, err)
+
+	msg := receive(t, copies)
+	assert.Equal(t, "order-1", msg.Body)
+	assert.Equal(t, "abc", msg.Headers["trace"])
+	assert.Equal(t, "staging", msg.Headers[HeaderPath])
+	assert.Equal(t, "orders", msg.Headers[HeaderOrigin])
+}
+
+func TestBridgesBothWaysShouldNotLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	east, eastClient := startBroker(t, "east")
+	west, westClient := startBroker(t, "west")
+	routes := []Route{{Subject: "orders"}}
+
+	eastMessages := subscribe(t, ctx, eastClient, "orders")
+	westMessages := subscribe(t, ctx, westClient, "orders")
+	go New(&Config{Source: east, Destination: west, Routes: routes}, eastClient, westClient).Run(ctx)
+	go New(&Config{Source: west, Destination: east, Routes: routes}, westClient, eastClient).Run(ctx)
+
+	// both bridges are up once a probe crosses each way
+	publishUntilBridged(t, ctx, eastClient, "orders", westMessages)
+	publishUntilBridged(t, ctx, westClient, "orders", eastMessages)
+	time.Sleep(300 * time.Millisecond)
+	for len(eastMessages) > 0 || len(westMessages) > 0 {
+		select {
+		case <-eastMessages:
+		case <-westMessages:
+		}
+	}
+
+	_, err := eastClient.Publish(ctx, "orders", broker.Message{Body: "once"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "once", receive(t, eastMessages).Body)
+	msg := receive(t, westMessages)
+	assert.Equal(t, "once", msg.Body)
+	assert.Equal(t, "east", msg.Headers[HeaderPath])
+	expectNothing(t, eastMessages)
+	expectNothing(t, westMessages)
+}
+
+func TestStampShouldEnforceMaxHops(t *testing.T) {
+	b := New(&Config{
+		Source:      Endpoint{Name: "c"},
+		Destination: Endpoint{Name: "d"},
+		MaxHops:     2,
+	}, nil, nil)
+
+	headers, ok := b.stamp(Route{Subject: "orders"}, map[string]string{HeaderPath: "a"})
+	assert.True(t, ok)
+	assert.Equal(t, "a,c", headers[HeaderPath])
+
+	_, ok = b.stamp(Route{Subject: "orders"}, map[string]string{HeaderPath: "a,b"})
+	assert.False(t, ok)
+	_, ok = b.stamp(Route{Subject: "orders"}, map[string]string{HeaderPath: "d"})
+	assert.False(t, ok)
+}
+
+func TestConfigShouldRejectSameBrokerNames(t *testing.T) {
+	config := &Config{
+		Source:      Endpoint{Name: "a", Address: "localhost:1"},
+		Destination: Endpoint{Name: "a", Address: "localhost:2"},
+		Routes:      []Route{{Subject: "orders"}},
+	}
+	assert.NotNil(t, config.Validate())
+	config.Destination.Name = "b"
+	assert.Nil(t, config.Validate())
+}
@@ -2,79 +2,535 @@ package broker
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"therealbroker/api/metrics"
 	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/logging"
+	"therealbroker/internal/tracing"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/filter"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+type subscription struct {
+	ch chan broker.Message
+	// closed when the subscriber context is done, nil if it never is
+	done <-chan struct{}
+	// only matching messages are queued, nil for every message
+	filter *filter.Filter
+}
+
 type Module struct {
-	// TODO: Add required fields
-	subscriptions map[string][]chan broker.Message
+	subscriptions map[string][]*subscription
 	data          datacontrol.DataControl
-	closed        bool
-	bufferSize    int
-	lock          sync.Mutex
+	// set by Close with lock held, calls check it without the lock
+	// first to fail fast
+	closed     atomic.Bool
+	bufferSize int
+	lock       sync.Mutex
+	backend    string
+
+	// keys of subscriptions that are patterns, checked on every publish
+	patterns map[string]struct{}
+
+	// forward gets every message published on this module, see SetForwarder
+	forward func(subject string, msg broker.Message)
+	// validate checks every message before it is published, see SetValidator
+	validate func(subject string, msg broker.Message) (broker.Message, error)
+	// interestChanged is called when a subject gains its first or loses
+	// its last subscriber
+	interestChanged func()
+
+	// level of the publishes that do not ask for one, see SetDurability
+	durability broker.Durability
+	// async publishes waiting to be saved, made by the first one
+	saves chan pendingSave
+	// savers of the async publishes, Close waits for them
+	saving sync.WaitGroup
+}
+
+// pendingSave is an async publish acknowledged but not saved yet
+type pendingSave struct {
+	ctx context.Context
+	msg broker.Message
 }
 
+// Messages queued per subscriber when no buffer size is given
+const DefaultBufferSize = 1000
+
+const (
+	// Async publishes waiting to be saved, later ones are saved before
+	// their publish returns
+	AsyncQueueSize = 10000
+	// Async publishes saved at once, backends like postgres batch them
+	asyncSavers = 16
+)
+
 func NewModule(data datacontrol.DataControl) broker.Broker {
+	return NewModuleWithBufferSize(data, DefaultBufferSize)
+}
+
+// NewModuleWithBufferSize is NewModule with bufferSize messages queued per
+// subscriber before publishes wait for it.
+func NewModuleWithBufferSize(data datacontrol.DataControl, bufferSize int) broker.Broker {
 	return &Module{
-		subscriptions: make(map[string][]chan broker.Message),
+		subscriptions: make(map[string][]*subscription),
+		patterns:      make(map[string]struct{}),
 		data:          data,
-		closed:        false,
-		bufferSize:    1000,
+		bufferSize:    bufferSize,
 		lock:          sync.Mutex{},
+		backend:       datacontrol.BackendName(data),
+		durability:    broker.DurabilitySync,
 	}
 }
 
+// Close ends every subscription and waits for the async publishes that
+// were acknowledged to be saved.
 func (m *Module) Close() error {
-	m.closed = true
+	m.lock.Lock()
+	if m.closed.Load() {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed.Store(true)
+	slog.Info("broker closed", "subjects", len(m.subscriptions))
 	for _, subs := range m.subscriptions {
-		for _, ch := range subs {
-			close(ch)
+		for _, sub := range subs {
+			close(sub.ch)
 		}
 	}
+	if m.saves != nil {
+		close(m.saves)
+	}
+	m.lock.Unlock()
+
+	m.saving.Wait()
+	return nil
+}
+
+// SetDurability sets the level of the publishes that do not ask for one,
+// sync until it is called. The default level keeps it sync.
+func (m *Module) SetDurability(d broker.Durability) error {
+	if !d.Valid() {
+		return fmt.Errorf("%w %q", broker.ErrInvalidDurability, d)
+	}
+	if d == broker.DurabilityDefault {
+		d = broker.DurabilitySync
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.durability = d
 	return nil
 }
 
+// SetForwarder makes every Publish pass the message to forward, e.g. to
+// send it to other cluster nodes. forward is called with the module
+// locked, right after the local fan-out, so it sees messages in the
+// order subscribers do. It must not block for long.
+func (m *Module) SetForwarder(forward func(subject string, msg broker.Message)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.forward = forward
+}
+
+// SetValidator makes every Publish pass the message to validate first,
+// e.g. to check the body against the schema of the subject. The message
+// validate returns is published instead, a message it rejects is neither
+// delivered nor stored and Publish returns the error. Messages handed to
+// Deliver are not validated, the node they were published on did it.
+func (m *Module) SetValidator(validate func(subject string, msg broker.Message) (broker.Message, error)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.validate = validate
+}
+
+// SetInterestHook registers f to be called whenever the set returned by
+// Subjects changes. f is called with the module locked and must not block.
+func (m *Module) SetInterestHook(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.interestChanged = f
+}
+
+// Subjects returns the subjects that have local subscribers
+func (m *Module) Subjects() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	subjects := make([]string, 0, len(m.subscriptions))
+	for subject := range m.subscriptions {
+		subjects = append(subjects, subject)
+	}
+	return subjects
+}
+
+// IsClosed reports whether Close has been called
+func (m *Module) IsClosed() bool {
+	return m.closed.Load()
+}
+
 func (m *Module) Publish(ctx context.Context, subject string, msg broker.Message) (string, error) {
-	if m.closed {
+	if m.closed.Load() {
 		return "", broker.ErrUnavailable
 	}
+	start := time.Now()
+	level := msg.Durability
+	if !level.Valid() {
+		return "", fmt.Errorf("%w %q", broker.ErrInvalidDurability, level)
+	}
+	msg.Durability = broker.DurabilityDefault
+
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+subject,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.AttrSubject.String(subject), tracing.AttrBodySize.Int(len(msg.Body))))
 
+	label := metrics.SubjectLabel(subject)
 	m.lock.Lock()
-	if _, ok := m.subscriptions[subject]; !ok {
-		m.subscriptions[subject] = make([]chan broker.Message, 0)
+	validate := m.validate
+	m.lock.Unlock()
+	if validate != nil {
+		validated, err := validate(subject, msg)
+		if err != nil {
+			metrics.SchemaRejections.WithLabelValues(label).Inc()
+			endSpan(span, err)
+			return "", err
+		}
+		msg = validated
 	}
+	msg = tracing.Inject(ctx, msg)
 
-	for _, sub := range m.subscriptions[subject] {
-		sub <- msg
+	m.lock.Lock()
+	if m.closed.Load() {
+		m.lock.Unlock()
+		endSpan(span, broker.ErrUnavailable)
+		return "", broker.ErrUnavailable
+	}
+	if level == broker.DurabilityDefault {
+		level = m.durability
+	}
+	m.fanOut(subject, msg, label)
+	if m.forward != nil {
+		m.forward(subject, msg)
 	}
+	metrics.PublishedMessages.WithLabelValues(label).Inc()
+	// stored with its subject, so it can be listed by Range
+	msg.Subject = subject
+	// queued with the module locked, so saves start in publish order
+	queued := level == broker.DurabilityAsync && m.queueSave(ctx, msg)
 	m.lock.Unlock()
+	metrics.PublishedByDurability.WithLabelValues(string(level)).Inc()
+	span.SetAttributes(tracing.AttrDurability.String(string(level)))
 
-	id, err := m.data.SaveMessage(msg)
+	if level == broker.DurabilityAsync && !queued {
+		// the queue is full, so the store is behind: wait for it
+		// instead of holding every other call of the module. The
+		// message is stored by now, so its id is returned like a sync one
+		metrics.AsyncSaveFallbacks.Inc()
+		id, err := m.save(ctx, msg)
+		metrics.PublishAckDurations.WithLabelValues(string(level)).Observe(time.Since(start).Seconds())
+		span.SetAttributes(tracing.AttrMessageID.String(id))
+		endSpan(span, err)
+		return id, err
+	}
+	if level != broker.DurabilitySync {
+		logging.FromContext(ctx).Debug("message published", "subject", subject, "durability", level)
+		metrics.PublishAckDurations.WithLabelValues(string(level)).Observe(time.Since(start).Seconds())
+		endSpan(span, nil)
+		return "", nil
+	}
+	id, err := m.save(ctx, msg)
+	metrics.PublishAckDurations.WithLabelValues(string(level)).Observe(time.Since(start).Seconds())
+	span.SetAttributes(tracing.AttrMessageID.String(id))
+	endSpan(span, err)
+	return id, err
+}
+
+// save stores msg, on the subject msg.Subject
+func (m *Module) save(ctx context.Context, msg broker.Message) (string, error) {
+	var id string
+	err := m.dataCall(ctx, "SaveMessage", func() (err error) {
+		id, err = m.data.SaveMessage(msg)
+		return err
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to save message", "subject", msg.Subject, "error", err)
+	} else {
+		logging.FromContext(ctx).Debug("message published", "subject", msg.Subject, "id", id)
+	}
 	return id, err
 }
 
+// queueSave hands msg to the async savers, starting them on the first
+// call. It never waits, false means the queue is full. m.lock must be
+// held.
+func (m *Module) queueSave(ctx context.Context, msg broker.Message) bool {
+	if m.saves == nil {
+		m.saves = make(chan pendingSave, AsyncQueueSize)
+		m.saving.Add(asyncSavers)
+		for i := 0; i < asyncSavers; i++ {
+			go m.saveAsync(m.saves)
+		}
+	}
+	select {
+	// outlives the publish call, but keeps its trace and logger
+	case m.saves <- pendingSave{ctx: context.WithoutCancel(ctx), msg: msg}:
+		metrics.AsyncSaveQueue.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// saveAsync saves the queued publishes until the queue is closed. Savers
+// run side by side, so messages may be saved out of publish order.
+func (m *Module) saveAsync(saves <-chan pendingSave) {
+	defer m.saving.Done()
+	for save := range saves {
+		metrics.AsyncSaveQueue.Dec()
+		if _, err := m.save(save.ctx, save.msg); err != nil {
+			metrics.AsyncSaveFailures.Inc()
+		}
+	}
+}
+
+// Deliver hands msg to the local subscribers of subject without storing
+// or forwarding it, for messages published on another cluster node.
+func (m *Module) Deliver(subject string, msg broker.Message) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed.Load() {
+		return broker.ErrUnavailable
+	}
+	m.fanOut(subject, msg, metrics.SubjectLabel(subject))
+	return nil
+}
+
+// fanOut sends msg to every subscriber of subject and of the patterns
+// matching it, m.lock must be held
+func (m *Module) fanOut(subject string, msg broker.Message, label string) {
+	// shared by the filters of every subscriber, so the body is parsed once
+	candidate := &filter.Message{Subject: subject, Headers: msg.Headers, Body: msg.Body}
+	delivered := m.send(m.subscriptions[subject], msg, candidate, label)
+	if len(m.patterns) > 0 {
+		matched := msg
+		matched.Subject = subject
+		for pattern := range m.patterns {
+			if pattern != subject && broker.MatchSubject(pattern, subject) {
+				delivered += m.send(m.subscriptions[pattern], matched, candidate, label)
+			}
+		}
+	}
+	metrics.DeliveredMessages.WithLabelValues(label).Add(float64(delivered))
+}
+
+func (m *Module) send(subs []*subscription, msg broker.Message, candidate *filter.Message, label string) int {
+	delivered := 0
+	for _, sub := range subs {
+		if sub.filter != nil && !sub.filter.Match(candidate) {
+			metrics.FilteredMessages.WithLabelValues(label).Inc()
+			continue
+		}
+		// a cancelled subscriber must not block the publish
+		select {
+		case sub.ch <- msg:
+			delivered++
+		case <-sub.done:
+			metrics.DroppedMessages.WithLabelValues(label, "unsubscribed").Inc()
+		}
+	}
+	return delivered
+}
+
 func (m *Module) Subscribe(ctx context.Context, subject string) (<-chan broker.Message, error) {
-	if m.closed {
+	return m.SubscribeFilter(ctx, subject, nil)
+}
+
+// SubscribeFilter is Subscribe, but only the messages f matches are
+// queued for the subscriber. f is evaluated during the fan-out of every
+// publish on subject, a nil f matches everything.
+func (m *Module) SubscribeFilter(ctx context.Context, subject string, f *filter.Filter) (<-chan broker.Message, error) {
+	if m.closed.Load() {
 		return nil, broker.ErrUnavailable
 	}
 
+	newsub := &subscription{
+		ch:     make(chan broker.Message, m.bufferSize),
+		done:   ctx.Done(),
+		filter: f,
+	}
 	m.lock.Lock()
-	if _, ok := m.subscriptions[subject]; !ok {
-		m.subscriptions[subject] = make([]chan broker.Message, 0)
+	if m.closed.Load() {
+		m.lock.Unlock()
+		return nil, broker.ErrUnavailable
 	}
-
-	newsub := make(chan broker.Message, m.bufferSize)
 	m.subscriptions[subject] = append(m.subscriptions[subject], newsub)
+	if broker.IsPattern(subject) {
+		m.patterns[subject] = struct{}{}
+	}
+	if len(m.subscriptions[subject]) == 1 && m.interestChanged != nil {
+		m.interestChanged()
+	}
 	m.lock.Unlock()
-	return newsub, nil
+	if f != nil {
+		logging.FromContext(ctx).Debug("subscribed", "subject", subject, "filter", f.String())
+	} else {
+		logging.FromContext(ctx).Debug("subscribed", "subject", subject)
+	}
+
+	if newsub.done != nil {
+		go func() {
+			<-newsub.done
+			m.unsubscribe(subject, newsub)
+		}()
+	}
+	return newsub.ch, nil
+}
+
+// unsubscribe stops sending to sub and closes it. Messages still queued
+// in sub are counted as dropped.
+func (m *Module) unsubscribe(subject string, sub *subscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed.Load() {
+		return
+	}
+	subs := m.subscriptions[subject]
+	for i, s := range subs {
+		if s != sub {
+			continue
+		}
+		if len(subs) == 1 {
+			delete(m.subscriptions, subject)
+			delete(m.patterns, subject)
+			if m.interestChanged != nil {
+				m.interestChanged()
+			}
+		} else {
+			m.subscriptions[subject] = append(subs[:i:i], subs[i+1:]...)
+		}
+		if pending := len(sub.ch); pending > 0 {
+			metrics.DroppedMessages.WithLabelValues(metrics.SubjectLabel(subject), "unsubscribed").Add(float64(pending))
+		}
+		close(sub.ch)
+		return
+	}
+}
+
+// QueueDepths returns the number of messages waiting in the fullest
+// subscriber queue of every subject that has subscribers.
+func (m *Module) QueueDepths() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	depths := make(map[string]int)
+	for subject, subs := range m.subscriptions {
+		for _, sub := range subs {
+			depths[subject] = max(depths[subject], len(sub.ch))
+		}
+	}
+	return depths
+}
+
+// SubscriberCounts returns the number of subscribers of every subject
+// that has any.
+func (m *Module) SubscriberCounts() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := make(map[string]int, len(m.subscriptions))
+	for subject, subs := range m.subscriptions {
+		if len(subs) > 0 {
+			counts[subject] = len(subs)
+		}
+	}
+	return counts
+}
+
+// Receivers returns how many local subscribers a publish on subject
+// reaches, the ones of matching patterns included.
+func (m *Module) Receivers(subject string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	receivers := len(m.subscriptions[subject])
+	for pattern := range m.patterns {
+		if pattern != subject && broker.MatchSubject(pattern, subject) {
+			receivers += len(m.subscriptions[pattern])
+		}
+	}
+	return receivers
 }
 
 func (m *Module) Fetch(ctx context.Context, subject string, id string) (broker.Message, error) {
-	if m.closed {
+	if m.closed.Load() {
 		return broker.Message{}, broker.ErrUnavailable
 	}
-	msg, err := m.data.RetriveMessage(id)
-	return msg, err
+	var msg broker.Message
+	err := m.dataCall(ctx, "RetriveMessage", func() (err error) {
+		msg, err = m.data.RetriveMessage(id)
+		return err
+	}, tracing.AttrSubject.String(subject), tracing.AttrMessageID.String(id))
+	if err != nil {
+		return broker.Message{}, err
+	}
+	// ids are only unique per store, and callers are only allowed to
+	// fetch on subject
+	if msg.Subject != subject {
+		return broker.Message{}, broker.ErrInvalidID
+	}
+	return msg, nil
+}
+
+// ListMessages reads a page of the stored messages of a subject, see
+// broker.Range. A range that can not be served is an error wrapping
+// broker.ErrInvalidRange.
+func (m *Module) ListMessages(ctx context.Context, r broker.Range) (broker.Page, error) {
+	if m.closed.Load() {
+		return broker.Page{}, broker.ErrUnavailable
+	}
+	if err := r.Validate(); err != nil {
+		return broker.Page{}, err
+	}
+	var page broker.Page
+	err := m.dataCall(ctx, "ListMessages", func() (err error) {
+		page, err = m.data.ListMessages(r)
+		return err
+	}, tracing.AttrSubject.String(r.Subject))
+	return page, err
+}
+
+// dataCall runs a data control operation inside its own span and
+// records its latency.
+func (m *Module) dataCall(ctx context.Context, operation string, call func() error, attrs ...attribute.KeyValue) error {
+	_, span := tracing.Tracer().Start(ctx, "datacontrol."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			tracing.AttrBackend.String(m.backend),
+			tracing.AttrOperation.String(operation)),
+		trace.WithAttributes(attrs...))
+	start := time.Now()
+
+	err := call()
+
+	result := "ok"
+	if err == broker.ErrInvalidID || err == broker.ErrExpiredID {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	metrics.DataControlDurations.WithLabelValues(m.backend, operation, result).Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	return err
+}
+
+// endSpan ends span, marking it failed when err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
 	datacontrol "therealbroker/internal/data_control"
@@ -23,63 +24,102 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	// postgres := datacontrol.NewDataPostgres("localhost", "5432", "postgres", "8764", "TestDB", context.Background())
-	// err := postgres.Connect()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// defer postgres.Close()
-	// err = postgres.ClearData()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// data = postgres
-
-	// scylla := datacontrol.NewDataScylla("127.0.0.1", "9042", "test_db", time.Duration(10*time.Second))
-	// err := scylla.Connect()
-	// if err != nil {
-	// 	log.Println(err)
-	// }
-	// defer scylla.Close()
-	// err = scylla.ClearData()
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return
-	// }
-	// data = scylla
-
-	data = datacontrol.NewDataMemory()
+	var err error
+	data, err = testData()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	service = NewModule(data)
 	rand.Seed(time.Now().Unix())
 	m.Run()
 }
 
+// testData picks the backend of the tests with BROKER_TEST_BACKEND,
+// memory by default. postgres and scylla connect with the same
+// POSTGRES_TEST_* and SCYLLA_TEST_* variables as the data control tests.
+func testData() (datacontrol.DataControl, error) {
+	switch backend := os.Getenv("BROKER_TEST_BACKEND"); backend {
+	case "", "memory":
+		return datacontrol.NewDataMemory(), nil
+	case "postgres":
+		postgres := datacontrol.NewDataPostgres(os.Getenv("POSTGRES_TEST_HOST"), envOr("POSTGRES_TEST_PORT", "5432"),
+			envOr("POSTGRES_TEST_USER", "postgres"), os.Getenv("POSTGRES_TEST_PASSWORD"),
+			envOr("POSTGRES_TEST_DB", "TestDB"), context.Background())
+		if err := postgres.Connect(); err != nil {
+			return nil, err
+		}
+		return postgres, postgres.ClearData()
+	case "scylla":
+		scylla := datacontrol.NewDataScylla(os.Getenv("SCYLLA_TEST_HOST"), envOr("SCYLLA_TEST_PORT", "9042"),
+			envOr("SCYLLA_TEST_KEYSPACE", "test_db"), 10*time.Second)
+		if err := scylla.Connect(); err != nil {
+			return nil, err
+		}
+		return scylla, scylla.ClearData()
+	default:
+		return nil, fmt.Errorf("unknown BROKER_TEST_BACKEND %q", backend)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// closedService is a module closed before use, service stays open for
+// the other tests
+func closedService(t *testing.T) broker.Broker {
+	closed := NewModule(data)
+	assert.Nil(t, closed.Close())
+	return closed
+}
+
+// testContext is cancelled when the test ends, so the subscriptions of a
+// test do not fill up and block the publishes of later tests
+func testContext(t testing.TB) context.Context {
+	ctx, cancel := context.WithCancel(mainCtx)
+	t.Cleanup(cancel)
+	return ctx
+}
+
 func TestPublishShouldFailOnClosed(t *testing.T) {
 	msg := createMessage()
 
-	err := service.Close()
-	assert.Nil(t, err)
-
-	_, err = service.Publish(mainCtx, "ali", msg)
+	_, err := closedService(t).Publish(mainCtx, "ali", msg)
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
 func TestSubscribeShouldFailOnClosed(t *testing.T) {
-	err := service.Close()
-	assert.Nil(t, err)
-
-	_, err = service.Subscribe(mainCtx, "ali")
+	_, err := closedService(t).Subscribe(mainCtx, "ali")
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
 func TestFetchShouldFailOnClosed(t *testing.T) {
-	err := service.Close()
-	assert.Nil(t, err)
+	_, err := closedService(t).Fetch(mainCtx, "ali", fmt.Sprintf("%v", rand.Intn(100)))
+	assert.Equal(t, broker.ErrUnavailable, err)
+}
 
-	_, err = service.Fetch(mainCtx, "ali", fmt.Sprintf("%v", rand.Intn(100)))
+// run with -race, the calls read closed while Close sets it
+func TestCallsShouldNotRaceClose(t *testing.T) {
+	module := NewModule(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				module.Publish(mainCtx, "closing", createMessage())
+				module.Fetch(mainCtx, "closing", "0")
+				module.Subscribe(testContext(t), "closing")
+			}
+		}()
+	}
+	assert.Nil(t, module.Close())
+	wg.Wait()
+	_, err := module.Publish(mainCtx, "closing", createMessage())
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
@@ -92,16 +132,18 @@ func TestPublishShouldNotFail(t *testing.T) {
 }
 
 func TestSubscribeShouldNotFail(t *testing.T) {
-	sub, err := service.Subscribe(mainCtx, "ali")
+	ctx := testContext(t)
+	sub, err := service.Subscribe(ctx, "ali")
 
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, sub)
 }
 
 func TestPublishShouldSendMessageToSubscribedChan(t *testing.T) {
+	ctx := testContext(t)
 	msg := createMessage()
 
-	sub, _ := service.Subscribe(mainCtx, "ali")
+	sub, _ := service.Subscribe(ctx, "ali")
 	_, _ = service.Publish(mainCtx, "ali", msg)
 	in := <-sub
 
@@ -109,11 +151,12 @@ func TestPublishShouldSendMessageToSubscribedChan(t *testing.T) {
 }
 
 func TestPublishShouldSendMessageToSubscribedChans(t *testing.T) {
+	ctx := testContext(t)
 	msg := createMessage()
 
-	sub1, _ := service.Subscribe(mainCtx, "ali")
-	sub2, _ := service.Subscribe(mainCtx, "ali")
-	sub3, _ := service.Subscribe(mainCtx, "ali")
+	sub1, _ := service.Subscribe(ctx, "ali")
+	sub2, _ := service.Subscribe(ctx, "ali")
+	sub3, _ := service.Subscribe(ctx, "ali")
 	_, _ = service.Publish(mainCtx, "ali", msg)
 	in1 := <-sub1
 	in2 := <-sub2
@@ -125,9 +168,10 @@ func TestPublishShouldSendMessageToSubscribedChans(t *testing.T) {
 }
 
 func TestPublishShouldPreserveOrder(t *testing.T) {
+	ctx := testContext(t)
 	n := 50
 	messages := make([]broker.Message, n)
-	sub, _ := service.Subscribe(mainCtx, "ali")
+	sub, _ := service.Subscribe(ctx, "ali")
 	for i := 0; i < n; i++ {
 		messages[i] = createMessage()
 		_, _ = service.Publish(mainCtx, "ali", messages[i])
@@ -140,9 +184,10 @@ func TestPublishShouldPreserveOrder(t *testing.T) {
 }
 
 func TestPublishShouldNotSendToOtherSubscriptions(t *testing.T) {
+	ctx := testContext(t)
 	msg := createMessage()
-	ali, _ := service.Subscribe(mainCtx, "ali")
-	maryam, _ := service.Subscribe(mainCtx, "maryam")
+	ali, _ := service.Subscribe(ctx, "ali")
+	maryam, _ := service.Subscribe(ctx, "maryam")
 
 	_, _ = service.Publish(mainCtx, "ali", msg)
 	select {
@@ -162,6 +207,17 @@ func TestNonExpiredMessageShouldBeFetchable(t *testing.T) {
 	assert.Equal(t, msg.Body, fMsg.Body)
 }
 
+func TestMessageShouldNotBeFetchableOnOtherSubjects(t *testing.T) {
+	id, err := service.Publish(mainCtx, "private", createMessageWithExpire(time.Minute))
+	assert.Nil(t, err)
+
+	fMsg, err := service.Fetch(mainCtx, "public", id)
+	assert.Equal(t, broker.ErrInvalidID, err)
+	assert.Equal(t, broker.Message{}, fMsg)
+	_, err = service.Fetch(mainCtx, "private", id)
+	assert.Nil(t, err)
+}
+
 func TestExpiredMessageShouldNotBeFetchable(t *testing.T) {
 	msg := createMessageWithExpire(time.Millisecond * 500)
 	id, _ := service.Publish(mainCtx, "ali", msg)
@@ -174,10 +230,34 @@ func TestExpiredMessageShouldNotBeFetchable(t *testing.T) {
 	assert.Equal(t, broker.Message{}, fMsg)
 }
 
+func TestPublishedMessagesShouldBeListedInOrder(t *testing.T) {
+	subject := fmt.Sprintf("listed-%v", rand.Int())
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := service.Publish(mainCtx, subject, createMessageWithExpire(time.Minute))
+		assert.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	page, err := service.(*Module).ListMessages(mainCtx, broker.Range{Subject: subject, Reverse: true})
+	assert.Nil(t, err)
+	assert.Len(t, page.Messages, 3)
+	for i, msg := range page.Messages {
+		assert.Equal(t, ids[2-i], msg.Id)
+		assert.Equal(t, subject, msg.Subject)
+	}
+
+	_, err = service.(*Module).ListMessages(mainCtx, broker.Range{Subject: "orders.*"})
+	assert.ErrorIs(t, err, broker.ErrInvalidRange)
+	_, err = closedService(t).(*Module).ListMessages(mainCtx, broker.Range{Subject: subject})
+	assert.Equal(t, broker.ErrUnavailable, err)
+}
+
 func TestNewSubscriptionShouldNotGetPreviousMessages(t *testing.T) {
+	ctx := testContext(t)
 	msg := createMessage()
 	_, _ = service.Publish(mainCtx, "ali", msg)
-	sub, _ := service.Subscribe(mainCtx, "ali")
+	sub, _ := service.Subscribe(ctx, "ali")
 
 	select {
 	case <-sub:
@@ -187,6 +267,7 @@ func TestNewSubscriptionShouldNotGetPreviousMessages(t *testing.T) {
 }
 
 func TestConcurrentSubscribesOnOneSubjectShouldNotFail(t *testing.T) {
+	ctx := testContext(t)
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 	var wg sync.WaitGroup
@@ -202,7 +283,7 @@ func TestConcurrentSubscribesOnOneSubjectShouldNotFail(t *testing.T) {
 			go func() {
 				defer wg.Done()
 
-				_, err := service.Subscribe(mainCtx, "ali")
+				_, err := service.Subscribe(ctx, "ali")
 				assert.Nil(t, err)
 			}()
 		}
@@ -210,6 +291,7 @@ func TestConcurrentSubscribesOnOneSubjectShouldNotFail(t *testing.T) {
 }
 
 func TestConcurrentSubscribesShouldNotFail(t *testing.T) {
+	ctx := testContext(t)
 	ticker := time.NewTicker(2000 * time.Millisecond)
 	defer ticker.Stop()
 	var wg sync.WaitGroup
@@ -225,7 +307,7 @@ func TestConcurrentSubscribesShouldNotFail(t *testing.T) {
 			go func() {
 				defer wg.Done()
 
-				_, err := service.Subscribe(mainCtx, randomString(4))
+				_, err := service.Subscribe(ctx, randomString(4))
 				assert.Nil(t, err)
 			}()
 		}
@@ -284,6 +366,7 @@ func TestConcurrentPublishShouldNotFail(t *testing.T) {
 }
 
 func TestDataRace(t *testing.T) {
+	ctx := testContext(t)
 	duration := 600 * time.Millisecond
 	ticker1 := time.NewTicker(duration)
 	ticker2 := time.NewTicker(duration)
@@ -327,8 +410,13 @@ func TestDataRace(t *testing.T) {
 				return
 
 			default:
-				_, err := service.Subscribe(mainCtx, "ali")
+				sub, err := service.Subscribe(ctx, "ali")
 				assert.Nil(t, err)
+				// keep the queue drained so the publisher is not blocked
+				go func() {
+					for range sub {
+					}
+				}()
 			}
 		}
 	}()
@@ -362,10 +450,11 @@ func BenchmarkPublish(b *testing.B) {
 }
 
 func BenchmarkSubscribe(b *testing.B) {
+	ctx := testContext(b)
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err := service.Subscribe(mainCtx, randomString(2))
+		_, err := service.Subscribe(ctx, randomString(2))
 		assert.Nil(b, err)
 	}
 }
@@ -0,0 +1,279 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"therealbroker/api/metrics"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/filter"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelledSubscriptionShouldBeClosed(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory())
+	ctx, cancel := context.WithCancel(mainCtx)
+
+	sub, err := module.Subscribe(ctx, "cancelled")
+	assert.Nil(t, err)
+	cancel()
+
+	select {
+	case _, ok := <-sub:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "subscription was not closed")
+	}
+}
+
+func TestCancelledSubscriberShouldNotBlockPublish(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory()).(*Module)
+	module.bufferSize = 1
+	ctx, cancel := context.WithCancel(mainCtx)
+	// other tests may have used up the tracked subjects
+	label := metrics.SubjectLabel("slow")
+	dropped := testutil.ToFloat64(metrics.DroppedMessages.WithLabelValues(label, "unsubscribed"))
+
+	_, err := module.Subscribe(ctx, "slow")
+	assert.Nil(t, err)
+	_, err = module.Publish(mainCtx, "slow", createMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"slow": 1}, module.QueueDepths())
+
+	published := make(chan error)
+	go func() {
+		_, err := module.Publish(mainCtx, "slow", createMessage())
+		published <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-published:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "publish is blocked by a cancelled subscriber")
+	}
+	assert.Eventually(t, func() bool {
+		return len(module.QueueDepths()) == 0
+	}, time.Second, 10*time.Millisecond)
+	// the queued message is dropped, the second one too unless the
+	// subscription was gone before it was published
+	assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.DroppedMessages.WithLabelValues(label, "unsubscribed")), dropped+1)
+}
+
+func TestPublishShouldCountDeliveries(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory())
+	label := metrics.SubjectLabel("fanout")
+	published := testutil.ToFloat64(metrics.PublishedMessages.WithLabelValues(label))
+	delivered := testutil.ToFloat64(metrics.DeliveredMessages.WithLabelValues(label))
+
+	module.Subscribe(mainCtx, "fanout")
+	module.Subscribe(mainCtx, "fanout")
+	_, err := module.Publish(mainCtx, "fanout", broker.Message{Body: "hi"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, published+1, testutil.ToFloat64(metrics.PublishedMessages.WithLabelValues(label)))
+	assert.Equal(t, delivered+2, testutil.ToFloat64(metrics.DeliveredMessages.WithLabelValues(label)))
+}
+
+func TestValidatorShouldRejectBeforeDelivery(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory()).(*Module)
+	module.SetValidator(func(subject string, msg broker.Message) (broker.Message, error) {
+		if msg.Body != "valid" {
+			return msg, broker.ErrInvalidMessage
+		}
+		msg.Headers = map[string]string{"x-checked": "yes"}
+		return msg, nil
+	})
+	label := metrics.SubjectLabel("checked")
+	rejected := testutil.ToFloat64(metrics.SchemaRejections.WithLabelValues(label))
+
+	sub, err := module.Subscribe(testContext(t), "checked")
+	assert.Nil(t, err)
+	_, err = module.Publish(mainCtx, "checked", broker.Message{Body: "invalid"})
+	assert.Equal(t, broker.ErrInvalidMessage, err)
+	id, err := module.Publish(mainCtx, "checked", broker.Message{Body: "valid", Expiration: time.Minute})
+	assert.Nil(t, err)
+
+	msg := <-sub
+	assert.Equal(t, "valid", msg.Body)
+	assert.Equal(t, "yes", msg.Headers["x-checked"])
+	assert.Empty(t, sub)
+	stored, err := module.Fetch(mainCtx, "checked", id)
+	assert.Nil(t, err)
+	assert.Equal(t, "yes", stored.Headers["x-checked"])
+	assert.Equal(t, rejected+1, testutil.ToFloat64(metrics.SchemaRejections.WithLabelValues(label)))
+}
+
+func TestSubjectLabelsShouldBeBounded(t *testing.T) {
+	labels := metrics.NewSubjectLabels(2)
+
+	assert.Equal(t, "a", labels.Label("a"))
+	assert.Equal(t, "b", labels.Label("b"))
+	assert.Equal(t, metrics.OtherSubjects, labels.Label("c"))
+	assert.Equal(t, "a", labels.Label("a"))
+}
+
+func TestPatternSubscriptionShouldGetMatchingSubjects(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory())
+	ctx := testContext(t)
+
+	single, err := module.Subscribe(ctx, "sensors.*.temp")
+	assert.Nil(t, err)
+	tail, err := module.Subscribe(ctx, "sensors.>")
+	assert.Nil(t, err)
+	exact, err := module.Subscribe(ctx, "sensors.a.temp")
+	assert.Nil(t, err)
+
+	for _, subject := range []string{"sensors.a.temp", "sensors.b.humidity", "other.a.temp"} {
+		_, err := module.Publish(mainCtx, subject, broker.Message{Body: subject})
+		assert.Nil(t, err)
+	}
+
+	// exact subscribers get the message as it was published
+	assert.Equal(t, broker.Message{Body: "sensors.a.temp"}, <-exact)
+	assert.Equal(t, broker.Message{Body: "sensors.a.temp", Subject: "sensors.a.temp"}, <-single)
+	assert.Equal(t, "sensors.a.temp", (<-tail).Subject)
+	assert.Equal(t, "sensors.b.humidity", (<-tail).Subject)
+	assert.Empty(t, single)
+	assert.Empty(t, tail)
+	assert.Empty(t, exact)
+
+	assert.Equal(t, 3, module.(*Module).Receivers("sensors.a.temp"))
+	assert.Equal(t, 1, module.(*Module).Receivers("sensors.b.humidity"))
+	assert.Equal(t, 0, module.(*Module).Receivers("other.a.temp"))
+}
+
+func TestMatchSubjectShouldNotWidenPatterns(t *testing.T) {
+	assert.True(t, broker.MatchSubject("orders.>", "orders.*"))
+	assert.True(t, broker.MatchSubject("orders.>", "orders.>"))
+	assert.True(t, broker.MatchSubject("orders.*", "orders.*"))
+	assert.False(t, broker.MatchSubject("orders.*", "orders.>"))
+	assert.False(t, broker.MatchSubject("orders.eu", "orders.*"))
+	assert.False(t, broker.MatchSubject("*", ">"))
+	assert.True(t, broker.IsPattern("orders.*.created"))
+	assert.True(t, broker.IsPattern(">"))
+	assert.False(t, broker.IsPattern("orders.>.created"))
+}
+
+func TestFilteredSubscriptionShouldOnlyGetMatchingMessages(t *testing.T) {
+	module := NewModule(datacontrol.NewDataMemory()).(*Module)
+	ctx := testContext(t)
+	// other tests may have used up the tracked subjects, and both
+	// subjects may share a label
+	filteredCount := func() float64 {
+		count := testutil.ToFloat64(metrics.FilteredMessages.WithLabelValues(metrics.SubjectLabel("payments.eu")))
+		if label := metrics.SubjectLabel("payments.us"); label != metrics.SubjectLabel("payments.eu") {
+			count += testutil.ToFloat64(metrics.FilteredMessages.WithLabelValues(label))
+		}
+		return count
+	}
+	filtered := filteredCount()
+
+	large, err := filter.Compile(`header.region == "eu" && body.amount > 100`)
+	assert.Nil(t, err)
+	exact, err := module.SubscribeFilter(ctx, "payments.eu", large)
+	assert.Nil(t, err)
+	bySubject, err := filter.Compile(`subject == "payments.eu"`)
+	assert.Nil(t, err)
+	pattern, err := module.SubscribeFilter(ctx, "payments.*", bySubject)
+	assert.Nil(t, err)
+	all, err := module.Subscribe(ctx, "payments.eu")
+	assert.Nil(t, err)
+
+	eu := map[string]string{"region": "eu"}
+	for _, msg := range []broker.Message{
+		{Body: `{"amount": 50}`, Headers: eu},
+		{Body: `{"amount": 150}`, Headers: map[string]string{"region": "us"}},
+		{Body: `{"amount": 150}`, Headers: eu},
+		{Body: "not json", Headers: eu},
+	} {
+		_, err := module.Publish(mainCtx, "payments.eu", msg)
+		assert.Nil(t, err)
+	}
+	_, err = module.Publish(mainCtx, "payments.us", broker.Message{Body: `{"amount": 150}`, Headers: eu})
+	assert.Nil(t, err)
+
+	assert.Equal(t, `{"amount": 150}`, (<-exact).Body)
+	assert.Empty(t, exact)
+	assert.Len(t, pattern, 4)
+	assert.Len(t, all, 4)
+	// 3 skipped by exact, the one on payments.us by pattern
+	assert.Equal(t, filtered+4, filteredCount())
+}
+
+func TestDurabilityShouldDecideWhatIsSaved(t *testing.T) {
+	data := datacontrol.NewDataMemory()
+	module := NewModule(data).(*Module)
+	counts := make(map[broker.Durability]float64)
+	for _, level := range broker.Durabilities {
+		counts[level] = testutil.ToFloat64(metrics.PublishedByDurability.WithLabelValues(string(level)))
+	}
+
+	sub, err := module.Subscribe(testContext(t), "durable")
+	assert.Nil(t, err)
+	for _, body := range []string{"sync", "async", "none"} {
+		id, err := module.Publish(mainCtx, "durable", broker.Message{Body: body, Expiration: time.Minute, Durability: broker.Durability(body)})
+		assert.Nil(t, err)
+		assert.Equal(t, body == "sync", id != "", body)
+		msg := <-sub
+		assert.Equal(t, body, msg.Body)
+		assert.Equal(t, broker.DurabilityDefault, msg.Durability)
+	}
+	assert.Nil(t, module.SetDurability(broker.DurabilityNone))
+	_, err = module.Publish(mainCtx, "durable", broker.Message{Body: "default", Expiration: time.Minute})
+	assert.Nil(t, err)
+	_, err = module.Publish(mainCtx, "durable", broker.Message{Body: "later", Durability: "later"})
+	assert.ErrorIs(t, err, broker.ErrInvalidDurability)
+
+	// the async publish is saved by the time Close returns
+	assert.Nil(t, module.Close())
+	page, err := data.ListMessages(broker.Range{Subject: "durable", Limit: 10})
+	assert.Nil(t, err)
+	var saved []string
+	for _, msg := range page.Messages {
+		saved = append(saved, msg.Body)
+	}
+	assert.ElementsMatch(t, []string{"sync", "async"}, saved)
+	for level, n := range map[broker.Durability]float64{broker.DurabilitySync: 1, broker.DurabilityAsync: 1, broker.DurabilityNone: 2} {
+		assert.Equal(t, counts[level]+n, testutil.ToFloat64(metrics.PublishedByDurability.WithLabelValues(string(level))), level)
+	}
+}
+
+func TestAsyncPublishShouldBeSavedWhenTheQueueIsFull(t *testing.T) {
+	data := datacontrol.NewDataMemory()
+	module := NewModule(data).(*Module)
+	// a full queue without savers, as if the store fell behind
+	module.saves = make(chan pendingSave, 1)
+	module.saves <- pendingSave{ctx: mainCtx, msg: broker.Message{Body: "queued"}}
+	fallbacks := testutil.ToFloat64(metrics.AsyncSaveFallbacks)
+
+	done := make(chan error)
+	var id string
+	go func() {
+		var err error
+		id, err = module.Publish(mainCtx, "behind", broker.Message{Body: "async", Expiration: time.Minute, Durability: broker.DurabilityAsync})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "publish waited for the queue")
+	}
+	// saved before the publish returned, so its id can be fetched
+	fetched, err := module.Fetch(mainCtx, "behind", id)
+	assert.Nil(t, err)
+	assert.Equal(t, "async", fetched.Body)
+
+	page, err := data.ListMessages(broker.Range{Subject: "behind", Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, page.Messages, 1) {
+		assert.Equal(t, "async", page.Messages[0].Body)
+	}
+	assert.Equal(t, fallbacks+1, testutil.ToFloat64(metrics.AsyncSaveFallbacks))
+}
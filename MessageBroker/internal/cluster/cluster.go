@@ -0,0 +1,430 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"therealbroker/api/metrics"
+	"therealbroker/api/peers"
+	pb "therealbroker/api/proto"
+	bm "therealbroker/internal/broker"
+	"therealbroker/pkg/broker"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultRefreshInterval = 10 * time.Second
+	DefaultQueueSize       = 10000
+)
+
+type Config struct {
+	// Unique name of the node, defaults to the hostname
+	NodeID    string
+	Discovery Discovery
+	// How often Discovery is asked for peers
+	RefreshInterval time.Duration
+	// Messages queued per peer before new ones are dropped
+	QueueSize int
+	// Options of the connections to peers, see package peers. Tls with
+	// the system roots when empty
+	DialOptions []grpc.DialOption
+}
+
+// Node joins a local Module to the cluster. Every publish on the module
+// is forwarded to the peers that have subscribers for its subject, and
+// messages forwarded by peers are delivered to the local subscribers.
+//
+// Each peer gets one ordered queue and stream, so messages of a subject
+// published on one node reach every node in the publish order.
+type Node struct {
+	pb.UnimplementedClusterServer
+
+	id     string
+	module *bm.Module
+	config Config
+
+	lock     sync.Mutex
+	links    map[string]*link
+	self     map[string]bool
+	watchers map[chan struct{}]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewNode(module *bm.Module, config Config) *Node {
+	if config.NodeID == "" {
+		config.NodeID, _ = os.Hostname()
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if len(config.DialOptions) == 0 {
+		config.DialOptions = peers.SecureDialOptions()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		id:       config.NodeID,
+		module:   module,
+		config:   config,
+		links:    make(map[string]*link),
+		self:     make(map[string]bool),
+		watchers: make(map[chan struct{}]bool),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	module.SetForwarder(n.forward)
+	module.SetInterestHook(n.notify)
+	return n
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Start links to the discovered peers and keeps the links up to date.
+func (n *Node) Start() {
+	n.refresh()
+	go func() {
+		ticker := time.NewTicker(n.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n.refresh()
+			case <-n.ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("cluster node started", "node_id", n.id)
+}
+
+// Close leaves the cluster. The module keeps working on its own.
+func (n *Node) Close() error {
+	n.module.SetForwarder(nil)
+	n.module.SetInterestHook(nil)
+	n.cancel()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for address, l := range n.links {
+		l.close()
+		delete(n.links, address)
+	}
+	return nil
+}
+
+func (n *Node) refresh() {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.RefreshInterval)
+	defer cancel()
+	peers, err := n.config.Discovery.Peers(ctx)
+	if err != nil {
+		slog.Warn("failed to discover cluster peers", "error", err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ctx.Err() != nil {
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, address := range peers {
+		wanted[address] = true
+		if n.self[address] || n.links[address] != nil {
+			continue
+		}
+		l, err := newLink(n, address)
+		if err != nil {
+			slog.Warn("failed to link cluster peer", "address", address, "error", err)
+			continue
+		}
+		n.links[address] = l
+		l.run()
+	}
+	for address, l := range n.links {
+		if !wanted[address] {
+			l.close()
+			delete(n.links, address)
+			slog.Info("cluster peer removed", "address", address)
+		}
+	}
+}
+
+// markSelf drops the link to address, it leads back to this node
+func (n *Node) markSelf(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.self[address] = true
+	if l := n.links[address]; l != nil {
+		l.close()
+		delete(n.links, address)
+	}
+}
+
+// forward queues msg for every peer interested in subject. It runs with
+// the module locked, so the queues get messages in publish order.
+func (n *Node) forward(subject string, msg broker.Message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var req *pb.ForwardRequest
+	for _, l := range n.links {
+		if !l.interested(subject) {
+			continue
+		}
+		if req == nil {
+			req = &pb.ForwardRequest{NodeId: n.id, Subject: subject, Body: msg.Body, Headers: msg.Headers}
+		}
+		l.enqueue(req)
+	}
+}
+
+// notify wakes the Interest streams after the local subjects changed
+func (n *Node) notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for changed := range n.watchers {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) watch() chan struct{} {
+	changed := make(chan struct{}, 1)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.watchers[changed] = true
+	return changed
+}
+
+func (n *Node) unwatch(changed chan struct{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.watchers, changed)
+}
+
+// interestedPeers counts the linked peers that want subject
+func (n *Node) interestedPeers(subject string) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	count := 0
+	for _, l := range n.links {
+		if l.interested(subject) {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *Node) Interest(req *pb.InterestRequest, stream pb.Cluster_InterestServer) error {
+	changed := n.watch()
+	defer n.unwatch(changed)
+	slog.Debug("cluster peer watching interest", "peer", req.NodeId)
+	for {
+		update := &pb.InterestUpdate{NodeId: n.id, Subjects: n.module.Subjects()}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		case <-n.ctx.Done():
+			return status.Error(codes.Unavailable, "node left the cluster")
+		}
+	}
+}
+
+func (n *Node) Forward(stream pb.Cluster_ForwardServer) error {
+	var delivered int64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.ForwardResponse{Delivered: delivered})
+		}
+		if err != nil {
+			return err
+		}
+		msg := broker.Message{Body: req.Body, Headers: req.Headers}
+		if err := n.module.Deliver(req.Subject, msg); err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		delivered++
+	}
+}
+
+// link is the connection to one peer. It follows the interest of the
+// peer and sends it the queued messages over a single Forward stream.
+type link struct {
+	node    *Node
+	address string
+	conn    *grpc.ClientConn
+	client  pb.ClusterClient
+	queue   chan *pb.ForwardRequest
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock     sync.RWMutex
+	subjects map[string]bool
+	// subjects of the peer that are patterns
+	patterns  []string
+	connected bool
+}
+
+func newLink(n *Node, address string) (*link, error) {
+	conn, err := grpc.NewClient(address, n.config.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	return &link{
+		node:     n,
+		address:  address,
+		conn:     conn,
+		client:   pb.NewClusterClient(conn),
+		queue:    make(chan *pb.ForwardRequest, n.config.QueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		subjects: make(map[string]bool),
+	}, nil
+}
+
+func (l *link) run() {
+	go l.watchInterest()
+	go l.send()
+}
+
+func (l *link) close() {
+	l.cancel()
+	l.setSubjects(nil, false)
+	l.conn.Close()
+}
+
+func (l *link) interested(subject string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.subjects[subject] || broker.MatchAnySubject(l.patterns, subject)
+}
+
+// setSubjects reports whether the link just became connected
+func (l *link) setSubjects(subjects []string, connected bool) bool {
+	set := make(map[string]bool, len(subjects))
+	var patterns []string
+	for _, s := range subjects {
+		set[s] = true
+		if broker.IsPattern(s) {
+			patterns = append(patterns, s)
+		}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.subjects, l.patterns = set, patterns
+	if connected == l.connected {
+		return false
+	}
+	l.connected = connected
+	if connected {
+		metrics.ClusterPeers.Inc()
+	} else {
+		metrics.ClusterPeers.Dec()
+	}
+	return connected
+}
+
+// enqueue never blocks, the module is locked while it runs. Messages
+// for a peer that does not keep up are dropped.
+func (l *link) enqueue(req *pb.ForwardRequest) {
+	select {
+	case l.queue <- req:
+		metrics.ForwardedMessages.WithLabelValues(metrics.SubjectLabel(req.Subject)).Inc()
+	default:
+		metrics.DroppedMessages.WithLabelValues(metrics.SubjectLabel(req.Subject), "peer_queue_full").Inc()
+	}
+}
+
+func (l *link) watchInterest() {
+	backoff := newBackoff()
+	for l.ctx.Err() == nil {
+		stream, err := l.client.Interest(l.ctx, &pb.InterestRequest{NodeId: l.node.id})
+		for err == nil {
+			var update *pb.InterestUpdate
+			update, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			if update.NodeId == l.node.id {
+				l.node.markSelf(l.address)
+				return
+			}
+			if l.setSubjects(update.Subjects, true) {
+				slog.Info("cluster peer linked", "address", l.address, "peer", update.NodeId)
+			}
+			backoff.reset()
+		}
+		l.setSubjects(nil, false)
+		if l.ctx.Err() == nil {
+			slog.Debug("cluster interest stream failed", "address", l.address, "error", err)
+		}
+		backoff.wait(l.ctx)
+	}
+}
+
+func (l *link) send() {
+	backoff := newBackoff()
+	for l.ctx.Err() == nil {
+		stream, err := l.client.Forward(l.ctx)
+		if err != nil {
+			backoff.wait(l.ctx)
+			continue
+		}
+		backoff.reset()
+		for err == nil {
+			select {
+			case req := <-l.queue:
+				if err = stream.Send(req); err != nil {
+					metrics.DroppedMessages.WithLabelValues(metrics.SubjectLabel(req.Subject), "peer_unavailable").Inc()
+				}
+			case <-l.ctx.Done():
+				stream.CloseSend()
+				return
+			}
+		}
+		_, err = stream.CloseAndRecv()
+		slog.Debug("cluster forward stream failed", "address", l.address, "error", err)
+		backoff.wait(l.ctx)
+	}
+}
+
+type backoff struct {
+	delay time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{delay: 100 * time.Millisecond}
+}
+
+func (b *backoff) reset() {
+	b.delay = 100 * time.Millisecond
+}
+
+func (b *backoff) wait(ctx context.Context) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+	}
+	b.delay = min(2*b.delay, 5*time.Second)
+}
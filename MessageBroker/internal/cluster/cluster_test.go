@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"therealbroker/api/peers"
+	pb "therealbroker/api/proto"
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// token the nodes of startCluster share
+const testToken = "cluster-secret"
+
+type testNode struct {
+	*Node
+	module *bm.Module
+}
+
+// startCluster runs count nodes in this process, all of them knowing
+// every address including their own.
+func startCluster(t *testing.T, count int) []testNode {
+	listeners := make([]net.Listener, count)
+	addresses := make(StaticPeers, count)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[i] = lis
+		addresses[i] = lis.Addr().String()
+	}
+
+	nodes := make([]testNode, count)
+	for i, lis := range listeners {
+		module := bm.NewModule(datacontrol.NewDataMemory()).(*bm.Module)
+		node := NewNode(module, Config{
+			NodeID:          fmt.Sprintf("node-%d", i),
+			Discovery:       addresses,
+			RefreshInterval: 50 * time.Millisecond,
+			DialOptions:     peers.DialOptions(nil, testToken),
+		})
+		grpcServer := grpc.NewServer(peers.ServerOptions(nil, testToken)...)
+		pb.RegisterClusterServer(grpcServer, node)
+		go grpcServer.Serve(lis)
+		node.Start()
+		t.Cleanup(func() {
+			node.Close()
+			grpcServer.Stop()
+			module.Close()
+		})
+		nodes[i] = testNode{Node: node, module: module}
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, ch <-chan broker.Message) broker.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return broker.Message{}
+	}
+}
+
+func TestPublishShouldReachSubscribersOnOtherNodes(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+
+	local, err := nodes[0].module.Subscribe(ctx, "orders")
+	assert.Nil(t, err)
+	remote, err := nodes[1].module.Subscribe(ctx, "orders")
+	assert.Nil(t, err)
+	waitFor(t, func() bool { return nodes[0].interestedPeers("orders") == 1 })
+	waitFor(t, func() bool { return nodes[2].interestedPeers("orders") == 2 })
+
+	_, err = nodes[0].module.Publish(ctx, "orders", broker.Message{Body: "from-0"})
+	assert.Nil(t, err)
+	_, err = nodes[2].module.Publish(ctx, "orders", broker.Message{Body: "from-2"})
+	assert.Nil(t, err)
+
+	// nothing orders messages published on different nodes
+	for _, ch := range []<-chan broker.Message{local, remote} {
+		assert.ElementsMatch(t, []string{"from-0", "from-2"}, []string{receive(t, ch).Body, receive(t, ch).Body})
+	}
+}
+
+func TestMeshShouldRefuseCallersWithoutTheToken(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	grpcServer := grpc.NewServer(peers.ServerOptions(nil, testToken)...)
+	pb.RegisterClusterServer(grpcServer, NewNode(bm.NewModule(datacontrol.NewDataMemory()).(*bm.Module), Config{}))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	for _, token := range []string{"", "guess"} {
+		conn, err := grpc.NewClient(lis.Addr().String(), peers.DialOptions(nil, token)...)
+		assert.Nil(t, err)
+		defer conn.Close()
+		stream, err := pb.NewClusterClient(conn).Forward(context.Background())
+		if err == nil {
+			stream.Send(&pb.ForwardRequest{Subject: "orders", Body: "forged"})
+			_, err = stream.CloseAndRecv()
+		}
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), token)
+	}
+}
+
+func TestForwardedMessagesShouldKeepSubjectOrder(t *testing.T) {
+	nodes := startCluster(t, 2)
+	ctx := context.Background()
+
+	ch, err := nodes[1].module.Subscribe(ctx, "orders")
+	assert.Nil(t, err)
+	waitFor(t, func() bool { return nodes[0].interestedPeers("orders") == 1 })
+
+	for i := 0; i < 500; i++ {
+		_, err := nodes[0].module.Publish(ctx, "orders", broker.Message{
+			Body:    fmt.Sprint(i),
+			Headers: map[string]string{"seq": fmt.Sprint(i)},
+		})
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		msg := receive(t, ch)
+		assert.Equal(t, fmt.Sprint(i), msg.Body)
+		assert.Equal(t, fmt.Sprint(i), msg.Headers["seq"])
+	}
+}
+
+func TestNodeShouldOnlyForwardToInterestedPeers(t *testing.T) {
+	nodes := startCluster(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch, err := nodes[1].module.Subscribe(ctx, "orders")
+	assert.Nil(t, err)
+	waitFor(t, func() bool { return nodes[0].interestedPeers("orders") == 1 })
+	assert.Equal(t, 0, nodes[0].interestedPeers("payments"))
+
+	cancel()
+	waitFor(t, func() bool { return nodes[0].interestedPeers("orders") == 0 })
+	_, err = nodes[0].module.Publish(context.Background(), "orders", broker.Message{Body: "late"})
+	assert.Nil(t, err)
+	for range ch {
+		t.Fatal("cancelled subscriber got a forwarded message")
+	}
+}
+
+func TestNodeShouldNotLinkToItself(t *testing.T) {
+	nodes := startCluster(t, 2)
+
+	waitFor(t, func() bool {
+		nodes[0].lock.Lock()
+		defer nodes[0].lock.Unlock()
+		return len(nodes[0].self) == 1 && len(nodes[0].links) == 1
+	})
+}
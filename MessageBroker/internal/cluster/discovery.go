@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+// Discovery finds the cluster addresses of the broker nodes. The result
+// may contain the node itself, links to it are dropped once the node id
+// is seen.
+type Discovery interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of host:port addresses
+type StaticPeers []string
+
+func (p StaticPeers) Peers(context.Context) ([]string, error) {
+	return p, nil
+}
+
+// DNSPeers resolves every address of Host, e.g. the headless service of
+// the broker statefulset, and pairs it with Port.
+type DNSPeers struct {
+	Host     string
+	Port     string
+	Resolver *net.Resolver
+}
+
+func (p DNSPeers) Peers(ctx context.Context) ([]string, error) {
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	hosts, err := resolver.LookupHost(ctx, p.Host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	peers := make([]string, len(hosts))
+	for i, host := range hosts {
+		peers[i] = net.JoinHostPort(host, p.Port)
+	}
+	return peers, nil
+}
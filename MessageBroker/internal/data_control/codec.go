@@ -0,0 +1,116 @@
+package datacontrol
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+
+	"therealbroker/api/metrics"
+	"therealbroker/internal/keyring"
+	"therealbroker/pkg/compression"
+)
+
+// A body is sealed by a key, but the backend has no keyring
+var errNoKeyring = errors.New("message body is encrypted and no keyring is configured")
+
+// bodyCodec turns bodies into what the backends store and back. Bodies
+// are compressed, then sealed by the keyring. The compression and the
+// key id are stored next to every body, so rows written before, or with
+// other settings, stay readable. Compressed or sealed bodies are base64
+// encoded to fit the text body columns.
+type bodyCodec struct {
+	algorithm string
+	// Bodies shorter than this are not compressed
+	threshold int
+	// Bodies are stored in plaintext when nil
+	keyring *keyring.Keyring
+}
+
+// storedBody is a body as stored, with what it takes to read it back
+type storedBody struct {
+	body string
+	// Empty when the body is not compressed
+	compression string
+	// Empty when the body is not encrypted
+	keyID string
+}
+
+func (c bodyCodec) encode(body string) (storedBody, error) {
+	data, algorithm := c.compress(body)
+	if c.keyring == nil {
+		if algorithm == compression.None {
+			return storedBody{body: body}, nil
+		}
+		return storedBody{body: base64.StdEncoding.EncodeToString(data), compression: algorithm}, nil
+	}
+	sealed, keyID, err := c.keyring.Seal(data)
+	if err != nil {
+		return storedBody{}, err
+	}
+	return storedBody{body: base64.StdEncoding.EncodeToString(sealed), compression: algorithm, keyID: keyID}, nil
+}
+
+// compress returns the body compressed, or as it is when it is small or
+// does not shrink, e.g. already compressed media.
+func (c bodyCodec) compress(body string) ([]byte, string) {
+	if c.algorithm == compression.None || len(body) < c.threshold {
+		return []byte(body), compression.None
+	}
+	data, err := compression.Compress(c.algorithm, []byte(body))
+	if err != nil {
+		slog.Error("failed to compress message body", "algorithm", c.algorithm, "error", err)
+		return []byte(body), compression.None
+	}
+	// base64 costs a third more, unless the body is sealed anyway
+	size := len(data)
+	if c.keyring == nil {
+		size = base64.StdEncoding.EncodedLen(size)
+	}
+	if size >= len(body) {
+		return []byte(body), compression.None
+	}
+	metrics.CompressedBytes.WithLabelValues(c.algorithm, "raw").Add(float64(len(body)))
+	metrics.CompressedBytes.WithLabelValues(c.algorithm, "compressed").Add(float64(len(data)))
+	return data, c.algorithm
+}
+
+// decode reverses encode, whatever the settings the body was stored with
+func (c bodyCodec) decode(stored storedBody) (string, error) {
+	if stored.compression == compression.None && stored.keyID == "" {
+		return stored.body, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(stored.body)
+	if err != nil {
+		return "", err
+	}
+	if stored.keyID != "" {
+		if c.keyring == nil {
+			return "", errNoKeyring
+		}
+		if data, err = c.keyring.Open(data, stored.keyID); err != nil {
+			return "", err
+		}
+	}
+	data, err = compression.Decompress(stored.compression, data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// reencode seals stored again with the primary key, plaintext bodies
+// included. It reports false when stored already uses the primary key.
+func (c bodyCodec) reencode(stored storedBody) (storedBody, bool, error) {
+	if c.keyring == nil {
+		return storedBody{}, false, errNoKeyring
+	}
+	if stored.keyID == c.keyring.Primary() {
+		return stored, false, nil
+	}
+	body, err := c.decode(stored)
+	if err != nil {
+		return storedBody{}, false, err
+	}
+	stored, err = c.encode(body)
+	return stored, err == nil, err
+}
@@ -0,0 +1,75 @@
+package datacontrol
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"therealbroker/internal/keyring"
+	"therealbroker/pkg/compression"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKeyring returns a keyring of the keys ids, the last one primary
+func newTestKeyring(t *testing.T, ids ...string) *keyring.Keyring {
+	file := &keyring.File{Primary: ids[len(ids)-1]}
+	for i, id := range ids {
+		secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32)))
+		file.Keys = append(file.Keys, keyring.Key{ID: id, Secret: secret})
+	}
+	k, err := keyring.New(file)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return k
+}
+
+func TestCodecShouldReadEveryStoredForm(t *testing.T) {
+	large := strings.Repeat(`{"item":"book","count":1}`, 100)
+	codecs := map[string]bodyCodec{
+		"plain":                    {},
+		"compressed":               {algorithm: compression.Zstd},
+		"encrypted":                {keyring: newTestKeyring(t, "key-1")},
+		"compressed and encrypted": {algorithm: compression.Gzip, keyring: newTestKeyring(t, "key-1")},
+	}
+	// the reader knows the keys, whatever it writes with
+	reader := bodyCodec{keyring: newTestKeyring(t, "key-1")}
+	for name, codec := range codecs {
+		stored, err := codec.encode(large)
+		assert.Nil(t, err, name)
+		if codec.keyring != nil {
+			assert.Equal(t, "key-1", stored.keyID, name)
+			assert.NotContains(t, stored.body, "book", name)
+		}
+		body, err := reader.decode(stored)
+		assert.Nil(t, err, name)
+		assert.Equal(t, large, body, name)
+	}
+
+	// a sealed body needs the keyring
+	stored, err := codecs["encrypted"].encode("secret")
+	assert.Nil(t, err)
+	_, err = bodyCodec{}.decode(stored)
+	assert.Equal(t, errNoKeyring, err)
+}
+
+func TestReencodeShouldMoveBodiesToThePrimaryKey(t *testing.T) {
+	old := bodyCodec{keyring: newTestKeyring(t, "key-1")}
+	stored, err := old.encode("secret")
+	assert.Nil(t, err)
+
+	codec := bodyCodec{keyring: newTestKeyring(t, "key-1", "key-2")}
+	for _, before := range []storedBody{stored, {body: "plain"}} {
+		after, changed, err := codec.reencode(before)
+		assert.Nil(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, "key-2", after.keyID)
+		_, changed, err = codec.reencode(after)
+		assert.Nil(t, err)
+		assert.False(t, changed)
+	}
+
+	_, _, err = bodyCodec{keyring: newTestKeyring(t, "key-3")}.reencode(stored)
+	assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+}
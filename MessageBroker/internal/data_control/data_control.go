@@ -7,5 +7,25 @@ import (
 type DataControl interface {
 	SaveMessage(msg broker.Message) (string, error)
 	RetriveMessage(id string) (broker.Message, error)
+	// ListMessages reads the page r selects, r is already validated. The
+	// subject of a saved message is the Subject field it was saved with.
+	ListMessages(r broker.Range) (broker.Page, error)
 	ClearData() error
+	// TestConnection reports whether the backend is reachable
+	TestConnection() bool
+}
+
+// BackendName names the storage behind a DataControl, for metrics and traces
+func BackendName(data DataControl) string {
+	switch data.(type) {
+	case *DataMemory:
+		return "memory"
+	case *DataPostgres:
+		return "postgres"
+	case *DataScylla:
+		return "scylla"
+	case *DataRaft:
+		return "raft"
+	}
+	return "unknown"
 }
@@ -2,7 +2,9 @@ package datacontrol
 
 import (
 	"fmt"
+	"log/slog"
 	"sync"
+	"therealbroker/internal/keyring"
 	"therealbroker/pkg/broker"
 	"time"
 )
@@ -10,19 +12,33 @@ import (
 type DataMemory struct {
 	DataControl
 	expirationTime map[string]time.Time
-	message        map[string]broker.Message
+	message        map[string]storedMessage
 	messageId      int
 	lock           sync.Mutex
+	codec          bodyCodec
+
+	// ids saved on every subject, the sequence of a message is its
+	// index plus one
+	subjects  map[string][]string
+	sequences map[string]uint64
 }
 
 func NewDataMemory() *DataMemory {
 	return &DataMemory{
 		expirationTime: make(map[string]time.Time),
-		message:        make(map[string]broker.Message),
+		message:        make(map[string]storedMessage),
 		messageId:      0,
+		subjects:       make(map[string][]string),
+		sequences:      make(map[string]uint64),
 	}
 }
 
+// SetEncryption seals the bodies with the primary key of k, see package
+// keyring. Call it before the first save.
+func (dm *DataMemory) SetEncryption(k *keyring.Keyring) {
+	dm.codec.keyring = k
+}
+
 func (dm *DataMemory) ClearData() error {
 	dm.lock.Lock()
 	defer dm.lock.Unlock()
@@ -34,17 +50,32 @@ func (dm *DataMemory) ClearData() error {
 		delete(dm.message, k)
 	}
 
+	clear(dm.subjects)
+	clear(dm.sequences)
 	dm.messageId = 0
 	return nil
 }
 
+func (dm *DataMemory) TestConnection() bool {
+	return true
+}
+
 func (dm *DataMemory) SaveMessage(msg broker.Message) (string, error) {
+	stored, err := dm.codec.encode(msg.Body)
+	if err != nil {
+		slog.Error("failed to encrypt message body", "backend", "memory", "error", err)
+		return "", broker.ErrRunQuery
+	}
+	msg.Body = ""
+
 	dm.lock.Lock()
 	msg.Id = fmt.Sprintf("%v", dm.messageId)
 	dm.messageId++
 
 	dm.expirationTime[msg.Id] = time.Now().Add(msg.Expiration)
-	dm.message[msg.Id] = msg
+	dm.message[msg.Id] = storedMessage{Message: msg, stored: stored}
+	dm.subjects[msg.Subject] = append(dm.subjects[msg.Subject], msg.Id)
+	dm.sequences[msg.Id] = uint64(len(dm.subjects[msg.Subject]))
 	dm.lock.Unlock()
 	return msg.Id, nil
 }
@@ -59,7 +90,59 @@ func (dm *DataMemory) RetriveMessage(id string) (broker.Message, error) {
 		return broker.Message{}, broker.ErrExpiredID
 	}
 	msg := dm.message[id]
-	return msg, nil
+	body, err := dm.codec.decode(msg.stored)
+	if err != nil {
+		slog.Error("failed to decode message body", "backend", "memory", "id", id, "error", err)
+		return broker.Message{}, broker.ErrRunQuery
+	}
+	msg.Body = body
+	return msg.Message, nil
+}
+
+func (dm *DataMemory) ListMessages(r broker.Range) (broker.Page, error) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	start, err := rangeStart(r, func(id string) (string, uint64, error) {
+		msg, ok := dm.message[id]
+		if !ok {
+			return "", 0, broker.ErrInvalidID
+		}
+		return msg.Subject, dm.sequences[id], nil
+	})
+	if err != nil {
+		return broker.Page{}, err
+	}
+
+	ids := dm.subjects[r.Subject]
+	// index of the first message read, past the end when there is none
+	i, step := 0, 1
+	if start > 0 {
+		i = int(min(start, uint64(len(ids)+1))) - 1
+	}
+	if r.Reverse {
+		step = -1
+		if start == 0 || i >= len(ids) {
+			i = len(ids) - 1
+		}
+	}
+	now := time.Now()
+	var messages []broker.StoredMessage
+	for ; i >= 0 && i < len(ids) && len(messages) <= r.Limit; i += step {
+		expiresAt := dm.expirationTime[ids[i]]
+		msg := dm.message[ids[i]]
+		savedAt := expiresAt.Add(-msg.Expiration)
+		if now.After(expiresAt) || !r.Includes(savedAt) {
+			continue
+		}
+		body, err := dm.codec.decode(msg.stored)
+		if err != nil {
+			slog.Error("failed to decode message body", "backend", "memory", "id", ids[i], "error", err)
+			return broker.Page{}, broker.ErrRunQuery
+		}
+		msg.Body = body
+		messages = append(messages, broker.StoredMessage{Message: msg.Message, Sequence: uint64(i + 1), SavedAt: savedAt})
+	}
+	return newPage(messages, r.Limit), nil
 }
 
 func (dm *DataMemory) IdExists(id string) bool {
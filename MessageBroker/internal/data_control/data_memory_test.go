@@ -0,0 +1,37 @@
+package datacontrol
+
+import (
+	"testing"
+	"time"
+
+	"therealbroker/internal/data_control/datatest"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	datatest.Run(t, func(t *testing.T) datatest.Store {
+		return NewDataMemory()
+	}, datatest.Options{MissingID: "999999999"})
+	t.Run("encrypted", func(t *testing.T) {
+		datatest.Run(t, func(t *testing.T) datatest.Store {
+			dm := NewDataMemory()
+			dm.SetEncryption(newTestKeyring(t, "key-1"))
+			return dm
+		}, datatest.Options{MissingID: "999999999"})
+	})
+}
+
+func TestMemoryShouldNotKeepPlaintextBodies(t *testing.T) {
+	dm := NewDataMemory()
+	dm.SetEncryption(newTestKeyring(t, "key-1"))
+	id, err := dm.SaveMessage(broker.Message{Body: "card 4111", Expiration: time.Minute})
+	assert.Nil(t, err)
+	assert.Equal(t, "key-1", dm.message[id].stored.keyID)
+	assert.NotContains(t, dm.message[id].stored.body, "4111")
+
+	msg, err := dm.RetriveMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "card 4111", msg.Body)
+}
@@ -4,18 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
+	"therealbroker/api/metrics"
+	"therealbroker/internal/keyring"
 	"therealbroker/pkg/broker"
 	"time"
 
 	"github.com/jackc/pgx/pgtype"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// postgresDB is the part of pgxpool.Pool the backend uses, so tests can
+// run it against a fake
+type postgresDB interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
 type DataPostgres struct {
 	DataControl
 	host     string
@@ -23,9 +36,14 @@ type DataPostgres struct {
 	username string
 	password string
 	dbName   string
-	db       *pgxpool.Pool
+	db       postgresDB
 	batch    *PublishBatch
 	ctx      context.Context
+
+	maxConns      int32
+	minConns      int32
+	flushInterval time.Duration
+	codec         bodyCodec
 }
 
 func NewDataPostgres(host, port, username, password, dbName string, ctx context.Context) *DataPostgres {
@@ -38,27 +56,68 @@ func NewDataPostgres(host, port, username, password, dbName string, ctx context.
 		db:       nil,
 		batch:    nil,
 		ctx:      ctx,
+
+		maxConns:      5,
+		minConns:      2,
+		flushInterval: 100 * time.Millisecond,
 	}
 }
 
+// SetPool sizes the connection pool, call it before Connect.
+func (dp *DataPostgres) SetPool(maxConns, minConns int32) {
+	dp.maxConns = maxConns
+	dp.minConns = minConns
+}
+
+// SetCompression compresses the bodies of at least threshold bytes with
+// algorithm, see package compression. Rows stored before stay readable.
+func (dp *DataPostgres) SetCompression(algorithm string, threshold int) {
+	dp.codec.algorithm, dp.codec.threshold = algorithm, threshold
+}
+
+// SetEncryption seals the bodies with the primary key of k, see package
+// keyring. Rows stored before stay readable, see Reencrypt.
+func (dp *DataPostgres) SetEncryption(k *keyring.Keyring) {
+	dp.codec.keyring = k
+}
+
+// SetFlushInterval sets how often queued publishes are inserted as one
+// batch, call it before Connect.
+func (dp *DataPostgres) SetFlushInterval(interval time.Duration) {
+	dp.flushInterval = interval
+}
+
 type PublishBatch struct {
 	lock          sync.Mutex
-	msgs          []broker.Message
-	responses     []chan string
-	db            *pgxpool.Pool
+	msgs          []storedMessage
+	responses     []chan saveResult
+	db            postgresDB
 	ctx           context.Context
 	flushInterval time.Duration
 	stopChan      chan bool
+	stopped       bool
+}
+
+// storedMessage is a queued message with its body as stored
+type storedMessage struct {
+	broker.Message
+	stored storedBody
+}
+
+// saveResult answers one queued publish
+type saveResult struct {
+	id  string
+	err error
 }
 
-func NewPublishBatch(db *pgxpool.Pool, ctx context.Context) *PublishBatch {
+func NewPublishBatch(db postgresDB, ctx context.Context, flushInterval time.Duration) *PublishBatch {
 	batch := PublishBatch{
 		lock:          sync.Mutex{},
-		msgs:          make([]broker.Message, 0),
-		responses:     make([]chan string, 0),
+		msgs:          make([]storedMessage, 0),
+		responses:     make([]chan saveResult, 0),
 		db:            db,
 		ctx:           ctx,
-		flushInterval: 100 * time.Millisecond,
+		flushInterval: flushInterval,
 		stopChan:      make(chan bool),
 	}
 	batch.StartExecuter()
@@ -74,76 +133,126 @@ func (dp *DataPostgres) Connect() error {
 		return errors.New("unable to parse database configuration")
 	}
 
-	config.MaxConns = 5
-	config.MinConns = 2
+	config.MaxConns = dp.maxConns
+	config.MinConns = dp.minConns
 
-	dp.db, err = pgxpool.NewWithConfig(dp.ctx, config)
+	pool, err := pgxpool.NewWithConfig(dp.ctx, config)
 	if err != nil {
 		return errors.New("unable to create connection pool")
 	}
+	if err := dp.attach(pool); err != nil {
+		return err
+	}
+	slog.Info("connected to database", "backend", "postgres", "host", dp.host, "port", dp.port, "db", dp.dbName)
+	return nil
+}
 
+// attach starts using db once it answers a ping
+func (dp *DataPostgres) attach(db postgresDB) error {
+	dp.db = db
 	if !dp.TestConnection() {
 		return errors.New("failed to ping the database")
 	}
-
-	dp.batch = NewPublishBatch(dp.db, dp.ctx)
-
+	dp.batch = NewPublishBatch(dp.db, dp.ctx, dp.flushInterval)
 	return nil
 }
 
+// Close inserts the queued publishes, then closes the pool
 func (dp *DataPostgres) Close() error {
-	dp.db.Close()
 	dp.batch.StopExecuter()
+	dp.db.Close()
 	return nil
 }
 
-func (b *PublishBatch) Query() string {
+// Query inserts the queued messages in one statement. The sequences of
+// their subjects are taken from subject_sequences in the same statement,
+// its row lock keeps brokers sharing the database from handing out a
+// sequence twice.
+func (b *PublishBatch) Query() (string, []interface{}) {
 	var builder strings.Builder
-	builder.WriteString("INSERT INTO messages (body, expiration_duration)\nVALUES\n")
+	args := make([]interface{}, 0, 6*len(b.msgs))
+	builder.WriteString("WITH batch (n, subject, body, expiration, headers, compression, key_id) AS (\nVALUES\n")
 	for i, msg := range b.msgs {
 		if i > 0 {
 			builder.WriteString(", ")
 		}
-		builder.WriteString(fmt.Sprintf("('%s', '%v')", msg.Body, msg.Expiration.Seconds()))
+		builder.WriteString(fmt.Sprintf("(%d, $%d::text, $%d::text, $%d::float8, $%d::jsonb, $%d::text, $%d::text)", i, 6*i+1, 6*i+2, 6*i+3, 6*i+4, 6*i+5, 6*i+6))
+		args = append(args, msg.Subject, msg.stored.body, msg.Expiration.Seconds(), msg.Headers, msg.stored.compression, msg.stored.keyID)
 	}
-	builder.WriteString("\n RETURNING id")
-	return builder.String()
+	builder.WriteString(`
+), counts AS (
+    INSERT INTO subject_sequences AS s (subject, last)
+    SELECT subject, count(*) FROM batch GROUP BY subject
+    ON CONFLICT (subject) DO UPDATE SET last = s.last + EXCLUDED.last
+    RETURNING subject, last
+)
+INSERT INTO messages (subject, sequence, body, expiration_duration, headers, compression, key_id)
+SELECT b.subject, c.last - count(*) OVER w + row_number() OVER (w ORDER BY b.n),
+    b.body, make_interval(secs => b.expiration), b.headers, NULLIF(b.compression, ''), NULLIF(b.key_id, '')
+FROM batch b JOIN counts c ON c.subject = b.subject
+WINDOW w AS (PARTITION BY b.subject)
+ORDER BY b.n
+ RETURNING id`)
+	return builder.String(), args
 }
 
-func (b *PublishBatch) AddtoQueue(msg broker.Message) chan string {
+// AddtoQueue queues msg, with its body as stored
+func (b *PublishBatch) AddtoQueue(msg broker.Message, stored storedBody) chan saveResult {
 	b.lock.Lock()
-	b.msgs = append(b.msgs, msg)
-	newresp := make(chan string, 1)
+	defer b.lock.Unlock()
+	newresp := make(chan saveResult, 1)
+	if b.stopped {
+		newresp <- saveResult{err: broker.ErrUnavailable}
+		return newresp
+	}
+	b.msgs = append(b.msgs, storedMessage{Message: msg, stored: stored})
 	b.responses = append(b.responses, newresp)
-	b.lock.Unlock()
 	return newresp
 }
 
+// Execute inserts the queued messages and answers every queued publish,
+// with an error when the batch could not be inserted.
 func (b *PublishBatch) Execute() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	if len(b.responses) == 0 {
 		return
 	}
-	rows, err := b.db.Query(b.ctx, b.Query())
+	answered := b.insert()
+	for _, resp := range b.responses[answered:] {
+		resp <- saveResult{err: broker.ErrRunQuery}
+	}
+	b.responses = make([]chan saveResult, 0)
+	b.msgs = make([]storedMessage, 0)
+}
+
+// insert runs the batch query and returns how many publishes got an id
+func (b *PublishBatch) insert() int {
+	query, args := b.Query()
+	rows, err := b.db.Query(b.ctx, query, args...)
 	if err != nil {
-		log.Println(err)
-		return
+		slog.Error("failed to insert message batch", "backend", "postgres", "batch_size", len(b.msgs), "error", err)
+		return 0
 	}
 	defer rows.Close()
 	i := 0
-	for rows.Next() {
+	for i < len(b.responses) && rows.Next() {
 		var id string
 		err := rows.Scan(&id)
 		if err != nil {
-			log.Println(err)
-			return
+			slog.Error("failed to scan inserted message id", "backend", "postgres", "error", err)
+			return i
 		}
-		b.responses[i] <- id
+		b.responses[i] <- saveResult{id: id}
 		i++
 	}
-	b.responses = make([]chan string, 0)
-	b.msgs = make([]broker.Message, 0)
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to insert message batch", "backend", "postgres", "batch_size", len(b.msgs), "error", err)
+		return i
+	}
+	metrics.PostgresBatchSize.Observe(float64(len(b.msgs)))
+	slog.Debug("message batch inserted", "backend", "postgres", "batch_size", len(b.msgs))
+	return i
 }
 
 func (b *PublishBatch) StartExecuter() {
@@ -155,6 +264,10 @@ func (b *PublishBatch) StartExecuter() {
 				b.Execute()
 			case <-b.stopChan:
 				ticker.Stop()
+				b.lock.Lock()
+				b.stopped = true
+				b.lock.Unlock()
+				b.Execute()
 				return
 			}
 		}
@@ -166,22 +279,30 @@ func (b *PublishBatch) StopExecuter() {
 }
 
 func (dp *DataPostgres) ClearData() error {
-	query := `DELETE FROM messages`
-	_, err := dp.db.Exec(dp.ctx, query)
-	if err != nil {
-		return broker.ErrClearData
+	for _, query := range []string{`DELETE FROM messages`, `DELETE FROM subject_sequences`} {
+		_, err := dp.db.Exec(dp.ctx, query)
+		if err != nil {
+			return broker.ErrClearData
+		}
 	}
 	return nil
 }
 
 func (dp *DataPostgres) TestConnection() bool {
+	if dp.db == nil {
+		return false
+	}
 	return dp.db.Ping(dp.ctx) == nil
 }
 
 func (dp *DataPostgres) SaveMessage(msg broker.Message) (string, error) {
-	resp := dp.batch.AddtoQueue(msg)
-	id := <-resp
-	return id, nil
+	stored, err := dp.codec.encode(msg.Body)
+	if err != nil {
+		slog.Error("failed to encrypt message body", "backend", "postgres", "error", err)
+		return "", broker.ErrRunQuery
+	}
+	result := <-dp.batch.AddtoQueue(msg, stored)
+	return result.id, result.err
 }
 
 // func (dp *DataPostgres) SaveMessage(msg broker.Message) (int, error) {
@@ -203,7 +324,7 @@ func (dp *DataPostgres) SaveMessage(msg broker.Message) (string, error) {
 
 func (dp *DataPostgres) RetriveMessage(id string) (broker.Message, error) {
 	query := `
-        SELECT id, body, expiration_duration, expires_at
+        SELECT id, body, expiration_duration, expires_at, headers, compression, key_id, COALESCE(subject, '')
         FROM messages 
         WHERE id=$1
     `
@@ -217,7 +338,8 @@ func (dp *DataPostgres) RetriveMessage(id string) (broker.Message, error) {
 	msg := broker.Message{}
 	var expiration pgtype.Text
 	var expiresAt pgtype.Timestamptz
-	err = row.Scan(&msg.Id, &msg.Body, &expiration, &expiresAt)
+	var compression, keyID pgtype.Text
+	err = row.Scan(&msg.Id, &msg.Body, &expiration, &expiresAt, &msg.Headers, &compression, &keyID, &msg.Subject)
 	if err == pgx.ErrNoRows {
 		return broker.Message{}, broker.ErrInvalidID
 	} else if err != nil {
@@ -230,9 +352,166 @@ func (dp *DataPostgres) RetriveMessage(id string) (broker.Message, error) {
 		return broker.Message{}, broker.ErrExpiredID
 	}
 
+	msg.Body, err = dp.codec.decode(storedBody{body: msg.Body, compression: compression.String, keyID: keyID.String})
+	if err != nil {
+		slog.Error("failed to decode message body", "backend", "postgres", "id", id, "compression", compression.String, "key_id", keyID.String, "error", err)
+		return broker.Message{}, broker.ErrRunQuery
+	}
 	return msg, nil
 }
 
+func (dp *DataPostgres) ListMessages(r broker.Range) (broker.Page, error) {
+	start, err := rangeStart(r, dp.position)
+	if err != nil {
+		return broker.Page{}, err
+	}
+	// the window bounds are NULL when not set. created_at holds utc
+	// times, see config/postgres-create-database.txt, so the bounds are
+	// converted to utc whatever the TimeZone of the session
+	var since, until *time.Time
+	if !r.Since.IsZero() {
+		since = &r.Since
+	}
+	if !r.Until.IsZero() {
+		until = &r.Until
+	}
+	from, order := ">=", "ASC"
+	if r.Reverse {
+		from, order = "<=", "DESC"
+	}
+	query := fmt.Sprintf(`SELECT id, sequence, body, expiration_duration, created_at, expires_at, headers, compression, key_id
+        FROM messages
+        WHERE subject = $1 AND sequence %s $2 AND expires_at > (now() AT TIME ZONE 'UTC')
+            AND ($3::timestamptz IS NULL OR created_at >= ($3::timestamptz AT TIME ZONE 'UTC'))
+            AND ($4::timestamptz IS NULL OR created_at < ($4::timestamptz AT TIME ZONE 'UTC'))
+        ORDER BY sequence %s
+        LIMIT $5`, from, order)
+	rows, err := dp.db.Query(dp.ctx, query, r.Subject, int64(rangeBound(r, start)), since, until, r.Limit+1)
+	if err != nil {
+		slog.Error("failed to list messages", "backend", "postgres", "subject", r.Subject, "error", err)
+		return broker.Page{}, broker.ErrRunQuery
+	}
+	defer rows.Close()
+	var messages []broker.StoredMessage
+	for rows.Next() {
+		msg := broker.StoredMessage{Message: broker.Message{Subject: r.Subject}}
+		var sequence int64
+		var expiration pgtype.Text
+		var createdAt, expiresAt pgtype.Timestamptz
+		var compression, keyID pgtype.Text
+		err := rows.Scan(&msg.Id, &sequence, &msg.Body, &expiration, &createdAt, &expiresAt, &msg.Headers, &compression, &keyID)
+		if err != nil {
+			slog.Error("failed to scan listed message", "backend", "postgres", "subject", r.Subject, "error", err)
+			return broker.Page{}, broker.ErrRunQuery
+		}
+		msg.Sequence, msg.SavedAt = uint64(sequence), createdAt.Time
+		msg.Expiration = timeStringToDuration(expiration.String)
+		msg.Body, err = dp.codec.decode(storedBody{body: msg.Body, compression: compression.String, keyID: keyID.String})
+		if err != nil {
+			slog.Error("failed to decode message body", "backend", "postgres", "id", msg.Id, "compression", compression.String, "key_id", keyID.String, "error", err)
+			return broker.Page{}, broker.ErrRunQuery
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to list messages", "backend", "postgres", "subject", r.Subject, "error", err)
+		return broker.Page{}, broker.ErrRunQuery
+	}
+	return newPage(messages, r.Limit), nil
+}
+
+// position looks up the subject and sequence of id, both are empty for
+// messages saved before they were stored
+func (dp *DataPostgres) position(id string) (string, uint64, error) {
+	intid, err := strconv.Atoi(id)
+	if err != nil {
+		return "", 0, broker.ErrInvalidID
+	}
+	var subject string
+	var sequence int64
+	err = dp.db.QueryRow(dp.ctx, `SELECT COALESCE(subject, ''), COALESCE(sequence, 0) FROM messages WHERE id=$1`, intid).Scan(&subject, &sequence)
+	if err == pgx.ErrNoRows {
+		return "", 0, broker.ErrInvalidID
+	} else if err != nil {
+		return "", 0, broker.ErrRunQuery
+	}
+	return subject, uint64(sequence), nil
+}
+
+// Messages read per query by Reencrypt
+const reencryptBatchSize = 500
+
+// Reencrypt seals the bodies that are not sealed by the primary key of
+// the keyring, plaintext ones included, with the primary key. Expired
+// messages are left alone. It returns how many messages were rewritten,
+// messages that could not be opened are logged and skipped.
+func (dp *DataPostgres) Reencrypt(ctx context.Context) (int, error) {
+	if dp.codec.keyring == nil {
+		return 0, errNoKeyring
+	}
+	primary := dp.codec.keyring.Primary()
+	rewritten, failed, last := 0, 0, 0
+	for {
+		batch, err := dp.staleBodies(ctx, last, primary)
+		if err != nil {
+			return rewritten, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, row := range batch {
+			last = row.id
+			stored, changed, err := dp.codec.reencode(row.stored)
+			if err != nil {
+				slog.Error("failed to re-encrypt message", "backend", "postgres", "id", row.id, "key_id", row.stored.keyID, "error", err)
+				failed++
+				continue
+			}
+			if !changed {
+				continue
+			}
+			_, err = dp.db.Exec(ctx, `UPDATE messages SET body = $1, compression = NULLIF($2, ''), key_id = $3 WHERE id = $4`,
+				stored.body, stored.compression, stored.keyID, row.id)
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+	}
+	if failed > 0 {
+		return rewritten, fmt.Errorf("%d messages could not be re-encrypted", failed)
+	}
+	return rewritten, nil
+}
+
+type staleBody struct {
+	id     int
+	stored storedBody
+}
+
+// staleBodies reads the next unexpired bodies after id last that are not
+// sealed by primary
+func (dp *DataPostgres) staleBodies(ctx context.Context, last int, primary string) ([]staleBody, error) {
+	rows, err := dp.db.Query(ctx, `SELECT id, body, compression, key_id FROM messages
+        WHERE id > $1 AND key_id IS DISTINCT FROM $2 AND expires_at > (now() AT TIME ZONE 'UTC')
+        ORDER BY id LIMIT $3`, last, primary, reencryptBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []staleBody
+	for rows.Next() {
+		var row staleBody
+		var compression, keyID pgtype.Text
+		if err := rows.Scan(&row.id, &row.stored.body, &compression, &keyID); err != nil {
+			return nil, err
+		}
+		row.stored.compression, row.stored.keyID = compression.String, keyID.String
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
 func (dp *DataPostgres) IdExists(id string) bool {
 	query := `
         SELECT id
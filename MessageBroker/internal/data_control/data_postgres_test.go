@@ -0,0 +1,463 @@
+package datacontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"therealbroker/internal/data_control/datatest"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+
+	"github.com/jackc/pgx/pgtype"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPostgresConformance runs the suite against a stub database, and
+// against a real one too when POSTGRES_TEST_HOST is set, see
+// config/postgres-create-database.txt for its tables. The stub does not
+// run the SQL, it only covers the Go side of DataPostgres: the SQL is
+// only checked by the postgres runs.
+func TestPostgresConformance(t *testing.T) {
+	options := datatest.Options{MissingID: "2147483000"}
+	for _, variant := range []struct {
+		name  string
+		setup func(t *testing.T, dp *DataPostgres)
+	}{
+		{"", func(*testing.T, *DataPostgres) {}},
+		{" compressed", func(t *testing.T, dp *DataPostgres) {
+			dp.SetCompression(compression.Zstd, 0)
+		}},
+		{" encrypted", func(t *testing.T, dp *DataPostgres) {
+			dp.SetCompression(compression.Snappy, 0)
+			dp.SetEncryption(newTestKeyring(t, "key-1"))
+		}},
+	} {
+		t.Run("stub"+variant.name, func(t *testing.T) {
+			datatest.Run(t, func(t *testing.T) datatest.Store {
+				dp := newStubbedDataPostgres(t, newStubPostgres())
+				variant.setup(t, dp)
+				return dp
+			}, options)
+		})
+		t.Run("postgres"+variant.name, func(t *testing.T) {
+			if os.Getenv("POSTGRES_TEST_HOST") == "" {
+				t.Skip("POSTGRES_TEST_HOST is not set")
+			}
+			datatest.Run(t, func(t *testing.T) datatest.Store {
+				dp, err := connectTestPostgres()
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { dp.Close() })
+				variant.setup(t, dp)
+				return dp
+			}, options)
+		})
+	}
+}
+
+func TestPostgresShouldCompressLargeBodies(t *testing.T) {
+	db := newStubPostgres()
+	dp := newStubbedDataPostgres(t, db)
+	large := strings.Repeat(`{"item":"book","count":1}`, 100)
+
+	// rows written before compression was enabled stay readable
+	plain, err := dp.SaveMessage(broker.Message{Body: large, Expiration: time.Minute})
+	assert.Nil(t, err)
+	dp.SetCompression(compression.Gzip, 256)
+	gzipped, err := dp.SaveMessage(broker.Message{Body: large, Expiration: time.Minute})
+	assert.Nil(t, err)
+	dp.SetCompression(compression.Zstd, 256)
+	zstd, err := dp.SaveMessage(broker.Message{Body: large, Expiration: time.Minute})
+	assert.Nil(t, err)
+	tiny, err := dp.SaveMessage(broker.Message{Body: "small", Expiration: time.Minute})
+	assert.Nil(t, err)
+
+	for id, marker := range map[string]string{plain: "", gzipped: compression.Gzip, zstd: compression.Zstd} {
+		row := db.row(t, id)
+		assert.Equal(t, marker, row.compression)
+		if marker != "" {
+			assert.Less(t, len(row.body), len(large)/4)
+		}
+		msg, err := dp.RetriveMessage(id)
+		assert.Nil(t, err)
+		assert.Equal(t, large, msg.Body)
+	}
+	// below the threshold
+	assert.Equal(t, stubPostgresRow{}.compression, db.row(t, tiny).compression)
+	assert.Equal(t, "small", db.row(t, tiny).body)
+}
+
+func TestPostgresReencryptShouldMoveBodiesToThePrimaryKey(t *testing.T) {
+	db := newStubPostgres()
+	dp := newStubbedDataPostgres(t, db)
+	dp.SetCompression(compression.Zstd, 0)
+	bodies := map[string]string{}
+	save := func(body string) {
+		id, err := dp.SaveMessage(broker.Message{Body: body, Expiration: time.Minute})
+		assert.Nil(t, err)
+		bodies[id] = body
+	}
+	// stored before encryption, then under the old key
+	save(strings.Repeat("plain ", 100))
+	dp.SetEncryption(newTestKeyring(t, "key-1"))
+	save("sealed by key-1")
+	dp.SetEncryption(newTestKeyring(t, "key-1", "key-2"))
+	save("sealed by key-2")
+
+	rewritten, err := dp.Reencrypt(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, rewritten)
+	for id, body := range bodies {
+		assert.Equal(t, "key-2", db.row(t, id).keyID)
+		assert.NotContains(t, db.row(t, id).body, "plain")
+		msg, err := dp.RetriveMessage(id)
+		assert.Nil(t, err)
+		assert.Equal(t, body, msg.Body)
+	}
+
+	// nothing left to do, and key-1 can go
+	dp.SetEncryption(newTestKeyring(t, "key-3", "key-2"))
+	rewritten, err = dp.Reencrypt(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rewritten)
+}
+
+func TestPostgresSaveShouldFailWhenBatchInsertFails(t *testing.T) {
+	db := newStubPostgres()
+	dp := newStubbedDataPostgres(t, db)
+	db.failInserts = errors.New("connection reset")
+
+	done := make(chan error)
+	go func() {
+		_, err := dp.SaveMessage(broker.Message{Body: "lost"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, broker.ErrRunQuery, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("save did not return")
+	}
+}
+
+func TestPostgresCloseShouldFlushQueuedSaves(t *testing.T) {
+	db := newStubPostgres()
+	dp := NewDataPostgres("", "", "", "", "", context.Background())
+	dp.SetFlushInterval(time.Hour)
+	assert.Nil(t, dp.attach(db))
+
+	done := make(chan error)
+	go func() {
+		_, err := dp.SaveMessage(broker.Message{Body: "queued", Expiration: time.Minute})
+		done <- err
+	}()
+	assert.Eventually(t, func() bool {
+		dp.batch.lock.Lock()
+		defer dp.batch.lock.Unlock()
+		return len(dp.batch.msgs) == 1
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, dp.Close())
+	assert.Nil(t, <-done)
+
+	_, err := dp.SaveMessage(broker.Message{Body: "late"})
+	assert.Equal(t, broker.ErrUnavailable, err)
+}
+
+func TestPostgresWindowShouldNotDependOnTheSessionTimeZone(t *testing.T) {
+	if os.Getenv("POSTGRES_TEST_HOST") == "" {
+		t.Skip("POSTGRES_TEST_HOST is not set")
+	}
+	dp := newTestPostgres()
+	// a single connection, so every statement runs in the session below
+	dp.SetPool(1, 1)
+	assert.Nil(t, dp.Connect())
+	defer dp.Close()
+	assert.Nil(t, dp.ClearData())
+	_, err := dp.db.Exec(context.Background(), "SET TimeZone = 'Pacific/Kiritimati'")
+	assert.Nil(t, err)
+
+	before := time.Now().Add(-time.Second)
+	_, err = dp.SaveMessage(broker.Message{Subject: "zones", Body: "now", Expiration: time.Minute})
+	assert.Nil(t, err)
+
+	page, err := dp.ListMessages(broker.Range{Subject: "zones", Since: before, Until: time.Now().Add(time.Second), Limit: 10})
+	assert.Nil(t, err)
+	if !assert.Len(t, page.Messages, 1) {
+		return
+	}
+	assert.WithinDuration(t, time.Now(), page.Messages[0].SavedAt, 5*time.Second)
+	// not taken for expired
+	msg, err := dp.RetriveMessage(page.Messages[0].Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "now", msg.Body)
+}
+
+// newTestPostgres returns a store on the database named by the
+// POSTGRES_TEST_* variables, not connected yet
+func newTestPostgres() *DataPostgres {
+	return NewDataPostgres(os.Getenv("POSTGRES_TEST_HOST"), envOr("POSTGRES_TEST_PORT", "5432"),
+		envOr("POSTGRES_TEST_USER", "postgres"), os.Getenv("POSTGRES_TEST_PASSWORD"),
+		envOr("POSTGRES_TEST_DB", "TestDB"), context.Background())
+}
+
+// connectTestPostgres connects to the database named by the
+// POSTGRES_TEST_* variables and empties it
+func connectTestPostgres() (*DataPostgres, error) {
+	dp := newTestPostgres()
+	if err := dp.Connect(); err != nil {
+		return nil, err
+	}
+	return dp, dp.ClearData()
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func newStubbedDataPostgres(t *testing.T, db *stubPostgres) *DataPostgres {
+	dp := NewDataPostgres("", "", "", "", "", context.Background())
+	dp.SetFlushInterval(time.Millisecond)
+	if err := dp.attach(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dp.Close() })
+	return dp
+}
+
+// stubPostgres answers the statements DataPostgres sends by matching
+// their text, keeping the tables in memory. It never runs the SQL, so
+// it does not tell whether the statements are right, see
+// TestPostgresConformance
+type stubPostgres struct {
+	lock        sync.Mutex
+	nextID      int
+	rows        map[int]stubPostgresRow
+	failInserts error
+	// subject_sequences
+	sequences map[string]int64
+}
+
+type stubPostgresRow struct {
+	body       string
+	expiration time.Duration
+	createdAt  time.Time
+	headers    map[string]string
+	// empty for NULL
+	compression string
+	keyID       string
+	subject     string
+	sequence    int64
+}
+
+func newStubPostgres() *stubPostgres {
+	return &stubPostgres{nextID: 1, rows: make(map[int]stubPostgresRow), sequences: make(map[string]int64)}
+}
+
+// interval formats d like postgres prints an interval
+func interval(d time.Duration) string {
+	seconds := int(d.Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// row returns the stored row of id
+func (f *stubPostgres) row(t *testing.T, id string) stubPostgresRow {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := strconv.Atoi(id)
+	assert.Nil(t, err)
+	return f.rows[n]
+}
+
+func (f *stubPostgres) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if strings.HasPrefix(sql, "SELECT id, body, compression, key_id FROM messages") {
+		return f.staleRows(args[0].(int), args[1].(string), args[2].(int)), nil
+	}
+	if strings.HasPrefix(sql, "SELECT id, sequence, body") {
+		since, _ := args[2].(*time.Time)
+		until, _ := args[3].(*time.Time)
+		return f.subjectRows(args[0].(string), args[1].(int64), since, until, args[4].(int), strings.Contains(sql, "DESC")), nil
+	}
+	if !strings.HasPrefix(sql, "WITH batch") {
+		return nil, fmt.Errorf("stub postgres: unexpected query %q", sql)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failInserts != nil {
+		return nil, f.failInserts
+	}
+	rows := &stubRows{}
+	for i := 0; i+5 < len(args); i += 6 {
+		headers, _ := args[i+3].(map[string]string)
+		subject := args[i].(string)
+		f.sequences[subject]++
+		f.rows[f.nextID] = stubPostgresRow{
+			subject:     subject,
+			sequence:    f.sequences[subject],
+			body:        args[i+1].(string),
+			expiration:  time.Duration(args[i+2].(float64) * float64(time.Second)),
+			createdAt:   time.Now(),
+			headers:     headers,
+			compression: args[i+4].(string),
+			keyID:       args[i+5].(string),
+		}
+		rows.values = append(rows.values, []any{f.nextID})
+		f.nextID++
+	}
+	return rows, nil
+}
+
+// subjectRows answers the select of ListMessages
+func (f *stubPostgres) subjectRows(subject string, bound int64, since, until *time.Time, limit int, reverse bool) *stubRows {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var ids []int
+	for id, row := range f.rows {
+		expiresAt := row.createdAt.Add(row.expiration)
+		switch {
+		case row.subject != subject, !time.Now().Before(expiresAt),
+			reverse && row.sequence > bound, !reverse && row.sequence < bound,
+			since != nil && row.createdAt.Before(*since), until != nil && !row.createdAt.Before(*until):
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	if reverse {
+		slices.Reverse(ids)
+	}
+	rows := &stubRows{}
+	for _, id := range ids[:min(limit, len(ids))] {
+		row := f.rows[id]
+		rows.values = append(rows.values, []any{id, row.sequence, row.body, interval(row.expiration),
+			row.createdAt, row.createdAt.Add(row.expiration), row.headers, row.compression, row.keyID})
+	}
+	return rows
+}
+
+// staleRows answers the paged select of Reencrypt
+func (f *stubPostgres) staleRows(last int, primary string, limit int) *stubRows {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ids := make([]int, 0, len(f.rows))
+	for id, row := range f.rows {
+		if id > last && row.keyID != primary && time.Now().Before(row.createdAt.Add(row.expiration)) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	rows := &stubRows{}
+	for _, id := range ids[:min(limit, len(ids))] {
+		row := f.rows[id]
+		rows.values = append(rows.values, []any{id, row.body, row.compression, row.keyID})
+	}
+	return rows
+}
+
+func (f *stubPostgres) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if !strings.Contains(sql, "FROM messages") {
+		return &stubRows{err: fmt.Errorf("stub postgres: unexpected query %q", sql)}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id, _ := args[0].(int)
+	row, ok := f.rows[id]
+	if !ok {
+		return &stubRows{err: pgx.ErrNoRows}
+	}
+	if strings.HasPrefix(sql, "SELECT COALESCE(subject, ''), COALESCE(sequence, 0)") {
+		return &stubRows{values: [][]any{{row.subject, row.sequence}}}
+	}
+	return &stubRows{values: [][]any{{id, row.body, interval(row.expiration), row.createdAt.Add(row.expiration), row.headers, row.compression, row.keyID, row.subject}}}
+}
+
+func (f *stubPostgres) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if strings.HasPrefix(sql, "UPDATE messages SET body = $1, compression = NULLIF($2, ''), key_id = $3") {
+		row := f.rows[args[3].(int)]
+		row.body, row.compression, row.keyID = args[0].(string), args[1].(string), args[2].(string)
+		f.rows[args[3].(int)] = row
+		return pgconn.NewCommandTag("UPDATE 1"), nil
+	}
+	switch sql {
+	case "DELETE FROM messages":
+		clear(f.rows)
+	case "DELETE FROM subject_sequences":
+		clear(f.sequences)
+	default:
+		return pgconn.CommandTag{}, fmt.Errorf("stub postgres: unexpected statement %q", sql)
+	}
+	return pgconn.NewCommandTag("DELETE"), nil
+}
+
+func (f *stubPostgres) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (f *stubPostgres) Close() {}
+
+// stubRows serves values as pgx.Rows and pgx.Row
+type stubRows struct {
+	values [][]any
+	next   int
+	err    error
+}
+
+func (r *stubRows) Next() bool {
+	if r.err != nil || r.next >= len(r.values) {
+		return false
+	}
+	r.next++
+	return true
+}
+
+func (r *stubRows) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	// QueryRow scans without calling Next
+	if r.next == 0 && !r.Next() {
+		return pgx.ErrNoRows
+	}
+	for i, value := range r.values[r.next-1] {
+		switch d := dest[i].(type) {
+		case *string:
+			*d = fmt.Sprint(value)
+		case *int:
+			*d = value.(int)
+		case *int64:
+			*d = value.(int64)
+		case *pgtype.Text:
+			*d = pgtype.Text{String: value.(string), Status: pgtype.Present}
+		case *pgtype.Timestamptz:
+			*d = pgtype.Timestamptz{Time: value.(time.Time), Status: pgtype.Present}
+		case *map[string]string:
+			*d, _ = value.(map[string]string)
+		default:
+			return fmt.Errorf("stub postgres: cannot scan into %T", d)
+		}
+	}
+	return nil
+}
+
+func (r *stubRows) Close()                                       {}
+func (r *stubRows) Err() error                                   { return nil }
+func (r *stubRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *stubRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *stubRows) Values() ([]any, error)                       { return r.values[r.next-1], nil }
+func (r *stubRows) RawValues() [][]byte                          { return nil }
+func (r *stubRows) Conn() *pgx.Conn                              { return nil }
@@ -0,0 +1,690 @@
+package datacontrol
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"therealbroker/api/peers"
+	pb "therealbroker/api/proto"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errNotLeader = errors.New("this node is not the raft leader")
+
+type RaftPeer struct {
+	ID      string
+	Address string
+}
+
+type RaftConfig struct {
+	NodeID string
+	// Address the raft transport listens on, and the one peers reach it at
+	BindAddress      string
+	AdvertiseAddress string
+	// Address of the Replication grpc service of this node, followers
+	// send their publishes to the leader through it
+	RPCAddress string
+	// Voters of a new cluster, including this node. Nodes that already
+	// have raft state ignore it.
+	Peers []RaftPeer
+	// Directory of the log, stable store and snapshots, kept in memory
+	// when empty
+	Dir string
+	// Log entries between snapshots, and how often that is checked
+	SnapshotThreshold uint64
+	SnapshotInterval  time.Duration
+	ApplyTimeout      time.Duration
+	// Used instead of a tcp transport on BindAddress when set, e.g. an
+	// in memory transport in tests
+	Transport raft.Transport
+	// Options of the connections to the Replication service of the
+	// leader, see package peers. Tls with the system roots when empty
+	DialOptions []grpc.DialOption
+}
+
+// DataRaft keeps the message log on every broker node, replicated with
+// raft. Saves go through the leader, reads are served by the local
+// replica and may lag the leader slightly.
+type DataRaft struct {
+	pb.UnimplementedReplicationServer
+
+	config RaftConfig
+	raft   *raft.Raft
+	fsm    *raftFSM
+	// settings of the raft library, tests shorten the timeouts
+	raftConfig *raft.Config
+	closers    []io.Closer
+
+	lock  sync.Mutex
+	conns map[string]*grpc.ClientConn
+
+	stopChan chan bool
+}
+
+func NewDataRaft(config RaftConfig) *DataRaft {
+	if config.ApplyTimeout <= 0 {
+		config.ApplyTimeout = 5 * time.Second
+	}
+	if len(config.DialOptions) == 0 {
+		config.DialOptions = peers.SecureDialOptions()
+	}
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+	if config.SnapshotThreshold > 0 {
+		raftConfig.SnapshotThreshold = config.SnapshotThreshold
+	}
+	if config.SnapshotInterval > 0 {
+		raftConfig.SnapshotInterval = config.SnapshotInterval
+	}
+	raftConfig.Logger = newRaftLogger()
+	return &DataRaft{
+		config:     config,
+		fsm:        newRaftFSM(),
+		raftConfig: raftConfig,
+		conns:      make(map[string]*grpc.ClientConn),
+		stopChan:   make(chan bool),
+	}
+}
+
+// newRaftLogger hands the raft logs to the slog logger of the process,
+// so they reach the same sinks and follow its reloadable level
+func newRaftLogger() hclog.Logger {
+	logger := hclog.NewInterceptLogger(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Trace,
+		Output: io.Discard,
+	})
+	logger.RegisterSink(raftLogSink{})
+	return logger
+}
+
+// raftLogSink logs to the default slog logger, looked up on every record
+// since logging may be set up after the node is created
+type raftLogSink struct{}
+
+func (raftLogSink) Accept(name string, level hclog.Level, msg string, args ...interface{}) {
+	slogLevel := slog.LevelDebug
+	switch level {
+	case hclog.Trace:
+		slogLevel = slog.LevelDebug - 4
+	case hclog.Info:
+		slogLevel = slog.LevelInfo
+	case hclog.Warn:
+		slogLevel = slog.LevelWarn
+	case hclog.Error:
+		slogLevel = slog.LevelError
+	}
+	logger := slog.Default()
+	if !logger.Enabled(context.Background(), slogLevel) {
+		return
+	}
+	logger.Log(context.Background(), slogLevel, msg, append([]interface{}{"component", name}, args...)...)
+}
+
+func (dr *DataRaft) Connect() error {
+	logs, stable, snapshots, err := dr.stores()
+	if err != nil {
+		return err
+	}
+	transport := dr.config.Transport
+	if transport == nil {
+		advertise, err := net.ResolveTCPAddr("tcp", dr.config.AdvertiseAddress)
+		if err != nil {
+			return fmt.Errorf("invalid raft advertise address: %w", err)
+		}
+		tcp, err := raft.NewTCPTransport(dr.config.BindAddress, advertise, 3, 10*time.Second, os.Stderr)
+		if err != nil {
+			return err
+		}
+		dr.closers = append(dr.closers, tcp)
+		transport = tcp
+	}
+
+	// buffered, leadership changes must not be missed before the
+	// register goroutine runs
+	leadership := make(chan bool, 16)
+	dr.raftConfig.NotifyCh = leadership
+	dr.raft, err = raft.NewRaft(dr.raftConfig, dr.fsm, logs, stable, snapshots, transport)
+	if err != nil {
+		return err
+	}
+
+	existing, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		return err
+	}
+	if !existing {
+		servers := make([]raft.Server, len(dr.config.Peers))
+		for i, p := range dr.config.Peers {
+			servers[i] = raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Address)}
+		}
+		// every node bootstraps with the same voters, later calls fail
+		// harmlessly once the cluster has a configuration
+		if err := dr.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+			return err
+		}
+	}
+
+	go dr.registerOnLeadership(leadership)
+	slog.Info("raft node started", "backend", "raft", "node_id", dr.config.NodeID, "peers", len(dr.config.Peers))
+	return nil
+}
+
+func (dr *DataRaft) stores() (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if dr.config.Dir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), nil
+	}
+	if err := os.MkdirAll(dr.config.Dir, 0o750); err != nil {
+		return nil, nil, nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dr.config.Dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dr.closers = append(dr.closers, store)
+	snapshots, err := raft.NewFileSnapshotStore(dr.config.Dir, 2, os.Stderr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return store, store, snapshots, nil
+}
+
+// registerOnLeadership records the rpc address of this node in the log
+// whenever it becomes the leader, so followers know where to send saves.
+func (dr *DataRaft) registerOnLeadership(leadership <-chan bool) {
+	for {
+		select {
+		case leader := <-leadership:
+			if !leader {
+				continue
+			}
+			_, err := dr.apply(raftCommand{Op: raftOpRegister, NodeID: dr.config.NodeID, Address: dr.config.RPCAddress})
+			if err != nil {
+				slog.Error("failed to register raft leader address", "error", err)
+				continue
+			}
+			slog.Info("raft leadership acquired", "node_id", dr.config.NodeID)
+		case <-dr.stopChan:
+			return
+		}
+	}
+}
+
+func (dr *DataRaft) Close() error {
+	close(dr.stopChan)
+	var err error
+	if dr.raft != nil {
+		err = dr.raft.Shutdown().Error()
+	}
+	for _, c := range dr.closers {
+		c.Close()
+	}
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	for address, conn := range dr.conns {
+		conn.Close()
+		delete(dr.conns, address)
+	}
+	return err
+}
+
+func (dr *DataRaft) apply(cmd raftCommand) (string, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	future := dr.raft.Apply(data, dr.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return "", errNotLeader
+		}
+		return "", err
+	}
+	id, _ := future.Response().(string)
+	return id, nil
+}
+
+func (dr *DataRaft) saveCommand(msg broker.Message) raftCommand {
+	now := time.Now()
+	return raftCommand{
+		Op:        raftOpSave,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		Headers:   msg.Headers,
+		Now:       now.UnixNano(),
+		ExpiresAt: now.Add(msg.Expiration).UnixNano(),
+	}
+}
+
+func (dr *DataRaft) SaveMessage(msg broker.Message) (string, error) {
+	if dr.raft.State() == raft.Leader {
+		id, err := dr.apply(dr.saveCommand(msg))
+		if err != errNotLeader {
+			return id, err
+		}
+	}
+	return dr.forward(msg)
+}
+
+// forward passes msg to the Replication service of the leader
+func (dr *DataRaft) forward(msg broker.Message) (string, error) {
+	_, leaderID := dr.raft.LeaderWithID()
+	address := dr.fsm.leaderAddress(string(leaderID))
+	if address == "" {
+		return "", broker.ErrUnavailable
+	}
+	conn, err := dr.conn(address)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dr.config.ApplyTimeout)
+	defer cancel()
+	resp, err := pb.NewReplicationClient(conn).Save(ctx, &pb.SaveRequest{
+		Body:         msg.Body,
+		Headers:      msg.Headers,
+		ExpirationMs: msg.Expiration.Milliseconds(),
+		Subject:      msg.Subject,
+	})
+	if err != nil {
+		slog.Warn("failed to forward message to raft leader", "leader", leaderID, "error", err)
+		return "", broker.ErrUnavailable
+	}
+	return resp.Id, nil
+}
+
+func (dr *DataRaft) conn(address string) (*grpc.ClientConn, error) {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	if conn, ok := dr.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(address, dr.config.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	dr.conns[address] = conn
+	return conn, nil
+}
+
+// Save serves the saves forwarded by followers
+func (dr *DataRaft) Save(ctx context.Context, req *pb.SaveRequest) (*pb.SaveResponse, error) {
+	id, err := dr.apply(dr.saveCommand(broker.Message{
+		Subject:    req.Subject,
+		Body:       req.Body,
+		Headers:    req.Headers,
+		Expiration: time.Duration(req.ExpirationMs) * time.Millisecond,
+	}))
+	if err == errNotLeader {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.SaveResponse{Id: id}, nil
+}
+
+func (dr *DataRaft) RetriveMessage(id string) (broker.Message, error) {
+	return dr.fsm.get(id, time.Now())
+}
+
+// ListMessages reads the local replica, like RetriveMessage
+func (dr *DataRaft) ListMessages(r broker.Range) (broker.Page, error) {
+	return dr.fsm.list(r, time.Now())
+}
+
+// ClearData empties the log on every node, only the leader can do it
+func (dr *DataRaft) ClearData() error {
+	_, err := dr.apply(raftCommand{Op: raftOpClear})
+	return err
+}
+
+// TestConnection reports whether the node knows a leader to save through
+func (dr *DataRaft) TestConnection() bool {
+	if dr.raft == nil {
+		return false
+	}
+	_, leaderID := dr.raft.LeaderWithID()
+	return leaderID != ""
+}
+
+// Leader reports whether this node is the raft leader
+func (dr *DataRaft) Leader() bool {
+	return dr.raft != nil && dr.raft.State() == raft.Leader
+}
+
+const (
+	raftOpSave     = "save"
+	raftOpClear    = "clear"
+	raftOpRegister = "register"
+)
+
+// raftCommand is one entry of the replicated log. Times come from the
+// leader, so every replica applies the same state.
+type raftCommand struct {
+	Op        string            `json:"op"`
+	Subject   string            `json:"subject,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Now       int64             `json:"now,omitempty"`
+	ExpiresAt int64             `json:"expires_at,omitempty"`
+	NodeID    string            `json:"node_id,omitempty"`
+	Address   string            `json:"address,omitempty"`
+}
+
+type raftEntry struct {
+	Body      string            `json:"body"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	ExpiresAt int64             `json:"expires_at"`
+	// Nanoseconds the message was saved for
+	Expiration int64 `json:"expiration,omitempty"`
+	// Zero for entries saved before subjects were kept
+	Subject  string `json:"subject,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+type raftState struct {
+	NextID   uint64               `json:"next_id"`
+	Messages map[string]raftEntry `json:"messages"`
+	// rpc address of every node that has been the leader
+	Leaders map[string]string `json:"leaders"`
+	// Last sequence saved on every subject
+	Sequences map[string]uint64 `json:"sequences"`
+}
+
+type raftFSM struct {
+	lock  sync.RWMutex
+	state raftState
+	// built from state.Messages, so snapshots do not carry them
+	subjects map[string]*raftSubject
+	expiries raftExpiries
+}
+
+// raftSubject lists the messages of a subject in sequence order. Expired
+// ones are left behind until they are half of it.
+type raftSubject struct {
+	messages []raftIndexed
+	removed  int
+}
+
+type raftIndexed struct {
+	Sequence uint64
+	ID       string
+}
+
+// raftExpiries is a heap of the messages, the first to expire on top
+type raftExpiries []raftExpiry
+
+type raftExpiry struct {
+	ExpiresAt int64
+	ID        string
+}
+
+func (h raftExpiries) Len() int           { return len(h) }
+func (h raftExpiries) Less(i, j int) bool { return h[i].ExpiresAt < h[j].ExpiresAt }
+func (h raftExpiries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *raftExpiries) Push(x any)        { *h = append(*h, x.(raftExpiry)) }
+
+func (h *raftExpiries) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newRaftFSM() *raftFSM {
+	f := &raftFSM{}
+	f.reset(raftState{
+		Messages:  make(map[string]raftEntry),
+		Leaders:   make(map[string]string),
+		Sequences: make(map[string]uint64),
+	})
+	return f
+}
+
+// reset replaces the state with state and indexes its messages. f.lock
+// must be held.
+func (f *raftFSM) reset(state raftState) {
+	f.state = state
+	f.subjects = make(map[string]*raftSubject)
+	f.expiries = make(raftExpiries, 0, len(state.Messages))
+	for id, e := range state.Messages {
+		f.expiries = append(f.expiries, raftExpiry{ExpiresAt: e.ExpiresAt, ID: id})
+		if e.Sequence == 0 {
+			continue
+		}
+		subject := f.subject(e.Subject)
+		subject.messages = append(subject.messages, raftIndexed{Sequence: e.Sequence, ID: id})
+	}
+	heap.Init(&f.expiries)
+	for _, subject := range f.subjects {
+		sort.Slice(subject.messages, func(i, j int) bool {
+			return subject.messages[i].Sequence < subject.messages[j].Sequence
+		})
+	}
+}
+
+func (f *raftFSM) subject(name string) *raftSubject {
+	subject, ok := f.subjects[name]
+	if !ok {
+		subject = &raftSubject{}
+		f.subjects[name] = subject
+	}
+	return subject
+}
+
+// expire removes the messages expired before now. f.lock must be held.
+func (f *raftFSM) expire(now int64) {
+	for len(f.expiries) > 0 && f.expiries[0].ExpiresAt < now {
+		id := heap.Pop(&f.expiries).(raftExpiry).ID
+		e, ok := f.state.Messages[id]
+		if !ok {
+			continue
+		}
+		delete(f.state.Messages, id)
+		if e.Sequence == 0 {
+			continue
+		}
+		subject := f.subjects[e.Subject]
+		subject.removed++
+		if subject.removed > len(subject.messages)/2 {
+			kept := subject.messages[:0]
+			for _, m := range subject.messages {
+				if _, ok := f.state.Messages[m.ID]; ok {
+					kept = append(kept, m)
+				}
+			}
+			clear(subject.messages[len(kept):])
+			subject.messages, subject.removed = kept, 0
+		}
+	}
+}
+
+func (f *raftFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch cmd.Op {
+	case raftOpSave:
+		id := strconv.FormatUint(f.state.NextID, 10)
+		f.state.NextID++
+		f.state.Sequences[cmd.Subject]++
+		e := raftEntry{
+			Body:      cmd.Body,
+			Headers:   cmd.Headers,
+			ExpiresAt: cmd.ExpiresAt,
+			Subject:   cmd.Subject,
+			Sequence:  f.state.Sequences[cmd.Subject],
+		}
+		if cmd.Now > 0 {
+			e.Expiration = cmd.ExpiresAt - cmd.Now
+		}
+		f.state.Messages[id] = e
+		heap.Push(&f.expiries, raftExpiry{ExpiresAt: e.ExpiresAt, ID: id})
+		subject := f.subject(cmd.Subject)
+		subject.messages = append(subject.messages, raftIndexed{Sequence: e.Sequence, ID: id})
+		f.expire(cmd.Now)
+		return id
+	case raftOpClear:
+		f.reset(raftState{
+			Messages:  make(map[string]raftEntry),
+			Leaders:   f.state.Leaders,
+			Sequences: make(map[string]uint64),
+		})
+	case raftOpRegister:
+		f.state.Leaders[cmd.NodeID] = cmd.Address
+	}
+	return ""
+}
+
+func (f *raftFSM) get(id string, now time.Time) (broker.Message, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	e, ok := f.state.Messages[id]
+	if !ok {
+		return broker.Message{}, broker.ErrInvalidID
+	}
+	if now.UnixNano() > e.ExpiresAt {
+		return broker.Message{}, broker.ErrExpiredID
+	}
+	return broker.Message{Id: id, Subject: e.Subject, Body: e.Body, Headers: e.Headers, Expiration: time.Duration(e.Expiration)}, nil
+}
+
+// list reads the page of r from the index of its subject, skipping the
+// messages that expired or were removed since
+func (f *raftFSM) list(r broker.Range, now time.Time) (broker.Page, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	start, err := rangeStart(r, func(id string) (string, uint64, error) {
+		e, ok := f.state.Messages[id]
+		if !ok {
+			return "", 0, broker.ErrInvalidID
+		}
+		return e.Subject, e.Sequence, nil
+	})
+	if err != nil {
+		return broker.Page{}, err
+	}
+	bound := rangeBound(r, start)
+
+	var indexed []raftIndexed
+	if subject, ok := f.subjects[r.Subject]; ok {
+		indexed = subject.messages
+	}
+	// first message past bound, the walk starts there or right before it
+	i := sort.Search(len(indexed), func(i int) bool {
+		return indexed[i].Sequence > bound || !r.Reverse && indexed[i].Sequence == bound
+	})
+	step := 1
+	if r.Reverse {
+		i, step = i-1, -1
+	}
+	var messages []broker.StoredMessage
+	for ; i >= 0 && i < len(indexed) && len(messages) <= r.Limit; i += step {
+		id := indexed[i].ID
+		e, ok := f.state.Messages[id]
+		if !ok || now.UnixNano() > e.ExpiresAt {
+			continue
+		}
+		savedAt := time.Unix(0, e.ExpiresAt-e.Expiration)
+		if !r.Includes(savedAt) {
+			continue
+		}
+		messages = append(messages, broker.StoredMessage{
+			Message: broker.Message{
+				Id:         id,
+				Body:       e.Body,
+				Headers:    e.Headers,
+				Expiration: time.Duration(e.Expiration),
+				Subject:    e.Subject,
+			},
+			Sequence: e.Sequence,
+			SavedAt:  savedAt,
+		})
+	}
+	return newPage(messages, r.Limit), nil
+}
+
+func (f *raftFSM) leaderAddress(id string) string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.state.Leaders[id]
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	state := raftState{
+		NextID:    f.state.NextID,
+		Messages:  make(map[string]raftEntry, len(f.state.Messages)),
+		Leaders:   make(map[string]string, len(f.state.Leaders)),
+		Sequences: make(map[string]uint64, len(f.state.Sequences)),
+	}
+	for id, e := range f.state.Messages {
+		state.Messages[id] = e
+	}
+	for id, address := range f.state.Leaders {
+		state.Leaders[id] = address
+	}
+	for subject, sequence := range f.state.Sequences {
+		state.Sequences[subject] = sequence
+	}
+	return &raftSnapshot{state: state}, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	state := raftState{}
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return err
+	}
+	if state.Messages == nil {
+		state.Messages = make(map[string]raftEntry)
+	}
+	if state.Leaders == nil {
+		state.Leaders = make(map[string]string)
+	}
+	if state.Sequences == nil {
+		state.Sequences = make(map[string]uint64)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reset(state)
+	return nil
+}
+
+type raftSnapshot struct {
+	state raftState
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {}
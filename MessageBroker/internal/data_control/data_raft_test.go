@@ -0,0 +1,373 @@
+package datacontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"therealbroker/api/peers"
+	pb "therealbroker/api/proto"
+	"therealbroker/internal/data_control/datatest"
+	"therealbroker/pkg/broker"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sent by the nodes of the test clusters to each other
+const testRaftToken = "raft-secret"
+
+type raftHarness struct {
+	nodes      []*DataRaft
+	transports []*raft.InmemTransport
+	servers    []*grpc.Server
+}
+
+// startRaftCluster runs count raft nodes in this process, linked by
+// in memory transports and serving Replication on local ports.
+func startRaftCluster(t *testing.T, count int, snapshotThreshold uint64) *raftHarness {
+	h := &raftHarness{}
+	voters := make([]RaftPeer, count)
+	listeners := make([]net.Listener, count)
+	for i := 0; i < count; i++ {
+		address, transport := raft.NewInmemTransport("")
+		h.transports = append(h.transports, transport)
+		voters[i] = RaftPeer{ID: fmt.Sprintf("node-%d", i), Address: string(address)}
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[i] = lis
+	}
+	for _, a := range h.transports {
+		for _, b := range h.transports {
+			if a != b {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		node := NewDataRaft(RaftConfig{
+			NodeID:            voters[i].ID,
+			RPCAddress:        listeners[i].Addr().String(),
+			Peers:             voters,
+			Transport:         h.transports[i],
+			SnapshotThreshold: snapshotThreshold,
+			SnapshotInterval:  50 * time.Millisecond,
+			DialOptions:       peers.DialOptions(nil, testRaftToken),
+		})
+		node.raftConfig.HeartbeatTimeout = 50 * time.Millisecond
+		node.raftConfig.ElectionTimeout = 50 * time.Millisecond
+		node.raftConfig.LeaderLeaseTimeout = 50 * time.Millisecond
+		node.raftConfig.CommitTimeout = 5 * time.Millisecond
+		node.raftConfig.TrailingLogs = 10
+		node.raftConfig.Logger = hclog.New(&hclog.LoggerOptions{Output: io.Discard})
+		assert.Nil(t, node.Connect())
+
+		server := grpc.NewServer(peers.ServerOptions(nil, testRaftToken)...)
+		pb.RegisterReplicationServer(server, node)
+		go server.Serve(listeners[i])
+
+		h.nodes = append(h.nodes, node)
+		h.servers = append(h.servers, server)
+	}
+	t.Cleanup(func() {
+		for i, node := range h.nodes {
+			if node != nil {
+				h.stop(i)
+			}
+		}
+	})
+	return h
+}
+
+func (h *raftHarness) stop(i int) {
+	h.servers[i].Stop()
+	h.nodes[i].Close()
+	for _, transport := range h.transports {
+		transport.Disconnect(h.transports[i].LocalAddr())
+	}
+	h.nodes[i] = nil
+}
+
+// leader waits until one running node leads and every follower knows
+// its rpc address
+func (h *raftHarness) leader(t *testing.T) int {
+	var leader int
+	waitUntil(t, func() bool {
+		leader = -1
+		for i, node := range h.nodes {
+			if node != nil && node.Leader() {
+				leader = i
+			}
+		}
+		if leader == -1 {
+			return false
+		}
+		for _, node := range h.nodes {
+			if node == nil {
+				continue
+			}
+			_, id := node.raft.LeaderWithID()
+			if id != raft.ServerID(h.nodes[leader].config.NodeID) || node.fsm.leaderAddress(string(id)) == "" {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func (h *raftHarness) follower(leader int) int {
+	for i, node := range h.nodes {
+		if node != nil && i != leader {
+			return i
+		}
+	}
+	return -1
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftConformance(t *testing.T) {
+	datatest.Run(t, func(t *testing.T) datatest.Store {
+		h := startRaftCluster(t, 1, 0)
+		return h.nodes[h.leader(t)]
+	}, datatest.Options{MissingID: "999999999"})
+}
+
+func TestRaftShouldReplicateSavesToFollowers(t *testing.T) {
+	h := startRaftCluster(t, 3, 0)
+	leader := h.leader(t)
+
+	id, err := h.nodes[leader].SaveMessage(broker.Message{
+		Body:       "hello",
+		Headers:    map[string]string{"k": "v"},
+		Expiration: time.Minute,
+	})
+	assert.Nil(t, err)
+
+	for _, node := range h.nodes {
+		waitUntil(t, func() bool {
+			msg, err := node.RetriveMessage(id)
+			return err == nil && msg.Body == "hello" && msg.Headers["k"] == "v"
+		})
+	}
+}
+
+func TestRaftFollowerShouldForwardSavesToLeader(t *testing.T) {
+	h := startRaftCluster(t, 3, 0)
+	follower := h.follower(h.leader(t))
+
+	first, err := h.nodes[follower].SaveMessage(broker.Message{Subject: "orders", Body: "a", Expiration: time.Minute})
+	assert.Nil(t, err)
+	second, err := h.nodes[follower].SaveMessage(broker.Message{Subject: "orders", Body: "b", Expiration: time.Minute})
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+
+	waitUntil(t, func() bool {
+		msg, err := h.nodes[follower].RetriveMessage(second)
+		return err == nil && msg.Body == "b"
+	})
+	page, err := h.nodes[follower].ListMessages(broker.Range{Subject: "orders", Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, page.Messages, 2) {
+		assert.Equal(t, first, page.Messages[0].Id)
+		assert.Equal(t, uint64(2), page.Messages[1].Sequence)
+	}
+}
+
+func TestRaftReplicationShouldRefuseCallersWithoutTheToken(t *testing.T) {
+	h := startRaftCluster(t, 1, 0)
+	leader := h.leader(t)
+
+	conn, err := grpc.NewClient(h.nodes[leader].config.RPCAddress, peers.DialOptions(nil, "")...)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = pb.NewReplicationClient(conn).Save(context.Background(), &pb.SaveRequest{Subject: "orders", Body: "forged"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	page, err := h.nodes[leader].ListMessages(broker.Range{Subject: "orders", Limit: 10})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Messages)
+}
+
+func TestRaftShouldExpireMessages(t *testing.T) {
+	h := startRaftCluster(t, 1, 0)
+	h.leader(t)
+
+	id, err := h.nodes[0].SaveMessage(broker.Message{Body: "short", Expiration: time.Millisecond})
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = h.nodes[0].RetriveMessage(id)
+	assert.Equal(t, broker.ErrExpiredID, err)
+	_, err = h.nodes[0].RetriveMessage("missing")
+	assert.Equal(t, broker.ErrInvalidID, err)
+}
+
+func TestRaftShouldFailOverToNewLeader(t *testing.T) {
+	h := startRaftCluster(t, 3, 0)
+	leader := h.leader(t)
+	before, err := h.nodes[leader].SaveMessage(broker.Message{Body: "before", Expiration: time.Minute})
+	assert.Nil(t, err)
+
+	h.stop(leader)
+	newLeader := h.leader(t)
+	assert.NotEqual(t, leader, newLeader)
+
+	after, err := h.nodes[h.follower(newLeader)].SaveMessage(broker.Message{Body: "after", Expiration: time.Minute})
+	assert.Nil(t, err)
+	for _, node := range h.nodes {
+		if node == nil {
+			continue
+		}
+		waitUntil(t, func() bool {
+			msg, err := node.RetriveMessage(after)
+			return err == nil && msg.Body == "after"
+		})
+		msg, err := node.RetriveMessage(before)
+		assert.Nil(t, err)
+		assert.Equal(t, "before", msg.Body)
+	}
+}
+
+func TestRaftLaggingFollowerShouldCatchUpFromSnapshot(t *testing.T) {
+	h := startRaftCluster(t, 3, 10)
+	leader := h.leader(t)
+	lagging := h.follower(leader)
+	lagAddr := h.transports[lagging].LocalAddr()
+	for i, transport := range h.transports {
+		if i != lagging {
+			transport.Disconnect(lagAddr)
+		}
+	}
+	h.transports[lagging].DisconnectAll()
+
+	var last string
+	for i := 0; i < 50; i++ {
+		id, err := h.nodes[leader].SaveMessage(broker.Message{Body: fmt.Sprint(i), Expiration: time.Minute})
+		assert.Nil(t, err)
+		last = id
+	}
+	assert.Nil(t, h.nodes[leader].raft.Snapshot().Error())
+
+	for i, transport := range h.transports {
+		if i != lagging {
+			transport.Connect(lagAddr, h.transports[lagging])
+			h.transports[lagging].Connect(transport.LocalAddr(), transport)
+		}
+	}
+	waitUntil(t, func() bool {
+		msg, err := h.nodes[lagging].RetriveMessage(last)
+		return err == nil && msg.Body == "49"
+	})
+}
+
+func TestRaftSnapshotShouldRestoreState(t *testing.T) {
+	fsm := newRaftFSM()
+	expiresAt := time.Now().Add(time.Minute).UnixNano()
+	fsm.Apply(&raft.Log{Data: []byte(fmt.Sprintf(`{"op":"save","subject":"orders","body":"kept","expires_at":%d}`, expiresAt))})
+	fsm.Apply(&raft.Log{Data: []byte(`{"op":"register","node_id":"node-0","address":"10.0.0.1:7001"}`)})
+
+	snapshot, err := fsm.Snapshot()
+	assert.Nil(t, err)
+	sink := &memorySink{}
+	assert.Nil(t, snapshot.Persist(sink))
+
+	restored := newRaftFSM()
+	assert.Nil(t, restored.Restore(io.NopCloser(&sink.buf)))
+	msg, err := restored.get("0", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", msg.Body)
+	assert.Equal(t, "10.0.0.1:7001", restored.leaderAddress("node-0"))
+	assert.Equal(t, "1", restored.Apply(&raft.Log{Data: []byte(fmt.Sprintf(`{"op":"save","subject":"orders","body":"next","expires_at":%d}`, expiresAt))}))
+	page, err := restored.list(broker.Range{Subject: "orders", Limit: 10}, time.Now())
+	assert.Nil(t, err)
+	if assert.Len(t, page.Messages, 2) {
+		assert.Equal(t, uint64(2), page.Messages[1].Sequence)
+	}
+}
+
+func TestRaftShouldRemoveMessagesOnceExpired(t *testing.T) {
+	fsm := newRaftFSM()
+	save := func(body string, now, expiresAt time.Time) {
+		fsm.Apply(&raft.Log{Data: []byte(fmt.Sprintf(`{"op":"save","subject":"orders","body":%q,"now":%d,"expires_at":%d}`,
+			body, now.UnixNano(), expiresAt.UnixNano()))})
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		save(fmt.Sprint("short-", i), start, start.Add(time.Second))
+	}
+	save("long", start, start.Add(time.Hour))
+	assert.Len(t, fsm.state.Messages, 5)
+
+	// the next save applied after they expired removes them
+	later := start.Add(time.Minute)
+	save("later", later, later.Add(time.Hour))
+	assert.Len(t, fsm.state.Messages, 2)
+	assert.Len(t, fsm.subjects["orders"].messages, 2)
+	_, err := fsm.get("0", later)
+	assert.Equal(t, broker.ErrInvalidID, err)
+
+	page, err := fsm.list(broker.Range{Subject: "orders", Limit: 10, Reverse: true}, later)
+	assert.Nil(t, err)
+	var bodies []string
+	for _, msg := range page.Messages {
+		bodies = append(bodies, msg.Body)
+	}
+	assert.Equal(t, []string{"later", "long"}, bodies)
+}
+
+type memorySink struct {
+	buf bytes.Buffer
+}
+
+func (s *memorySink) Write(p []byte) (int, error) { return s.buf.Write(p) }
+func (s *memorySink) Close() error                { return nil }
+func (s *memorySink) ID() string                  { return "test" }
+func (s *memorySink) Cancel() error               { return nil }
+
+func TestRaftLogsShouldGoToTheProcessLogger(t *testing.T) {
+	var out bytes.Buffer
+	level := new(slog.LevelVar)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: level})))
+
+	logger := NewDataRaft(RaftConfig{NodeID: "n1"}).raftConfig.Logger
+	logger.Debug("hidden")
+	logger.Warn("heartbeat failed", "peer", "n2")
+	level.Set(slog.LevelDebug)
+	logger.Named("snapshot").Debug("shown")
+
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		record := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(line, &record))
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "heartbeat failed", records[0]["msg"])
+		assert.Equal(t, "WARN", records[0]["level"])
+		assert.Equal(t, "raft", records[0]["component"])
+		assert.Equal(t, "n2", records[0]["peer"])
+		assert.Equal(t, "shown", records[1]["msg"])
+		assert.Equal(t, "raft.snapshot", records[1]["component"])
+	}
+}
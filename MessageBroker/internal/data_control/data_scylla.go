@@ -1,8 +1,12 @@
 package datacontrol
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"therealbroker/internal/keyring"
 	"therealbroker/pkg/broker"
 	"time"
 
@@ -10,14 +14,52 @@ import (
 	"github.com/google/uuid"
 )
 
+// scyllaSession is the part of gocql.Session the backend uses, so tests
+// can run it against a fake
+type scyllaSession interface {
+	Exec(stmt string, values ...any) error
+	Scan(stmt string, values []any, dest ...any) error
+	// ScanCAS runs a lightweight transaction, dest gets the current
+	// values when it is not applied
+	ScanCAS(stmt string, values []any, dest ...any) (bool, error)
+	Iter(stmt string, values ...any) gocql.Scanner
+	Closed() bool
+	Close()
+}
+
+type gocqlSession struct {
+	*gocql.Session
+}
+
+func (s gocqlSession) Exec(stmt string, values ...any) error {
+	return s.Query(stmt, values...).Exec()
+}
+
+func (s gocqlSession) Scan(stmt string, values []any, dest ...any) error {
+	return s.Query(stmt, values...).Scan(dest...)
+}
+
+func (s gocqlSession) ScanCAS(stmt string, values []any, dest ...any) (bool, error) {
+	return s.Query(stmt, values...).ScanCAS(dest...)
+}
+
+func (s gocqlSession) Iter(stmt string, values ...any) gocql.Scanner {
+	return s.Query(stmt, values...).Iter().Scanner()
+}
+
 type DataScylla struct {
 	DataControl
 	cluster  *gocql.ClusterConfig
-	session  *gocql.Session
+	session  scyllaSession
 	host     string
 	port     string
 	keyspace string
 	forget   time.Duration
+	codec    bodyCodec
+
+	// sequences handed out on every subject
+	lock      sync.Mutex
+	sequences map[string]*subjectSequence
 }
 
 func NewDataScylla(host, port, keyspace string, forget time.Duration) *DataScylla {
@@ -28,19 +70,34 @@ func NewDataScylla(host, port, keyspace string, forget time.Duration) *DataScyll
 		port:     port,
 		keyspace: keyspace,
 		forget:   forget,
+
+		sequences: make(map[string]*subjectSequence),
 	}
 }
 
+// SetCompression compresses the bodies of at least threshold bytes with
+// algorithm, see package compression. Rows stored before stay readable.
+func (ds *DataScylla) SetCompression(algorithm string, threshold int) {
+	ds.codec.algorithm, ds.codec.threshold = algorithm, threshold
+}
+
+// SetEncryption seals the bodies with the primary key of k, see package
+// keyring. Rows stored before stay readable, see Reencrypt.
+func (ds *DataScylla) SetEncryption(k *keyring.Keyring) {
+	ds.codec.keyring = k
+}
+
 func (ds *DataScylla) Connect() error {
 	ds.cluster = gocql.NewCluster(fmt.Sprintf("%s:%s", ds.host, ds.port))
 	ds.cluster.Keyspace = ds.keyspace
 	ds.cluster.Consistency = gocql.Quorum
-	var err error
-	ds.session, err = ds.cluster.CreateSession()
+	session, err := ds.cluster.CreateSession()
 	if err != nil {
-		log.Println("Failed to connect to ScyllaDB: ", err)
+		slog.Error("failed to connect to database", "backend", "scylla", "host", ds.host, "port", ds.port, "error", err)
 		return broker.ErrDBConnect
 	}
+	ds.session = gocqlSession{session}
+	slog.Info("connected to database", "backend", "scylla", "host", ds.host, "port", ds.port, "keyspace", ds.keyspace)
 	return nil
 }
 
@@ -49,36 +106,168 @@ func (ds *DataScylla) Close() error {
 	return nil
 }
 
+func (ds *DataScylla) TestConnection() bool {
+	if ds.session == nil || ds.session.Closed() {
+		return false
+	}
+	var version string
+	return ds.session.Scan(`SELECT release_version FROM system.local`, nil, &version) == nil
+}
+
 func (ds *DataScylla) SaveMessage(msg broker.Message) (string, error) {
 	id := gocql.TimeUUID()
 	expires_at := time.Now().Add(msg.Expiration)
 	ttl := int((msg.Expiration + ds.forget).Seconds())
-	query := `INSERT INTO messages (id, body, expiration_duration, expires_at)
+	stored, err := ds.codec.encode(msg.Body)
+	if err != nil {
+		slog.Error("failed to encrypt message body", "backend", "scylla", "error", err)
+		return "", broker.ErrRunQuery
+	}
+	sequence, err := ds.nextSequence(msg.Subject)
+	if err != nil {
+		slog.Error("failed to take message sequence", "backend", "scylla", "subject", msg.Subject, "error", err)
+		return "", broker.ErrRunQuery
+	}
+	query := `BEGIN BATCH
+              INSERT INTO messages (id, body, expiration_duration, expires_at, headers, compression, key_id, subject, sequence)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+              USING TTL ?;
+              INSERT INTO messages_by_subject (subject, sequence, id, expires_at)
               VALUES (?, ?, ?, ?)
-			  USING TTL ?;`
+              USING TTL ?;
+              APPLY BATCH;`
 
-	err := ds.session.Query(query, id, msg.Body, int(msg.Expiration.Seconds()), expires_at, ttl).Exec()
+	err = ds.session.Exec(query, id, stored.body, int(msg.Expiration.Seconds()), expires_at, msg.Headers, stored.compression, stored.keyID, msg.Subject, sequence, ttl,
+		msg.Subject, sequence, id, expires_at, ttl)
 	if err != nil {
+		slog.Error("failed to save message", "backend", "scylla", "error", err)
 		return "", broker.ErrRunQuery
 	}
 
 	return fmt.Sprintf("%v", id), nil
 }
 
+// Most a node waits between lightweight transactions it lost to other
+// nodes, the actual wait is random so they do not collide again
+const scyllaSequenceBackoff = 20 * time.Millisecond
+
+// subjectSequence hands out the sequences of one subject on this node,
+// one lightweight transaction at a time
+type subjectSequence struct {
+	// last sequence this node took, the first guess of the next
+	// transaction
+	last int64
+	// saves waiting for the next transaction, nil when there are none
+	next *sequenceClaim
+	// a goroutine is running the transactions
+	running bool
+}
+
+// sequenceClaim reserves count sequences for the saves that joined it
+type sequenceClaim struct {
+	count int64
+	first int64
+	err   error
+	done  chan struct{}
+}
+
+// nextSequence takes the next sequence of subject. The saves on subject
+// arriving while a lightweight transaction runs share the next one, so
+// the node runs one at a time per subject whatever its load.
+func (ds *DataScylla) nextSequence(subject string) (int64, error) {
+	ds.lock.Lock()
+	sequence := ds.sequences[subject]
+	if sequence == nil {
+		sequence = &subjectSequence{}
+		ds.sequences[subject] = sequence
+	}
+	if sequence.next == nil {
+		sequence.next = &sequenceClaim{done: make(chan struct{})}
+	}
+	claim := sequence.next
+	index := claim.count
+	claim.count++
+	if !sequence.running {
+		sequence.running = true
+		go ds.claimSequences(subject, sequence)
+	}
+	ds.lock.Unlock()
+
+	<-claim.done
+	return claim.first + index, claim.err
+}
+
+// claimSequences reserves the sequences of the waiting claims until
+// none are left
+func (ds *DataScylla) claimSequences(subject string, sequence *subjectSequence) {
+	for {
+		ds.lock.Lock()
+		claim, last := sequence.next, sequence.last
+		sequence.next = nil
+		if claim == nil {
+			sequence.running = false
+			ds.lock.Unlock()
+			return
+		}
+		ds.lock.Unlock()
+
+		last, err := ds.reserveSequences(subject, last, claim.count)
+		ds.lock.Lock()
+		if err == nil {
+			sequence.last = last
+		}
+		ds.lock.Unlock()
+		claim.first, claim.err = last-claim.count+1, err
+		close(claim.done)
+	}
+}
+
+// reserveSequences moves the last sequence of subject count further with
+// a lightweight transaction, starting from the guess last, and returns
+// the new last one. Transactions lost to other nodes are retried, only
+// a failing query fails the saves.
+func (ds *DataScylla) reserveSequences(subject string, last, count int64) (int64, error) {
+	for {
+		var applied bool
+		var err error
+		var current int64
+		if last == 0 {
+			// the first save on subject, or its row was truncated
+			var existing string
+			applied, err = ds.session.ScanCAS(`INSERT INTO subject_sequences (subject, last) VALUES (?, ?) IF NOT EXISTS`,
+				[]any{subject, count}, &existing, &current)
+		} else {
+			applied, err = ds.session.ScanCAS(`UPDATE subject_sequences SET last = ? WHERE subject = ? IF last = ?`,
+				[]any{last + count, subject, last}, &current)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return last + count, nil
+		}
+		// zero when the row went away under the update
+		last = current
+		time.Sleep(rand.N(scyllaSequenceBackoff))
+	}
+}
+
 func (ds *DataScylla) RetriveMessage(id string) (broker.Message, error) {
 	uuid, err := uuid.Parse(id)
 	if err != nil {
 		return broker.Message{}, broker.ErrInvalidID
 	}
 
-	query := `SELECT body, expiration_duration, expires_at FROM messages WHERE id = ?`
+	query := `SELECT body, expiration_duration, expires_at, headers, compression, key_id, subject FROM messages WHERE id = ?`
 
 	cqluuid := gocql.UUID(uuid)
 	msg := broker.Message{Id: id}
 	var expiresAt time.Time
-	if err := ds.session.Query(query, cqluuid).Scan(&msg.Body, &msg.Expiration, &expiresAt); err == gocql.ErrNotFound {
+	var compression, keyID string
+	if err := ds.session.Scan(query, []any{cqluuid}, &msg.Body, &msg.Expiration, &expiresAt, &msg.Headers, &compression, &keyID, &msg.Subject); err == gocql.ErrNotFound {
 		return broker.Message{}, broker.ErrInvalidID
 	} else if err != nil {
+		slog.Error("failed to retrieve message", "backend", "scylla", "id", id, "error", err)
 		return broker.Message{}, broker.ErrRunQuery
 	}
 
@@ -88,15 +277,136 @@ func (ds *DataScylla) RetriveMessage(id string) (broker.Message, error) {
 		return broker.Message{}, broker.ErrExpiredID
 	}
 
+	msg.Body, err = ds.codec.decode(storedBody{body: msg.Body, compression: compression, keyID: keyID})
+	if err != nil {
+		slog.Error("failed to decode message body", "backend", "scylla", "id", id, "compression", compression, "key_id", keyID, "error", err)
+		return broker.Message{}, broker.ErrRunQuery
+	}
 	return msg, nil
 }
 
-func (ds *DataScylla) ClearData() error {
-	query := `TRUNCATE messages;`
-	err := ds.session.Query(query).Exec()
+func (ds *DataScylla) ListMessages(r broker.Range) (broker.Page, error) {
+	start, err := rangeStart(r, ds.position)
+	if err != nil {
+		return broker.Page{}, err
+	}
+	query := `SELECT sequence, id, expires_at FROM messages_by_subject WHERE subject = ? AND sequence >= ? ORDER BY sequence ASC`
+	if r.Reverse {
+		query = `SELECT sequence, id, expires_at FROM messages_by_subject WHERE subject = ? AND sequence <= ? ORDER BY sequence DESC`
+	}
+	rows := ds.session.Iter(query, r.Subject, int64(rangeBound(r, start)))
+	var messages []broker.StoredMessage
+	for len(messages) <= r.Limit && rows.Next() {
+		var sequence int64
+		var id gocql.UUID
+		var expiresAt time.Time
+		if err = rows.Scan(&sequence, &id, &expiresAt); err != nil {
+			break
+		}
+		// the id is a time uuid taken when the message was saved
+		if time.Now().After(expiresAt) || !r.Includes(id.Time()) {
+			continue
+		}
+		msg, retrieveErr := ds.RetriveMessage(id.String())
+		if retrieveErr == broker.ErrInvalidID || retrieveErr == broker.ErrExpiredID {
+			continue
+		} else if retrieveErr != nil {
+			err = retrieveErr
+			break
+		}
+		msg.Subject = r.Subject
+		messages = append(messages, broker.StoredMessage{Message: msg, Sequence: uint64(sequence), SavedAt: id.Time()})
+	}
+	// Err closes the iterator too
+	if iterErr := rows.Err(); err == nil {
+		err = iterErr
+	}
+	if err != nil {
+		slog.Error("failed to list messages", "backend", "scylla", "subject", r.Subject, "error", err)
+		return broker.Page{}, broker.ErrRunQuery
+	}
+	return newPage(messages, r.Limit), nil
+}
+
+// position looks up the subject and sequence of id, both are empty for
+// messages saved before they were stored
+func (ds *DataScylla) position(id string) (string, uint64, error) {
+	parsed, err := uuid.Parse(id)
 	if err != nil {
-		log.Println(err)
-		return broker.ErrClearData
+		return "", 0, broker.ErrInvalidID
+	}
+	var subject string
+	var sequence int64
+	err = ds.session.Scan(`SELECT subject, sequence FROM messages WHERE id = ?`, []any{gocql.UUID(parsed)}, &subject, &sequence)
+	if err == gocql.ErrNotFound {
+		return "", 0, broker.ErrInvalidID
+	} else if err != nil {
+		slog.Error("failed to look up message", "backend", "scylla", "id", id, "error", err)
+		return "", 0, broker.ErrRunQuery
+	}
+	return subject, uint64(sequence), nil
+}
+
+// Reencrypt seals the bodies that are not sealed by the primary key of
+// the keyring, plaintext ones included, with the primary key. It scans
+// the whole table, expired messages are left alone and the rewritten
+// rows keep their ttl. It returns how many messages were rewritten,
+// messages that could not be opened are logged and skipped.
+func (ds *DataScylla) Reencrypt(ctx context.Context) (int, error) {
+	if ds.codec.keyring == nil {
+		return 0, errNoKeyring
+	}
+	primary := ds.codec.keyring.Primary()
+	rows := ds.session.Iter(`SELECT id, body, compression, key_id, expires_at, TTL(body) FROM messages`)
+	rewritten, failed := 0, 0
+	var err error
+	for err == nil && rows.Next() {
+		var id gocql.UUID
+		var stored storedBody
+		var expiresAt time.Time
+		var ttl int
+		if err = rows.Scan(&id, &stored.body, &stored.compression, &stored.keyID, &expiresAt, &ttl); err != nil {
+			break
+		}
+		if stored.keyID == primary || time.Now().After(expiresAt) {
+			continue
+		}
+		next, changed, reencodeErr := ds.codec.reencode(stored)
+		if reencodeErr != nil {
+			slog.Error("failed to re-encrypt message", "backend", "scylla", "id", id.String(), "key_id", stored.keyID, "error", reencodeErr)
+			failed++
+			continue
+		}
+		if !changed {
+			continue
+		}
+		err = ds.session.Exec(`UPDATE messages USING TTL ? SET body = ?, compression = ?, key_id = ? WHERE id = ?;`,
+			ttl, next.body, next.compression, next.keyID, id)
+		if err == nil {
+			rewritten++
+			err = ctx.Err()
+		}
+	}
+	// Err closes the iterator too
+	if iterErr := rows.Err(); err == nil {
+		err = iterErr
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d messages could not be re-encrypted", failed)
+	}
+	return rewritten, err
+}
+
+func (ds *DataScylla) ClearData() error {
+	for _, table := range []string{"messages", "messages_by_subject", "subject_sequences"} {
+		err := ds.session.Exec(`TRUNCATE ` + table + `;`)
+		if err != nil {
+			slog.Error("failed to clear data", "backend", "scylla", "table", table, "error", err)
+			return broker.ErrClearData
+		}
 	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	clear(ds.sequences)
 	return nil
 }
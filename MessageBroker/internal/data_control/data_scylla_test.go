@@ -0,0 +1,387 @@
+package datacontrol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"therealbroker/internal/data_control/datatest"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestScyllaConformance runs the suite against a fake session, and
+// against a real cluster too when SCYLLA_TEST_HOST is set, see
+// config/scylla-create-database.txt for its table.
+func TestScyllaConformance(t *testing.T) {
+	options := datatest.Options{MissingID: uuid.NewString()}
+	t.Run("fake", func(t *testing.T) {
+		datatest.Run(t, func(t *testing.T) datatest.Store {
+			ds := NewDataScylla("", "", "", 10*time.Second)
+			ds.session = newFakeScylla()
+			return ds
+		}, options)
+	})
+	t.Run("fake compressed", func(t *testing.T) {
+		datatest.Run(t, func(t *testing.T) datatest.Store {
+			ds := NewDataScylla("", "", "", 10*time.Second)
+			ds.session = newFakeScylla()
+			ds.SetCompression(compression.Snappy, 0)
+			return ds
+		}, options)
+	})
+	t.Run("fake encrypted", func(t *testing.T) {
+		datatest.Run(t, func(t *testing.T) datatest.Store {
+			ds := NewDataScylla("", "", "", 10*time.Second)
+			ds.session = newFakeScylla()
+			ds.SetEncryption(newTestKeyring(t, "key-1"))
+			return ds
+		}, options)
+	})
+	t.Run("scylla", func(t *testing.T) {
+		if os.Getenv("SCYLLA_TEST_HOST") == "" {
+			t.Skip("SCYLLA_TEST_HOST is not set")
+		}
+		datatest.Run(t, func(t *testing.T) datatest.Store {
+			ds := NewDataScylla(os.Getenv("SCYLLA_TEST_HOST"), envOr("SCYLLA_TEST_PORT", "9042"),
+				envOr("SCYLLA_TEST_KEYSPACE", "test_db"), 10*time.Second)
+			if err := ds.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ds.Close() })
+			if err := ds.ClearData(); err != nil {
+				t.Fatal(err)
+			}
+			return ds
+		}, options)
+	})
+}
+
+func TestScyllaShouldCompressLargeBodies(t *testing.T) {
+	ds := NewDataScylla("", "", "", 10*time.Second)
+	session := newFakeScylla()
+	ds.session = session
+	ds.SetCompression(compression.Snappy, 256)
+	large := strings.Repeat(`{"item":"book","count":1}`, 100)
+
+	id, err := ds.SaveMessage(broker.Message{Body: large, Expiration: time.Minute})
+	assert.Nil(t, err)
+	tiny, err := ds.SaveMessage(broker.Message{Body: "small", Expiration: time.Minute})
+	assert.Nil(t, err)
+
+	row := session.rows[gocql.UUID(uuid.MustParse(id))]
+	assert.Equal(t, compression.Snappy, row.compression)
+	assert.Less(t, len(row.body), len(large)/4)
+	assert.Equal(t, "", session.rows[gocql.UUID(uuid.MustParse(tiny))].compression)
+
+	msg, err := ds.RetriveMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, large, msg.Body)
+}
+
+func TestScyllaReencryptShouldKeepTheRowTTL(t *testing.T) {
+	ds := NewDataScylla("", "", "", 10*time.Second)
+	session := newFakeScylla()
+	ds.session = session
+	ds.SetEncryption(newTestKeyring(t, "key-1"))
+	id, err := ds.SaveMessage(broker.Message{Body: "secret", Expiration: time.Minute})
+	assert.Nil(t, err)
+	uuid := gocql.UUID(uuid.MustParse(id))
+	deleteAt := session.rows[uuid].deleteAt
+
+	ds.SetEncryption(newTestKeyring(t, "key-1", "key-2"))
+	rewritten, err := ds.Reencrypt(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rewritten)
+	assert.Equal(t, "key-2", session.rows[uuid].keyID)
+	assert.WithinDuration(t, deleteAt, session.rows[uuid].deleteAt, 2*time.Second)
+
+	msg, err := ds.RetriveMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", msg.Body)
+}
+
+func TestScyllaSavesShouldNotFailOnContendedSequences(t *testing.T) {
+	session := newFakeScylla()
+	var nodes []*DataScylla
+	for i := 0; i < 2; i++ {
+		ds := NewDataScylla("", "", "", 10*time.Second)
+		ds.session = session
+		nodes = append(nodes, ds)
+	}
+
+	const saves = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*saves)
+	for i := 0; i < saves; i++ {
+		for _, ds := range nodes {
+			wg.Add(1)
+			go func(ds *DataScylla) {
+				defer wg.Done()
+				_, err := ds.SaveMessage(broker.Message{Subject: "contended", Body: "body", Expiration: time.Minute})
+				errs <- err
+			}(ds)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	page, err := nodes[0].ListMessages(broker.Range{Subject: "contended", Limit: 2 * saves})
+	assert.Nil(t, err)
+	assert.Len(t, page.Messages, 2*saves)
+	for i, msg := range page.Messages {
+		assert.Equal(t, uint64(i+1), msg.Sequence)
+	}
+}
+
+// fakeScylla answers the statements DataScylla sends, keeping the
+// tables in memory and honouring the row ttl
+type fakeScylla struct {
+	lock   sync.Mutex
+	rows   map[gocql.UUID]fakeScyllaRow
+	closed bool
+	// messages_by_subject and subject_sequences
+	bySubject map[string]map[int64]fakeScyllaRow
+	sequences map[string]int64
+}
+
+type fakeScyllaRow struct {
+	body       string
+	expiration int
+	expiresAt  time.Time
+	headers    map[string]string
+	// empty for null
+	compression string
+	keyID       string
+	subject     string
+	sequence    int64
+	// zero when the row has no ttl
+	deleteAt time.Time
+	// set in messages_by_subject rows
+	id gocql.UUID
+}
+
+func newFakeScylla() *fakeScylla {
+	return &fakeScylla{
+		rows:      make(map[gocql.UUID]fakeScyllaRow),
+		bySubject: make(map[string]map[int64]fakeScyllaRow),
+		sequences: make(map[string]int64),
+	}
+}
+
+// deleteAt is when a row saved now with ttl goes away
+func deleteAt(ttl int) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (r fakeScyllaRow) deleted() bool {
+	return !r.deleteAt.IsZero() && time.Now().After(r.deleteAt)
+}
+
+func (f *fakeScylla) Exec(stmt string, values ...any) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case strings.HasPrefix(stmt, "BEGIN BATCH"):
+		row := fakeScyllaRow{
+			body:       values[1].(string),
+			expiration: values[2].(int),
+			expiresAt:  values[3].(time.Time),
+			subject:    values[7].(string),
+			sequence:   values[8].(int64),
+			deleteAt:   deleteAt(values[9].(int)),
+		}
+		row.headers, _ = values[4].(map[string]string)
+		row.compression, row.keyID = values[5].(string), values[6].(string)
+		f.rows[values[0].(gocql.UUID)] = row
+		subject := values[10].(string)
+		if f.bySubject[subject] == nil {
+			f.bySubject[subject] = make(map[int64]fakeScyllaRow)
+		}
+		f.bySubject[subject][values[11].(int64)] = fakeScyllaRow{
+			id:        values[12].(gocql.UUID),
+			expiresAt: values[13].(time.Time),
+			deleteAt:  deleteAt(values[14].(int)),
+		}
+	case strings.HasPrefix(stmt, "UPDATE messages USING TTL ? SET body = ?, compression = ?, key_id = ?"):
+		id := values[4].(gocql.UUID)
+		row, ok := f.rows[id]
+		if !ok {
+			// an update of a missing row inserts it
+			row = fakeScyllaRow{}
+		}
+		row.body, row.compression, row.keyID = values[1].(string), values[2].(string), values[3].(string)
+		row.deleteAt = deleteAt(values[0].(int))
+		f.rows[id] = row
+	case stmt == "TRUNCATE messages;":
+		clear(f.rows)
+	case stmt == "TRUNCATE messages_by_subject;":
+		clear(f.bySubject)
+	case stmt == "TRUNCATE subject_sequences;":
+		clear(f.sequences)
+	default:
+		return fmt.Errorf("fake scylla: unexpected statement %q", stmt)
+	}
+	return nil
+}
+
+func (f *fakeScylla) Scan(stmt string, values []any, dest ...any) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case strings.Contains(stmt, "FROM system.local"):
+		*dest[0].(*string) = "fake"
+	case strings.HasPrefix(stmt, "SELECT body, expiration_duration, expires_at, headers, compression, key_id, subject FROM messages"):
+		row, ok := f.rows[values[0].(gocql.UUID)]
+		if !ok || row.deleted() {
+			return gocql.ErrNotFound
+		}
+		*dest[0].(*string) = row.body
+		*dest[1].(*time.Duration) = time.Duration(row.expiration)
+		*dest[2].(*time.Time) = row.expiresAt
+		*dest[3].(*map[string]string) = row.headers
+		*dest[4].(*string) = row.compression
+		*dest[5].(*string) = row.keyID
+		*dest[6].(*string) = row.subject
+	case strings.HasPrefix(stmt, "SELECT subject, sequence FROM messages"):
+		row, ok := f.rows[values[0].(gocql.UUID)]
+		if !ok || row.deleted() {
+			return gocql.ErrNotFound
+		}
+		*dest[0].(*string) = row.subject
+		*dest[1].(*int64) = row.sequence
+	default:
+		return fmt.Errorf("fake scylla: unexpected query %q", stmt)
+	}
+	return nil
+}
+
+func (f *fakeScylla) ScanCAS(stmt string, values []any, dest ...any) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case strings.HasPrefix(stmt, "INSERT INTO subject_sequences"):
+		subject := values[0].(string)
+		if last, ok := f.sequences[subject]; ok {
+			*dest[0].(*string), *dest[1].(*int64) = subject, last
+			return false, nil
+		}
+		f.sequences[subject] = values[1].(int64)
+		return true, nil
+	case strings.HasPrefix(stmt, "UPDATE subject_sequences"):
+		subject := values[1].(string)
+		last, ok := f.sequences[subject]
+		if !ok || last != values[2].(int64) {
+			*dest[0].(*int64) = last
+			return false, nil
+		}
+		f.sequences[subject] = values[0].(int64)
+		return true, nil
+	}
+	return false, fmt.Errorf("fake scylla: unexpected transaction %q", stmt)
+}
+
+func (f *fakeScylla) Iter(stmt string, values ...any) gocql.Scanner {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	scanner := &fakeScanner{}
+	switch {
+	case strings.HasPrefix(stmt, "SELECT id, body, compression, key_id, expires_at, TTL(body) FROM messages"):
+		for id, row := range f.rows {
+			if row.deleted() {
+				continue
+			}
+			ttl := 0
+			if !row.deleteAt.IsZero() {
+				ttl = int(time.Until(row.deleteAt).Seconds())
+			}
+			scanner.rows = append(scanner.rows, []any{id, row.body, row.compression, row.keyID, row.expiresAt, ttl})
+		}
+	case strings.HasPrefix(stmt, "SELECT sequence, id, expires_at FROM messages_by_subject"):
+		reverse := strings.HasSuffix(stmt, "DESC")
+		bound := values[1].(int64)
+		var sequences []int64
+		for sequence, row := range f.bySubject[values[0].(string)] {
+			if !row.deleted() && (reverse && sequence <= bound || !reverse && sequence >= bound) {
+				sequences = append(sequences, sequence)
+			}
+		}
+		slices.Sort(sequences)
+		if reverse {
+			slices.Reverse(sequences)
+		}
+		for _, sequence := range sequences {
+			row := f.bySubject[values[0].(string)][sequence]
+			scanner.rows = append(scanner.rows, []any{sequence, row.id, row.expiresAt})
+		}
+	default:
+		scanner.err = fmt.Errorf("fake scylla: unexpected query %q", stmt)
+	}
+	return scanner
+}
+
+// fakeScanner serves rows as a gocql.Scanner
+type fakeScanner struct {
+	rows [][]any
+	next int
+	err  error
+}
+
+func (s *fakeScanner) Next() bool {
+	if s.err != nil || s.next >= len(s.rows) {
+		return false
+	}
+	s.next++
+	return true
+}
+
+func (s *fakeScanner) Scan(dest ...any) error {
+	for i, value := range s.rows[s.next-1] {
+		switch d := dest[i].(type) {
+		case *gocql.UUID:
+			*d = value.(gocql.UUID)
+		case *string:
+			*d = value.(string)
+		case *time.Time:
+			*d = value.(time.Time)
+		case *int:
+			*d = value.(int)
+		case *int64:
+			*d = value.(int64)
+		default:
+			return fmt.Errorf("fake scylla: cannot scan into %T", d)
+		}
+	}
+	return nil
+}
+
+func (s *fakeScanner) Err() error {
+	return s.err
+}
+
+func (f *fakeScylla) Closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+func (f *fakeScylla) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
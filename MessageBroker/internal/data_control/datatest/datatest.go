@@ -0,0 +1,364 @@
+// Package datatest is the conformance suite of the DataControl backends.
+// A backend passes it by running Run from its tests:
+//
+//	func TestMemoryConformance(t *testing.T) {
+//		datatest.Run(t, func(t *testing.T) datatest.Store {
+//			return NewDataMemory()
+//		}, datatest.Options{MissingID: "999999999"})
+//	}
+package datatest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Store is the DataControl interface, repeated so the backends can run
+// the suite from their own package.
+type Store interface {
+	SaveMessage(msg broker.Message) (string, error)
+	RetriveMessage(id string) (broker.Message, error)
+	ListMessages(r broker.Range) (broker.Page, error)
+	ClearData() error
+	TestConnection() bool
+}
+
+type Options struct {
+	// A well formed id that is never handed out by the store
+	MissingID string
+	// An id the store can tell is malformed, "not-an-id" when empty
+	MalformedID string
+	// Saves done at the same time by the concurrency checks
+	Concurrency int
+}
+
+// Run checks the store returned by newStore against the behaviour the
+// broker expects. Every check gets a fresh store, the checks do not run
+// in parallel since ClearData empties the whole store.
+func Run(t *testing.T, newStore func(t *testing.T) Store, options Options) {
+	if options.MalformedID == "" {
+		options.MalformedID = "not-an-id"
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 8
+	}
+	checks := []struct {
+		name  string
+		check func(*testing.T, Store, Options)
+	}{
+		{"SaveAndRetrieve", testSaveAndRetrieve},
+		{"SaveWithoutHeaders", testSaveWithoutHeaders},
+		{"UniqueIDs", testUniqueIDs},
+		{"Ordering", testOrdering},
+		{"Expiry", testExpiry},
+		{"InvalidIDs", testInvalidIDs},
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"ConcurrentSavesAndRetrieves", testConcurrentSavesAndRetrieves},
+		{"ClearData", testClearData},
+		{"Range", testRange},
+		{"RangeStarts", testRangeStarts},
+		{"RangeWindow", testRangeWindow},
+		{"TestConnection", testConnection},
+	}
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			c.check(t, newStore(t), options)
+		})
+	}
+}
+
+func save(t *testing.T, store Store, msg broker.Message) string {
+	t.Helper()
+	id, err := store.SaveMessage(msg)
+	if !assert.Nil(t, err) || !assert.NotEmpty(t, id) {
+		t.FailNow()
+	}
+	return id
+}
+
+func testSaveAndRetrieve(t *testing.T, store Store, _ Options) {
+	id := save(t, store, broker.Message{
+		Subject:    "orders",
+		Body:       "hello",
+		Headers:    map[string]string{"traceparent": "00-abc-def-01", "k": "v"},
+		Expiration: time.Minute,
+	})
+
+	msg, err := store.RetriveMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, id, msg.Id)
+	assert.Equal(t, "orders", msg.Subject)
+	assert.Equal(t, "hello", msg.Body)
+	assert.Equal(t, map[string]string{"traceparent": "00-abc-def-01", "k": "v"}, msg.Headers)
+	assert.Equal(t, time.Minute, msg.Expiration)
+}
+
+func testSaveWithoutHeaders(t *testing.T, store Store, _ Options) {
+	id := save(t, store, broker.Message{Body: "plain", Expiration: time.Minute})
+
+	msg, err := store.RetriveMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", msg.Body)
+	assert.Empty(t, msg.Headers)
+}
+
+func testUniqueIDs(t *testing.T, store Store, _ Options) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := save(t, store, broker.Message{Body: "same", Expiration: time.Minute})
+		assert.False(t, seen[id], "id %s handed out twice", id)
+		seen[id] = true
+	}
+}
+
+// testOrdering saves messages one after another and checks every id
+// still leads to its own message, e.g. when saves are batched.
+func testOrdering(t *testing.T, store Store, _ Options) {
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = save(t, store, broker.Message{Body: fmt.Sprint(i), Expiration: time.Minute})
+	}
+	for i, id := range ids {
+		msg, err := store.RetriveMessage(id)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(i), msg.Body)
+	}
+}
+
+func testExpiry(t *testing.T, store Store, _ Options) {
+	short := save(t, store, broker.Message{Body: "short", Expiration: time.Second})
+	long := save(t, store, broker.Message{Body: "long", Expiration: time.Minute})
+
+	_, err := store.RetriveMessage(short)
+	assert.Nil(t, err, "message expired too early")
+	time.Sleep(1500 * time.Millisecond)
+
+	msg, err := store.RetriveMessage(short)
+	assert.Equal(t, broker.ErrExpiredID, err)
+	assert.Equal(t, broker.Message{}, msg)
+	msg, err = store.RetriveMessage(long)
+	assert.Nil(t, err)
+	assert.Equal(t, "long", msg.Body)
+}
+
+func testInvalidIDs(t *testing.T, store Store, options Options) {
+	save(t, store, broker.Message{Body: "exists", Expiration: time.Minute})
+
+	for _, id := range []string{options.MissingID, options.MalformedID, ""} {
+		msg, err := store.RetriveMessage(id)
+		assert.Equal(t, broker.ErrInvalidID, err, "id %q", id)
+		assert.Equal(t, broker.Message{}, msg)
+	}
+}
+
+// testConcurrentSaves saves from several goroutines at once, every id
+// must be unique and lead to the message saved with it
+func testConcurrentSaves(t *testing.T, store Store, options Options) {
+	const perWorker = 25
+	ids := make([][]string, options.Concurrency)
+	var wg sync.WaitGroup
+	for w := range ids {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id, err := store.SaveMessage(broker.Message{Body: fmt.Sprintf("%d-%d", w, i), Expiration: time.Minute})
+				assert.Nil(t, err)
+				ids[w] = append(ids[w], id)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for w := range ids {
+		for i, id := range ids[w] {
+			assert.False(t, seen[id], "id %s handed out twice", id)
+			seen[id] = true
+			msg, err := store.RetriveMessage(id)
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("%d-%d", w, i), msg.Body)
+		}
+	}
+}
+
+func testConcurrentSavesAndRetrieves(t *testing.T, store Store, options Options) {
+	ids := make(chan string, 1000)
+	var savers, readers sync.WaitGroup
+	for w := 0; w < options.Concurrency; w++ {
+		savers.Add(1)
+		go func() {
+			defer savers.Done()
+			for i := 0; i < 25; i++ {
+				id, err := store.SaveMessage(broker.Message{Body: "racing", Expiration: time.Minute})
+				assert.Nil(t, err)
+				ids <- id
+			}
+		}()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for id := range ids {
+				msg, err := store.RetriveMessage(id)
+				assert.Nil(t, err)
+				assert.Equal(t, "racing", msg.Body)
+			}
+		}()
+	}
+	savers.Wait()
+	close(ids)
+	readers.Wait()
+}
+
+func testClearData(t *testing.T, store Store, _ Options) {
+	before := save(t, store, broker.Message{Body: "before", Expiration: time.Minute})
+
+	assert.Nil(t, store.ClearData())
+	_, err := store.RetriveMessage(before)
+	assert.Equal(t, broker.ErrInvalidID, err)
+
+	after := save(t, store, broker.Message{Body: "after", Expiration: time.Minute})
+	msg, err := store.RetriveMessage(after)
+	assert.Nil(t, err)
+	assert.Equal(t, "after", msg.Body)
+}
+
+func testConnection(t *testing.T, store Store, _ Options) {
+	assert.True(t, store.TestConnection())
+}
+
+func list(t *testing.T, store Store, r broker.Range) broker.Page {
+	t.Helper()
+	if !assert.Nil(t, r.Validate()) {
+		t.FailNow()
+	}
+	page, err := store.ListMessages(r)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return page
+}
+
+func bodies(page broker.Page) []string {
+	bodies := make([]string, len(page.Messages))
+	for i, msg := range page.Messages {
+		bodies[i] = msg.Body
+	}
+	return bodies
+}
+
+// saveOrders saves o1 to o5 on orders, with an expired message after o2
+// and messages of another subject in between, and returns their ids
+func saveOrders(t *testing.T, store Store) []string {
+	var ids []string
+	for i := 1; i <= 5; i++ {
+		ids = append(ids, save(t, store, broker.Message{
+			Subject:    "orders",
+			Body:       fmt.Sprintf("o%d", i),
+			Headers:    map[string]string{"n": fmt.Sprint(i)},
+			Expiration: time.Minute,
+		}))
+		save(t, store, broker.Message{Subject: "other", Body: "x", Expiration: time.Minute})
+		if i == 2 {
+			save(t, store, broker.Message{Subject: "orders", Body: "expired"})
+		}
+	}
+	return ids
+}
+
+// testRange pages through a subject both ways, expired messages and
+// other subjects are skipped
+func testRange(t *testing.T, store Store, _ Options) {
+	ids := saveOrders(t, store)
+
+	page := list(t, store, broker.Range{Subject: "orders", Limit: 2})
+	assert.Equal(t, []string{"o1", "o2"}, bodies(page))
+	assert.NotEmpty(t, page.Next)
+	first := page.Messages[0]
+	assert.Equal(t, ids[0], first.Id)
+	assert.Equal(t, "orders", first.Subject)
+	assert.Equal(t, map[string]string{"n": "1"}, first.Headers)
+	assert.Equal(t, time.Minute, first.Expiration)
+	assert.Equal(t, uint64(1), first.Sequence)
+	assert.WithinDuration(t, time.Now(), first.SavedAt, time.Minute)
+
+	page = list(t, store, broker.Range{Subject: "orders", Limit: 2, Cursor: page.Next})
+	assert.Equal(t, []string{"o3", "o4"}, bodies(page))
+	// the expired message keeps its sequence
+	assert.Equal(t, uint64(4), page.Messages[0].Sequence)
+	page = list(t, store, broker.Range{Subject: "orders", Limit: 2, Cursor: page.Next})
+	assert.Equal(t, []string{"o5"}, bodies(page))
+	assert.Empty(t, page.Next)
+
+	var reversed []string
+	for page := (broker.Page{Next: ""}); ; {
+		page = list(t, store, broker.Range{Subject: "orders", Limit: 2, Reverse: true, Cursor: page.Next})
+		reversed = append(reversed, bodies(page)...)
+		if page.Next == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"o5", "o4", "o3", "o2", "o1"}, reversed)
+
+	assert.Equal(t, []string{"x", "x", "x", "x", "x"}, bodies(list(t, store, broker.Range{Subject: "other"})))
+	assert.Empty(t, list(t, store, broker.Range{Subject: "missing"}).Messages)
+
+	// sequences start over with the data
+	assert.Nil(t, store.ClearData())
+	save(t, store, broker.Message{Subject: "orders", Body: "again", Expiration: time.Minute})
+	page = list(t, store, broker.Range{Subject: "orders"})
+	assert.Equal(t, []string{"again"}, bodies(page))
+	assert.Equal(t, uint64(1), page.Messages[0].Sequence)
+}
+
+func testRangeStarts(t *testing.T, store Store, options Options) {
+	ids := saveOrders(t, store)
+
+	page := list(t, store, broker.Range{Subject: "orders", StartID: ids[2]})
+	assert.Equal(t, []string{"o3", "o4", "o5"}, bodies(page))
+	page = list(t, store, broker.Range{Subject: "orders", StartID: ids[2], Reverse: true})
+	assert.Equal(t, []string{"o3", "o2", "o1"}, bodies(page))
+	page = list(t, store, broker.Range{Subject: "orders", StartSequence: 5, Limit: 1})
+	assert.Equal(t, []string{"o4"}, bodies(page))
+	page = list(t, store, broker.Range{Subject: "orders", StartSequence: 3, Reverse: true})
+	assert.Equal(t, []string{"o2", "o1"}, bodies(page))
+	assert.Empty(t, list(t, store, broker.Range{Subject: "orders", StartSequence: 100}).Messages)
+	assert.Equal(t, []string{"o5"}, bodies(list(t, store, broker.Range{Subject: "orders", StartSequence: 100, Reverse: true, Limit: 1})))
+
+	// ids of other subjects and unknown ids
+	for _, id := range []string{ids[0], options.MissingID} {
+		r := broker.Range{Subject: "other", StartID: id}
+		assert.Nil(t, r.Validate())
+		_, err := store.ListMessages(r)
+		assert.Equal(t, broker.ErrInvalidID, err, "id %q", id)
+	}
+	for _, cursor := range []string{"not-a-cursor", "0", "-1"} {
+		r := broker.Range{Subject: "orders", Cursor: cursor}
+		assert.Nil(t, r.Validate())
+		_, err := store.ListMessages(r)
+		assert.True(t, errors.Is(err, broker.ErrInvalidRange), "cursor %q", cursor)
+	}
+}
+
+func testRangeWindow(t *testing.T, store Store, _ Options) {
+	save(t, store, broker.Message{Subject: "orders", Body: "before", Expiration: time.Minute})
+	time.Sleep(50 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	save(t, store, broker.Message{Subject: "orders", Body: "during", Expiration: time.Minute})
+	time.Sleep(50 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	save(t, store, broker.Message{Subject: "orders", Body: "after", Expiration: time.Minute})
+
+	assert.Equal(t, []string{"during", "after"}, bodies(list(t, store, broker.Range{Subject: "orders", Since: since})))
+	assert.Equal(t, []string{"during", "before"}, bodies(list(t, store, broker.Range{Subject: "orders", Until: until, Reverse: true})))
+	assert.Equal(t, []string{"during"}, bodies(list(t, store, broker.Range{Subject: "orders", Since: since, Until: until})))
+}
@@ -0,0 +1,51 @@
+package datacontrol
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"therealbroker/pkg/broker"
+)
+
+// rangeStart returns the sequence the page of r starts at, 0 for the
+// oldest message, or the newest when r is reversed. position looks up the
+// subject and sequence of a message id.
+func rangeStart(r broker.Range, position func(id string) (string, uint64, error)) (uint64, error) {
+	switch {
+	case r.Cursor != "":
+		sequence, err := strconv.ParseUint(r.Cursor, 10, 64)
+		if err != nil || sequence == 0 {
+			return 0, fmt.Errorf("%w: malformed cursor %q", broker.ErrInvalidRange, r.Cursor)
+		}
+		return sequence, nil
+	case r.StartID != "":
+		subject, sequence, err := position(r.StartID)
+		if err != nil {
+			return 0, err
+		}
+		// messages saved before subjects were stored have no sequence
+		if subject != r.Subject || sequence == 0 {
+			return 0, broker.ErrInvalidID
+		}
+		return sequence, nil
+	}
+	return r.StartSequence, nil
+}
+
+// rangeBound is the first sequence a query of r reads from start, for
+// backends that compare sequences in the query
+func rangeBound(r broker.Range, start uint64) uint64 {
+	if r.Reverse && start == 0 {
+		return math.MaxInt64
+	}
+	return start
+}
+
+// newPage keeps the first limit of messages, read one past the limit
+// to tell whether there is a next page
+func newPage(messages []broker.StoredMessage, limit int) broker.Page {
+	if len(messages) <= limit {
+		return broker.Page{Messages: messages}
+	}
+	return broker.Page{Messages: messages[:limit], Next: strconv.FormatUint(messages[limit].Sequence, 10)}
+}
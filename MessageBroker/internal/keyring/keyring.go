@@ -0,0 +1,191 @@
+// Package keyring encrypts stored message bodies with envelope
+// encryption. Every body gets its own random data key, sealed with
+// AES-GCM, and the data key is sealed in turn by a key of the keyring.
+// The id of that key is stored with the body, so keys can rotate: new
+// bodies use the primary key and older keys stay for decryption until
+// the re-encryption job has moved every body to the primary one.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format of a sealed body: version, the nonce and the sealed data key,
+// then the nonce and the sealed body.
+const (
+	version     = 1
+	dataKeySize = 32
+	nonceSize   = 12
+	overhead    = 16
+	headerSize  = 1 + nonceSize + dataKeySize + overhead + nonceSize
+)
+
+var (
+	// The body was sealed by a key missing from the keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// The body is not a sealed body, or was sealed by another key
+	ErrCorrupted = errors.New("sealed body is corrupted")
+)
+
+// Key is a key of the keyring file, its secret is base64 encoded and
+// 16, 24 or 32 bytes long, e.g. from `openssl rand -base64 32`.
+type Key struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+type File struct {
+	// Id of the key sealing new bodies
+	Primary string `yaml:"primary"`
+	Keys    []Key  `yaml:"keys"`
+}
+
+// LoadFile reads and checks a keyring file
+func LoadFile(path string) (*File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{}
+	if err := yaml.Unmarshal(content, file); err != nil {
+		return nil, err
+	}
+	if _, _, err := file.ciphers(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ciphers builds the cipher of every key
+func (f *File) ciphers() (map[string]cipher.AEAD, string, error) {
+	keys := make(map[string]cipher.AEAD, len(f.Keys))
+	for _, key := range f.Keys {
+		if key.ID == "" {
+			return nil, "", errors.New("keyring: key without id")
+		}
+		if _, ok := keys[key.ID]; ok {
+			return nil, "", fmt.Errorf("keyring: duplicate key %q", key.ID)
+		}
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil {
+			return nil, "", fmt.Errorf("keyring: key %q is not base64: %w", key.ID, err)
+		}
+		aead, err := newAEAD(secret)
+		if err != nil {
+			return nil, "", fmt.Errorf("keyring: key %q: %w", key.ID, err)
+		}
+		keys[key.ID] = aead
+	}
+	if _, ok := keys[f.Primary]; !ok {
+		return nil, "", fmt.Errorf("keyring: primary key %q is not in the keyring", f.Primary)
+	}
+	return keys, f.Primary, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Keyring seals and opens bodies, it is safe for concurrent use
+type Keyring struct {
+	lock    sync.RWMutex
+	keys    map[string]cipher.AEAD
+	primary string
+}
+
+func New(file *File) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Update(file); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Update swaps the keys, e.g. after a new primary key was added
+func (k *Keyring) Update(file *File) error {
+	keys, primary, err := file.ciphers()
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys, k.primary = keys, primary
+	return nil
+}
+
+// Primary returns the id of the key sealing new bodies
+func (k *Keyring) Primary() string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.primary
+}
+
+// Seal encrypts body under a new data key, sealed by the primary key. It
+// returns the sealed body and the id of the primary key.
+func (k *Keyring) Seal(body []byte) ([]byte, string, error) {
+	k.lock.RLock()
+	kek, keyID := k.keys[k.primary], k.primary
+	k.lock.RUnlock()
+
+	random := make([]byte, dataKeySize+2*nonceSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	dataKey, keyNonce, bodyNonce := random[:dataKeySize], random[dataKeySize:dataKeySize+nonceSize], random[dataKeySize+nonceSize:]
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sealed := make([]byte, 0, headerSize+len(body)+overhead)
+	sealed = append(sealed, version)
+	sealed = append(sealed, keyNonce...)
+	// the key id is authenticated, a body can't be opened as another key's
+	sealed = kek.Seal(sealed, keyNonce, dataKey, []byte(keyID))
+	sealed = append(sealed, bodyNonce...)
+	sealed = dek.Seal(sealed, bodyNonce, body, nil)
+	return sealed, keyID, nil
+}
+
+// Open decrypts a body sealed under the key keyID.
+func (k *Keyring) Open(sealed []byte, keyID string) ([]byte, error) {
+	k.lock.RLock()
+	kek, ok := k.keys[keyID]
+	k.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(sealed) < headerSize+overhead || sealed[0] != version {
+		return nil, ErrCorrupted
+	}
+
+	keyNonce := sealed[1 : 1+nonceSize]
+	wrapped := sealed[1+nonceSize : headerSize-nonceSize]
+	bodyNonce := sealed[headerSize-nonceSize : headerSize]
+	dataKey, err := kek.Open(nil, keyNonce, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	body, err := dek.Open(nil, bodyNonce, sealed[headerSize:], nil)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return body, nil
+}
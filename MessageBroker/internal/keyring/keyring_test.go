@@ -0,0 +1,94 @@
+package keyring
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func secret(b byte, size int) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), size)))
+}
+
+func newKeyring(t *testing.T, file *File) *Keyring {
+	k, err := New(file)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return k
+}
+
+func TestSealShouldRoundTripAndRotate(t *testing.T) {
+	k := newKeyring(t, &File{Primary: "key-1", Keys: []Key{{ID: "key-1", Secret: secret('a', 32)}}})
+	sealed, keyID, err := k.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "key-1", keyID)
+	assert.NotContains(t, string(sealed), "hello")
+
+	// every body has its own data key
+	again, _, err := k.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed, again)
+
+	// a new primary seals new bodies, old ones still open
+	assert.Nil(t, k.Update(&File{Primary: "key-2", Keys: []Key{
+		{ID: "key-1", Secret: secret('a', 32)},
+		{ID: "key-2", Secret: secret('b', 16)},
+	}}))
+	assert.Equal(t, "key-2", k.Primary())
+	body, err := k.Open(sealed, "key-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+	rotated, keyID, err := k.Seal(body)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-2", keyID)
+	body, err = k.Open(rotated, "key-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestOpenShouldRefuseTamperedBodies(t *testing.T) {
+	k := newKeyring(t, &File{Primary: "key-1", Keys: []Key{
+		{ID: "key-1", Secret: secret('a', 32)},
+		{ID: "key-2", Secret: secret('a', 32)},
+	}})
+	sealed, _, err := k.Seal([]byte("hello"))
+	assert.Nil(t, err)
+
+	_, err = k.Open(sealed, "key-3")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	// the same secret under another id
+	_, err = k.Open(sealed, "key-2")
+	assert.ErrorIs(t, err, ErrCorrupted)
+	sealed[len(sealed)-1] ^= 1
+	_, err = k.Open(sealed, "key-1")
+	assert.ErrorIs(t, err, ErrCorrupted)
+	_, err = k.Open([]byte("short"), "key-1")
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestLoadFileShouldCheckKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.yml")
+	write := func(content string) {
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	write("primary: key-1\nkeys:\n  - id: key-1\n    secret: " + secret('a', 32) + "\n")
+	file, err := LoadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-1", file.Primary)
+
+	write("primary: key-2\nkeys:\n  - id: key-1\n    secret: " + secret('a', 32) + "\n")
+	_, err = LoadFile(path)
+	assert.ErrorContains(t, err, "primary key")
+	write("primary: key-1\nkeys:\n  - id: key-1\n    secret: " + secret('a', 20) + "\n")
+	_, err = LoadFile(path)
+	assert.ErrorContains(t, err, "key-1")
+	write("primary: key-1\nkeys:\n  - id: key-1\n    secret: " + secret('a', 32) + "\n  - id: key-1\n    secret: " + secret('b', 32) + "\n")
+	_, err = LoadFile(path)
+	assert.ErrorContains(t, err, "duplicate")
+}
@@ -0,0 +1,141 @@
+package loadgen
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Bucket bounds grow by this factor, so percentiles are within 2% of
+// the recorded values.
+const bucketGrowth = 1.02
+
+// Histogram counts durations in logarithmic buckets. It is safe for
+// concurrent use.
+type Histogram struct {
+	lock   sync.Mutex
+	counts map[int]int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make(map[int]int64)}
+}
+
+// bucketOf returns the bucket of d, bucket i holding durations up to
+// bucketGrowth^i microseconds
+func bucketOf(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(us) / math.Log(bucketGrowth)))
+}
+
+func bucketBound(i int) time.Duration {
+	return time.Duration(math.Pow(bucketGrowth, float64(i)) * float64(time.Microsecond))
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[bucketOf(d)]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.count++
+	h.sum += d
+}
+
+func (h *Histogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Percentile returns the upper bound of the bucket holding the q
+// quantile, 0 < q <= 1, capped at the largest recorded duration
+func (h *Histogram) Percentile(q float64) time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.percentile(q, h.sortedBuckets())
+}
+
+func (h *Histogram) percentile(q float64, buckets []int) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var seen int64
+	for _, i := range buckets {
+		seen += h.counts[i]
+		if seen >= rank {
+			return min(bucketBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *Histogram) sortedBuckets() []int {
+	buckets := make([]int, 0, len(h.counts))
+	for i := range h.counts {
+		buckets = append(buckets, i)
+	}
+	slices.Sort(buckets)
+	return buckets
+}
+
+// BucketCount is one non empty bucket of a Summary
+type BucketCount struct {
+	// Upper bound of the bucket in milliseconds
+	LessOrEqualMs float64 `json:"le_ms"`
+	Count         int64   `json:"count"`
+}
+
+// Summary is the report form of a Histogram, durations in milliseconds
+type Summary struct {
+	Count   int64         `json:"count"`
+	Min     float64       `json:"min_ms"`
+	Mean    float64       `json:"mean_ms"`
+	P50     float64       `json:"p50_ms"`
+	P90     float64       `json:"p90_ms"`
+	P99     float64       `json:"p99_ms"`
+	P999    float64       `json:"p999_ms"`
+	Max     float64       `json:"max_ms"`
+	Buckets []BucketCount `json:"buckets"`
+}
+
+func (h *Histogram) Summary() Summary {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	buckets := h.sortedBuckets()
+	s := Summary{
+		Count:   h.count,
+		Min:     ms(h.min),
+		Max:     ms(h.max),
+		P50:     ms(h.percentile(0.5, buckets)),
+		P90:     ms(h.percentile(0.9, buckets)),
+		P99:     ms(h.percentile(0.99, buckets)),
+		P999:    ms(h.percentile(0.999, buckets)),
+		Buckets: make([]BucketCount, 0, len(buckets)),
+	}
+	if h.count > 0 {
+		s.Mean = ms(h.sum / time.Duration(h.count))
+	}
+	for _, i := range buckets {
+		s.Buckets = append(s.Buckets, BucketCount{LessOrEqualMs: ms(bucketBound(i)), Count: h.counts[i]})
+	}
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
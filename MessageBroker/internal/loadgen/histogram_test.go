@@ -0,0 +1,41 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramPercentilesShouldBeWithinBucketPrecision(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	summary := h.Summary()
+	assert.Equal(t, int64(1000), summary.Count)
+	assert.Equal(t, 1.0, summary.Min)
+	assert.Equal(t, 1000.0, summary.Max)
+	assert.InEpsilon(t, 500.5, summary.Mean, 0.001)
+	assert.InEpsilon(t, 500, summary.P50, 0.02)
+	assert.InEpsilon(t, 900, summary.P90, 0.02)
+	assert.InEpsilon(t, 990, summary.P99, 0.02)
+	assert.InEpsilon(t, 999, summary.P999, 0.02)
+
+	var counted int64
+	for i, b := range summary.Buckets {
+		counted += b.Count
+		if i > 0 {
+			assert.Greater(t, b.LessOrEqualMs, summary.Buckets[i-1].LessOrEqualMs)
+		}
+	}
+	assert.Equal(t, int64(1000), counted)
+}
+
+func TestEmptyHistogramShouldReportZeros(t *testing.T) {
+	summary := NewHistogram().Summary()
+	assert.Zero(t, summary.Count)
+	assert.Zero(t, summary.P99)
+	assert.Empty(t, summary.Buckets)
+}
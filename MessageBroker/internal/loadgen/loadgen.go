@@ -0,0 +1,393 @@
+// Package loadgen drives a broker with configurable publishers and
+// subscribers, and reports throughput and publish to delivery latency.
+// The target is any broker.Broker: the embedded Module, or a
+// client.Client of a remote broker.
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"therealbroker/pkg/broker"
+)
+
+const (
+	// Unix nanoseconds of the publish, for the end to end latency
+	HeaderSent = "x-loadgen-sent"
+	// Set on the messages sent until every subscription is open
+	HeaderProbe = "x-loadgen-probe"
+
+	// Distinct publish errors kept in the report
+	maxReportedErrors = 10
+)
+
+type Config struct {
+	// Concurrent publishers, each cycling through the subjects
+	Publishers int `json:"publishers"`
+	// Subscribers of every subject, publishes are not delivered when 0
+	Subscribers int `json:"subscribers"`
+	// Subjects are named SubjectPrefix.0, SubjectPrefix.1, ...
+	Subjects      int    `json:"subjects"`
+	SubjectPrefix string `json:"subject_prefix"`
+	// Body sizes in bytes, publishers cycle through them
+	PayloadSizes []int `json:"payload_sizes"`
+	// Publishes per second over all publishers, unlimited when 0
+	Rate     int           `json:"rate"`
+	Duration time.Duration `json:"duration_ns"`
+	// Expiration of the messages, they are not stored when 0
+	Expiration time.Duration `json:"expiration_ns"`
+	// How long to wait for missing deliveries after the last publish
+	DrainTimeout   time.Duration `json:"drain_timeout_ns"`
+	PublishTimeout time.Duration `json:"publish_timeout_ns"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Publishers:     1,
+		Subscribers:    1,
+		Subjects:       1,
+		SubjectPrefix:  "load",
+		PayloadSizes:   []int{128},
+		Duration:       10 * time.Second,
+		DrainTimeout:   5 * time.Second,
+		PublishTimeout: 30 * time.Second,
+	}
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if c.Publishers <= 0 {
+		errs = append(errs, errors.New("publishers must be positive"))
+	}
+	if c.Subscribers < 0 {
+		errs = append(errs, errors.New("subscribers must not be negative"))
+	}
+	if c.Subjects <= 0 {
+		errs = append(errs, errors.New("subjects must be positive"))
+	}
+	if len(c.PayloadSizes) == 0 {
+		errs = append(errs, errors.New("at least one payload size is required"))
+	}
+	for _, size := range c.PayloadSizes {
+		if size < 0 {
+			errs = append(errs, fmt.Errorf("payload size %d is negative", size))
+		}
+	}
+	if c.Rate < 0 {
+		errs = append(errs, errors.New("rate must not be negative"))
+	}
+	if c.Duration <= 0 {
+		errs = append(errs, errors.New("duration must be positive"))
+	}
+	if c.PublishTimeout <= 0 {
+		errs = append(errs, errors.New("publish timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// ParseSizes parses a comma separated list of payload sizes
+func ParseSizes(list string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(list, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func (c Config) subject(i int) string {
+	return c.SubjectPrefix + "." + strconv.Itoa(i)
+}
+
+type Report struct {
+	Config Config `json:"config"`
+	// Where the load went, e.g. an address or "in-process"
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	// Length of the publishing phase
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+
+	Published      int64    `json:"published"`
+	PublishedBytes int64    `json:"published_bytes"`
+	PublishErrors  int64    `json:"publish_errors"`
+	Errors         []string `json:"errors,omitempty"`
+	// Successful publishes per second
+	PublishRate float64 `json:"publish_rate"`
+
+	// Published messages times the subscribers of their subject
+	ExpectedDeliveries int64   `json:"expected_deliveries"`
+	Delivered          int64   `json:"delivered"`
+	Lost               int64   `json:"lost"`
+	DeliveryRate       float64 `json:"delivery_rate"`
+
+	PublishLatency  Summary `json:"publish_latency"`
+	EndToEndLatency Summary `json:"end_to_end_latency"`
+}
+
+// Write writes the report as indented json
+func (r *Report) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteFile writes the report to path, or to stdout when path is "-"
+func (r *Report) WriteFile(path string) error {
+	if path == "-" {
+		return r.Write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// String is a short human readable summary
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "published %d messages in %.1fs, %.0f msg/s, %d errors\n",
+		r.Published, r.ElapsedSeconds, r.PublishRate, r.PublishErrors)
+	fmt.Fprintf(&b, "delivered %d of %d, %d lost, %.0f msg/s\n",
+		r.Delivered, r.ExpectedDeliveries, r.Lost, r.DeliveryRate)
+	for _, l := range []struct {
+		name string
+		s    Summary
+	}{{"publish", r.PublishLatency}, {"end to end", r.EndToEndLatency}} {
+		fmt.Fprintf(&b, "%s latency: p50 %.2fms p90 %.2fms p99 %.2fms p99.9 %.2fms max %.2fms\n",
+			l.name, l.s.P50, l.s.P90, l.s.P99, l.s.P999, l.s.Max)
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(&b, "error: %s\n", err)
+	}
+	return b.String()
+}
+
+type run struct {
+	config Config
+	target broker.Broker
+
+	publishLatency  *Histogram
+	endToEndLatency *Histogram
+	published       atomic.Int64
+	publishedBytes  atomic.Int64
+	publishErrors   atomic.Int64
+	delivered       atomic.Int64
+	// signalled, without blocking, on every delivery
+	progress chan struct{}
+
+	lock   sync.Mutex
+	errors []string
+}
+
+// Run subscribes to the subjects, publishes for the configured duration
+// and waits for the deliveries. The report is returned with the error
+// when the load could not be started.
+func Run(ctx context.Context, target broker.Broker, config Config) (*Report, error) {
+	report := &Report{Config: config, StartedAt: time.Now()}
+	if err := config.Validate(); err != nil {
+		return report, err
+	}
+	r := &run{
+		config:          config,
+		target:          target,
+		publishLatency:  NewHistogram(),
+		endToEndLatency: NewHistogram(),
+		progress:        make(chan struct{}, 1),
+	}
+
+	subCtx, cancelSubs := context.WithCancel(ctx)
+	defer cancelSubs()
+	var subscribers sync.WaitGroup
+	if err := r.subscribe(subCtx, &subscribers); err != nil {
+		return report, err
+	}
+
+	start := time.Now()
+	var publishers sync.WaitGroup
+	for p := 0; p < config.Publishers; p++ {
+		publishers.Add(1)
+		go func(p int) {
+			defer publishers.Done()
+			r.publish(ctx, p, start)
+		}(p)
+	}
+	publishers.Wait()
+	elapsed := time.Since(start)
+	expected := r.published.Load() * int64(config.Subscribers)
+	r.drain(ctx, expected)
+	deliveryElapsed := time.Since(start)
+	cancelSubs()
+	subscribers.Wait()
+
+	report.ElapsedSeconds = elapsed.Seconds()
+	report.Published = r.published.Load()
+	report.PublishedBytes = r.publishedBytes.Load()
+	report.PublishErrors = r.publishErrors.Load()
+	report.Errors = r.errors
+	report.PublishRate = float64(report.Published) / elapsed.Seconds()
+	report.ExpectedDeliveries = expected
+	report.Delivered = r.delivered.Load()
+	report.Lost = max(0, expected-report.Delivered)
+	report.DeliveryRate = float64(report.Delivered) / deliveryElapsed.Seconds()
+	report.PublishLatency = r.publishLatency.Summary()
+	report.EndToEndLatency = r.endToEndLatency.Summary()
+	return report, ctx.Err()
+}
+
+// subscribe opens every subscription and probes the subjects until each
+// of them is known to be in place.
+func (r *run) subscribe(ctx context.Context, wg *sync.WaitGroup) error {
+	if r.config.Subscribers == 0 {
+		return nil
+	}
+	ready := make([][]chan struct{}, r.config.Subjects)
+	for s := 0; s < r.config.Subjects; s++ {
+		for i := 0; i < r.config.Subscribers; i++ {
+			messages, err := r.target.Subscribe(ctx, r.config.subject(s))
+			if err != nil {
+				return fmt.Errorf("failed to subscribe to %s: %w", r.config.subject(s), err)
+			}
+			opened := make(chan struct{})
+			ready[s] = append(ready[s], opened)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.receive(messages, opened)
+			}()
+		}
+	}
+
+	deadline := time.After(r.config.PublishTimeout)
+	for s := 0; s < r.config.Subjects; s++ {
+		probe := broker.Message{Headers: map[string]string{HeaderProbe: "1"}}
+		for _, opened := range ready[s] {
+			for waiting := true; waiting; {
+				if _, err := r.target.Publish(ctx, r.config.subject(s), probe); err != nil {
+					return fmt.Errorf("failed to probe %s: %w", r.config.subject(s), err)
+				}
+				select {
+				case <-opened:
+					waiting = false
+				case <-deadline:
+					return fmt.Errorf("subscriptions to %s did not open in %s", r.config.subject(s), r.config.PublishTimeout)
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *run) receive(messages <-chan broker.Message, opened chan struct{}) {
+	var once sync.Once
+	for msg := range messages {
+		if msg.Headers[HeaderProbe] != "" {
+			once.Do(func() { close(opened) })
+			continue
+		}
+		sent, err := strconv.ParseInt(msg.Headers[HeaderSent], 10, 64)
+		if err != nil {
+			continue
+		}
+		r.endToEndLatency.Record(time.Since(time.Unix(0, sent)))
+		r.delivered.Add(1)
+		select {
+		case r.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// publish sends the share of publisher p of the rate until the duration
+// is over. Sends are scheduled from start, so a slow publish is followed
+// by faster ones instead of lowering the rate.
+func (r *run) publish(ctx context.Context, p int, start time.Time) {
+	var interval time.Duration
+	if r.config.Rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(r.config.Publishers) / float64(r.config.Rate))
+	}
+	end := start.Add(r.config.Duration)
+	bodies := make([]string, len(r.config.PayloadSizes))
+	for i, size := range r.config.PayloadSizes {
+		bodies[i] = strings.Repeat("x", size)
+	}
+
+	// spread the publishers over the first interval
+	next := start.Add(interval * time.Duration(p) / time.Duration(r.config.Publishers))
+	for n := 0; ctx.Err() == nil; n++ {
+		if interval > 0 {
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			}
+			next = next.Add(interval)
+		}
+		if !time.Now().Before(end) {
+			return
+		}
+		subject := r.config.subject((p + n) % r.config.Subjects)
+		body := bodies[n%len(bodies)]
+		sent := time.Now()
+		callCtx, cancel := context.WithTimeout(ctx, r.config.PublishTimeout)
+		_, err := r.target.Publish(callCtx, subject, broker.Message{
+			Body:       body,
+			Expiration: r.config.Expiration,
+			Headers:    map[string]string{HeaderSent: strconv.FormatInt(sent.UnixNano(), 10)},
+		})
+		cancel()
+		if err != nil {
+			r.publishErrors.Add(1)
+			r.recordError(err)
+			continue
+		}
+		r.publishLatency.Record(time.Since(sent))
+		r.published.Add(1)
+		r.publishedBytes.Add(int64(len(body)))
+	}
+}
+
+func (r *run) recordError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.errors) >= maxReportedErrors {
+		return
+	}
+	for _, known := range r.errors {
+		if known == err.Error() {
+			return
+		}
+	}
+	r.errors = append(r.errors, err.Error())
+}
+
+// drain waits until expected messages are delivered, or none arrived
+// for the drain timeout
+func (r *run) drain(ctx context.Context, expected int64) {
+	for r.delivered.Load() < expected {
+		select {
+		case <-r.progress:
+		case <-time.After(r.config.DrainTimeout):
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
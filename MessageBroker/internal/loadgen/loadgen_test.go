@@ -0,0 +1,74 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunShouldDeliverToEverySubscriber(t *testing.T) {
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	defer module.Close()
+	config := DefaultConfig()
+	config.Publishers = 3
+	config.Subscribers = 2
+	config.Subjects = 4
+	config.PayloadSizes = []int{16, 1024}
+	config.Rate = 600
+	config.Duration = 500 * time.Millisecond
+
+	report, err := Run(context.Background(), module, config)
+	assert.Nil(t, err)
+	assert.Zero(t, report.PublishErrors)
+	assert.InDelta(t, 300, report.Published, 60)
+	assert.Equal(t, 2*report.Published, report.ExpectedDeliveries)
+	assert.Equal(t, report.ExpectedDeliveries, report.Delivered)
+	assert.Zero(t, report.Lost)
+	assert.Equal(t, report.Delivered, report.EndToEndLatency.Count)
+	assert.Equal(t, report.Published, report.PublishLatency.Count)
+
+	var buf bytes.Buffer
+	assert.Nil(t, report.Write(&buf))
+	var decoded Report
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, report.Delivered, decoded.Delivered)
+	assert.Equal(t, config, decoded.Config)
+}
+
+func TestRunShouldReportPublishErrors(t *testing.T) {
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	module.Close()
+	config := DefaultConfig()
+	config.Subscribers = 0
+	config.Rate = 100
+	config.Duration = 100 * time.Millisecond
+
+	report, err := Run(context.Background(), module, config)
+	assert.Nil(t, err)
+	assert.Zero(t, report.Published)
+	assert.NotZero(t, report.PublishErrors)
+	assert.Len(t, report.Errors, 1)
+}
+
+func TestConfigShouldRejectInvalidValues(t *testing.T) {
+	config := DefaultConfig()
+	assert.Nil(t, config.Validate())
+	config.Publishers = 0
+	config.PayloadSizes = nil
+	err := config.Validate()
+	assert.ErrorContains(t, err, "publishers")
+	assert.ErrorContains(t, err, "payload size")
+
+	sizes, err := ParseSizes("16, 1024")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{16, 1024}, sizes)
+	_, err = ParseSizes("16,big")
+	assert.NotNil(t, err)
+}
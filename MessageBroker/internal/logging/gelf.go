@@ -0,0 +1,323 @@
+package logging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gelfVersion = "1.1"
+	// Datagrams bigger than this are split into gelf chunks
+	gelfChunkSize = 8192
+	// Upper bound of chunks per message set by the gelf spec
+	gelfMaxChunks = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+var ErrMessageTooLarge = errors.New("gelf message does not fit in 128 chunks")
+
+// Sink sends encoded gelf messages to graylog.
+type Sink interface {
+	Write(msg []byte) error
+	Close() error
+}
+
+// NewSink dials a gelf input of graylog, protocol is "udp" or "tcp".
+func NewSink(protocol, address string) (Sink, error) {
+	switch protocol {
+	case "udp":
+		return NewUDPSink(address)
+	case "tcp":
+		return NewTCPSink(address), nil
+	}
+	return nil, fmt.Errorf("unknown gelf protocol %q", protocol)
+}
+
+// UDPSink zlib compresses messages and chunks the large ones.
+type UDPSink struct {
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func NewUDPSink(address string) (*UDPSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPSink{conn: conn}, nil
+}
+
+func (s *UDPSink) Write(msg []byte) error {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(msg)
+	w.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if compressed.Len() <= gelfChunkSize {
+		_, err := s.conn.Write(compressed.Bytes())
+		return err
+	}
+	return s.writeChunks(compressed.Bytes())
+}
+
+func (s *UDPSink) writeChunks(msg []byte) error {
+	// each chunk has a 12 byte header: magic, message id, sequence number and count
+	payload := gelfChunkSize - 12
+	count := (len(msg) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		return ErrMessageTooLarge
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	for i := 0; i < count; i++ {
+		end := min((i+1)*payload, len(msg))
+		chunk := make([]byte, 0, 12+end-i*payload)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, msg[i*payload:end]...)
+		if _, err := s.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *UDPSink) Close() error {
+	return s.conn.Close()
+}
+
+// Messages a TCPSink holds while graylog is slow or unreachable, the
+// ones written while it is full are dropped
+const TCPSinkQueueSize = 1024
+
+var gelfFrameEnd = []byte{0}
+
+// TCPSink writes null byte delimited messages from its own goroutine, so
+// logging never waits for graylog. It redials after failures and drops
+// the messages it cannot send.
+type TCPSink struct {
+	lock    sync.RWMutex
+	closed  bool
+	queue   chan []byte
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	address string
+	timeout time.Duration
+	// only used by the writer goroutine
+	conn     net.Conn
+	failedAt time.Time
+}
+
+func NewTCPSink(address string) *TCPSink {
+	s := &TCPSink{
+		address: address,
+		timeout: 3 * time.Second,
+		queue:   make(chan []byte, TCPSinkQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues msg without waiting, it is dropped when the queue is full
+func (s *TCPSink) Write(msg []byte) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped counts the messages that did not reach graylog
+func (s *TCPSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *TCPSink) run() {
+	defer close(s.done)
+	for msg := range s.queue {
+		if s.write(msg) != nil {
+			s.dropped.Add(1)
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *TCPSink) write(msg []byte) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			// graylog is down: drop instead of dialing for every message
+			if time.Since(s.failedAt) < s.timeout {
+				return errors.New("gelf input " + s.address + " is unreachable")
+			}
+			conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+			if err != nil {
+				s.failedAt = time.Now()
+				return err
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		frame := net.Buffers{msg, gelfFrameEnd}
+		if _, err := frame.WriteTo(s.conn); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return errors.New("failed to write gelf message to " + s.address)
+}
+
+// Close sends the queued messages and closes the connection. While
+// graylog is unreachable they are dropped, so it does not wait for long.
+func (s *TCPSink) Close() error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+	<-s.done
+	return nil
+}
+
+// GELFHandler is a slog.Handler that encodes records as gelf 1.1 messages.
+// Attributes become additional fields, groups are joined with "_".
+type GELFHandler struct {
+	sink   Sink
+	level  slog.Leveler
+	host   string
+	attrs  map[string]interface{}
+	prefix string
+}
+
+func NewGELFHandler(sink Sink, level slog.Leveler) *GELFHandler {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "message-broker"
+	}
+	return &GELFHandler{sink: sink, level: level, host: host, attrs: map[string]interface{}{}}
+}
+
+func (h *GELFHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *GELFHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := make(map[string]interface{}, len(h.attrs)+r.NumAttrs()+6)
+	for k, v := range h.attrs {
+		msg[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addGELFField(msg, h.prefix, a)
+		return true
+	})
+	msg["version"] = gelfVersion
+	msg["host"] = h.host
+	msg["short_message"] = r.Message
+	msg["timestamp"] = float64(r.Time.UnixMicro()) / 1e6
+	msg["level"] = syslogLevel(r.Level)
+	msg["_level_name"] = r.Level.String()
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return h.sink.Write(encoded)
+}
+
+func (h *GELFHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = make(map[string]interface{}, len(h.attrs)+len(attrs))
+	for k, v := range h.attrs {
+		clone.attrs[k] = v
+	}
+	for _, a := range attrs {
+		addGELFField(clone.attrs, h.prefix, a)
+	}
+	return &clone
+}
+
+func (h *GELFHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "_"
+	return &clone
+}
+
+func addGELFField(fields map[string]interface{}, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			addGELFField(fields, prefix+a.Key+"_", ga)
+		}
+		return
+	}
+	key := "_" + strings.ReplaceAll(prefix+a.Key, ".", "_")
+	// `_id` is reserved by graylog
+	if key == "_id" {
+		key = "_id_"
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		fields[key] = a.Value.String()
+	case slog.KindInt64:
+		fields[key] = a.Value.Int64()
+	case slog.KindUint64:
+		fields[key] = a.Value.Uint64()
+	case slog.KindFloat64:
+		fields[key] = a.Value.Float64()
+	case slog.KindBool:
+		fields[key] = a.Value.Bool()
+	case slog.KindDuration:
+		fields[key] = float64(a.Value.Duration().Microseconds()) / 1000
+	case slog.KindTime:
+		fields[key] = a.Value.Time().Format(time.RFC3339Nano)
+	default:
+		if err, ok := a.Value.Any().(error); ok {
+			fields[key] = err.Error()
+		} else {
+			fields[key] = fmt.Sprintf("%+v", a.Value.Any())
+		}
+	}
+}
+
+func syslogLevel(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
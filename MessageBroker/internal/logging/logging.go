@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Options of the broker logs. Records always go to Output, and to graylog
+// too when GELFAddress is set.
+type Options struct {
+	// debug, info, warn or error
+	Level string
+	// json or text
+	Format       string
+	Output       io.Writer
+	GELFProtocol string
+	GELFAddress  string
+}
+
+// Setup builds the logger described by options and installs it as the
+// slog default, so log.Println calls end up in the same outputs.
+// The returned func closes the gelf sink.
+func Setup(options Options) (*slog.Logger, func() error, error) {
+	if err := SetLevel(options.Level); err != nil {
+		return nil, nil, err
+	}
+	handlerOptions := &slog.HandlerOptions{Level: level}
+
+	var handlers []slog.Handler
+	switch options.Format {
+	case "", "json":
+		handlers = append(handlers, slog.NewJSONHandler(options.Output, handlerOptions))
+	case "text":
+		handlers = append(handlers, slog.NewTextHandler(options.Output, handlerOptions))
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", options.Format)
+	}
+
+	closeSink := func() error { return nil }
+	if options.GELFAddress != "" {
+		sink, err := NewSink(options.GELFProtocol, options.GELFAddress)
+		if err != nil {
+			return nil, nil, err
+		}
+		handlers = append(handlers, NewGELFHandler(sink, level))
+		closeSink = sink.Close
+	}
+
+	logger := slog.New(NewFanoutHandler(handlers...))
+	slog.SetDefault(logger)
+	return logger, closeSink, nil
+}
+
+// level is shared by every handler Setup builds, so SetLevel applies to
+// loggers that were derived before the change too.
+var level = new(slog.LevelVar)
+
+// SetLevel changes the level of the loggers built by Setup.
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+}
+
+// FanoutHandler passes every record to all of its handlers.
+type FanoutHandler struct {
+	handlers []slog.Handler
+}
+
+func NewFanoutHandler(handlers ...slog.Handler) *FanoutHandler {
+	return &FanoutHandler{handlers: handlers}
+}
+
+func (h *FanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *FanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *FanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return NewFanoutHandler(handlers...)
+}
+
+func (h *FanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return NewFanoutHandler(handlers...)
+}
+
+type loggerKey struct{}
+
+// NewContext returns ctx carrying logger, used to pass request scoped
+// fields like the request id down to the broker and data control.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,229 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeGELF(t *testing.T, datagram []byte) map[string]interface{} {
+	r, err := zlib.NewReader(bytes.NewReader(datagram))
+	assert.Nil(t, err)
+	content, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	msg := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(content, &msg))
+	return msg
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readDatagram(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	return buf[:n]
+}
+
+func TestGELFOverUDPShouldCarryFields(t *testing.T) {
+	listener := listenUDP(t)
+	sink, err := NewSink("udp", listener.LocalAddr().String())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	logger := slog.New(NewGELFHandler(sink, slog.LevelInfo)).With("request_id", "r-1")
+	logger.WithGroup("rpc").Warn("rpc finished",
+		"subject", "orders",
+		"latency", 1500*time.Microsecond,
+		"error", errors.New("boom"),
+		"id", "42")
+
+	msg := decodeGELF(t, readDatagram(t, listener))
+	assert.Equal(t, "1.1", msg["version"])
+	assert.Equal(t, "rpc finished", msg["short_message"])
+	assert.Equal(t, float64(4), msg["level"])
+	assert.Equal(t, "r-1", msg["_request_id"])
+	assert.Equal(t, "orders", msg["_rpc_subject"])
+	assert.Equal(t, 1.5, msg["_rpc_latency"])
+	assert.Equal(t, "boom", msg["_rpc_error"])
+	assert.Equal(t, "42", msg["_rpc_id"])
+	assert.NotEmpty(t, msg["host"])
+}
+
+func TestGELFShouldSkipDisabledLevels(t *testing.T) {
+	listener := listenUDP(t)
+	sink, err := NewSink("udp", listener.LocalAddr().String())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	logger := slog.New(NewGELFHandler(sink, slog.LevelInfo))
+	logger.Debug("hidden")
+	logger.Error("shown")
+
+	msg := decodeGELF(t, readDatagram(t, listener))
+	assert.Equal(t, "shown", msg["short_message"])
+	assert.Equal(t, float64(3), msg["level"])
+}
+
+func TestLargeGELFMessageShouldBeChunked(t *testing.T) {
+	listener := listenUDP(t)
+	sink, err := NewUDPSink(listener.LocalAddr().String())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	// random letters barely compress, so this needs several chunks
+	body := make([]byte, 30000)
+	seed := uint32(7)
+	for i := range body {
+		seed = seed*1103515245 + 12345
+		body[i] = byte('a' + (seed>>16)%26)
+	}
+	assert.Nil(t, sink.Write([]byte(`{"short_message":"`+string(body)+`"}`)))
+
+	var compressed []byte
+	count := -1
+	for i := 0; count == -1 || i < count; i++ {
+		chunk := readDatagram(t, listener)
+		assert.Equal(t, gelfChunkMagic, chunk[:2])
+		assert.Equal(t, byte(i), chunk[10])
+		count = int(chunk[11])
+		compressed = append(compressed, chunk[12:]...)
+	}
+	assert.Greater(t, count, 1)
+	assert.Equal(t, string(body), decodeGELF(t, compressed)["short_message"])
+}
+
+func TestGELFOverTCPShouldBeNullDelimited(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer lis.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+			received <- strings.TrimSuffix(frame, "\x00")
+		}
+	}()
+
+	sink, err := NewSink("tcp", lis.Addr().String())
+	assert.Nil(t, err)
+	defer sink.Close()
+	logger := slog.New(NewGELFHandler(sink, slog.LevelDebug))
+	logger.Info("first")
+	logger.Info("second")
+
+	for _, want := range []string{"first", "second"} {
+		msg := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(<-received), &msg))
+		assert.Equal(t, want, msg["short_message"])
+	}
+}
+
+func TestGELFOverTCPShouldNotWaitForSlowGraylog(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	// accepts but never reads, so the writer is stuck once buffers fill
+	stop := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			<-stop
+			conn.Close()
+		}
+	}()
+
+	sink := NewTCPSink(lis.Addr().String())
+	msg := bytes.Repeat([]byte("x"), 64<<10)
+	start := time.Now()
+	for i := 0; i < 2*TCPSinkQueueSize; i++ {
+		assert.Nil(t, sink.Write(msg))
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	assert.NotZero(t, sink.Dropped())
+
+	// graylog goes away, the queued messages are dropped on close
+	lis.Close()
+	close(stop)
+	start = time.Now()
+	assert.Nil(t, sink.Close())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.ErrorIs(t, sink.Write(msg), net.ErrClosed)
+}
+
+func TestSetupShouldWriteJSONToOutput(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+
+	var out bytes.Buffer
+	logger, closeLogs, err := Setup(Options{Level: "debug", Format: "json", Output: &out})
+	assert.Nil(t, err)
+	defer closeLogs()
+
+	ctx := NewContext(context.Background(), logger.With("request_id", "r-2"))
+	FromContext(ctx).Debug("published", "subject", "orders")
+
+	record := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "published", record["msg"])
+	assert.Equal(t, "DEBUG", record["level"])
+	assert.Equal(t, "r-2", record["request_id"])
+	assert.Equal(t, "orders", record["subject"])
+}
+
+func TestSetupShouldRejectUnknownOptions(t *testing.T) {
+	_, _, err := Setup(Options{Level: "loud", Output: io.Discard})
+	assert.NotNil(t, err)
+
+	_, _, err = Setup(Options{Format: "xml", Output: io.Discard})
+	assert.NotNil(t, err)
+
+	_, _, err = Setup(Options{Output: io.Discard, GELFProtocol: "http", GELFAddress: "localhost:12201"})
+	assert.NotNil(t, err)
+}
+
+func TestSetLevelShouldApplyToExistingLoggers(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+	defer SetLevel("info")
+
+	var out bytes.Buffer
+	logger, closeLogs, err := Setup(Options{Level: "info", Output: &out})
+	assert.Nil(t, err)
+	defer closeLogs()
+	requestLogger := logger.With("request_id", "r-3")
+
+	requestLogger.Debug("hidden")
+	assert.Equal(t, 0, out.Len())
+
+	assert.Nil(t, SetLevel("debug"))
+	requestLogger.Debug("shown")
+	assert.Contains(t, out.String(), "shown")
+
+	assert.NotNil(t, SetLevel("loud"))
+}
@@ -0,0 +1,232 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// compatibilityProblems lists why next breaks mode against latest. The
+// checks are structural and cover the common changes: added required
+// fields, removed or retyped fields, narrowed enums and tightened limits.
+func compatibilityProblems(latest, next *compiled, mode Compatibility) []string {
+	if mode == None {
+		return nil
+	}
+	if latest.Type != next.Type {
+		return []string{fmt.Sprintf("type changed from %s to %s", latest.Type, next.Type)}
+	}
+	var problems []string
+	// backward: bodies written for latest are read with next
+	if mode == Backward || mode == Full {
+		problems = append(problems, readable(next, latest)...)
+	}
+	// forward: bodies written for next are read with latest
+	if mode == Forward || mode == Full {
+		problems = append(problems, readable(latest, next)...)
+	}
+	return problems
+}
+
+// readable lists why bodies valid under writer may be invalid under reader
+func readable(reader, writer *compiled) []string {
+	if reader.message != nil {
+		return protoReadable(reader.message, writer.message, "", map[[2]protoreflect.FullName]bool{})
+	}
+	return jsonReadable(reader.document, writer.document, "")
+}
+
+// Keywords whose value is a lower or an upper bound of the instance
+var (
+	lowerBounds = []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"}
+	upperBounds = []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"}
+)
+
+func jsonReadable(reader, writer map[string]any, path string) []string {
+	var problems []string
+	at := func(format string, args ...any) {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, location+": "+fmt.Sprintf(format, args...))
+	}
+
+	if readerTypes := jsonTypes(reader); readerTypes != nil {
+		writerTypes := jsonTypes(writer)
+		if writerTypes == nil {
+			at("type restricted to %v", readerTypes)
+		}
+		for _, t := range writerTypes {
+			if !slices.Contains(readerTypes, t) && !(t == "integer" && slices.Contains(readerTypes, "number")) {
+				at("type %s is no longer allowed", t)
+			}
+		}
+	}
+
+	writerRequired := stringList(writer["required"])
+	for _, name := range stringList(reader["required"]) {
+		if !slices.Contains(writerRequired, name) {
+			at("property %q became required", name)
+		}
+	}
+
+	readerProperties, _ := reader["properties"].(map[string]any)
+	writerProperties, _ := writer["properties"].(map[string]any)
+	closed := reader["additionalProperties"] == false
+	if closed && writer["additionalProperties"] != false {
+		at("additional properties are no longer allowed")
+	}
+	for name, w := range writerProperties {
+		r, ok := readerProperties[name]
+		if !ok {
+			if closed {
+				at("property %q was removed", name)
+			}
+			continue
+		}
+		rm, rok := r.(map[string]any)
+		wm, wok := w.(map[string]any)
+		if rok && wok {
+			problems = append(problems, jsonReadable(rm, wm, path+"/"+name)...)
+		}
+	}
+
+	if ri, ok := reader["items"].(map[string]any); ok {
+		wi, _ := writer["items"].(map[string]any)
+		problems = append(problems, jsonReadable(ri, wi, path+"/items")...)
+	}
+
+	if readerEnum, ok := reader["enum"].([]any); ok {
+		writerEnum, ok := writer["enum"].([]any)
+		if !ok {
+			at("values restricted to an enum")
+		}
+		for _, value := range writerEnum {
+			if !slices.ContainsFunc(readerEnum, func(v any) bool { return equalJSON(v, value) }) {
+				at("enum value %v was removed", value)
+			}
+		}
+	}
+
+	for _, keyword := range lowerBounds {
+		if r, ok := number(reader[keyword]); ok {
+			if w, ok := number(writer[keyword]); !ok || w < r {
+				at("%s was raised to %v", keyword, r)
+			}
+		}
+	}
+	for _, keyword := range upperBounds {
+		if r, ok := number(reader[keyword]); ok {
+			if w, ok := number(writer[keyword]); !ok || w > r {
+				at("%s was lowered to %v", keyword, r)
+			}
+		}
+	}
+	return problems
+}
+
+// jsonTypes returns the "type" keyword as a list, nil when any type goes
+func jsonTypes(document map[string]any) []string {
+	switch t := document["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		return stringList(t)
+	}
+	return nil
+}
+
+func stringList(value any) []string {
+	values, _ := value.([]any)
+	var list []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func number(value any) (float64, bool) {
+	n, ok := value.(float64)
+	return n, ok
+}
+
+func equalJSON(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// protoReadable compares fields by number. Bodies are parsed strictly in
+// their json mapping, so a removed or renamed field breaks them as well.
+func protoReadable(reader, writer protoreflect.MessageDescriptor, path string, seen map[[2]protoreflect.FullName]bool) []string {
+	pair := [2]protoreflect.FullName{reader.FullName(), writer.FullName()}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	var problems []string
+	at := func(field protoreflect.FieldDescriptor, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%s%s (%d): ", path, field.Name(), field.Number())+fmt.Sprintf(format, args...))
+	}
+
+	writerFields := writer.Fields()
+	for i := 0; i < writerFields.Len(); i++ {
+		w := writerFields.Get(i)
+		r := reader.Fields().ByNumber(w.Number())
+		if r == nil {
+			at(w, "field was removed")
+			continue
+		}
+		if r.JSONName() != w.JSONName() {
+			at(w, "field was renamed to %s", r.Name())
+			continue
+		}
+		if r.Kind() != w.Kind() || r.Cardinality() == protoreflect.Repeated != (w.Cardinality() == protoreflect.Repeated) || r.IsMap() != w.IsMap() {
+			at(w, "field type changed from %s to %s", fieldType(w), fieldType(r))
+			continue
+		}
+		switch {
+		case r.Message() != nil:
+			problems = append(problems, protoReadable(r.Message(), w.Message(), fmt.Sprintf("%s%s.", path, w.Name()), seen)...)
+		case r.Enum() != nil:
+			readerValues := r.Enum().Values()
+			writerValues := w.Enum().Values()
+			for j := 0; j < writerValues.Len(); j++ {
+				if readerValues.ByName(writerValues.Get(j).Name()) == nil {
+					at(w, "enum value %s was removed", writerValues.Get(j).Name())
+				}
+			}
+		}
+	}
+
+	readerFields := reader.Fields()
+	for i := 0; i < readerFields.Len(); i++ {
+		r := readerFields.Get(i)
+		if r.Cardinality() == protoreflect.Required && writerFields.ByNumber(r.Number()) == nil {
+			at(r, "required field was added")
+		}
+	}
+	return problems
+}
+
+func fieldType(field protoreflect.FieldDescriptor) string {
+	name := field.Kind().String()
+	switch {
+	case field.IsMap():
+		name = "map"
+	case field.Message() != nil:
+		name = string(field.Message().FullName())
+	case field.Enum() != nil:
+		name = string(field.Enum().FullName())
+	}
+	if field.Cardinality() == protoreflect.Repeated && !field.IsMap() {
+		return "repeated " + name
+	}
+	return name
+}
@@ -0,0 +1,79 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func compileJSONSchema(t *testing.T, definition string) *compiled {
+	c, err := compile(Schema{Subject: "orders", Type: JSON, Definition: definition, Compatibility: Backward})
+	assert.Nil(t, err)
+	return c
+}
+
+func TestJSONCompatibilityShouldFollowTheMode(t *testing.T) {
+	open := compileJSONSchema(t, `{"type": "object", "properties": {"status": {"enum": ["new", "paid"]}}}`)
+	widened := compileJSONSchema(t, `{"type": "object", "properties": {"status": {"enum": ["new", "paid", "refunded"]}}}`)
+
+	// consumers of the widened enum read every old body
+	assert.Empty(t, compatibilityProblems(open, widened, Backward))
+	// but old consumers do not know "refunded"
+	assert.Equal(t, []string{`/status: enum value refunded was removed`}, compatibilityProblems(open, widened, Forward))
+	assert.Len(t, compatibilityProblems(open, widened, Full), 1)
+	assert.Empty(t, compatibilityProblems(open, widened, None))
+}
+
+func TestJSONCompatibilityShouldFindBreakingChanges(t *testing.T) {
+	latest := compileJSONSchema(t, `{
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer"},
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 10}}
+		}
+	}`)
+	next := compileJSONSchema(t, `{
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "string"},
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}
+		}
+	}`)
+	assert.ElementsMatch(t, []string{
+		"/: additional properties are no longer allowed",
+		"/id: type integer is no longer allowed",
+		"/tags/items: maxLength was lowered to 5",
+	}, compatibilityProblems(latest, next, Backward))
+
+	// integers are numbers
+	number := compileJSONSchema(t, `{"type": "object", "properties": {"id": {"type": "number"}}}`)
+	assert.Empty(t, compatibilityProblems(latest, number, Backward))
+}
+
+func TestProtobufCompatibilityShouldCompareFieldsByNumber(t *testing.T) {
+	compileProto := func(fields ...*descriptorpb.FieldDescriptorProto) *compiled {
+		s := protoSchema(t, "orders", fields...)
+		s.Compatibility = Backward
+		c, err := compile(s)
+		assert.Nil(t, err)
+		return c
+	}
+	id := field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING)
+	amount := field("amount", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64)
+	latest := compileProto(id, amount)
+
+	added := compileProto(id, amount, field("note", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING))
+	assert.Empty(t, compatibilityProblems(latest, added, Backward))
+	assert.Equal(t, []string{"note (3): field was removed"}, compatibilityProblems(latest, added, Forward))
+
+	retyped := compileProto(id, field("amount", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE))
+	assert.Equal(t, []string{"amount (2): field type changed from int64 to double"}, compatibilityProblems(latest, retyped, Backward))
+
+	renamed := compileProto(id, field("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64))
+	assert.Equal(t, []string{"amount (2): field was renamed to total"}, compatibilityProblems(latest, renamed, Backward))
+
+	json := compileJSONSchema(t, `{}`)
+	assert.Equal(t, []string{"type changed from protobuf to json"}, compatibilityProblems(latest, json, Backward))
+}
@@ -0,0 +1,321 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"therealbroker/pkg/broker"
+)
+
+// Registry keeps every version of the schemas bound to subject patterns.
+// Changes are written to its file, so they survive restarts; nodes of a
+// cluster that share the file pick up the changes of the others with
+// Reload.
+type Registry struct {
+	lock sync.RWMutex
+	path string
+	// versions per subject pattern, oldest first
+	subjects map[string][]*compiled
+}
+
+// file is the json document a registry is saved as
+type file struct {
+	Schemas []Schema `json:"schemas"`
+}
+
+// Open loads the registry saved at path, a missing file is an empty
+// registry. With an empty path the registry is only kept in memory.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, subjects: make(map[string][]*compiled)}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload replaces the schemas with the ones saved in the file. The
+// current schemas are kept if the file does not load.
+func (r *Registry) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := file{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("schema registry %s: %w", r.path, err)
+	}
+	subjects := make(map[string][]*compiled)
+	for _, s := range saved.Schemas {
+		c, err := compile(s)
+		if err != nil {
+			return fmt.Errorf("schema registry %s: %s version %d: %w", r.path, s.Subject, s.Version, err)
+		}
+		subjects[s.Subject] = append(subjects[s.Subject], c)
+	}
+	for _, versions := range subjects {
+		slices.SortFunc(versions, func(a, b *compiled) int { return a.Version - b.Version })
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subjects = subjects
+	return nil
+}
+
+// Register adds s as the next version of its subject pattern. Without a
+// compatibility s keeps the one of the latest version, or Backward. If
+// s has the definition of the latest version, that version is returned
+// and nothing is added.
+func (r *Registry) Register(s Schema) (Schema, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	next, problems, err := r.check(s)
+	if err != nil {
+		return Schema{}, err
+	}
+	if len(problems) > 0 {
+		return Schema{}, fmt.Errorf("%w: %s", ErrIncompatible, strings.Join(problems, "; "))
+	}
+
+	versions := r.subjects[s.Subject]
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if latest.sameDefinition(next.Schema) && latest.Compatibility == next.Compatibility {
+			return latest.Schema, nil
+		}
+		next.Version = latest.Version + 1
+	} else {
+		next.Version = 1
+	}
+
+	r.subjects[s.Subject] = append(versions, next)
+	if err := r.save(); err != nil {
+		r.subjects[s.Subject] = versions
+		if len(versions) == 0 {
+			delete(r.subjects, s.Subject)
+		}
+		return Schema{}, err
+	}
+	return next.Schema, nil
+}
+
+// Check returns why Register would reject s for breaking compatibility.
+// The error is only set when s does not compile.
+func (r *Registry) Check(s Schema) ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, problems, err := r.check(s)
+	return problems, err
+}
+
+// check compiles s and compares it with the latest version, r.lock must
+// be held
+func (r *Registry) check(s Schema) (*compiled, []string, error) {
+	versions := r.subjects[s.Subject]
+	if s.Compatibility == "" {
+		s.Compatibility = Backward
+		if len(versions) > 0 {
+			s.Compatibility = versions[len(versions)-1].Compatibility
+		}
+	}
+	s.Version = 0
+	next, err := compile(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(versions) == 0 {
+		return next, nil, nil
+	}
+	return next, compatibilityProblems(versions[len(versions)-1], next, s.Compatibility), nil
+}
+
+// Get returns a version of the schema of a subject pattern, the latest
+// one when version is 0.
+func (r *Registry) Get(subject string, version int) (Schema, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	versions := r.subjects[subject]
+	if len(versions) == 0 {
+		return Schema{}, ErrNotFound
+	}
+	if version == 0 {
+		return versions[len(versions)-1].Schema, nil
+	}
+	for _, c := range versions {
+		if c.Version == version {
+			return c.Schema, nil
+		}
+	}
+	return Schema{}, ErrNotFound
+}
+
+// List returns the latest version of every subject pattern, sorted by
+// pattern.
+func (r *Registry) List() []Schema {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	list := make([]Schema, 0, len(r.subjects))
+	for _, subject := range r.patterns() {
+		versions := r.subjects[subject]
+		list = append(list, versions[len(versions)-1].Schema)
+	}
+	return list
+}
+
+// Delete removes every version of the schema of a subject pattern and
+// returns how many there were.
+func (r *Registry) Delete(subject string) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	versions, ok := r.subjects[subject]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	delete(r.subjects, subject)
+	if err := r.save(); err != nil {
+		r.subjects[subject] = versions
+		return 0, err
+	}
+	return len(versions), nil
+}
+
+// Validate checks the body of msg against the latest schema of the most
+// specific pattern matching subject, and records that schema in the
+// headers. Schema headers set by the publisher are dropped, so they only
+// ever name a schema the body passed. Subjects without a schema pass
+// otherwise as they are. Invalid bodies return an error wrapping
+// broker.ErrInvalidMessage.
+func (r *Registry) Validate(subject string, msg broker.Message) (broker.Message, error) {
+	msg.Headers = withoutSchemaHeaders(msg.Headers)
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c := r.match(subject)
+	if c == nil {
+		return msg, nil
+	}
+	if err := c.validate(msg.Body); err != nil {
+		return msg, fmt.Errorf("%w: %s version %d: %v", broker.ErrInvalidMessage, c.Subject, c.Version, err)
+	}
+	headers := make(map[string]string, len(msg.Headers)+2)
+	maps.Copy(headers, msg.Headers)
+	headers[HeaderSubject] = c.Subject
+	headers[HeaderVersion] = strconv.Itoa(c.Version)
+	msg.Headers = headers
+	return msg, nil
+}
+
+// withoutSchemaHeaders returns headers without HeaderSubject and
+// HeaderVersion, copying them only when one is there
+func withoutSchemaHeaders(headers map[string]string) map[string]string {
+	_, hasSubject := headers[HeaderSubject]
+	_, hasVersion := headers[HeaderVersion]
+	if !hasSubject && !hasVersion {
+		return headers
+	}
+	stripped := maps.Clone(headers)
+	delete(stripped, HeaderSubject)
+	delete(stripped, HeaderVersion)
+	return stripped
+}
+
+// match returns the latest version of the most specific pattern that
+// matches subject, nil if none does. r.lock must be held.
+func (r *Registry) match(subject string) *compiled {
+	var best string
+	found := false
+	for pattern := range r.subjects {
+		if !broker.MatchSubject(pattern, subject) {
+			continue
+		}
+		if !found || moreSpecific(pattern, best) {
+			best, found = pattern, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	versions := r.subjects[best]
+	return versions[len(versions)-1]
+}
+
+// moreSpecific orders patterns by literal tokens, then prefers "*" to a
+// trailing ">", so "orders.eu" wins over "orders.*" over "orders.>".
+func moreSpecific(a, b string) bool {
+	la, ta := literals(a)
+	lb, tb := literals(b)
+	if la != lb {
+		return la > lb
+	}
+	if ta != tb {
+		return !ta
+	}
+	return a < b
+}
+
+func literals(pattern string) (count int, tail bool) {
+	tokens := strings.Split(pattern, broker.SubjectSeparator)
+	for i, t := range tokens {
+		switch {
+		case t == broker.TailWildcard && i == len(tokens)-1:
+			tail = true
+		case t != broker.SingleWildcard:
+			count++
+		}
+	}
+	return count, tail
+}
+
+// patterns returns the subject patterns sorted, r.lock must be held
+func (r *Registry) patterns() []string {
+	patterns := make([]string, 0, len(r.subjects))
+	for pattern := range r.subjects {
+		patterns = append(patterns, pattern)
+	}
+	slices.Sort(patterns)
+	return patterns
+}
+
+// save writes every version to the file, through a temporary file so a
+// crash never leaves half of it. r.lock must be held.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	saved := file{Schemas: []Schema{}}
+	for _, subject := range r.patterns() {
+		for _, c := range r.subjects[subject] {
+			saved.Schemas = append(saved.Schemas, c.Schema)
+		}
+	}
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
@@ -0,0 +1,215 @@
+package schema
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id"],
+	"properties": {
+		"id": {"type": "string"},
+		"amount": {"type": "number", "minimum": 0}
+	}
+}`
+
+func jsonSchema(subject, definition string) Schema {
+	return Schema{Subject: subject, Type: JSON, Definition: definition}
+}
+
+// protoSchema builds a descriptor set with the message test.Order made of
+// fields, e.g. "id" and "amount", numbered in order.
+func protoSchema(t *testing.T, subject string, fields ...*descriptorpb.FieldDescriptorProto) Schema {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("order.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:  proto.String("Order"),
+			Field: fields,
+		}},
+	}}}
+	content, err := proto.Marshal(set)
+	assert.Nil(t, err)
+	return Schema{Subject: subject, Type: Protobuf, DescriptorSet: content, MessageType: "test.Order"}
+}
+
+func field(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Type:     kind.Enum(),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+}
+
+func TestValidateShouldCheckJSONBodies(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	_, err = r.Register(jsonSchema("orders.*", orderSchema))
+	assert.Nil(t, err)
+
+	msg, err := r.Validate("orders.eu", broker.Message{Body: `{"id": "a1", "amount": 3}`, Headers: map[string]string{"k": "v"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"k": "v", HeaderSubject: "orders.*", HeaderVersion: "1"}, msg.Headers)
+
+	for _, body := range []string{`{"amount": 3}`, `{"id": "a1", "amount": -1}`, `not json`, `{"id": "a1"} {}`} {
+		_, err = r.Validate("orders.eu", broker.Message{Body: body})
+		assert.True(t, errors.Is(err, broker.ErrInvalidMessage), body)
+	}
+
+	msg, err = r.Validate("payments", broker.Message{Body: "anything"})
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Headers)
+}
+
+func TestValidateShouldDropSchemaHeadersSetByThePublisher(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	_, err = r.Register(jsonSchema("orders.*", orderSchema))
+	assert.Nil(t, err)
+	forged := map[string]string{"k": "v", HeaderSubject: "orders.*", HeaderVersion: "7"}
+
+	msg, err := r.Validate("orders.eu", broker.Message{Body: `{"id": "a1", "amount": 3}`, Headers: forged})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"k": "v", HeaderSubject: "orders.*", HeaderVersion: "1"}, msg.Headers)
+
+	msg, err = r.Validate("payments", broker.Message{Body: "anything", Headers: forged})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"k": "v"}, msg.Headers)
+	// the publisher's map is left alone
+	assert.Equal(t, "7", forged[HeaderVersion])
+}
+
+func TestValidateShouldCheckProtobufBodies(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	_, err = r.Register(protoSchema(t, "orders",
+		field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		field("amount", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64)))
+	assert.Nil(t, err)
+
+	_, err = r.Validate("orders", broker.Message{Body: `{"id": "a1", "amount": "3"}`})
+	assert.Nil(t, err)
+	_, err = r.Validate("orders", broker.Message{Body: `{"id": "a1", "price": 3}`})
+	assert.True(t, errors.Is(err, broker.ErrInvalidMessage))
+	_, err = r.Validate("orders", broker.Message{Body: `{"id": 5}`})
+	assert.True(t, errors.Is(err, broker.ErrInvalidMessage))
+}
+
+func TestValidateShouldUseTheMostSpecificPattern(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	for _, subject := range []string{"orders.>", "orders.*", "orders.eu"} {
+		_, err = r.Register(jsonSchema(subject, `{"type": "object"}`))
+		assert.Nil(t, err)
+	}
+	for subject, pattern := range map[string]string{
+		"orders.eu":         "orders.eu",
+		"orders.us":         "orders.*",
+		"orders.us.created": "orders.>",
+	} {
+		msg, err := r.Validate(subject, broker.Message{Body: "{}"})
+		assert.Nil(t, err)
+		assert.Equal(t, pattern, msg.Headers[HeaderSubject], subject)
+	}
+}
+
+func TestRegisterShouldRejectBadSchemas(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	for _, s := range []Schema{
+		jsonSchema("", orderSchema),
+		jsonSchema("orders", `{"type": 5}`),
+		jsonSchema("orders", `{"$ref": "http://example.com/schema.json"}`),
+		{Subject: "orders", Type: "avro"},
+		{Subject: "orders", Type: Protobuf, DescriptorSet: []byte("junk"), MessageType: "test.Order"},
+	} {
+		_, err := r.Register(s)
+		assert.True(t, errors.Is(err, ErrInvalidSchema), s)
+	}
+	s := protoSchema(t, "orders")
+	s.MessageType = "test.Missing"
+	_, err = r.Register(s)
+	assert.True(t, errors.Is(err, ErrInvalidSchema))
+	assert.Empty(t, r.List())
+}
+
+func TestRegisterShouldEnforceCompatibility(t *testing.T) {
+	r, err := Open("")
+	assert.Nil(t, err)
+	_, err = r.Register(jsonSchema("orders", orderSchema))
+	assert.Nil(t, err)
+
+	// a new required property breaks the bodies already published
+	required := jsonSchema("orders", `{"type": "object", "required": ["id", "currency"]}`)
+	problems, err := r.Check(required)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`/: property "currency" became required`}, problems)
+	_, err = r.Register(required)
+	assert.True(t, errors.Is(err, ErrIncompatible))
+
+	// an optional property is fine
+	v2, err := r.Register(jsonSchema("orders", `{
+		"type": "object",
+		"required": ["id"],
+		"properties": {"id": {"type": "string"}, "amount": {"type": "number"}, "note": {"type": "string"}}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v2.Version)
+	assert.Equal(t, Backward, v2.Compatibility)
+
+	// registering the latest definition again adds no version
+	again, err := r.Register(jsonSchema("orders", v2.Definition))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, again.Version)
+
+	required.Compatibility = None
+	v3, err := r.Register(required)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, v3.Version)
+
+	first, err := r.Get("orders", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, orderSchema, first.Definition)
+	_, err = r.Get("orders", 4)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRegistryShouldSurviveAReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	r, err := Open(path)
+	assert.Nil(t, err)
+	_, err = r.Register(jsonSchema("orders", orderSchema))
+	assert.Nil(t, err)
+	_, err = r.Register(protoSchema(t, "payments", field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING)))
+	assert.Nil(t, err)
+	_, err = r.Register(jsonSchema("refunds", `{}`))
+	assert.Nil(t, err)
+	deleted, err := r.Delete("refunds")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	_, err = r.Delete("refunds")
+	assert.Equal(t, ErrNotFound, err)
+
+	reopened, err := Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, r.List(), reopened.List())
+	_, err = reopened.Validate("payments", broker.Message{Body: `{"id": 1}`})
+	assert.True(t, errors.Is(err, broker.ErrInvalidMessage))
+
+	// changes of another node show up on reload
+	_, err = reopened.Register(jsonSchema("refunds", `{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, r.Reload())
+	assert.Len(t, r.List(), 3)
+}
@@ -0,0 +1,182 @@
+// Package schema keeps the schemas bound to subject patterns and checks
+// published bodies against them.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type Type string
+
+const (
+	// A JSON Schema document, draft 2020-12 unless $schema says otherwise
+	JSON Type = "json"
+	// A message of a descriptor set, bodies are its json mapping since
+	// bodies are strings
+	Protobuf Type = "protobuf"
+)
+
+// Compatibility is checked between a new version and the latest one
+type Compatibility string
+
+const (
+	// Bodies valid under the latest version stay valid under the new one,
+	// consumers can upgrade first
+	Backward Compatibility = "backward"
+	// Bodies valid under the new version are valid under the latest one,
+	// producers can upgrade first
+	Forward Compatibility = "forward"
+	// Both backward and forward
+	Full Compatibility = "full"
+	// Any change is accepted
+	None Compatibility = "none"
+)
+
+const (
+	// Headers added to every message that matched a schema
+	HeaderSubject = "x-schema-subject"
+	HeaderVersion = "x-schema-version"
+)
+
+var (
+	// No schema is registered for the subject pattern or version
+	ErrNotFound = errors.New("schema not found")
+	// The schema is malformed or does not compile
+	ErrInvalidSchema = errors.New("invalid schema")
+	// The schema breaks the compatibility of the subject pattern
+	ErrIncompatible = errors.New("schema is not compatible with the latest version")
+)
+
+// Schema is one version of the schema bound to a subject pattern
+type Schema struct {
+	Subject       string        `json:"subject"`
+	Version       int           `json:"version"`
+	Type          Type          `json:"type"`
+	Definition    string        `json:"definition,omitempty"`
+	DescriptorSet []byte        `json:"descriptor_set,omitempty"`
+	MessageType   string        `json:"message_type,omitempty"`
+	Compatibility Compatibility `json:"compatibility"`
+}
+
+// sameDefinition reports whether s and other accept the same bodies
+func (s Schema) sameDefinition(other Schema) bool {
+	return s.Type == other.Type &&
+		s.Definition == other.Definition &&
+		bytes.Equal(s.DescriptorSet, other.DescriptorSet) &&
+		s.MessageType == other.MessageType
+}
+
+// compiled is a schema ready to validate bodies. Exactly one of document
+// and message is set, they are what compatibility checks compare.
+type compiled struct {
+	Schema
+	jsonSchema *jsonschema.Schema
+	document   map[string]any
+	message    protoreflect.MessageDescriptor
+}
+
+func compile(s Schema) (*compiled, error) {
+	if s.Subject == "" {
+		return nil, fmt.Errorf("%w: subject is required", ErrInvalidSchema)
+	}
+	switch s.Compatibility {
+	case Backward, Forward, Full, None:
+	default:
+		return nil, fmt.Errorf("%w: compatibility %q must be backward, forward, full or none", ErrInvalidSchema, s.Compatibility)
+	}
+	switch s.Type {
+	case JSON:
+		return compileJSON(s)
+	case Protobuf:
+		return compileProtobuf(s)
+	}
+	return nil, fmt.Errorf("%w: type %q must be json or protobuf", ErrInvalidSchema, s.Type)
+}
+
+func compileJSON(s Schema) (*compiled, error) {
+	document := map[string]any{}
+	if err := json.Unmarshal([]byte(s.Definition), &document); err != nil {
+		return nil, fmt.Errorf("%w: definition is not a json object: %v", ErrInvalidSchema, err)
+	}
+	compiler := jsonschema.NewCompiler()
+	// a schema must not make the broker read files or call urls
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external $ref %q is not supported", url)
+	}
+	const url = "schema.json"
+	if err := compiler.AddResource(url, strings.NewReader(s.Definition)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	jsonSchema, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return &compiled{Schema: s, jsonSchema: jsonSchema, document: document}, nil
+}
+
+func compileProtobuf(s Schema) (*compiled, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(s.DescriptorSet, set); err != nil {
+		return nil, fmt.Errorf("%w: descriptor set does not parse: %v", ErrInvalidSchema, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(s.MessageType))
+	if err != nil {
+		return nil, fmt.Errorf("%w: message type %q: %v", ErrInvalidSchema, s.MessageType, err)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not a message", ErrInvalidSchema, s.MessageType)
+	}
+	return &compiled{Schema: s, message: message}, nil
+}
+
+// validate returns why body is not valid, nil if it is
+func (c *compiled) validate(body string) error {
+	if c.message != nil {
+		return protojson.Unmarshal([]byte(body), dynamicpb.NewMessage(c.message))
+	}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("body is not json: %v", err)
+	}
+	if decoder.More() {
+		return errors.New("body has data after the json value")
+	}
+	err := c.jsonSchema.Validate(value)
+	var invalid *jsonschema.ValidationError
+	if errors.As(err, &invalid) {
+		return errors.New(describe(invalid))
+	}
+	return err
+}
+
+// describe names the first innermost failure, the whole tree is long
+func describe(err *jsonschema.ValidationError) string {
+	for len(err.Causes) > 0 {
+		err = err.Causes[0]
+	}
+	location := err.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	return fmt.Sprintf("%s: %s", location, err.Message)
+}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"therealbroker/pkg/broker"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracerName = "therealbroker"
+
+	AttrSubject    = attribute.Key("messaging.destination.name")
+	AttrMessageID  = attribute.Key("messaging.message.id")
+	AttrBodySize   = attribute.Key("messaging.message.body.size")
+	AttrDurability = attribute.Key("messaging.broker.durability")
+	AttrBackend    = attribute.Key("db.system")
+	AttrOperation  = attribute.Key("db.operation.name")
+)
+
+// Setup installs a global tracer provider that exports spans over OTLP
+// gRPC to endpoint, and the w3c trace context propagator. The returned
+// func flushes and stops the exporter.
+func Setup(ctx context.Context, endpoint string, insecure bool, sampleRatio float64) (func(context.Context) error, error) {
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(TracerName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// Inject returns msg with the trace context of ctx added to its headers.
+// The headers of msg are copied, never modified in place.
+func Inject(ctx context.Context, msg broker.Message) broker.Message {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return msg
+	}
+	headers := make(map[string]string, len(msg.Headers)+len(carrier))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	for k, v := range carrier {
+		headers[k] = v
+	}
+	msg.Headers = headers
+	return msg
+}
+
+// Extract returns ctx with the trace context carried by the headers of msg.
+func Extract(ctx context.Context, msg broker.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Headers))
+}
+
+// StartDelivery starts the consumer span of a delivered message. It is a
+// child of the subscription and links to the producer span of the message.
+func StartDelivery(ctx context.Context, subject string, msg broker.Message) (context.Context, trace.Span) {
+	producer := trace.SpanContextFromContext(Extract(context.Background(), msg))
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(AttrSubject.String(subject), AttrBodySize.Int(len(msg.Body))),
+	}
+	if producer.IsValid() {
+		options = append(options, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	return Tracer().Start(ctx, "deliver "+subject, options...)
+}
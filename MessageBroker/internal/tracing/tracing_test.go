@@ -0,0 +1,142 @@
+package tracing_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	bm "therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/tracing"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+)
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	})
+	return recorder
+}
+
+func spanByName(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, s := range spans {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestPublishShouldPropagateTraceContextToDelivery(t *testing.T) {
+	recorder := setupRecorder(t)
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	ctx := context.Background()
+
+	sub, err := module.Subscribe(ctx, "orders")
+	assert.Nil(t, err)
+	_, err = module.Publish(ctx, "orders", broker.Message{Body: "hi", Headers: map[string]string{"region": "eu"}})
+	assert.Nil(t, err)
+
+	msg := <-sub
+	assert.Equal(t, "eu", msg.Headers["region"])
+	assert.NotEmpty(t, msg.Headers["traceparent"])
+
+	_, delivery := tracing.StartDelivery(ctx, "orders", msg)
+	delivery.End()
+
+	spans := recorder.Ended()
+	publish := spanByName(spans, "publish orders")
+	save := spanByName(spans, "datacontrol.SaveMessage")
+	deliver := spanByName(spans, "deliver orders")
+	assert.NotNil(t, publish)
+	assert.NotNil(t, save)
+	assert.NotNil(t, deliver)
+
+	assert.Equal(t, trace.SpanKindProducer, publish.SpanKind())
+	assert.Equal(t, publish.SpanContext().SpanID(), save.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, deliver.SpanKind())
+	assert.Len(t, deliver.Links(), 1)
+	assert.Equal(t, publish.SpanContext().SpanID(), deliver.Links()[0].SpanContext.SpanID())
+}
+
+func TestInjectShouldNotModifyCallerHeaders(t *testing.T) {
+	setupRecorder(t)
+	headers := map[string]string{"region": "eu"}
+	ctx, span := tracing.Tracer().Start(context.Background(), "test")
+	defer span.End()
+
+	msg := tracing.Inject(ctx, broker.Message{Headers: headers})
+
+	assert.Len(t, headers, 1)
+	assert.Len(t, msg.Headers, 2)
+	assert.Equal(t, span.SpanContext().TraceID(), trace.SpanContextFromContext(tracing.Extract(context.Background(), msg)).TraceID())
+}
+
+func TestInjectWithoutTracingShouldKeepMessage(t *testing.T) {
+	msg := broker.Message{Body: "hi"}
+
+	assert.Equal(t, msg, tracing.Inject(context.Background(), msg))
+}
+
+// collector stands in for an OTLP collector and keeps the exported spans
+type collector struct {
+	collectorpb.UnimplementedTraceServiceServer
+	lock  sync.Mutex
+	names []string
+}
+
+func (c *collector) Export(ctx context.Context, req *collectorpb.ExportTraceServiceRequest) (*collectorpb.ExportTraceServiceResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.names = append(c.names, s.Name)
+			}
+		}
+	}
+	return &collectorpb.ExportTraceServiceResponse{}, nil
+}
+
+func TestSetupShouldExportToCollector(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	c := &collector{}
+	grpcServer := grpc.NewServer()
+	collectorpb.RegisterTraceServiceServer(grpcServer, c)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	shutdown, err := tracing.Setup(context.Background(), lis.Addr().String(), true, 1)
+	assert.Nil(t, err)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	module := bm.NewModule(datacontrol.NewDataMemory())
+	_, err = module.Publish(context.Background(), "orders", broker.Message{Body: "hi"})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, shutdown(ctx))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	assert.Contains(t, c.names, "publish orders")
+	assert.Contains(t, c.names, "datacontrol.SaveMessage")
+}
@@ -2,18 +2,43 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"therealbroker/api/auth"
+	"therealbroker/api/certs"
+	"therealbroker/api/gateway"
 	"therealbroker/api/metrics"
+	"therealbroker/api/mqtt"
+	"therealbroker/api/peers"
+	"therealbroker/api/ratelimit"
+	"therealbroker/api/resp"
 	"therealbroker/api/server"
 	"therealbroker/config"
+	"therealbroker/internal/broker"
+	"therealbroker/internal/cluster"
 	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/internal/keyring"
+	"therealbroker/internal/logging"
+	"therealbroker/internal/schema"
+	"therealbroker/internal/tracing"
+	pkgbroker "therealbroker/pkg/broker"
+	"time"
 
 	pb "therealbroker/api/proto"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 // Main requirements:
@@ -22,71 +47,511 @@ import (
 //  3. Basic prometheus metrics ( latency, throughput, etc. ) should be implemented
 //     for every base functionality ( publish, subscribe etc. )
 func main() {
-	if err := config.LoadConfig(); err != nil {
-		log.Println("failed to load configs")
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error("failed to load configs", "error", err)
+		return
+	}
+
+	_, closeLogs, err := logging.Setup(logging.Options{
+		Level:        cfg.Log.Level,
+		Format:       cfg.Log.Format,
+		Output:       os.Stdout,
+		GELFProtocol: cfg.Log.GELFProtocol,
+		GELFAddress:  cfg.Log.GELFAddress,
+	})
+	if err != nil {
+		slog.Error("failed to setup logging", "error", err)
 		return
 	}
-	log.Println("*** config loaded ***")
+	defer closeLogs()
+	slog.Info("config loaded", "data_control", cfg.DataControl, "gelf_address", cfg.Log.GELFAddress)
+
+	var keys *keyring.Keyring
+	if cfg.Encryption.Enabled {
+		file, err := keyring.LoadFile(cfg.Encryption.KeyringFile)
+		if err == nil {
+			keys, err = keyring.New(file)
+		}
+		if err != nil {
+			slog.Error("failed to load keyring", "file", cfg.Encryption.KeyringFile, "error", err)
+			return
+		}
+		slog.Info("encryption enabled", "keyring_file", cfg.Encryption.KeyringFile, "primary_key", keys.Primary())
+	}
+
+	// loaded before the backend, the raft nodes use it between them.
+	// peerTLS is how this node calls the other ones, in the cluster mesh
+	// and raft: the broker certificate is the client certificate and
+	// peers are verified with the client ca, or the system roots
+	var tlsConfig, peerTLS *tls.Config
+	if cfg.TLS.Enabled {
+		reloader, err := certs.NewReloader(
+			cfg.TLS.CertFile,
+			cfg.TLS.KeyFile,
+			cfg.TLS.ClientCAFile,
+			certs.ClientAuth(cfg.TLS.ClientAuth))
+		if err != nil {
+			slog.Error("failed to load tls certificates", "error", err)
+			return
+		}
+		reloader.Watch(cfg.TLS.ReloadInterval)
+		defer reloader.Stop()
+		tlsConfig = reloader.ServerConfig()
+		peerTLS = reloader.ClientConfig("")
+		slog.Info("tls enabled", "client_auth", cfg.TLS.ClientAuth)
+	}
 
 	var DB datacontrol.DataControl
-	if config.DATA_CONTROL == "memory" {
+	switch cfg.DataControl {
+	case "memory":
 		memory := datacontrol.NewDataMemory()
+		if keys != nil {
+			memory.SetEncryption(keys)
+		}
 		DB = memory
-	}
 
-	if config.DATA_CONTROL == "postgres" {
+	case "postgres":
 		postgres := datacontrol.NewDataPostgres(
-			config.POSTGRES_HOST,
-			config.POSTGRES_PORT,
-			config.POSTGRES_USER,
-			config.POSTGRES_PASS,
-			config.POSTGRES_DBNAME,
+			cfg.Postgres.Host,
+			cfg.Postgres.Port,
+			cfg.Postgres.User,
+			cfg.Postgres.Password,
+			cfg.Postgres.DBName,
 			context.Background())
+		postgres.SetPool(int32(cfg.Postgres.MaxConns), int32(cfg.Postgres.MinConns))
+		postgres.SetFlushInterval(cfg.Postgres.FlushInterval)
+		postgres.SetCompression(cfg.Compression.Algorithm, cfg.Compression.Threshold)
+		if keys != nil {
+			postgres.SetEncryption(keys)
+		}
 
 		err := postgres.Connect()
 		if err != nil {
-			log.Println(err)
+			slog.Error("failed to connect to postgres", "error", err)
 			return
 		}
 		defer postgres.Close()
 		DB = postgres
 
-	}
-
-	if config.DATA_CONTROL == "scylla" {
+	case "scylla":
 		scylla := datacontrol.NewDataScylla(
-			config.SCYLLA_HOST,
-			config.SCYLLA_PORT,
-			config.SCYLLA_KEYSPACE,
-			config.SCYLLA_FORGET)
+			cfg.Scylla.Host,
+			cfg.Scylla.Port,
+			cfg.Scylla.Keyspace,
+			cfg.Scylla.Forget)
+		scylla.SetCompression(cfg.Compression.Algorithm, cfg.Compression.Threshold)
+		if keys != nil {
+			scylla.SetEncryption(keys)
+		}
 
 		err := scylla.Connect()
 		if err != nil {
-			log.Println(err)
+			slog.Error("failed to connect to scylla", "error", err)
 			return
 		}
 		defer scylla.Close()
 		DB = scylla
+
+	case "raft":
+		replicated, err := startRaft(cfg.Raft, tlsConfig, peerTLS)
+		if err != nil {
+			slog.Error("failed to start raft", "error", err)
+			return
+		}
+		defer replicated.Close()
+		DB = replicated
+	}
+
+	slog.Info("data control started", "backend", cfg.DataControl)
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		server.UnaryMetricsInterceptor(),
+		server.UnaryLoggingInterceptor(),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		server.StreamMetricsInterceptor(),
+		server.StreamLoggingInterceptor(),
+	}
+
+	var authorizer *auth.Authorizer
+	if cfg.Auth.Enabled {
+		policy, err := auth.LoadPolicy(cfg.Auth.PolicyFile)
+		if err != nil {
+			slog.Error("failed to load auth policy", "file", cfg.Auth.PolicyFile, "error", err)
+			return
+		}
+		authorizer = auth.NewAuthorizer(policy, []byte(cfg.Auth.JWTSecret))
+		unaryInterceptors = append(unaryInterceptors, server.UnaryAuthInterceptor(authorizer))
+		streamInterceptors = append(streamInterceptors, server.StreamAuthInterceptor(authorizer))
+		slog.Info("auth enabled", "policy_file", cfg.Auth.PolicyFile)
+	}
+
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimit.Enabled {
+		limits, err := ratelimit.LoadConfig(cfg.RateLimit.File)
+		if err != nil {
+			slog.Error("failed to load rate limits", "file", cfg.RateLimit.File, "error", err)
+			return
+		}
+		limiter = ratelimit.NewLimiter(limits)
+		unaryInterceptors = append(unaryInterceptors, server.UnaryRateLimitInterceptor(limiter))
+		streamInterceptors = append(streamInterceptors, server.StreamRateLimitInterceptor(limiter))
+		slog.Info("rate limits enabled", "file", cfg.RateLimit.File)
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	if tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	if cfg.Tracing.Enabled {
+		shutdown, err := tracing.Setup(context.Background(), cfg.Tracing.OTLPEndpoint, cfg.Tracing.OTLPInsecure, cfg.Tracing.SampleRatio)
+		if err != nil {
+			slog.Error("failed to setup tracing", "error", err)
+			return
+		}
+		defer shutdown(context.Background())
+		serverOptions = append(serverOptions, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+		slog.Info("tracing enabled", "otlp_endpoint", cfg.Tracing.OTLPEndpoint)
 	}
 
-	log.Println("*** data control started on", config.DATA_CONTROL, "***")
+	module := broker.NewModuleWithBufferSize(DB, cfg.Broker.BufferSize)
+	if err := module.(*broker.Module).SetDurability(pkgbroker.Durability(cfg.Broker.Durability)); err != nil {
+		slog.Error("failed to set publish durability", "error", err)
+		return
+	}
+	if cfg.Cluster.Enabled {
+		node, err := startClusterNode(cfg.Cluster, module.(*broker.Module), tlsConfig, peerTLS)
+		if err != nil {
+			slog.Error("failed to start cluster node", "error", err)
+			return
+		}
+		defer node.Close()
+	}
+
+	var registry *schema.Registry
+	if cfg.Schema.Enabled {
+		registry, err = schema.Open(cfg.Schema.File)
+		if err != nil {
+			slog.Error("failed to load schema registry", "file", cfg.Schema.File, "error", err)
+			return
+		}
+		// every frontend publishes through the module, so all of them are checked
+		module.(*broker.Module).SetValidator(registry.Validate)
+		slog.Info("schema registry enabled", "file", cfg.Schema.File, "schemas", len(registry.List()))
+	}
 
-	brokerServer := server.NewServer(DB)
-	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(server.UnaryMetricsInterceptor()),
-		grpc.StreamInterceptor(server.StreamMetricsInterceptor()),
-	)
+	brokerServer := server.NewServerWithBroker(module, DB)
+	grpcServer := grpc.NewServer(serverOptions...)
 	pb.RegisterBrokerServer(grpcServer, brokerServer)
+	if registry != nil {
+		pb.RegisterSchemaRegistryServer(grpcServer, server.NewSchemaServer(registry))
+	}
+
+	healthChecker := server.NewHealthChecker(brokerServer, cfg.Health.CheckInterval)
+	healthChecker.Start()
+	defer healthChecker.Stop()
+	healthpb.RegisterHealthServer(grpcServer, healthChecker)
+	reflection.Register(grpcServer)
+
+	if cfg.Gateway.Enabled {
+		gw := gateway.New(module, gateway.Options{
+			Authorizer:     authorizer,
+			Limiter:        limiter,
+			ReplaySize:     cfg.Gateway.ReplaySize,
+			Retention:      cfg.Gateway.Retention,
+			KeepAlive:      cfg.Gateway.KeepAlive,
+			AllowedOrigins: cfg.Gateway.AllowedOrigins,
+		})
+		defer gw.Close()
+		if err := serveGateway(cfg.Gateway.Port, gw, tlsConfig); err != nil {
+			slog.Error("failed to start http gateway", "error", err)
+			return
+		}
+	}
+
+	if cfg.MQTT.Enabled {
+		mqttServer := mqtt.New(module, mqtt.Options{
+			Authorizer:    authorizer,
+			Limiter:       limiter,
+			Expiration:    cfg.MQTT.Expiration,
+			MaxInflight:   cfg.MQTT.MaxInflight,
+			MaxQueued:     cfg.MQTT.MaxQueued,
+			SessionExpiry: cfg.MQTT.SessionExpiry,
+		})
+		defer mqttServer.Close()
+		if err := serveMQTT(cfg.MQTT.Port, mqttServer, tlsConfig); err != nil {
+			slog.Error("failed to start mqtt listener", "error", err)
+			return
+		}
+	}
+
+	if cfg.RESP.Enabled {
+		respServer := resp.New(module, resp.Options{
+			Authorizer: authorizer,
+			Limiter:    limiter,
+			Expiration: cfg.RESP.Expiration,
+		})
+		defer respServer.Close()
+		if err := serveRESP(cfg.RESP.Port, respServer, tlsConfig); err != nil {
+			slog.Error("failed to start resp listener", "error", err)
+			return
+		}
+	}
+
+	metrics.SetMaxSubjects(cfg.Metrics.MaxSubjects)
+	prometheus.MustRegister(metrics.NewQueueDepthCollector(brokerServer.QueueDepths))
+	metrics.StartMetricsServer(fmt.Sprintf(":%s", cfg.Metrics.Port))
 
-	metrics.StartMetricsServer()
+	go reloadOnSignal(cfg, authorizer, limiter, keys, registry)
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", config.GRPC_PORT))
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.GRPCPort))
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		slog.Error("failed to listen", "port", cfg.GRPCPort, "error", err)
+		return
 	}
 
-	log.Printf("Server listening at %v", lis.Addr())
+	// on SIGTERM, or when serving fails, drain the server before the
+	// deferred closes shut the backends, see shutdown
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-stop.Done()
+		slog.Info("shutting down")
+		shutdown(grpcServer, healthChecker, module, shutdownTimeout)
+	}()
+
+	slog.Info("server listening", "address", lis.Addr().String())
 	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		slog.Error("failed to serve", "error", err)
+	}
+	// Serve returns as soon as the shutdown starts, wait for it to end
+	cancel()
+	<-drained
+}
+
+// Longest the calls in flight may take to finish on shutdown
+const shutdownTimeout = 20 * time.Second
+
+// shutdown reports the server as not serving, closes the module so the
+// subscriptions end and the queued async saves are stored, then waits
+// for the calls in flight. Those still running after timeout are cut.
+func shutdown(grpcServer *grpc.Server, healthChecker *server.HealthChecker, module pkgbroker.Broker, timeout time.Duration) {
+	healthChecker.Shutdown()
+	if err := module.Close(); err != nil {
+		slog.Error("failed to close broker", "error", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		slog.Warn("calls still running after the shutdown timeout, cutting them", "timeout", timeout)
+		grpcServer.Stop()
+	}
+}
+
+// startRaft joins the raft cluster and serves the Replication service
+// followers use to reach the leader, guarded like the cluster mesh.
+func startRaft(cfg config.RaftConfig, serverTLS, clientTLS *tls.Config) (*datacontrol.DataRaft, error) {
+	ids, addresses, err := cfg.RaftPeers()
+	if err != nil {
+		return nil, err
+	}
+	voters := make([]datacontrol.RaftPeer, len(ids))
+	for i := range ids {
+		voters[i] = datacontrol.RaftPeer{ID: ids[i], Address: addresses[i]}
+	}
+	nodeID := cfg.NodeID
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+	replicated := datacontrol.NewDataRaft(datacontrol.RaftConfig{
+		NodeID:            nodeID,
+		BindAddress:       cfg.BindAddress,
+		AdvertiseAddress:  cfg.AdvertiseAddress,
+		RPCAddress:        cfg.RPCAdvertiseAddress,
+		Peers:             voters,
+		Dir:               cfg.Dir,
+		SnapshotThreshold: uint64(cfg.SnapshotThreshold),
+		SnapshotInterval:  cfg.SnapshotInterval,
+		DialOptions:       peers.DialOptions(clientTLS, cfg.Token),
+	})
+
+	lis, err := net.Listen("tcp", cfg.RPCBindAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := replicated.Connect(); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	replicationServer := grpc.NewServer(peers.ServerOptions(serverTLS, cfg.Token)...)
+	pb.RegisterReplicationServer(replicationServer, replicated)
+	go func() {
+		if err := replicationServer.Serve(lis); err != nil {
+			slog.Error("failed to serve raft replication", "error", err)
+		}
+	}()
+	return replicated, nil
+}
+
+// startClusterNode serves the cluster mesh on its own port, next to the
+// public one, so peers skip the client auth and rate limits. Peers must
+// send the cluster token or a client certificate, see package peers.
+func startClusterNode(cfg config.ClusterConfig, module *broker.Module, serverTLS, clientTLS *tls.Config) (*cluster.Node, error) {
+	var discovery cluster.Discovery = cluster.StaticPeers(cfg.Peers)
+	if cfg.DNSName != "" {
+		discovery = cluster.DNSPeers{Host: cfg.DNSName, Port: cfg.Port}
+	}
+	node := cluster.NewNode(module, cluster.Config{
+		NodeID:          cfg.NodeID,
+		Discovery:       discovery,
+		RefreshInterval: cfg.RefreshInterval,
+		QueueSize:       cfg.QueueSize,
+		DialOptions:     peers.DialOptions(clientTLS, cfg.Token),
+	})
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+	clusterServer := grpc.NewServer(peers.ServerOptions(serverTLS, cfg.Token)...)
+	pb.RegisterClusterServer(clusterServer, node)
+	go func() {
+		if err := clusterServer.Serve(lis); err != nil {
+			slog.Error("failed to serve cluster mesh", "error", err)
+		}
+	}()
+	node.Start()
+	slog.Info("cluster mesh listening", "address", lis.Addr().String(), "node_id", node.ID())
+	return node, nil
+}
+
+// serveGateway serves the HTTP/JSON gateway on its own port, with the
+// certificates of the grpc server when tls is enabled.
+func serveGateway(port string, gw *gateway.Gateway, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	// no write timeout, streams stay open
+	httpServer := &http.Server{Handler: gw, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := httpServer.Serve(lis); err != nil {
+			slog.Error("failed to serve http gateway", "error", err)
+		}
+	}()
+	slog.Info("http gateway listening", "address", lis.Addr().String(), "tls", tlsConfig != nil)
+	return nil
+}
+
+// serveMQTT serves mqtt clients on their own port, with the certificates
+// of the grpc server when tls is enabled.
+func serveMQTT(port string, mqttServer *mqtt.Server, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	go func() {
+		if err := mqttServer.Serve(lis); err != nil {
+			slog.Error("failed to serve mqtt", "error", err)
+		}
+	}()
+	slog.Info("mqtt listening", "address", lis.Addr().String(), "tls", tlsConfig != nil)
+	return nil
+}
+
+// serveRESP serves redis pub/sub clients on their own port, with the
+// certificates of the grpc server when tls is enabled.
+func serveRESP(port string, respServer *resp.Server, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	go func() {
+		if err := respServer.Serve(lis); err != nil {
+			slog.Error("failed to serve resp", "error", err)
+		}
+	}()
+	slog.Info("resp listening", "address", lis.Addr().String(), "tls", tlsConfig != nil)
+	return nil
+}
+
+// reloadOnSignal applies the reloadable settings every time the process
+// gets SIGHUP: log level, metrics subjects, auth policy, rate limits, the
+// keyring and the schemas saved by other nodes. Other changed settings are
+// only reported, they need a restart.
+func reloadOnSignal(cfg *config.Config, authorizer *auth.Authorizer, limiter *ratelimit.Limiter, keys *keyring.Keyring, registry *schema.Registry) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		next, err := config.Load(os.Args[1:])
+		if err != nil {
+			slog.Error("failed to reload configs, keeping the current ones", "error", err)
+			continue
+		}
+		if changed := cfg.RestartRequired(next); len(changed) > 0 {
+			slog.Warn("changed settings need a restart", "settings", changed)
+		}
+
+		if authorizer != nil {
+			policy, err := auth.LoadPolicy(next.Auth.PolicyFile)
+			if err != nil {
+				slog.Error("failed to reload auth policy", "file", next.Auth.PolicyFile, "error", err)
+			} else {
+				authorizer.Update(policy, []byte(next.Auth.JWTSecret))
+				cfg.Auth.PolicyFile, cfg.Auth.JWTSecret = next.Auth.PolicyFile, next.Auth.JWTSecret
+			}
+		}
+		if limiter != nil {
+			limits, err := ratelimit.LoadConfig(next.RateLimit.File)
+			if err != nil {
+				slog.Error("failed to reload rate limits", "file", next.RateLimit.File, "error", err)
+			} else {
+				limiter.SetConfig(limits)
+				cfg.RateLimit.File = next.RateLimit.File
+			}
+		}
+		if keys != nil {
+			file, err := keyring.LoadFile(next.Encryption.KeyringFile)
+			if err == nil {
+				err = keys.Update(file)
+			}
+			if err != nil {
+				slog.Error("failed to reload keyring", "file", next.Encryption.KeyringFile, "error", err)
+			} else {
+				cfg.Encryption.KeyringFile = next.Encryption.KeyringFile
+				slog.Info("keyring reloaded", "primary_key", keys.Primary())
+			}
+		}
+		if registry != nil {
+			if err := registry.Reload(); err != nil {
+				slog.Error("failed to reload schema registry", "file", cfg.Schema.File, "error", err)
+			} else {
+				slog.Info("schema registry reloaded", "schemas", len(registry.List()))
+			}
+		}
+		logging.SetLevel(next.Log.Level)
+		metrics.SetMaxSubjects(next.Metrics.MaxSubjects)
+		cfg.Log.Level, cfg.Metrics.MaxSubjects = next.Log.Level, next.Metrics.MaxSubjects
+		slog.Info("configs reloaded", "log_level", cfg.Log.Level)
 	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "therealbroker/api/proto"
+	"therealbroker/api/server"
+	"therealbroker/internal/broker"
+	datacontrol "therealbroker/internal/data_control"
+	pkgbroker "therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestShutdownShouldNotWaitForSubscribers(t *testing.T) {
+	data := datacontrol.NewDataMemory()
+	module := broker.NewModule(data)
+	assert.Nil(t, module.(*broker.Module).SetDurability(pkgbroker.DurabilityAsync))
+	brokerServer := server.NewServerWithBroker(module, data)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBrokerServer(grpcServer, brokerServer)
+	healthChecker := server.NewHealthChecker(brokerServer, time.Hour)
+	healthpb.RegisterHealthServer(grpcServer, healthChecker)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := pb.NewBrokerClient(conn)
+	stream, err := client.Subscribe(context.Background(), &pb.SubscribeRequest{Subject: "orders"})
+	assert.Nil(t, err)
+	// the subscription is open once a publish reaches it
+	assert.Eventually(t, func() bool {
+		_, err := client.Publish(context.Background(), &pb.PublishRequest{Subject: "orders", Body: "probe", ExpirationSeconds: 60})
+		assert.Nil(t, err)
+		return module.(*broker.Module).SubscriberCounts()["orders"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = client.Publish(context.Background(), &pb.PublishRequest{Subject: "orders", Body: "last", ExpirationSeconds: 60})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(grpcServer, healthChecker, module, time.Minute)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waited for the subscriber")
+	}
+
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	health, err := healthChecker.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health.Status)
+	// the async save was stored before the module closed
+	page, err := data.ListMessages(pkgbroker.Range{Subject: "orders", Limit: 1, Reverse: true})
+	assert.Nil(t, err)
+	if assert.Len(t, page.Messages, 1) {
+		assert.Equal(t, "last", page.Messages[0].Body)
+	}
+}
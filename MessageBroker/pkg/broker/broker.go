@@ -17,6 +17,16 @@ type Message struct {
 	// with the proper Message id
 	// 0 when there is no need to keep message ( fire & forget mode )
 	Expiration time.Duration
+	// Optional metadata delivered and stored with the message,
+	// e.g. the trace context of the producer
+	Headers map[string]string
+	// Subject the message was published on, only set on messages
+	// delivered to a pattern subscription ( see MatchSubject ), and on
+	// messages saved and read back by a Range
+	Subject string
+	// How Publish stores the message, the level of the broker when
+	// empty. Not delivered or stored
+	Durability Durability
 }
 
 // The whole implementation should be thread-safe
@@ -30,12 +40,14 @@ type Broker interface {
 	Publish(ctx context.Context, subject string, msg Message) (string, error)
 
 	// Subscribe listens to every publish, and returns the messages to all
-	// subscribed clients ( channels ).
+	// subscribed clients ( channels ). subject may be a pattern, e.g.
+	// "orders.*" or "orders.>", to get the messages of every matching subject.
 	// If the context is cancelled, you have to stop sending messages
 	// to this subscriber. Do nothing on time-out
 	Subscribe(ctx context.Context, subject string) (<-chan Message, error)
 
 	// Fetch enables us to retrieve a message that is already published, if
-	// it's not expired yet.
+	// it's not expired yet. An id published on another subject is
+	// ErrInvalidID.
 	Fetch(ctx context.Context, subject string, id string) (Message, error)
 }
@@ -0,0 +1,30 @@
+package broker
+
+// Durability tells Publish how a message is stored before it returns
+type Durability string
+
+const (
+	// The level the broker is configured with
+	DurabilityDefault Durability = ""
+	// Return after the message is saved, with its id
+	DurabilitySync Durability = "sync"
+	// Return after the fan-out, the message is saved in the background
+	// and no id is returned. When the save queue is full it is saved
+	// before returning, with its id
+	DurabilityAsync Durability = "async"
+	// Never save the message, for fire & forget publishes that are not
+	// fetched. No id is returned
+	DurabilityNone Durability = "none"
+)
+
+// Durabilities lists the levels a publish can ask for
+var Durabilities = []Durability{DurabilitySync, DurabilityAsync, DurabilityNone}
+
+// Valid reports whether d is a known level or the default
+func (d Durability) Valid() bool {
+	switch d {
+	case DurabilityDefault, DurabilitySync, DurabilityAsync, DurabilityNone:
+		return true
+	}
+	return false
+}
@@ -2,6 +2,10 @@ package broker
 
 import "errors"
 
+// ErrorDomain is the domain of the google.rpc.ErrorInfo detail attached
+// to the grpc statuses of the errors below, its reason names the error
+const ErrorDomain = "therealbroker"
+
 var (
 	// Use this error for the calls that are coming after that
 	// When id is used befor in publishing message
@@ -13,6 +17,15 @@ var (
 	// Use this error when message had been published, but it is not
 	// available anymore because the expiration time has reached.
 	ErrExpiredID = errors.New("message with id provided is expired")
+	// Use this error when the body does not match the schema registered
+	// for the subject, wrapped with the reason
+	ErrInvalidMessage = errors.New("message does not match the schema of the subject")
+	// Use this error when a Range can not be served, e.g. its cursor is
+	// malformed, wrapped with the reason
+	ErrInvalidRange = errors.New("invalid message range")
+	// Use this error when a message asks for a Durability that is not
+	// one of Durabilities
+	ErrInvalidDurability = errors.New("unknown durability level")
 
 	// Openning connection failed
 	ErrDBConnect = errors.New("failed to open db connection")
@@ -23,3 +36,38 @@ var (
 	// Clear data
 	ErrClearData = errors.New("failed to clear data")
 )
+
+// Reasons of the errors that reach clients of the grpc api
+var errorReasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrAlreadyExistID, "ALREADY_EXIST_ID"},
+	{ErrUnavailable, "UNAVAILABLE"},
+	{ErrInvalidID, "INVALID_ID"},
+	{ErrExpiredID, "EXPIRED_ID"},
+	{ErrInvalidMessage, "INVALID_MESSAGE"},
+	{ErrInvalidRange, "INVALID_RANGE"},
+	{ErrInvalidDurability, "INVALID_DURABILITY"},
+}
+
+// ErrorReason returns the reason of err, or of the error it wraps, false
+// if it is not one sent to clients
+func ErrorReason(err error) (string, bool) {
+	for _, r := range errorReasons {
+		if errors.Is(err, r.err) {
+			return r.reason, true
+		}
+	}
+	return "", false
+}
+
+// ReasonError returns the error named by reason, false if unknown
+func ReasonError(reason string) (error, bool) {
+	for _, r := range errorReasons {
+		if r.reason == reason {
+			return r.err, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Messages in a page when a Range does not set a limit
+	DefaultRangeLimit = 100
+	// Most messages in a page
+	MaxRangeLimit = 1000
+)
+
+// Range selects stored, unexpired messages of one subject in the order
+// they were saved. The page starts at Cursor, StartID or StartSequence,
+// at most one of them is set, or at the oldest message ( the newest when
+// Reverse ) when none is.
+type Range struct {
+	Subject string
+	// Next of the previous page
+	Cursor string
+	// Id of the first message of the page
+	StartID string
+	// Sequence of the first message of the page
+	StartSequence uint64
+	// Only messages saved at or after Since and before Until, zero for
+	// no bound
+	Since time.Time
+	Until time.Time
+	// Messages in the page, DefaultRangeLimit when 0
+	Limit int
+	// Newest messages first
+	Reverse bool
+}
+
+// Validate checks r and sets the default limit
+func (r *Range) Validate() error {
+	starts := 0
+	for _, set := range []bool{r.Cursor != "", r.StartID != "", r.StartSequence > 0} {
+		if set {
+			starts++
+		}
+	}
+	switch {
+	case r.Subject == "":
+		return fmt.Errorf("%w: no subject", ErrInvalidRange)
+	case IsPattern(r.Subject):
+		return fmt.Errorf("%w: %q is a pattern", ErrInvalidRange, r.Subject)
+	case starts > 1:
+		return fmt.Errorf("%w: more than one of cursor, start id and start sequence", ErrInvalidRange)
+	case !r.Since.IsZero() && !r.Until.IsZero() && !r.Since.Before(r.Until):
+		return fmt.Errorf("%w: since is not before until", ErrInvalidRange)
+	case r.Limit < 0 || r.Limit > MaxRangeLimit:
+		return fmt.Errorf("%w: limit is not between 1 and %d", ErrInvalidRange, MaxRangeLimit)
+	}
+	if r.Limit == 0 {
+		r.Limit = DefaultRangeLimit
+	}
+	return nil
+}
+
+// Includes reports whether a message saved at saved falls in the time
+// window of r
+func (r Range) Includes(saved time.Time) bool {
+	return (r.Since.IsZero() || !saved.Before(r.Since)) && (r.Until.IsZero() || saved.Before(r.Until))
+}
+
+// StoredMessage is a message read back by a Range
+type StoredMessage struct {
+	Message
+	// Position of the message among the messages saved on its subject,
+	// starting at 1
+	Sequence uint64
+	SavedAt  time.Time
+}
+
+// ExpiresAt is when the message stops being fetchable
+func (m StoredMessage) ExpiresAt() time.Time {
+	return m.SavedAt.Add(m.Expiration)
+}
+
+// Page is the answer to a Range
+type Page struct {
+	Messages []StoredMessage
+	// Cursor of the next page, empty when there are no more messages
+	Next string
+}
@@ -0,0 +1,65 @@
+package broker
+
+import "strings"
+
+const (
+	// Separates the tokens of a subject, e.g. "orders.eu.created"
+	SubjectSeparator = "."
+	// Matches exactly one token in a subject pattern
+	SingleWildcard = "*"
+	// Matches one or more trailing tokens, only valid as the last token
+	TailWildcard = ">"
+)
+
+// MatchSubject reports whether subject matches pattern.
+// Patterns are subjects that may contain "*" to match a single token
+// and a trailing ">" to match the rest of the subject.
+// A subject without separators is a single token, so "*" and ">"
+// both match any plain subject like "ali".
+// When subject is a pattern itself, it matches if every subject it
+// matches also matches pattern, so "orders.>" is not matched by
+// "orders.*".
+func MatchSubject(pattern, subject string) bool {
+	if pattern == subject {
+		return true
+	}
+	pTokens := strings.Split(pattern, SubjectSeparator)
+	sTokens := strings.Split(subject, SubjectSeparator)
+
+	for i, pt := range pTokens {
+		if pt == TailWildcard && i == len(pTokens)-1 {
+			return len(sTokens) > i
+		}
+		if i >= len(sTokens) {
+			return false
+		}
+		if sTokens[i] == TailWildcard && i == len(sTokens)-1 {
+			return false
+		}
+		if pt != SingleWildcard && pt != sTokens[i] {
+			return false
+		}
+	}
+	return len(pTokens) == len(sTokens)
+}
+
+// IsPattern reports whether subject contains wildcards
+func IsPattern(subject string) bool {
+	tokens := strings.Split(subject, SubjectSeparator)
+	for i, t := range tokens {
+		if t == SingleWildcard || (t == TailWildcard && i == len(tokens)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAnySubject reports whether subject matches at least one of patterns.
+func MatchAnySubject(patterns []string, subject string) bool {
+	for _, p := range patterns {
+		if MatchSubject(p, subject) {
+			return true
+		}
+	}
+	return false
+}
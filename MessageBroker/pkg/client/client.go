@@ -0,0 +1,429 @@
+// Package client is the Go client of the broker grpc api. Client
+// implements broker.Broker, so code written against the embedded Module
+// can talk to a remote broker instead.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	pb "therealbroker/api/proto"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+	"therealbroker/pkg/filter"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// ErrClosed is returned by calls on a closed client
+var ErrClosed = errors.New("client is closed")
+
+var _ broker.Broker = (*Client)(nil)
+
+type Options struct {
+	Address string
+	// Plaintext when nil
+	TLS *tls.Config
+	// Sent as a bearer token with every call, New fails without TLS
+	// unless InsecureToken is set
+	Token string
+	// Sends Token over plaintext connections too, only for trusted
+	// networks or tls terminated in front of the broker
+	InsecureToken bool
+	// Attempts of a call failing with Unavailable, before giving up
+	MaxRetries int
+	// Wait before the first retry, doubled up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Messages buffered per subscription
+	BufferSize int
+	// Compresses calls with gzip, snappy or zstd, see package compression.
+	// The server answers with the same one. Uncompressed when empty
+	Compression string
+	// Extra options for the grpc connection
+	DialOptions []grpc.DialOption
+}
+
+func (o *Options) setDefaults() {
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = 100
+	}
+}
+
+// Client calls a remote broker. The connection is re-established by grpc
+// when it breaks, calls failing with Unavailable are retried with
+// backoff and subscriptions are opened again transparently.
+//
+// Messages published while a subscription is being re-opened are not
+// delivered to it, and a retried publish may be stored twice.
+type Client struct {
+	options Options
+	conn    *grpc.ClientConn
+	rpc     pb.BrokerClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(options Options) (*Client, error) {
+	options.setDefaults()
+	if !compression.Valid(options.Compression) {
+		return nil, fmt.Errorf("unknown compression %q", options.Compression)
+	}
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if options.TLS != nil {
+		dialOptions[0] = grpc.WithTransportCredentials(credentials.NewTLS(options.TLS))
+	}
+	if options.Token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(tokenCredentials{options.Token, options.InsecureToken}))
+	}
+	if options.Compression != compression.None {
+		dialOptions = append(dialOptions, grpc.WithDefaultCallOptions(grpc.UseCompressor(options.Compression)))
+	}
+	dialOptions = append(dialOptions, options.DialOptions...)
+
+	conn, err := grpc.NewClient(options.Address, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		options: options,
+		conn:    conn,
+		rpc:     pb.NewBrokerClient(conn),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+type tokenCredentials struct {
+	token    string
+	insecure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// RequireTransportSecurity keeps grpc from sending the token in the
+// clear, unless the caller opted in
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return !t.insecure
+}
+
+// RPC exposes the generated client, for calls the Client does not wrap
+func (c *Client) RPC() pb.BrokerClient {
+	return c.rpc
+}
+
+// Schemas returns a client of the schema registry admin api, on the same
+// connection
+func (c *Client) Schemas() pb.SchemaRegistryClient {
+	return pb.NewSchemaRegistryClient(c.conn)
+}
+
+func (c *Client) Close() error {
+	return c.CloseContext(context.Background())
+}
+
+// CloseContext ends every subscription and waits for their channels to
+// be closed, or for ctx to be done, before closing the connection.
+func (c *Client) CloseContext(ctx context.Context) error {
+	c.cancel()
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *Client) Publish(ctx context.Context, subject string, msg broker.Message) (string, error) {
+	req := &pb.PublishRequest{
+		Subject:           subject,
+		Body:              msg.Body,
+		ExpirationSeconds: int32(msg.Expiration.Seconds()),
+		Headers:           msg.Headers,
+		Durability:        string(msg.Durability),
+	}
+	var resp *pb.PublishResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.rpc.Publish(ctx, req)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Id, nil
+}
+
+func (c *Client) Fetch(ctx context.Context, subject string, id string) (broker.Message, error) {
+	var resp *pb.MessageResponse
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		resp, err = c.rpc.Fetch(ctx, &pb.FetchRequest{Subject: subject, Id: id})
+		return err
+	})
+	if err != nil {
+		return broker.Message{}, err
+	}
+	return broker.Message{Id: id, Body: resp.Body, Headers: resp.Headers}, nil
+}
+
+// ListMessages pages through the stored messages selected by r, without
+// their bodies. Pass the Next of a page as the Cursor of the following
+// one.
+func (c *Client) ListMessages(ctx context.Context, r broker.Range) (broker.Page, error) {
+	return c.messageRange(ctx, r, c.rpc.ListMessages)
+}
+
+// FetchRange is ListMessages with the bodies
+func (c *Client) FetchRange(ctx context.Context, r broker.Range) (broker.Page, error) {
+	return c.messageRange(ctx, r, c.rpc.FetchRange)
+}
+
+func (c *Client) messageRange(ctx context.Context, r broker.Range, rpc func(context.Context, *pb.RangeRequest, ...grpc.CallOption) (*pb.MessagePage, error)) (broker.Page, error) {
+	req := &pb.RangeRequest{
+		Subject:       r.Subject,
+		Cursor:        r.Cursor,
+		StartId:       r.StartID,
+		StartSequence: r.StartSequence,
+		Limit:         int32(r.Limit),
+		Reverse:       r.Reverse,
+	}
+	if !r.Since.IsZero() {
+		req.SinceMs = r.Since.UnixMilli()
+	}
+	if !r.Until.IsZero() {
+		req.UntilMs = r.Until.UnixMilli()
+	}
+	var resp *pb.MessagePage
+	err := c.retry(ctx, func(ctx context.Context) (err error) {
+		resp, err = rpc(ctx, req)
+		return err
+	})
+	if err != nil {
+		return broker.Page{}, err
+	}
+	page := broker.Page{Next: resp.NextCursor}
+	for _, msg := range resp.Messages {
+		savedAt := time.UnixMilli(msg.PublishedAtMs)
+		page.Messages = append(page.Messages, broker.StoredMessage{
+			Message: broker.Message{
+				Id:         msg.Id,
+				Subject:    r.Subject,
+				Body:       msg.Body,
+				Headers:    msg.Headers,
+				Expiration: time.UnixMilli(msg.ExpiresAtMs).Sub(savedAt),
+			},
+			Sequence: msg.Sequence,
+			SavedAt:  savedAt,
+		})
+	}
+	return page, nil
+}
+
+// Subscribe returns a channel of the messages published on subject. The
+// subscription is re-opened after failures until ctx is done, the
+// client is closed or the broker refuses it, then the channel is closed.
+func (c *Client) Subscribe(ctx context.Context, subject string) (<-chan broker.Message, error) {
+	return c.SubscribeFilter(ctx, subject, "")
+}
+
+// SubscribeFilter is Subscribe, but the broker only sends the messages
+// that match expression ( see package filter ), e.g.
+// `header.region == "eu" && body.amount > 100`. An expression that does
+// not compile is returned as an error wrapping filter.ErrSyntax.
+func (c *Client) SubscribeFilter(ctx context.Context, subject, expression string) (<-chan broker.Message, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	if expression != "" {
+		if _, err := filter.Compile(expression); err != nil {
+			return nil, err
+		}
+	}
+	req := &pb.SubscribeRequest{Subject: subject, Filter: expression}
+	ch := make(chan broker.Message, c.options.BufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(ch)
+		c.subscribe(ctx, req, func(msg broker.Message) bool {
+			select {
+			case ch <- msg:
+				return true
+			case <-ctx.Done():
+				return false
+			case <-c.ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch, nil
+}
+
+// SubscribeFunc calls handler with every message published on subject,
+// one at a time and in order, like Subscribe. It returns at once.
+func (c *Client) SubscribeFunc(ctx context.Context, subject string, handler func(broker.Message)) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.subscribe(ctx, &pb.SubscribeRequest{Subject: subject}, func(msg broker.Message) bool {
+			handler(msg)
+			return true
+		})
+	}()
+	return nil
+}
+
+// subscribe keeps a Subscribe stream open and passes its messages to
+// deliver, until deliver returns false or the subscription ends for good
+func (c *Client) subscribe(ctx context.Context, req *pb.SubscribeRequest, deliver func(broker.Message) bool) {
+	ctx, cancel := mergeContexts(ctx, c.ctx)
+	defer cancel()
+	backoff := c.options.InitialBackoff
+	for ctx.Err() == nil {
+		stream, err := c.rpc.Subscribe(ctx, req)
+		for err == nil {
+			var resp *pb.MessageResponse
+			resp, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			backoff = c.options.InitialBackoff
+			if !deliver(broker.Message{Body: resp.Body, Headers: resp.Headers}) {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !resubscribable(status.Code(err)) {
+			slog.Warn("subscription refused by the broker", "subject", req.Subject, "error", err)
+			return
+		}
+		slog.Debug("subscription interrupted, resubscribing", "subject", req.Subject, "error", err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = min(2*backoff, c.options.MaxBackoff)
+	}
+}
+
+// resubscribable tells failures worth opening the subscription again
+// after from refusals like a denied permission
+func resubscribable(code codes.Code) bool {
+	switch code {
+	case codes.OK, codes.Unavailable, codes.Unknown, codes.Internal, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// retry runs call until it succeeds, fails with something other than
+// Unavailable or runs out of attempts
+func (c *Client) retry(ctx context.Context, call func(context.Context) error) error {
+	ctx, cancel := mergeContexts(ctx, c.ctx)
+	defer cancel()
+	backoff := c.options.InitialBackoff
+	var err error
+	for attempt := 0; attempt < c.options.MaxRetries; attempt++ {
+		if c.ctx.Err() != nil {
+			return ErrClosed
+		}
+		err = call(ctx)
+		if status.Code(err) != codes.Unavailable {
+			break
+		}
+		if !sleep(ctx, backoff) {
+			break
+		}
+		backoff = min(2*backoff, c.options.MaxBackoff)
+	}
+	return brokerError(err)
+}
+
+// brokerError turns grpc statuses into the errors of pkg/broker, named
+// by the ErrorInfo detail the server attaches
+func brokerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if s.Code() == codes.Unavailable {
+		return broker.ErrUnavailable
+	}
+	for _, detail := range s.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != broker.ErrorDomain {
+			continue
+		}
+		known, ok := broker.ReasonError(info.Reason)
+		if !ok {
+			continue
+		}
+		// keep the reason of wrapped errors, like a schema violation
+		if reason, ok := strings.CutPrefix(s.Message(), known.Error()); ok && reason != "" {
+			return fmt.Errorf("%w%s", known, reason)
+		}
+		return known
+	}
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// mergeContexts is done when either a or b is, keeping the values of a
+func mergeContexts(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	stop := context.AfterFunc(b, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
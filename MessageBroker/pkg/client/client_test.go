@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	pb "therealbroker/api/proto"
+	"therealbroker/api/server"
+	datacontrol "therealbroker/internal/data_control"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+	"therealbroker/pkg/filter"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serve runs an in memory broker on address and returns a stop function
+func serve(t *testing.T, address string) (string, func()) {
+	lis, err := net.Listen("tcp", address)
+	assert.Nil(t, err)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBrokerServer(grpcServer, server.NewServer(datacontrol.NewDataMemory()))
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String(), grpcServer.Stop
+}
+
+func newClient(t *testing.T, address string) *Client {
+	c, err := New(Options{Address: address, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func receive(t *testing.T, ch <-chan broker.Message) broker.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return broker.Message{}
+	}
+}
+
+// publishUntilReceived publishes probes until the subscription is open
+// and one of them arrives on ch
+func publishUntilReceived(t *testing.T, c *Client, subject string, ch <-chan broker.Message) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := c.Publish(context.Background(), subject, broker.Message{Body: "probe"})
+		if err == nil {
+			select {
+			case <-ch:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+	t.Fatal("subscription did not open")
+}
+
+func TestPublishShouldBeFetchable(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+
+	id, err := c.Publish(context.Background(), "orders", broker.Message{
+		Body:       "order-1",
+		Expiration: time.Minute,
+		Headers:    map[string]string{"k": "v"},
+	})
+	assert.Nil(t, err)
+
+	msg, err := c.Fetch(context.Background(), "orders", id)
+	assert.Nil(t, err)
+	assert.Equal(t, "order-1", msg.Body)
+	assert.Equal(t, "v", msg.Headers["k"])
+}
+
+func TestCompressedCallsShouldReachTheBroker(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	body := strings.Repeat(`{"item":"book","count":1}`, 100)
+	for _, algorithm := range compression.Algorithms {
+		c, err := New(Options{Address: address, Compression: algorithm})
+		assert.Nil(t, err)
+		defer c.Close()
+
+		id, err := c.Publish(context.Background(), "orders", broker.Message{Body: body, Expiration: time.Minute})
+		assert.Nil(t, err, algorithm)
+		msg, err := c.Fetch(context.Background(), "orders", id)
+		assert.Nil(t, err, algorithm)
+		assert.Equal(t, body, msg.Body, algorithm)
+	}
+
+	_, err := New(Options{Address: address, Compression: "lz4"})
+	assert.NotNil(t, err)
+}
+
+func TestFetchShouldReturnBrokerErrors(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+
+	_, err := c.Fetch(context.Background(), "orders", "42")
+	assert.Equal(t, broker.ErrInvalidID, err)
+
+	id, err := c.Publish(context.Background(), "orders", broker.Message{Body: "short", Expiration: time.Second})
+	assert.Nil(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = c.Fetch(context.Background(), "orders", id)
+	assert.Equal(t, broker.ErrExpiredID, err)
+}
+
+func TestListMessagesShouldPageThroughStoredMessages(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+	for _, body := range []string{"a", "b", "c"} {
+		_, err := c.Publish(context.Background(), "orders", broker.Message{Body: body, Expiration: time.Minute})
+		assert.Nil(t, err)
+	}
+
+	page, err := c.FetchRange(context.Background(), broker.Range{Subject: "orders", Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, page.Messages, 2)
+	assert.Equal(t, "a", page.Messages[0].Body)
+	assert.Equal(t, time.Minute, page.Messages[0].Expiration)
+	assert.NotEmpty(t, page.Next)
+
+	page, err = c.ListMessages(context.Background(), broker.Range{Subject: "orders", Cursor: page.Next})
+	assert.Nil(t, err)
+	assert.Len(t, page.Messages, 1)
+	assert.Equal(t, uint64(3), page.Messages[0].Sequence)
+	assert.Empty(t, page.Messages[0].Body)
+	assert.Empty(t, page.Next)
+
+	_, err = c.ListMessages(context.Background(), broker.Range{Subject: "orders", Limit: broker.MaxRangeLimit + 1})
+	assert.ErrorIs(t, err, broker.ErrInvalidRange)
+}
+
+func TestPublishShouldPassDurability(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+
+	id, err := c.Publish(context.Background(), "orders", broker.Message{Body: "gone", Expiration: time.Minute, Durability: broker.DurabilityNone})
+	assert.Nil(t, err)
+	assert.Empty(t, id)
+	page, err := c.ListMessages(context.Background(), broker.Range{Subject: "orders"})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Messages)
+
+	_, err = c.Publish(context.Background(), "orders", broker.Message{Body: "x", Durability: "later"})
+	assert.ErrorIs(t, err, broker.ErrInvalidDurability)
+}
+
+func TestBrokerErrorsShouldBeNamedByTheStatusDetails(t *testing.T) {
+	detailed, err := status.New(codes.InvalidArgument, "no such message").
+		WithDetails(&errdetails.ErrorInfo{Reason: "INVALID_ID", Domain: broker.ErrorDomain})
+	assert.Nil(t, err)
+	assert.Equal(t, broker.ErrInvalidID, brokerError(detailed.Err()))
+
+	wrapped, err := status.New(codes.InvalidArgument, broker.ErrInvalidMessage.Error()+": missing id").
+		WithDetails(&errdetails.ErrorInfo{Reason: "INVALID_MESSAGE", Domain: broker.ErrorDomain})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, brokerError(wrapped.Err()), broker.ErrInvalidMessage)
+	assert.Contains(t, brokerError(wrapped.Err()).Error(), "missing id")
+
+	// the message alone names nothing
+	plain := status.Error(codes.InvalidArgument, broker.ErrExpiredID.Error())
+	assert.Equal(t, plain, brokerError(plain))
+}
+
+func TestTokenShouldOnlyBeSentInTheClearWhenAllowed(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	options := Options{Address: address, Token: "key-1"}
+
+	_, err := New(options)
+	assert.NotNil(t, err)
+
+	options.InsecureToken = true
+	insecureClient, err := New(options)
+	assert.Nil(t, err)
+	defer insecureClient.Close()
+	_, err = insecureClient.Publish(context.Background(), "orders", broker.Message{Body: "secret"})
+	assert.Nil(t, err)
+}
+
+func TestPublishShouldGiveUpWhenBrokerIsDown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := lis.Addr().String()
+	lis.Close()
+	c := newClient(t, address)
+
+	_, err = c.Publish(context.Background(), "orders", broker.Message{Body: "lost"})
+	assert.Equal(t, broker.ErrUnavailable, err)
+}
+
+func TestSubscribeFuncShouldCallHandler(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan broker.Message, 100)
+	assert.Nil(t, c.SubscribeFunc(ctx, "orders", func(msg broker.Message) { received <- msg }))
+	publishUntilReceived(t, c, "orders", received)
+
+	_, err := c.Publish(ctx, "orders", broker.Message{Body: "order-1"})
+	assert.Nil(t, err)
+	for msg := receive(t, received); msg.Body != "order-1"; msg = receive(t, received) {
+	}
+}
+
+func TestSubscribeShouldResumeAfterBrokerRestart(t *testing.T) {
+	address, stop := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+	messages, err := c.Subscribe(context.Background(), "orders")
+	assert.Nil(t, err)
+	publishUntilReceived(t, c, "orders", messages)
+
+	stop()
+	serve(t, address)
+	publishUntilReceived(t, c, "orders", messages)
+
+	_, err = c.Publish(context.Background(), "orders", broker.Message{Body: "after restart"})
+	assert.Nil(t, err)
+	for msg := receive(t, messages); msg.Body != "after restart"; msg = receive(t, messages) {
+	}
+}
+
+func TestCloseShouldEndSubscriptions(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c, err := New(Options{Address: address})
+	assert.Nil(t, err)
+	messages, err := c.Subscribe(context.Background(), "orders")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, c.CloseContext(ctx))
+	for range messages {
+	}
+
+	_, err = c.Subscribe(context.Background(), "orders")
+	assert.Equal(t, ErrClosed, err)
+	_, err = c.Publish(context.Background(), "orders", broker.Message{Body: "late"})
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestSubscribeFilterShouldOnlyGetMatchingMessages(t *testing.T) {
+	address, _ := serve(t, "127.0.0.1:0")
+	c := newClient(t, address)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := c.SubscribeFilter(ctx, "orders", `body.amount >`)
+	assert.True(t, errors.Is(err, filter.ErrSyntax))
+
+	messages, err := c.SubscribeFilter(ctx, "orders", `header.region == "eu" && body.amount > 100`)
+	assert.Nil(t, err)
+	// publish until the subscription is open, skipped messages never arrive
+	deadline := time.Now().Add(5 * time.Second)
+	for received := false; !received && time.Now().Before(deadline); {
+		for _, msg := range []broker.Message{
+			{Body: `{"amount": 5}`, Headers: map[string]string{"region": "eu"}},
+			{Body: `{"amount": 500}`, Headers: map[string]string{"region": "us"}},
+			{Body: `{"amount": 500}`, Headers: map[string]string{"region": "eu"}},
+		} {
+			_, err := c.Publish(ctx, "orders", msg)
+			assert.Nil(t, err)
+		}
+		select {
+		case msg := <-messages:
+			assert.Equal(t, `{"amount": 500}`, msg.Body)
+			assert.Equal(t, "eu", msg.Headers["region"])
+			received = true
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	assert.True(t, time.Now().Before(deadline), "no message received")
+}
@@ -0,0 +1,83 @@
+// Package compression names the codecs the broker compresses bodies with,
+// on the grpc connection and at rest. Importing it registers snappy and
+// zstd with grpc next to gzip, so clients and servers can negotiate them.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names, as sent in the grpc-encoding header and stored per message
+const (
+	None   = ""
+	Gzip   = "gzip"
+	Snappy = "snappy"
+	Zstd   = "zstd"
+)
+
+// Algorithms lists the supported codecs
+var Algorithms = []string{Gzip, Snappy, Zstd}
+
+// EncodeAll and DecodeAll are safe for concurrent use
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+)
+
+// Valid reports whether algorithm names a codec, or None
+func Valid(algorithm string) bool {
+	switch algorithm {
+	case None, Gzip, Snappy, Zstd:
+		return true
+	}
+	return false
+}
+
+// Compress returns data compressed with algorithm, data itself for None.
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case None:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// Decompress reverses Compress with the same algorithm.
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case None:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case Snappy:
+		return snappy.Decode(nil, data)
+	case Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
@@ -0,0 +1,57 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestCompressShouldRoundTrip(t *testing.T) {
+	body := []byte(strings.Repeat(`{"item":"book","count":1}`, 100))
+	for _, algorithm := range append(Algorithms, None) {
+		assert.True(t, Valid(algorithm))
+		compressed, err := Compress(algorithm, body)
+		assert.Nil(t, err, algorithm)
+		if algorithm != None {
+			assert.Less(t, len(compressed), len(body)/4, algorithm)
+		}
+		decompressed, err := Decompress(algorithm, compressed)
+		assert.Nil(t, err, algorithm)
+		assert.Equal(t, body, decompressed, algorithm)
+	}
+}
+
+func TestUnknownAlgorithmsShouldFail(t *testing.T) {
+	assert.False(t, Valid("lz4"))
+	_, err := Compress("lz4", []byte("x"))
+	assert.NotNil(t, err)
+	_, err = Decompress("lz4", []byte("x"))
+	assert.NotNil(t, err)
+	_, err = Decompress(Zstd, []byte("not zstd"))
+	assert.NotNil(t, err)
+}
+
+func TestGRPCCompressorsShouldRoundTripWithReusedCoders(t *testing.T) {
+	for _, algorithm := range []string{Snappy, Zstd} {
+		compressor := encoding.GetCompressor(algorithm)
+		for i := 0; i < 3; i++ {
+			body := []byte(strings.Repeat(fmt.Sprintf(`{"item":"book","count":%d}`, i), 100))
+			var compressed bytes.Buffer
+			w, err := compressor.Compress(&compressed)
+			assert.Nil(t, err, algorithm)
+			w.Write(body)
+			assert.Nil(t, w.Close(), algorithm)
+
+			r, err := compressor.Decompress(&compressed)
+			assert.Nil(t, err, algorithm)
+			decompressed, err := io.ReadAll(r)
+			assert.Nil(t, err, algorithm)
+			assert.Equal(t, body, decompressed, algorithm)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package compression
+
+import (
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+func init() {
+	encoding.RegisterCompressor(snappyCompressor{})
+	encoding.RegisterCompressor(&zstdCompressor{})
+}
+
+// snappyCompressor frames grpc messages with the snappy stream format
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return Snappy
+}
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// zstdCompressor reuses its encoders and decoders like the gzip
+// compressor of grpc, they are costly to create for every message
+type zstdCompressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (*zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if z, ok := c.encoders.Get().(*zstdWriter); ok {
+		z.Reset(w)
+		return z, nil
+	}
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{Encoder: encoder, pool: &c.encoders}, nil
+}
+
+// Decompress streams, so grpc can stop reading at its message size limit.
+// A decoder of concurrency 1 starts no goroutines and needs no Close, so
+// one that is not read to the end is left to the garbage collector.
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	if z, ok := c.decoders.Get().(*zstdReader); ok {
+		if err := z.Reset(r); err != nil {
+			c.decoders.Put(z)
+			return nil, err
+		}
+		return z, nil
+	}
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{Decoder: decoder, pool: &c.decoders}, nil
+}
+
+// zstdWriter goes back to the pool once closed
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (z *zstdWriter) Close() error {
+	defer z.pool.Put(z)
+	return z.Encoder.Close()
+}
+
+// zstdReader goes back to the pool once read to the end
+type zstdReader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.Decoder.Read(p)
+	if err == io.EOF {
+		z.pool.Put(z)
+	}
+	return n, err
+}
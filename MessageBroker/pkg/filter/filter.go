@@ -0,0 +1,275 @@
+// Package filter compiles the expressions subscribers use to pick the
+// messages they get, e.g.
+//
+//	header.region == "eu" && body.amount > 100
+//
+// Operands are literals ( strings, numbers, true, false, null and lists
+// like ["eu", "us"] ), `subject`, `header.<name>` and `body.<field>...`
+// for the fields of a json body. Names that are not identifiers are
+// quoted in brackets: header["x-request-id"]. Operators are ||, &&, !,
+// ==, !=, <, <=, >, >= and in, with parentheses for grouping.
+//
+// A missing header or field, or any field of a body that is not json, is
+// null. Header values are strings, compared with a number they are read
+// as one. < and friends compare two numbers or two strings, and are false
+// otherwise. An operand used as a condition is true unless it is null or
+// false.
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// Longest expression Compile accepts
+	MaxLength = 4096
+	// Deepest nesting of parentheses and operators Compile accepts
+	MaxDepth = 64
+)
+
+// ErrSyntax is wrapped by every error of Compile
+var ErrSyntax = errors.New("invalid filter")
+
+// Filter is a compiled expression, safe for concurrent use
+type Filter struct {
+	source string
+	root   node
+}
+
+// Compile parses expression, an empty one is an error.
+func Compile(expression string) (*Filter, error) {
+	if len(expression) > MaxLength {
+		return nil, fmt.Errorf("%w: longer than %d bytes", ErrSyntax, MaxLength)
+	}
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return &Filter{source: expression, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	return f.source
+}
+
+// Match reports whether m passes the filter
+func (f *Filter) Match(m *Message) bool {
+	return truthy(f.root.eval(m))
+}
+
+// Message is what filters are evaluated against. The body is parsed on
+// first use and kept, so the filters of every subscriber share it; a
+// Message is not safe for concurrent use.
+type Message struct {
+	Subject string
+	Headers map[string]string
+	Body    string
+
+	parsed bool
+	body   any
+}
+
+func (m *Message) parsedBody() any {
+	if !m.parsed {
+		m.parsed = true
+		if err := json.Unmarshal([]byte(m.Body), &m.body); err != nil {
+			m.body = nil
+		}
+	}
+	return m.body
+}
+
+type node interface {
+	eval(m *Message) any
+}
+
+type literal struct {
+	value any
+}
+
+func (n literal) eval(*Message) any {
+	return n.value
+}
+
+type list struct {
+	items []node
+}
+
+func (n list) eval(m *Message) any {
+	values := make([]any, len(n.items))
+	for i, item := range n.items {
+		values[i] = item.eval(m)
+	}
+	return values
+}
+
+type subjectNode struct{}
+
+func (subjectNode) eval(m *Message) any {
+	return m.Subject
+}
+
+type headerNode struct {
+	name string
+}
+
+func (n headerNode) eval(m *Message) any {
+	if value, ok := m.Headers[n.name]; ok {
+		return value
+	}
+	return nil
+}
+
+type bodyNode struct {
+	fields []string
+}
+
+func (n bodyNode) eval(m *Message) any {
+	value := m.parsedBody()
+	for _, field := range n.fields {
+		switch v := value.(type) {
+		case map[string]any:
+			value = v[field]
+		case []any:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n notNode) eval(m *Message) any {
+	return !truthy(n.operand.eval(m))
+}
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (n logical) eval(m *Message) any {
+	left := truthy(n.left.eval(m))
+	if left != n.and {
+		return left
+	}
+	return truthy(n.right.eval(m))
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (n comparison) eval(m *Message) any {
+	left, right := n.left.eval(m), n.right.eval(m)
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	case "in":
+		values, _ := right.([]any)
+		for _, v := range values {
+			if equal(left, v) {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := order(left, right)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func truthy(value any) bool {
+	return value != nil && value != false
+}
+
+// coerce reads a string as a number when it is compared with one, so
+// headers, which are always strings, compare with numbers
+func coerce(a, b any) (any, any) {
+	if s, ok := a.(string); ok {
+		if _, ok := b.(float64); ok {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n, b
+			}
+		}
+	}
+	if s, ok := b.(string); ok {
+		if _, ok := a.(float64); ok {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return a, n
+			}
+		}
+	}
+	return a, b
+}
+
+func equal(a, b any) bool {
+	a, b = coerce(a, b)
+	switch a.(type) {
+	case map[string]any, []any:
+		return reflect.DeepEqual(a, b)
+	}
+	switch b.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return a == b
+}
+
+func order(a, b any) (int, bool) {
+	a, b = coerce(a, b)
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return compare(x, y), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+func compare[T float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func match(t *testing.T, expression string, m *Message) bool {
+	f, err := Compile(expression)
+	if !assert.Nil(t, err, expression) {
+		t.FailNow()
+	}
+	return f.Match(m)
+}
+
+func TestFilterShouldMatchHeadersAndBodyFields(t *testing.T) {
+	m := &Message{
+		Subject: "orders.eu",
+		Headers: map[string]string{"region": "eu", "priority": "7", "x-request-id": "r1"},
+		Body:    `{"amount": 150, "customer": {"tier": "gold"}, "items": [{"sku": "a"}, {"sku": "b"}], "paid": false}`,
+	}
+	for expression, want := range map[string]bool{
+		`header.region == "eu" && body.amount > 100`:                          true,
+		`header.region == "eu" && body.amount > 200`:                          false,
+		`header.region != 'eu' || body.amount >= 150`:                         true,
+		`!(header.region == "us")`:                                            true,
+		`header.priority > 5`:                                                 true,
+		`header["x-request-id"] == "r1"`:                                      true,
+		`header.x-request-id == "r1"`:                                         true,
+		`body.customer.tier in ["gold", "platinum"]`:                          true,
+		`body.customer.tier in []`:                                            false,
+		`body.items[1].sku == "b"`:                                            true,
+		`body.items[5].sku == null`:                                           true,
+		`body.missing == null && body.missing != 1`:                           true,
+		`body.missing < 1 || body.missing >= 1`:                               false,
+		`body.paid`:                                                           false,
+		`body.customer && header.region`:                                      true,
+		`subject == "orders.eu"`:                                              true,
+		`subject >= "orders"`:                                                 true,
+		`body.amount == 1.5e2`:                                                true,
+		`body.amount > "abc"`:                                                 false,
+		`header.region == "eu" || header.region == "us" && body.amount < 0`:   true,
+		`(header.region == "eu" || header.region == "us") && body.amount < 0`: false,
+	} {
+		assert.Equal(t, want, match(t, expression, m), expression)
+	}
+}
+
+func TestFilterShouldTreatNonJSONBodiesAsEmpty(t *testing.T) {
+	m := &Message{Body: "plain text", Headers: map[string]string{"k": "v"}}
+	assert.False(t, match(t, `body.amount > 1`, m))
+	assert.True(t, match(t, `body.amount == null && header.k == "v"`, m))
+	assert.False(t, match(t, `body`, m))
+}
+
+func TestCompileShouldRejectBadExpressions(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`header.region ==`,
+		`header == "eu"`,
+		`header.a.b == "eu"`,
+		`body.amount > 1 &&`,
+		`(body.amount > 1`,
+		`body.amount > 1)`,
+		`"unterminated`,
+		`amount > 1`,
+		`body.amount === 1`,
+		`body.tier in ["a" "b"]`,
+		`body.tier in [body.x]`,
+		`body.amount # 1`,
+		strings.Repeat("(", MaxDepth+2) + "true" + strings.Repeat(")", MaxDepth+2),
+		strings.Repeat("!", MaxDepth+2) + "true",
+		`body.x == "` + strings.Repeat("a", MaxLength) + `"`,
+	} {
+		_, err := Compile(expression)
+		assert.True(t, errors.Is(err, ErrSyntax), expression)
+	}
+}
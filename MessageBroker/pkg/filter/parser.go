@@ -0,0 +1,327 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value any
+	// byte offset in the expression, for errors
+	pos int
+}
+
+// Operators, longest first so "<=" is not read as "<"
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".", ","}
+
+func lex(expression string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(expression) && expression[end] != c {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, i)
+			}
+			quoted := expression[i : end+1]
+			if c == '\'' {
+				// single quoted strings follow the double quoted escapes
+				quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad string at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expression[i : end+1], value: value, pos: i})
+			i = end + 1
+
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(expression) && expression[i+1] >= '0' && expression[i+1] <= '9':
+			end := i + 1
+			for end < len(expression) && strings.IndexByte("0123456789.eE+-", expression[end]) >= 0 {
+				// a sign only follows an exponent
+				if (expression[end] == '+' || expression[end] == '-') && !strings.ContainsAny(expression[end-1:end], "eE") {
+					break
+				}
+				end++
+			}
+			value, err := strconv.ParseFloat(expression[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad number %q at %d", ErrSyntax, expression[i:end], i)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: expression[i:end], value: value, pos: i})
+			i = end
+
+		case isIdentStart(rune(c)):
+			end := i + 1
+			for end < len(expression) && isIdentPart(rune(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expression[i:end], pos: i})
+			i = end
+
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(expression[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, expression[i:i+1], i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(expression)}), nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r < unicode.MaxASCII && unicode.IsLetter(r)
+}
+
+// header names often have dashes, e.g. header.x-request-id
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || r == '-' || r >= '0' && r <= '9'
+}
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// accept takes the next token if it is the operator op
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return p.unexpected(p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return fmt.Errorf("%w: unexpected end", ErrSyntax)
+	}
+	return fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+}
+
+func (p *parser) parseOr(depth int) (node, error) {
+	if depth > MaxDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrSyntax, MaxDepth)
+	}
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (node, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if p.accept("!") {
+		if depth+1 > MaxDepth {
+			return nil, fmt.Errorf("%w: nested deeper than %d", ErrSyntax, MaxDepth)
+		}
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison(depth)
+}
+
+func (p *parser) parseComparison(depth int) (node, error) {
+	left, err := p.parseOperand(depth)
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokenOperator && strings.Contains(" == != < <= > >= ", " "+t.text+" "):
+	case t.kind == tokenIdent && t.text == "in":
+	default:
+		return left, nil
+	}
+	p.take()
+	right, err := p.parseOperand(depth)
+	if err != nil {
+		return nil, err
+	}
+	return comparison{op: t.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand(depth int) (node, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return literal{value: t.value}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return literal{value: true}, nil
+		case "false":
+			return literal{value: false}, nil
+		case "null":
+			return literal{value: nil}, nil
+		case "subject":
+			return subjectNode{}, nil
+		case "header":
+			names, err := p.parseFields()
+			if err != nil {
+				return nil, err
+			}
+			if len(names) != 1 {
+				return nil, fmt.Errorf("%w: header at %d needs exactly one name", ErrSyntax, t.pos)
+			}
+			return headerNode{name: names[0]}, nil
+		case "body":
+			fields, err := p.parseFields()
+			if err != nil {
+				return nil, err
+			}
+			return bodyNode{fields: fields}, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+// parseList reads the items of a list literal after its "["
+func (p *parser) parseList() (node, error) {
+	items := []node{}
+	if p.accept("]") {
+		return list{items: items}, nil
+	}
+	for {
+		t := p.take()
+		switch t.kind {
+		case tokenString, tokenNumber:
+			items = append(items, literal{value: t.value})
+		case tokenIdent:
+			switch t.text {
+			case "true", "false":
+				items = append(items, literal{value: t.text == "true"})
+			case "null":
+				items = append(items, literal{value: nil})
+			default:
+				return nil, p.unexpected(t)
+			}
+		default:
+			return nil, p.unexpected(t)
+		}
+		if p.accept("]") {
+			return list{items: items}, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseFields reads the .name, ["name"] and [index] selectors after
+// header or body
+func (p *parser) parseFields() ([]string, error) {
+	var fields []string
+	for {
+		switch {
+		case p.accept("."):
+			t := p.take()
+			if t.kind != tokenIdent {
+				return nil, p.unexpected(t)
+			}
+			fields = append(fields, t.text)
+		case p.accept("["):
+			t := p.take()
+			switch t.kind {
+			case tokenString:
+				fields = append(fields, t.value.(string))
+			case tokenNumber:
+				fields = append(fields, t.text)
+			default:
+				return nil, p.unexpected(t)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return fields, nil
+		}
+	}
+}